@@ -0,0 +1,89 @@
+package v1
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/auth"
+	"go-api/db"
+	"go-api/logging"
+	"go-api/models"
+	"go-api/pagination"
+	"go-api/webhook"
+)
+
+// accept a signed delivery from another service. Nothing consumes them yet,
+// so a verified delivery is logged and acknowledged; bad signatures and
+// stale timestamps are 401s and an id seen before is a 409.
+func receiveWebhookHandler(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id := c.GetHeader(webhook.HeaderID)
+	err = webhooks.Verify(id, c.GetHeader(webhook.HeaderTimestamp), c.GetHeader(webhook.HeaderSignature), body, time.Now())
+
+	if errors.Is(err, webhook.ErrReplay) {
+		respondError(c, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	logging.From(c).Info("webhook received", "id", id, "bytes", len(body))
+	c.Status(http.StatusNoContent)
+}
+
+// every change of every user, newest first, a ?page= at a time as the
+// history; ?user_id= keeps the changes of one user, purged ones included
+func auditLogHandler(c *gin.Context) {
+	var id models.ID
+
+	if s := c.Query("user_id"); s != "" {
+		var err error
+		id, err = db.ParseID(s)
+
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid user_id")
+			return
+		}
+	}
+
+	page, err := pagination.ParsePage(c.Query("page"), c.Query("per_page"))
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, total, err := store.Audit(c.Request.Context(), id, page)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	respondPage(c, entries, total, page)
+}
+
+// purge users soft-deleted longer than COMPACT_AFTER ago for good
+func compactUsersHandler(c *gin.Context) {
+	purged, err := store.Compact(c.Request.Context(), conf.CompactAfter, auth.Admin)
+
+	if err != nil {
+		logging.From(c).Error("compact failed", "error", err)
+		respondError(c, http.StatusInternalServerError, "users purged but the data file could not be rewritten")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"purged": purged, "older_than": conf.CompactAfter.String()})
+}
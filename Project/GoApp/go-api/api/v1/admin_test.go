@@ -0,0 +1,168 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"go-api/db"
+	"go-api/models"
+	"go-api/webhook"
+)
+
+// the type and actor of each entry of the audit log of the user id, newest
+// first
+func auditOf(t *testing.T, r http.Handler, id models.ID) []string {
+	t.Helper()
+	w := serve(r, request{
+		method: http.MethodGet,
+		path:   "/admin/audit?user_id=" + string(id),
+		header: map[string]string{"Authorization": "Bearer " + testAdminToken},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("audit log: status %d: %s", w.Code, w.Body)
+	}
+	var entries []db.AuditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		if e.UserID != id {
+			t.Errorf("entry of user %s in the audit log of %s", e.UserID, id)
+		}
+		got = append(got, e.Type+" by "+e.Actor)
+	}
+	return got
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"ADMIN_TOKEN": testAdminToken})
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	path := "/users/" + string(ada.ID)
+	_, key := createKey(t, r, string(ada.ID))
+	asAda := map[string]string{"X-API-Key": key}
+
+	steps := []struct {
+		name string
+		req  request
+		want int
+	}{
+		{"restore of a user not deleted", request{method: http.MethodPost, path: path + "/restore"}, http.StatusNotFound},
+		{"own update", request{method: http.MethodPatch, path: path, body: `{"name":"Ada L"}`, header: asAda}, http.StatusOK},
+		{"delete", request{method: http.MethodDelete, path: path, header: asAda}, http.StatusOK},
+		{"read of the deleted user", request{method: http.MethodGet, path: path}, http.StatusNotFound},
+		{"delete again", request{method: http.MethodDelete, path: path}, http.StatusNotFound},
+		{"email free again", request{method: http.MethodPost, path: "/users", body: `{"name":"Eve","email":"ada@example.com"}`}, http.StatusCreated},
+		{"restore while the email is taken", request{method: http.MethodPost, path: path + "/restore"}, http.StatusConflict},
+		{"delete of the other user", request{method: http.MethodDelete, path: "/users/2"}, http.StatusOK},
+		{"restore", request{method: http.MethodPost, path: path + "/restore"}, http.StatusOK},
+		{"read of the restored user", request{method: http.MethodGet, path: path}, http.StatusOK},
+		{"restore malformed id", request{method: http.MethodPost, path: "/users/x/restore"}, http.StatusBadRequest},
+	}
+	for _, step := range steps {
+		w := serve(r, step.req)
+		if w.Code != step.want {
+			t.Fatalf("%s: status %d, want %d: %s", step.name, w.Code, step.want, w.Body)
+		}
+	}
+
+	var restored models.User
+	json.Unmarshal(serve(r, request{method: http.MethodGet, path: path}).Body.Bytes(), &restored)
+	if restored.Name != "Ada L" || restored.DeletedAt != nil || restored.DeletedBy != "" {
+		t.Errorf("restored %+v, want the user as it was before the delete", restored)
+	}
+
+	want := []string{
+		"restored by anonymous",
+		"deleted by user:" + string(ada.ID),
+		"updated by user:" + string(ada.ID),
+		"api_key_created by anonymous",
+		"created by anonymous",
+	}
+	if got := auditOf(t, r, ada.ID); !slices.Equal(got, want) {
+		t.Errorf("audit log %q, want %q", got, want)
+	}
+}
+
+func TestAuditLogErrors(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"ADMIN_TOKEN": testAdminToken})
+	admin := map[string]string{"Authorization": "Bearer " + testAdminToken}
+	tests := []struct {
+		name   string
+		query  string
+		header map[string]string
+		want   int
+	}{
+		{"without the admin token", "", nil, http.StatusUnauthorized},
+		{"empty log", "", admin, http.StatusOK},
+		{"unknown user", "?user_id=999", admin, http.StatusOK},
+		{"malformed user_id", "?user_id=x", admin, http.StatusBadRequest},
+		{"malformed page", "?page=0", admin, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: "/admin/audit" + tt.query, header: tt.header})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusOK && w.Body.String() != "[]" {
+				t.Errorf("body %s, want an empty list", w.Body)
+			}
+		})
+	}
+}
+
+func TestReceiveWebhook(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"WEBHOOK_SECRET": "secret", "WEBHOOK_TOLERANCE": "5m"})
+	secret := []byte("secret")
+	body := `{"event":"paid"}`
+	// the headers of a delivery of id sent at, signed with signature or, when
+	// it is empty, by secret over body
+	delivery := func(id string, at time.Time, signature string) map[string]string {
+		if signature == "" {
+			signature = webhook.Sign(secret, id, at, []byte(body))
+		}
+		return map[string]string{
+			webhook.HeaderID:        id,
+			webhook.HeaderTimestamp: strconv.FormatInt(at.Unix(), 10),
+			webhook.HeaderSignature: signature,
+		}
+	}
+	now := time.Now()
+
+	steps := []struct {
+		name    string
+		body    string
+		header  map[string]string
+		want    int
+		message string
+	}{
+		{"first delivery", body, delivery("evt_1", now, ""), http.StatusNoContent, ""},
+		{"the same delivery again", body, delivery("evt_1", now, ""), http.StatusConflict, "webhook already received"},
+		{"its id, signed again later", body, delivery("evt_1", now.Add(time.Minute), ""), http.StatusConflict, "webhook already received"},
+		{"a body changed", `{"event":"refunded"}`, delivery("evt_2", now, ""), http.StatusUnauthorized, "invalid webhook signature"},
+		{"another secret", body, delivery("evt_2", now, webhook.Sign([]byte("other"), "evt_2", now, []byte(body))), http.StatusUnauthorized, "invalid webhook signature"},
+		{"the id changed", body, delivery("evt_3", now, webhook.Sign(secret, "evt_2", now, []byte(body))), http.StatusUnauthorized, "invalid webhook signature"},
+		{"a stale timestamp", body, delivery("evt_2", now.Add(-6*time.Minute), ""), http.StatusUnauthorized, "webhook timestamp outside the allowed window"},
+		{"a timestamp ahead", body, delivery("evt_2", now.Add(6*time.Minute), ""), http.StatusUnauthorized, "webhook timestamp outside the allowed window"},
+		{"no headers", body, nil, http.StatusUnauthorized, "invalid webhook signature"},
+		{"old enough but in the window", body, delivery("evt_2", now.Add(-4*time.Minute), ""), http.StatusNoContent, ""},
+		{"one of rotated signatures", body, delivery("evt_4", now, "v1=00, "+webhook.Sign(secret, "evt_4", now, []byte(body))), http.StatusNoContent, ""},
+	}
+	for _, s := range steps {
+		w := serve(r, request{method: http.MethodPost, path: "/webhooks", body: s.body, header: s.header})
+		if w.Code != s.want || errorMessage(w) != s.message {
+			t.Errorf("%s: status %d %q, want %d %q", s.name, w.Code, errorMessage(w), s.want, s.message)
+		}
+	}
+
+	// not served without a secret
+	r = newTestRouter(t, map[string]string{"WEBHOOK_SECRET": ""})
+	if w := serve(r, request{method: http.MethodPost, path: "/webhooks", body: body, header: delivery("evt_5", now, "")}); w.Code != http.StatusNotFound {
+		t.Errorf("without a secret: status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,367 @@
+package v1
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/auth"
+	"go-api/db"
+	"go-api/graphql"
+	"go-api/jobs"
+	"go-api/models"
+	"go-api/openapi"
+	"go-api/validation"
+)
+
+// the OpenAPI document of the routes, see /openapi.json; rebuilt by Setup
+// and filled in by DocumentRoute as the router registers them
+var apiDoc *openapi.Document
+
+// what the OpenAPI document says of an endpoint besides its path and method
+type endpointDoc struct {
+	summary string
+	tag     string
+	// what the handlers check of the caller beyond the role of the router
+	role  string
+	query []openapi.Parameter
+	// the request body: nil for none, a mediaTypes for other bodies than
+	// JSON, else a value of the JSON type or an *openapi.Schema
+	body any
+	// the answers by status, as body: nil for an empty one
+	replies map[int]any
+}
+
+// the schemas of a body by content type
+type mediaTypes map[string]*openapi.Schema
+
+// a non-JSON answer of this content type
+type rawReply string
+
+// the JSON body answering an error, see apierror.Error
+type errorReply struct {
+	Error     string         `json:"error" validate:"required"`
+	Code      string         `json:"code" validate:"required"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+}
+
+// bodies of the endpoints answering small objects of their own
+type (
+	idList struct {
+		IDs []models.ID `json:"ids" validate:"required"`
+	}
+	touchReply struct {
+		Touched  []models.ID `json:"touched"`
+		NotFound []models.ID `json:"not_found"`
+	}
+	deleteReply struct {
+		Deleted  []models.ID `json:"deleted"`
+		NotFound []models.ID `json:"not_found"`
+	}
+	countReply struct {
+		Count          int  `json:"count"`
+		IncludeDeleted bool `json:"include_deleted"`
+	}
+	batchReply struct {
+		Results []batchResult `json:"results"`
+	}
+	createdUsers struct {
+		Users []models.User `json:"users"`
+	}
+	loginRequest struct {
+		Key string `json:"key" validate:"required"`
+	}
+	loginReply struct {
+		Token     string    `json:"token"`
+		TokenType string    `json:"token_type"`
+		Role      string    `json:"role"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	apiKeyRequest struct {
+		Name string `json:"name" validate:"required"`
+	}
+	newAPIKey struct {
+		db.APIKey
+		Key string `json:"key"`
+	}
+	apiKeyList struct {
+		APIKeys []db.APIKey `json:"api_keys"`
+	}
+	message struct {
+		Message string `json:"message"`
+	}
+	backupReply struct {
+		Bucket string `json:"bucket"`
+		Key    string `json:"key"`
+		Size   int    `json:"size"`
+		Users  int    `json:"users"`
+	}
+	compactReply struct {
+		Purged    int    `json:"purged"`
+		OlderThan string `json:"older_than"`
+	}
+)
+
+func query(name, typ, description string) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "query", Description: description, Schema: &openapi.Schema{Type: typ}}
+}
+
+// ?page= and ?per_page= of a paged list, perPage describing the latter
+func pageParams(perPage string) []openapi.Parameter {
+	return []openapi.Parameter{query("page", "integer", "Page number, from 1"), query("per_page", "integer", perPage)}
+}
+
+// ?fields= and ?tz= apply to every answer with users
+var userParams = []openapi.Parameter{
+	query("fields", "string", "Comma-separated fields to answer, dotted for nested ones"),
+	query("tz", "string", "Time zone to render timestamps in, e.g. America/New_York"),
+}
+
+var userReply = map[int]any{http.StatusOK: models.User{}}
+
+// writes of a user name the version they were made from, see ifMatchVersion
+var ifMatch = []openapi.Parameter{{
+	Name: "If-Match", In: "header",
+	Description: `ETag of the version the write is made from, or "*" for any; required unless REQUIRE_IF_MATCH=false`,
+	Schema:      &openapi.Schema{Type: "string"},
+}}
+
+// documentation of the endpoints by route name
+var endpointDocs = map[string]endpointDoc{
+	"list_users": {
+		summary: "List active users a page at a time",
+		tag:     "users",
+		query: append(append([]openapi.Parameter{
+			query("page", "integer", "Page number, from 1"),
+			query("per_page", "integer", "Users a page"),
+			query("sort", "string", `Field to order by, "-" in front for descending`),
+			query("include_inactive", "boolean", "List deactivated users too"),
+		}, filterParams()...), userParams...),
+		replies: map[int]any{http.StatusOK: []models.User{}, http.StatusNotModified: nil},
+	},
+	"search_users": {
+		summary: "Search the name and email of users, best match first",
+		tag:     "users",
+		query: append(append([]openapi.Parameter{
+			{Name: "q", In: "query", Required: true, Description: "Words to match exactly, as a prefix or within a typo", Schema: &openapi.Schema{Type: "string"}},
+			query("page", "integer", "Page number, from 1"),
+			query("per_page", "integer", "Users a page"),
+			query("sort", "string", "Order of equal matches"),
+			query("include_inactive", "boolean", "Search deactivated users too"),
+		}, filterParams()...), userParams...),
+		replies: map[int]any{http.StatusOK: []models.User{}},
+	},
+	"user_stats":  {summary: "Current user count and lifetime totals", tag: "users", replies: map[int]any{http.StatusOK: db.Stats{}}},
+	"count_users": {summary: "Count users", tag: "users", query: []openapi.Parameter{query("include_deleted", "boolean", "Count soft-deleted users too")}, replies: map[int]any{http.StatusOK: countReply{}}},
+	"user_events": {
+		summary: "Stream user changes as server-sent events",
+		tag:     "users",
+		query: []openapi.Parameter{
+			query("types", "string", "Comma-separated event types to stream, all by default"),
+			query("last_event_id", "integer", "Replay the events after this id first, as the Last-Event-ID header does"),
+		},
+		replies: map[int]any{http.StatusOK: rawReply("text/event-stream")},
+	},
+	"export_users": {
+		summary: "Export all users by ascending id",
+		tag:     "users",
+		query: []openapi.Parameter{
+			query("format", "string", "ndjson, the default, json or csv"),
+			query("from_id", "string", "Resume after this id, answering 206"),
+		},
+		replies: map[int]any{http.StatusOK: exportTypes, http.StatusPartialContent: exportTypes},
+	},
+	"get_me":      {summary: "The user the request is authenticated as", tag: "users", role: auth.User, query: userParams, replies: userReply},
+	"get_user":    {summary: "Get a user", tag: "users", query: userParams, replies: map[int]any{http.StatusOK: models.User{}, http.StatusNotModified: nil}},
+	"create_user": {summary: "Create a user", tag: "users", body: models.User{}, replies: map[int]any{http.StatusCreated: models.User{}}},
+	"create_users": {
+		summary: "Create users from a JSON array",
+		tag:     "users",
+		query:   []openapi.Parameter{query("atomic", "boolean", "Store all of the users or none")},
+		body:    []models.User{},
+		replies: map[int]any{http.StatusMultiStatus: batchReply{}, http.StatusCreated: createdUsers{}},
+	},
+	"bulk_create_users": {
+		summary: "Create users from a JSON array, as /users/batch",
+		tag:     "users",
+		query:   []openapi.Parameter{query("atomic", "boolean", "Store all of the users or none")},
+		body:    []models.User{},
+		replies: map[int]any{http.StatusMultiStatus: batchReply{}, http.StatusCreated: createdUsers{}},
+	},
+	"bulk_delete_users": {summary: "Soft-delete users", tag: "users", body: idList{}, replies: map[int]any{http.StatusOK: deleteReply{}}},
+	"import_users": {
+		summary: "Create users from a CSV or JSON file",
+		tag:     "users",
+		query: []openapi.Parameter{
+			query("format", "string", "csv or json, else told by the content type or file name"),
+			query("async", "boolean", "Store the rows in a background job"),
+		},
+		body: mediaTypes{
+			"text/csv":             {Type: "string"},
+			"application/json":     {Type: "array", Items: &openapi.Schema{Ref: "#/components/schemas/User"}},
+			"application/x-ndjson": {Type: "string", Description: "One user a line"},
+			"multipart/form-data": {Type: "object", Required: []string{"file"}, Properties: map[string]*openapi.Schema{
+				"file": {Type: "string", Format: "binary"},
+			}},
+		},
+		replies: map[int]any{http.StatusMultiStatus: importReport{}, http.StatusAccepted: jobs.Job{}},
+	},
+	"get_job":       {summary: "Progress of a background job", tag: "jobs", replies: map[int]any{http.StatusOK: jobs.Job{}}},
+	"reorder_users": {summary: "Give users priorities in the order of their ids", tag: "users", body: idList{}, replies: map[int]any{http.StatusOK: idList{}}},
+	"touch_users":   {summary: "Bump updated_at of users", tag: "users", body: idList{}, replies: map[int]any{http.StatusOK: touchReply{}}},
+	"update_user":   {summary: "Replace a user", tag: "users", query: ifMatch, body: models.User{}, replies: userReply},
+	"patch_user": {
+		summary: "Change only the fields sent",
+		tag:     "users",
+		query:   ifMatch,
+		body: mediaTypes{
+			"application/json":             {Type: "object", Description: "Any of the fields of a User"},
+			"application/merge-patch+json": {Type: "object", Description: "Any of the fields of a User"},
+		},
+		replies: userReply,
+	},
+	"delete_user":     {summary: "Soft-delete a user", tag: "users", query: ifMatch, replies: map[int]any{http.StatusOK: message{}}},
+	"restore_user":    {summary: "Undo the soft delete of a user", tag: "users", replies: userReply},
+	"send_welcome":    {summary: "Send the welcome email", tag: "users", replies: userReply},
+	"confirm_email":   {summary: "Confirm a pending email change", tag: "users", query: []openapi.Parameter{query("token", "string", "Token of the confirmation email")}, replies: userReply},
+	"user_history":    {summary: "Changes of a user, newest first", tag: "users", query: pageParams("Entries a page"), replies: map[int]any{http.StatusOK: []db.HistoryEntry{}}},
+	"get_avatar":      {summary: "The avatar image of a user", tag: "users", replies: map[int]any{http.StatusOK: rawReply("image/*")}},
+	"merge_users":     {summary: "Merge a duplicate user into another", tag: "users", replies: userReply},
+	"create_api_key":  {summary: "Create an API key, answered only once", tag: "api keys", role: auth.User, body: apiKeyRequest{}, replies: map[int]any{http.StatusCreated: newAPIKey{}}},
+	"list_api_keys":   {summary: "API keys of a user, without the keys", tag: "api keys", role: auth.User, replies: map[int]any{http.StatusOK: apiKeyList{}}},
+	"revoke_api_key":  {summary: "Revoke an API key", tag: "api keys", role: auth.User, replies: map[int]any{http.StatusNoContent: nil}},
+	"deactivate_user": {summary: "Deactivate a user", tag: "users", replies: userReply},
+	"activate_user":   {summary: "Reactivate a user", tag: "users", replies: userReply},
+	"backup_users":    {summary: "Upload a snapshot of all users, soft-deleted ones included, to object storage", tag: "admin", replies: map[int]any{http.StatusCreated: backupReply{}}},
+	"login":           {summary: "Exchange ADMIN_TOKEN or an API key for a JWT", tag: "auth", body: loginRequest{}, replies: map[int]any{http.StatusOK: loginReply{}}},
+	"receive_webhook": {summary: "Receive a signed webhook", tag: "webhooks", body: &openapi.Schema{}, replies: map[int]any{http.StatusNoContent: nil}},
+	"audit_log": {
+		summary: "Every change of every user, newest first",
+		tag:     "admin",
+		role:    auth.Admin,
+		query:   append([]openapi.Parameter{query("user_id", "string", "Only the changes of this user")}, pageParams("Entries a page")...),
+		replies: map[int]any{http.StatusOK: []db.AuditEntry{}},
+	},
+	"graphql": {
+		summary: "Run a GraphQL query or mutation of graphql/schema.graphql",
+		tag:     "graphql",
+		role:    auth.User,
+		body:    graphql.Request{},
+		replies: map[int]any{http.StatusOK: graphql.Response{}, http.StatusBadRequest: graphql.Response{}},
+	},
+	"graphql_query": {
+		summary: "Run a GraphQL query of graphql/schema.graphql",
+		tag:     "graphql",
+		role:    auth.User,
+		query: []openapi.Parameter{
+			query("query", "string", "The GraphQL document"),
+			query("operationName", "string", "The operation of the document to run"),
+			query("variables", "string", "The variables as a JSON object"),
+		},
+		replies: map[int]any{http.StatusOK: graphql.Response{}, http.StatusBadRequest: graphql.Response{}},
+	},
+	"compact_users": {summary: "Purge users soft-deleted long ago", tag: "admin", role: auth.Admin, replies: map[int]any{http.StatusOK: compactReply{}}},
+}
+
+// a document with the components every operation refers to, for routes
+// under basePath
+func newAPIDoc(basePath string) *openapi.Document {
+	doc := openapi.New("go-api", "1.0.0", "Users API. Errors are answered as an ErrorReply with the status of the response.")
+	doc.Servers = []openapi.Server{{URL: basePath}}
+	if basePath == "" {
+		doc.Servers[0].URL = "/"
+	}
+	doc.Define(models.ID(""), &openapi.Schema{
+		Description: "Sequential ids are numbers unless ID_AS_STRING is set, others strings",
+		OneOf:       []*openapi.Schema{{Type: "integer", Format: "int64"}, {Type: "string"}},
+	})
+	// the fields of validation.Errors are all there is to it
+	doc.Define(validation.Errors{}, &openapi.Schema{Type: "array", Items: doc.Schema(validation.FieldError{})})
+
+	// completeness is added by User.MarshalJSON, and the store sets the
+	// id, version and timestamps whatever is sent
+	doc.Schema(models.User{})
+	user := doc.Components.Schemas["User"]
+	user.Properties["completeness"] = &openapi.Schema{Type: "integer", ReadOnly: true, Description: "Percentage of the profile fields filled in"}
+	for _, name := range []string{"id", "version", "created_at", "updated_at"} {
+		field := *user.Properties[name]
+		field.ReadOnly = true
+		user.Properties[name] = &field
+	}
+
+	doc.Schema(errorReply{})
+	doc.Components.SecuritySchemes["bearer"] = openapi.SecurityScheme{
+		Type: "http", Scheme: "bearer", BearerFormat: "JWT",
+		Description: "A JWT from POST /auth/login, an API key, or ADMIN_TOKEN on admin routes",
+	}
+	doc.Components.SecuritySchemes["api_key"] = openapi.SecurityScheme{Type: "apiKey", In: "header", Name: "X-API-Key"}
+	return doc
+}
+
+// DocumentRoute adds the route of name at method and path to the OpenAPI
+// document. role is what the router requires of the caller, auth.User,
+// auth.Admin or "".
+func DocumentRoute(method, path, name, role string) {
+	d := endpointDocs[name]
+	if d.role != "" {
+		role = d.role
+	}
+	op := openapi.Operation{OperationID: name, Summary: d.summary, Parameters: d.query, Responses: map[string]openapi.Response{}}
+	if d.tag != "" {
+		op.Tags = []string{d.tag}
+	}
+	switch body := d.body.(type) {
+	case nil:
+	case mediaTypes:
+		op.RequestBody = &openapi.RequestBody{Required: true, Content: map[string]openapi.MediaType{}}
+		for contentType, schema := range body {
+			op.RequestBody.Content[contentType] = openapi.MediaType{Schema: schema}
+		}
+	default:
+		op.RequestBody = &openapi.RequestBody{Required: true, Content: apiDoc.JSON(body)}
+	}
+	for status, reply := range d.replies {
+		r := openapi.Response{Description: http.StatusText(status)}
+		switch reply := reply.(type) {
+		case rawReply:
+			r.Content = map[string]openapi.MediaType{string(reply): {}}
+		case map[string]string:
+			// content types by name, as exportTypes
+			r.Content = map[string]openapi.MediaType{}
+			for _, contentType := range reply {
+				r.Content[contentType] = openapi.MediaType{}
+			}
+		default:
+			r.Content = apiDoc.JSON(reply)
+		}
+		op.Responses[strconv.Itoa(status)] = r
+	}
+	op.Responses["default"] = openapi.Response{Description: "Error", Content: apiDoc.JSON(errorReply{})}
+	switch role {
+	case auth.Admin:
+		op.Security = []map[string][]string{{"bearer": {}}}
+	case auth.User:
+		op.Security = []map[string][]string{{"bearer": {}}, {"api_key": {}}}
+	}
+	apiDoc.Add(method, path, op)
+}
+
+// filters of GET /users, one for each field of models.FilterFields
+func filterParams() []openapi.Parameter {
+	var params []openapi.Parameter
+	for field := range models.FilterFields {
+		params = append(params, query(field, "string", "Only users with this "+field))
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i].Name < params[j].Name })
+	return params
+}
+
+// OpenAPIHandler serves the document of the routes registered, see
+// /openapi.json
+func OpenAPIHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, apiDoc)
+}
@@ -0,0 +1,166 @@
+package v1
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/auth"
+	"go-api/db"
+	"go-api/models"
+)
+
+// id of the user whose API keys are managed, for a caller authenticated as
+// that user or as an admin: the admin role of a JWT, or ADMIN_TOKEN itself.
+// The caller is checked before the id is even read, and the user is only
+// looked up afterwards: 401 without credentials and 403 with those of
+// another user, whatever the id, so the answer does not tell whether the
+// user exists.
+func apiKeyOwner(c *gin.Context) (models.ID, bool) {
+	admin := auth.Role(c) == auth.Admin || adminBearer(c)
+	caller, signedIn := auth.UserID(c)
+
+	if !admin && !signedIn {
+		c.Header("WWW-Authenticate", `Bearer realm="api"`)
+		respondError(c, http.StatusUnauthorized, "authentication required")
+		return "", false
+	}
+
+	id, err := db.ParseID(c.Param("id"))
+
+	if !admin && (err != nil || caller != id) {
+		respondError(c, http.StatusForbidden, "api keys of another user")
+		return "", false
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return "", false
+	}
+
+	return id, true
+}
+
+// whether the request carries "Authorization: Bearer <ADMIN_TOKEN>"
+func adminBearer(c *gin.Context) bool {
+	got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return ok && conf.AdminToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(conf.AdminToken)) == 1
+}
+
+// exchange ADMIN_TOKEN for an admin JWT, or an API key for a user JWT of
+// its user
+func loginHandler(c *gin.Context) {
+	var body struct {
+		Key string `json:"key" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	subject, role := "", ""
+	if conf.AdminToken != "" && subtle.ConstantTimeCompare([]byte(body.Key), []byte(conf.AdminToken)) == 1 {
+		role = auth.Admin
+	} else if id, ok, err := store.AuthenticateAPIKey(c.Request.Context(), body.Key); err != nil {
+		respondStoreError(c, err)
+		return
+	} else if ok {
+		subject, role = string(id), auth.User
+	}
+
+	if role == "" {
+		respondError(c, http.StatusUnauthorized, "invalid credentials")
+		return
+	}
+
+	token, claims, err := tokens.Issue(subject, role, time.Now())
+
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"token_type": "Bearer",
+		"role":       role,
+		"expires_at": time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+// create a named API key, the only response that has the key itself
+func createAPIKeyHandler(c *gin.Context) {
+	id, ok := apiKeyOwner(c)
+
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if body.Name = strings.TrimSpace(body.Name); body.Name == "" {
+		respondError(c, http.StatusUnprocessableEntity, "name is required")
+		return
+	}
+
+	meta, key, err := store.CreateAPIKey(c.Request.Context(), id, body.Name, Actor(c))
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, struct {
+		*db.APIKey
+		Key string `json:"key"`
+	}{meta, key})
+}
+
+func listAPIKeysHandler(c *gin.Context) {
+	id, ok := apiKeyOwner(c)
+
+	if !ok {
+		return
+	}
+
+	keys, err := store.APIKeys(c.Request.Context(), id)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+func revokeAPIKeyHandler(c *gin.Context) {
+	id, ok := apiKeyOwner(c)
+
+	if !ok {
+		return
+	}
+
+	err := store.RevokeAPIKey(c.Request.Context(), id, c.Param("key_id"), Actor(c))
+
+	if errors.Is(err, db.ErrAPIKeyNotFound) {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
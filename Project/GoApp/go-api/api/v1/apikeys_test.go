@@ -0,0 +1,130 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "test-admin-token"
+
+// create an API key of the user id as the admin, failing the test unless it
+// is created
+func createKey(t *testing.T, r http.Handler, id string) (keyID, key string) {
+	t.Helper()
+	w := serve(r, request{
+		method: http.MethodPost,
+		path:   "/users/" + id + "/api-keys",
+		body:   `{"name":"ci"}`,
+		header: map[string]string{"Authorization": "Bearer " + testAdminToken},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create key: status %d: %s", w.Code, w.Body)
+	}
+	var body struct{ ID, Key string }
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return body.ID, body.Key
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"ADMIN_TOKEN": testAdminToken, "PRIVATE_READS": "true"})
+	user := createUser(t, r, "Ada", "ada@example.com")
+	id := string(user.ID)
+	keyID, key := createKey(t, r, id)
+	if !strings.HasPrefix(key, "uk_") {
+		t.Fatalf("key %q lacks the uk_ prefix", key)
+	}
+
+	steps := []struct {
+		name string
+		req  request
+		want int
+	}{
+		{"read without the key", request{method: http.MethodGet, path: "/users/" + id}, http.StatusUnauthorized},
+		{"read as bearer", request{method: http.MethodGet, path: "/users/" + id, header: map[string]string{"Authorization": "Bearer " + key}}, http.StatusOK},
+		{"read with X-API-Key", request{method: http.MethodGet, path: "/users/me", header: map[string]string{"X-API-Key": key}}, http.StatusOK},
+		{"list own keys", request{method: http.MethodGet, path: "/users/" + id + "/api-keys", header: map[string]string{"X-API-Key": key}}, http.StatusOK},
+		{"wrong key", request{method: http.MethodGet, path: "/users/me", header: map[string]string{"X-API-Key": key + "x"}}, http.StatusUnauthorized},
+		{"revoke", request{method: http.MethodDelete, path: "/users/" + id + "/api-keys/" + keyID, header: map[string]string{"X-API-Key": key}}, http.StatusNoContent},
+		{"read after revoking", request{method: http.MethodGet, path: "/users/me", header: map[string]string{"X-API-Key": key}}, http.StatusUnauthorized},
+		{"revoke again", request{method: http.MethodDelete, path: "/users/" + id + "/api-keys/" + keyID, header: map[string]string{"Authorization": "Bearer " + testAdminToken}}, http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if w := serve(r, step.req); w.Code != step.want {
+			t.Fatalf("%s: status %d, want %d: %s", step.name, w.Code, step.want, w.Body)
+		}
+	}
+}
+
+func TestAPIKeyListHasNoSecret(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"ADMIN_TOKEN": testAdminToken})
+	user := createUser(t, r, "Ada", "ada@example.com")
+	keyID, key := createKey(t, r, string(user.ID))
+
+	w := serve(r, request{method: http.MethodGet, path: "/users/" + string(user.ID) + "/api-keys", header: map[string]string{"X-API-Key": key}})
+	body := w.Body.String()
+	if !strings.Contains(body, keyID) || strings.Contains(body, key) || strings.Contains(body, "hash") {
+		t.Errorf("list of keys %s, want key %s without its secret", body, keyID)
+	}
+}
+
+// a caller who may not manage the keys of :id gets the same answer whether
+// the user exists or not
+func TestAPIKeyAuthorizationComesFirst(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"ADMIN_TOKEN": testAdminToken})
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+	_, bobKey := createKey(t, r, string(bob.ID))
+
+	admin := map[string]string{"Authorization": "Bearer " + testAdminToken}
+	asBob := map[string]string{"X-API-Key": bobKey}
+	tests := []struct {
+		name   string
+		method string
+		id     string
+		header map[string]string
+		want   int
+	}{
+		{"anonymous create, existing user", http.MethodPost, string(ada.ID), nil, http.StatusUnauthorized},
+		{"anonymous create, missing user", http.MethodPost, "999", nil, http.StatusUnauthorized},
+		{"anonymous create, not an id", http.MethodPost, "x", nil, http.StatusUnauthorized},
+		{"anonymous list, existing user", http.MethodGet, string(ada.ID), nil, http.StatusUnauthorized},
+		{"anonymous list, missing user", http.MethodGet, "999", nil, http.StatusUnauthorized},
+		{"other user create, existing user", http.MethodPost, string(ada.ID), asBob, http.StatusForbidden},
+		{"other user create, missing user", http.MethodPost, "999", asBob, http.StatusForbidden},
+		{"other user create, not an id", http.MethodPost, "x", asBob, http.StatusForbidden},
+		{"other user list, missing user", http.MethodGet, "999", asBob, http.StatusForbidden},
+		{"admin create, existing user", http.MethodPost, string(ada.ID), admin, http.StatusCreated},
+		{"admin create, missing user", http.MethodPost, "999", admin, http.StatusNotFound},
+		{"admin create, not an id", http.MethodPost, "x", admin, http.StatusBadRequest},
+		{"own create", http.MethodPost, string(bob.ID), asBob, http.StatusCreated},
+	}
+	answers := map[int]string{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: tt.method, path: "/users/" + tt.id + "/api-keys", body: `{"name":"ci"}`, header: tt.header})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusUnauthorized && tt.want != http.StatusForbidden {
+				return
+			}
+			msg := errorMessage(w)
+			if seen, ok := answers[w.Code]; ok && seen != msg {
+				t.Errorf("answered %q, another refusal %q", msg, seen)
+			}
+			answers[w.Code] = msg
+		})
+	}
+}
+
+func TestAPIKeyCreateNeedsAnAdmin(t *testing.T) {
+	// with no way to be an admin, nobody can mint the first key
+	r := newTestRouter(t, nil)
+	user := createUser(t, r, "Ada", "ada@example.com")
+	w := serve(r, request{method: http.MethodPost, path: "/users/" + string(user.ID) + "/api-keys", body: `{"name":"ci"}`})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404 for the unrouted create", w.Code)
+	}
+}
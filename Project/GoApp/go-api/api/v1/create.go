@@ -0,0 +1,409 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+	"go-api/db"
+	"go-api/models"
+	"go-api/usercsv"
+	"go-api/validation"
+)
+
+func createUserHandler(c *gin.Context) {
+	if rejectUserType(c) {
+		return
+	}
+
+	var user models.User
+
+	if err := bindUser(c, &user); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	user.Normalize()
+
+	if errs := CheckUser(user); errs != nil {
+		respondInvalid(c, errs)
+		return
+	}
+
+	if creates != nil {
+		createOnce(c, user)
+		return
+	}
+
+	added, err := store.AddUser(c.Request.Context(), user, Actor(c))
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	respondUser(c, http.StatusCreated, *added)
+}
+
+// create the user unless the same normalized body was created within
+// DEDUPE_WINDOW, in which case the earlier user is answered with a 200
+func createOnce(c *gin.Context, user models.User) {
+	body, err := json.Marshal(user)
+
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	alive := func(id models.ID) bool {
+		_, err := store.GetUser(c.Request.Context(), id)
+		return err == nil
+	}
+	id, duplicate, err := creates.Do(body, alive, func() (models.ID, error) {
+		added, err := store.AddUser(c.Request.Context(), user, Actor(c))
+		if err != nil {
+			return "", err
+		}
+		return added.ID, nil
+	})
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	added, err := store.GetUser(c.Request.Context(), id)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	status := http.StatusCreated
+	if duplicate {
+		status = http.StatusOK
+	}
+	respondUser(c, status, *added)
+}
+
+// outcome of one user of a batch create
+type batchResult struct {
+	Index  int               `json:"index"`
+	Status int               `json:"status"`
+	User   *models.User      `json:"user,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	Fields validation.Errors `json:"fields,omitempty"`
+}
+
+// create several users from a JSON array. By default each user stands on its
+// own and the response reports every outcome; with ?atomic=true one invalid
+// user fails the whole batch and nothing is stored.
+func createUsersHandler(c *gin.Context) {
+	var users []models.User
+
+	if err := c.ShouldBindJSON(&users); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !checkBatchSize(c, len(users)) {
+		return
+	}
+
+	if c.Query("atomic") != "true" {
+		results, err := addEach(c.Request.Context(), users, Actor(c))
+
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusMultiStatus, gin.H{"results": localize(c, results)})
+		return
+	}
+
+	for n := range users {
+		users[n].Normalize()
+		if errs := CheckUser(users[n]); errs != nil {
+			apierror.Respond(c, apierror.New(http.StatusUnprocessableEntity, errs.Error()).With("fields", errs).With("index", n))
+			return
+		}
+	}
+
+	added, _, err := store.AddUsers(c.Request.Context(), users, true, Actor(c))
+
+	var failed *db.BatchError
+	if errors.As(err, &failed) {
+		storeRetryAfter(c, failed.Err)
+		apierror.Respond(c, storeError(failed.Err).With("index", failed.Index))
+		return
+	}
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"users": localize(c, added)})
+}
+
+// answer 400 with the limit when a bulk request carries more than
+// MAX_BATCH_SIZE items, before anything is checked or stored, and tell
+// whether it is within the limit
+func checkBatchSize(c *gin.Context, n int) bool {
+	if n <= conf.MaxBatchSize {
+		return true
+	}
+	apierror.Respond(c, apierror.New(http.StatusBadRequest, fmt.Sprintf("%d items, at most %d are allowed", n, conf.MaxBatchSize)).With("limit", conf.MaxBatchSize))
+	return false
+}
+
+// check and store each user on its own, reporting every outcome; the error
+// is for a failure of the store as a whole
+func addEach(ctx context.Context, users []models.User, by string) ([]batchResult, error) {
+	results := make([]batchResult, len(users))
+	valid := make([]models.User, 0, len(users))
+	indexes := make([]int, 0, len(users))
+	for n, user := range users {
+		results[n].Index = n
+		user.Normalize()
+		if errs := CheckUser(user); errs != nil {
+			results[n].Status = http.StatusUnprocessableEntity
+			results[n].Error, results[n].Fields = errs.Error(), errs
+			continue
+		}
+		valid = append(valid, user)
+		indexes = append(indexes, n)
+	}
+
+	added, errs, err := store.AddUsers(ctx, valid, false, by)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, n := range indexes {
+		if errs[i] != nil {
+			results[n].Status = storeErrorStatus(errs[i])
+			results[n].Error = storeErrorMessage(errs[i])
+			continue
+		}
+		user := added[0]
+		added = added[1:]
+		results[n].Status = http.StatusCreated
+		results[n].User = &user
+	}
+	return results, nil
+}
+
+// outcome of one row of an import
+type importResult struct {
+	Row    int               `json:"row"`
+	Status int               `json:"status"`
+	User   *models.User      `json:"user,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	Fields validation.Errors `json:"fields,omitempty"`
+}
+
+// outcome of a whole import
+type importReport struct {
+	Results  []importResult `json:"results"`
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+}
+
+// rows an import stores at a time, reporting progress in between
+const importChunk = 100
+
+// import users from a CSV or JSON file, sent as the "file" field of a
+// multipart form or as the body, the format told by ?format=, else by the
+// content type or file name, see importFormat. Each row, or user of a JSON
+// file, stands on its own as in a batch create and the response reports
+// every row by its number in the file. With ?async=true the file is only
+// parsed, and the rows are stored by a job answered as 202 with its Location.
+func importUsersHandler(c *gin.Context) {
+	var body io.Reader = c.Request.Body
+	format := importFormat(c.ContentType(), "")
+
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		header, err := c.FormFile("file")
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "multipart import needs a \"file\" field")
+			return
+		}
+		f, err := header.Open()
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer f.Close()
+		body = f
+		format = importFormat(header.Header.Get("Content-Type"), header.Filename)
+	}
+
+	if f := c.Query("format"); f != "" {
+		format = f
+	}
+
+	var rows []usercsv.Row
+	var err error
+
+	switch format {
+	case "csv":
+		rows, err = usercsv.Read(body)
+	case "json":
+		rows, err = readJSONRows(body)
+	default:
+		respondError(c, http.StatusBadRequest, "format must be csv or json")
+		return
+	}
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !checkBatchSize(c, len(rows)) {
+		return
+	}
+
+	if c.Query("async") == "true" {
+		// the job outlives the request, but keeps its logger and trace
+		ctx, by := context.WithoutCancel(c.Request.Context()), Actor(c)
+		job, err := background.Start("import_users", len(rows), func(progress func(int)) (any, error) {
+			return importRows(ctx, rows, progress, by)
+		})
+
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		c.Header("Location", routePrefix(c)+"/jobs/"+job.ID)
+		c.JSON(http.StatusAccepted, localize(c, job))
+		return
+	}
+
+	report, err := importRows(c.Request.Context(), rows, func(int) {}, Actor(c))
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusMultiStatus, localize(c, report))
+}
+
+// format of an imported file by its content type and file name: json for
+// JSON and NDJSON, as the exports write them, csv otherwise
+func importFormat(contentType, filename string) string {
+	contentType, _, _ = strings.Cut(contentType, ";")
+
+	switch strings.TrimSpace(contentType) {
+	case gin.MIMEJSON, "application/x-ndjson":
+		return "json"
+	}
+
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".json", ".ndjson", ".jsonl":
+		return "json"
+	}
+	return "csv"
+}
+
+// rows of a JSON import: an array of users, as ?format=json exports them, or
+// one user after the other, as NDJSON. A value that is not a user fails its
+// row only; the error is for input that is not JSON at all. The fields the
+// store manages, such as the id, are not taken over.
+func readJSONRows(r io.Reader) ([]usercsv.Row, error) {
+	data, err := io.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var values []json.RawMessage
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &values); err != nil {
+			return nil, err
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var v json.RawMessage
+			if err := dec.Decode(&v); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+	}
+
+	rows := make([]usercsv.Row, len(values))
+	for i, v := range values {
+		rows[i].Row = i + 1
+		rows[i].Err = json.Unmarshal(v, &rows[i].User)
+	}
+	return rows, nil
+}
+
+// store the valid rows, importChunk at a time, calling progress with the
+// rows done after each chunk. Rows stored before a failure of the store
+// stay stored.
+func importRows(ctx context.Context, rows []usercsv.Row, progress func(int), by string) (importReport, error) {
+	report := importReport{Results: make([]importResult, len(rows))}
+	for start := 0; start < len(rows); start += importChunk {
+		chunk := rows[start:min(start+importChunk, len(rows))]
+		users := make([]models.User, 0, len(chunk))
+		indexes := make([]int, 0, len(chunk))
+		for i, row := range chunk {
+			n := start + i
+			report.Results[n].Row = row.Row
+			if row.Err != nil {
+				report.Results[n].Status = http.StatusBadRequest
+				report.Results[n].Error = row.Err.Error()
+				continue
+			}
+			users = append(users, row.User)
+			indexes = append(indexes, n)
+		}
+
+		added, err := addEach(ctx, users, by)
+		if err != nil {
+			return importReport{}, err
+		}
+
+		for i, r := range added {
+			n := indexes[i]
+			report.Results[n].Status, report.Results[n].User, report.Results[n].Error = r.Status, r.User, r.Error
+			report.Results[n].Fields = r.Fields
+			if r.Status == http.StatusCreated {
+				report.Imported++
+			}
+		}
+		progress(start + len(chunk))
+	}
+	report.Failed = len(rows) - report.Imported
+	return report, nil
+}
+
+// state of a background job, with its result once completed
+func getJobHandler(c *gin.Context) {
+	job, ok := background.Get(c.Param("id"))
+
+	if !ok {
+		respondError(c, http.StatusNotFound, "job not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, localize(c, job))
+}
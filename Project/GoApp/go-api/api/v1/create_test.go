@@ -0,0 +1,607 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go-api/db"
+	"go-api/models"
+)
+
+// a request of a test played in order with others on one store, and its
+// answer. Its path may name a user created by an earlier step, as in
+// "/users/{Ada}".
+type step struct {
+	name    string
+	method  string
+	path    string
+	body    string
+	want    int
+	message string
+}
+
+// play the steps in order, failing at the first unexpected answer
+func play(t *testing.T, r http.Handler, steps []step) {
+	t.Helper()
+	var ids []string
+	for _, s := range steps {
+		path := strings.NewReplacer(ids...).Replace(s.path)
+		w := serve(r, request{method: s.method, path: path, body: s.body})
+		if w.Code != s.want || (s.message != "" && errorMessage(w) != s.message) {
+			t.Fatalf("%s: status %d %q, want %d %q", s.name, w.Code, errorMessage(w), s.want, s.message)
+		}
+		if w.Code == http.StatusCreated {
+			var user models.User
+			if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, "{"+user.Name+"}", string(user.ID))
+		}
+	}
+}
+
+func TestUniqueFields(t *testing.T) {
+	const (
+		post  = http.MethodPost
+		patch = http.MethodPatch
+		del   = http.MethodDelete
+	)
+	tests := []struct {
+		name   string
+		unique string
+		steps  []step
+	}{
+		{"usernames", "email,username", []step{
+			{"create", post, "/users", `{"name":"Ada","email":"ada@example.com","username":"ada","phone":"+15550100"}`, http.StatusCreated, ""},
+			{"create with the username taken", post, "/users", `{"name":"Eve","email":"eve@example.com","username":"ada"}`, http.StatusConflict, `unique constraint "username" violated`},
+			{"create with the phone taken", post, "/users", `{"name":"Bob","email":"bob@example.com","username":"bob","phone":"+15550100"}`, http.StatusCreated, ""},
+			{"create with the email taken", post, "/users", `{"name":"Eve","email":"ada@example.com","username":"eve"}`, http.StatusConflict, `unique constraint "email" violated`},
+			{"create without a username", post, "/users", `{"name":"Cy","email":"cy@example.com"}`, http.StatusCreated, ""},
+			{"another without a username", post, "/users", `{"name":"Dan","email":"dan@example.com"}`, http.StatusCreated, ""},
+			{"update to the username taken", patch, "/users/{Bob}", `{"username":"ada"}`, http.StatusConflict, `unique constraint "username" violated`},
+			{"update keeping the username", patch, "/users/{Ada}", `{"name":"Ada L","username":"ada"}`, http.StatusOK, ""},
+			{"delete of the holder", del, "/users/{Ada}", "", http.StatusOK, ""},
+			{"update to the username freed", patch, "/users/{Cy}", `{"username":"ada"}`, http.StatusOK, ""},
+		}},
+		{"a composite", "email,name+phone", []step{
+			{"create", post, "/users", `{"name":"Ada","email":"ada@example.com","phone":"+15550100"}`, http.StatusCreated, ""},
+			{"create with the name", post, "/users", `{"name":"Ada","email":"ada2@example.com","phone":"+15550101"}`, http.StatusCreated, ""},
+			{"create with the phone", post, "/users", `{"name":"Bob","email":"bob@example.com","phone":"+15550100"}`, http.StatusCreated, ""},
+			{"create with both", post, "/users", `{"name":"Ada","email":"ada3@example.com","phone":"+15550100"}`, http.StatusConflict, `unique constraint "name+phone" violated`},
+			{"update to both", patch, "/users/{Bob}", `{"name":"Ada"}`, http.StatusConflict, `unique constraint "name+phone" violated`},
+		}},
+		{"no constraint", "", []step{
+			{"create", post, "/users", `{"name":"Ada","email":"ada@example.com"}`, http.StatusCreated, ""},
+			{"create with the email taken", post, "/users", `{"name":"Eve","email":"ada@example.com"}`, http.StatusCreated, ""},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			play(t, newTestRouter(t, map[string]string{"UNIQUE_FIELDS": tt.unique}), tt.steps)
+		})
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"UNIQUE_FIELDS": "email,username"})
+	jo := createUser(t, r, "Jo", "jo@example.com")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+		// the fields stored, for a success
+		stored models.User
+	}{
+		{"create", http.MethodPost, "/users", `{"name":" John  Doe ","email":" john@example.com ","username":"\tjohn "}`, http.StatusCreated,
+			models.User{Name: "John Doe", Email: "john@example.com", Username: "john"}},
+		{"create with a padded email taken", http.MethodPost, "/users", `{"name":"John","email":"  jo@example.com\n"}`, http.StatusConflict, models.User{}},
+		{"create with a padded username taken", http.MethodPost, "/users", `{"name":"John","email":"j@example.com","username":" john"}`, http.StatusConflict, models.User{}},
+		{"create with a blank name", http.MethodPost, "/users", `{"name":" \t ","email":"blank@example.com"}`, http.StatusUnprocessableEntity, models.User{}},
+		{"put", http.MethodPut, "/users/" + string(jo.ID), `{"name":"  Jo   Ann\tSmith ","email":"jo@example.com"}`, http.StatusOK,
+			models.User{Name: "Jo Ann Smith", Email: "jo@example.com"}},
+		{"patch", http.MethodPatch, "/users/" + string(jo.ID), `{"name":" Jo  Smith","username":" jo "}`, http.StatusOK,
+			models.User{Name: "Jo Smith", Email: "jo@example.com", Username: "jo"}},
+		{"patch to a padded username taken", http.MethodPatch, "/users/" + string(jo.ID), `{"username":"john  "}`, http.StatusConflict, models.User{}},
+		{"patch to a blank name", http.MethodPatch, "/users/" + string(jo.ID), `{"name":"   "}`, http.StatusUnprocessableEntity, models.User{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: tt.method, path: tt.path, body: tt.body})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.stored == (models.User{}) {
+				return
+			}
+			var user models.User
+			if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+				t.Fatal(err)
+			}
+			stored := db.GetUser(user.ID)
+			if stored == nil {
+				t.Fatalf("user %s not stored", user.ID)
+			}
+			for _, got := range []models.User{user, *stored} {
+				if got.Name != tt.stored.Name || got.Email != tt.stored.Email || got.Username != tt.stored.Username {
+					t.Errorf("name %q, email %q, username %q, want %q, %q, %q",
+						got.Name, got.Email, got.Username, tt.stored.Name, tt.stored.Email, tt.stored.Username)
+				}
+			}
+		})
+	}
+}
+
+// the raw ids an answer holds: of a user, of a list of them, or of a batch
+// reporting the ids touched and not found
+func rawIDs(t *testing.T, body []byte) []json.RawMessage {
+	t.Helper()
+	type user struct {
+		ID json.RawMessage `json:"id"`
+	}
+	var list []user
+	if err := json.Unmarshal(body, &list); err == nil {
+		var ids []json.RawMessage
+		for _, u := range list {
+			ids = append(ids, u.ID)
+		}
+		return ids
+	}
+	var one struct {
+		user
+		Touched  []json.RawMessage `json:"touched"`
+		NotFound []json.RawMessage `json:"not_found"`
+	}
+	if err := json.Unmarshal(body, &one); err != nil {
+		t.Fatal(err)
+	}
+	if one.ID != nil {
+		return []json.RawMessage{one.ID}
+	}
+	return append(one.Touched, one.NotFound...)
+}
+
+func TestIDAsString(t *testing.T) {
+	for _, asString := range []bool{false, true} {
+		name := "numbers"
+		if asString {
+			name = "strings"
+		}
+		t.Run(name, func(t *testing.T) {
+			r := newTestRouter(t, map[string]string{"ID_AS_STRING": strconv.FormatBool(asString)})
+			ada := createUser(t, r, "Ada", "ada@example.com")
+			// an unknown id past the precision of a JS number, kept exact
+			want, big := string(ada.ID), "9007199254740993"
+			if asString {
+				want, big = strconv.Quote(want), strconv.Quote(big)
+			}
+			tests := []struct {
+				name   string
+				method string
+				path   string
+				body   string
+				// the ids the answer must hold
+				want []string
+			}{
+				{"get", http.MethodGet, "/users/" + string(ada.ID), "", []string{want}},
+				{"list", http.MethodGet, "/users", "", []string{want}},
+				{"patch", http.MethodPatch, "/users/" + string(ada.ID), `{"name":"Ada L"}`, []string{want}},
+				{"touch of a large id", http.MethodPost, "/users/touch", `{"ids":[9007199254740993]}`, []string{big}},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					w := serve(r, request{method: tt.method, path: tt.path, body: tt.body})
+					if w.Code != http.StatusOK {
+						t.Fatalf("status %d: %s", w.Code, w.Body)
+					}
+					var got []string
+					for _, id := range rawIDs(t, w.Body.Bytes()) {
+						got = append(got, string(id))
+					}
+					if !slices.Equal(got, tt.want) {
+						t.Errorf("ids %s, want %s", got, tt.want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestIDInput(t *testing.T) {
+	for _, asString := range []bool{false, true} {
+		t.Run("ID_AS_STRING="+strconv.FormatBool(asString), func(t *testing.T) {
+			r := newTestRouter(t, map[string]string{"ID_AS_STRING": strconv.FormatBool(asString)})
+			ada := createUser(t, r, "Ada", "ada@example.com")
+			id := string(ada.ID)
+			tests := []struct {
+				name   string
+				method string
+				path   string
+				body   string
+				want   int
+			}{
+				{"create with a numeric id", http.MethodPost, "/users", `{"id":` + id + `,"name":"Bob","email":"bob@example.com"}`, http.StatusCreated},
+				{"create with a string id", http.MethodPost, "/users", `{"id":"` + id + `","name":"Cy","email":"cy@example.com"}`, http.StatusCreated},
+				{"create with a bad id", http.MethodPost, "/users", `{"id":true,"name":"Dan","email":"dan@example.com"}`, http.StatusBadRequest},
+				{"put with a numeric id", http.MethodPut, "/users/" + id, `{"id":` + id + `,"name":"Ada L","email":"ada@example.com"}`, http.StatusOK},
+				{"put with a string id", http.MethodPut, "/users/" + id, `{"id":"` + id + `","name":"Ada M","email":"ada@example.com"}`, http.StatusOK},
+				{"patch with a numeric id", http.MethodPatch, "/users/" + id, `{"id":` + id + `,"name":"Ada N"}`, http.StatusOK},
+				{"patch with a string id", http.MethodPatch, "/users/" + id, `{"id":"` + id + `","name":"Ada O"}`, http.StatusOK},
+				{"touch by numeric and string ids", http.MethodPost, "/users/touch", `{"ids":[` + id + `,"` + id + `"]}`, http.StatusOK},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					w := serve(r, request{method: tt.method, path: tt.path, body: tt.body})
+					if w.Code != tt.want {
+						t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+					}
+					if w.Code != http.StatusOK {
+						return
+					}
+					// the user changed is the one of the path, whichever form
+					// its id came in
+					for _, raw := range rawIDs(t, w.Body.Bytes()) {
+						var got models.ID
+						if err := json.Unmarshal(raw, &got); err != nil || got != ada.ID {
+							t.Errorf("answered user %s, want %s", raw, id)
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestProtobufBodies(t *testing.T) {
+	r := newTestRouter(t, nil)
+	proto := func(u models.User) string { return string(u.MarshalProto()) }
+	protobuf := map[string]string{"Content-Type": models.MIMEProtobuf, "Accept": models.MIMEProtobuf}
+
+	// a create in protobuf, answered in protobuf
+	w := serve(r, request{method: http.MethodPost, path: "/users", body: proto(models.User{Name: " Ada ", Email: "ada@example.com", Priority: 3}), header: protobuf})
+	if w.Code != http.StatusCreated || w.Header().Get("Content-Type") != models.MIMEProtobuf {
+		t.Fatalf("create: status %d as %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+	var ada models.User
+	if err := ada.UnmarshalProto(w.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if ada.ID == "" || ada.Name != "Ada" || ada.Email != "ada@example.com" || ada.Priority != 3 || ada.Version != 1 {
+		t.Errorf("created %+v", ada)
+	}
+	// the same user as the JSON path stores
+	if got := db.GetUser(ada.ID); got == nil || got.Name != "Ada" || got.Priority != 3 {
+		t.Errorf("stored %+v", got)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		header map[string]string
+		want   int
+		// the error of a failed request, the name of the user answered in
+		// JSON when it succeeds
+		message string
+		user    string
+	}{
+		{"update in protobuf", http.MethodPut, proto(models.User{Name: "Ada L", Email: "ada@example.com"}), map[string]string{"Content-Type": models.MIMEProtobuf}, http.StatusOK, "", "Ada L"},
+		{"create in protobuf, answered in JSON", http.MethodPost, proto(models.User{Name: "Bob", Email: "bob@example.com"}), map[string]string{"Content-Type": models.MIMEProtobuf}, http.StatusCreated, "", "Bob"},
+		{"create of an invalid user", http.MethodPost, proto(models.User{Name: "Cy"}), map[string]string{"Content-Type": models.MIMEProtobuf}, http.StatusUnprocessableEntity, "", ""},
+		{"malformed create", http.MethodPost, "\x0a\x05", map[string]string{"Content-Type": models.MIMEProtobuf}, http.StatusBadRequest, "invalid protobuf field 1: unexpected EOF", ""},
+		{"malformed update", http.MethodPut, "\x0a\x05Ada", map[string]string{"Content-Type": models.MIMEProtobuf}, http.StatusUnprocessableEntity, "invalid protobuf field 1: unexpected EOF", ""},
+		{"create of a wrong content type", http.MethodPost, `{"name":"Cy","email":"cy@example.com"}`, map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType, "content type must be application/json or application/x-protobuf", ""},
+		{"update of a wrong content type", http.MethodPut, `<user/>`, map[string]string{"Content-Type": "application/xml"}, http.StatusUnsupportedMediaType, "content type must be application/json, application/x-protobuf or multipart/form-data", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/users"
+			if tt.method == http.MethodPut {
+				path += "/" + string(ada.ID)
+			}
+			w := serve(r, request{method: tt.method, path: path, body: tt.body, header: tt.header})
+			if w.Code != tt.want || tt.message != "" && errorMessage(w) != tt.message {
+				t.Fatalf("status %d %q, want %d %q", w.Code, errorMessage(w), tt.want, tt.message)
+			}
+			if tt.user == "" {
+				return
+			}
+			var user models.User
+			if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil || user.Name != tt.user {
+				t.Errorf("answered %s, want %s in JSON", w.Body, tt.user)
+			}
+		})
+	}
+	if n := db.CountUsers(true); n != 2 {
+		t.Errorf("%d users, want ada and bob", n)
+	}
+}
+
+// a create of TestDedupe: its body, its answer and the create, by index,
+// whose user it answers, -1 for none
+type dedupeStep struct {
+	body string
+	want int
+	same int
+}
+
+func TestDedupe(t *testing.T) {
+	const (
+		ada = `{"name":"Ada","email":"ada@example.com"}`
+		bob = `{"name":"Bob","email":"bob@example.com"}`
+	)
+	tests := []struct {
+		name, window, unique string
+		steps                []dedupeStep
+	}{
+		{"a window", "1m", "email", []dedupeStep{
+			{ada, http.StatusCreated, -1},
+			{ada, http.StatusOK, 0},
+			// the same once normalized
+			{`{"email":" ada@example.com","name":"  Ada "}`, http.StatusOK, 0},
+			{bob, http.StatusCreated, -1},
+			{`{"name":"Ada L","email":"ada@example.com"}`, http.StatusConflict, -1},
+			{ada, http.StatusOK, 0},
+		}},
+		{"a window, no unique email", "1m", "", []dedupeStep{
+			{ada, http.StatusCreated, -1},
+			{ada, http.StatusOK, 0},
+			{`{"name":"Ada L","email":"ada@example.com"}`, http.StatusCreated, -1},
+		}},
+		{"no window", "", "email", []dedupeStep{
+			{ada, http.StatusCreated, -1},
+			{ada, http.StatusConflict, -1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t, map[string]string{"DEDUPE_WINDOW": tt.window, "UNIQUE_FIELDS": tt.unique})
+			var ids []models.ID
+			for n, s := range tt.steps {
+				w := serve(r, request{method: http.MethodPost, path: "/users", body: s.body})
+				var user models.User
+				json.Unmarshal(w.Body.Bytes(), &user)
+				ids = append(ids, user.ID)
+				if w.Code != s.want {
+					t.Fatalf("create %d: status %d, want %d: %s", n, w.Code, s.want, w.Body)
+				}
+				if s.same >= 0 && user.ID != ids[s.same] {
+					t.Errorf("create %d: answered user %s, want the user %s of create %d", n, user.ID, ids[s.same], s.same)
+				}
+				if s.same < 0 && s.want == http.StatusCreated && slices.Contains(ids[:n], user.ID) {
+					t.Errorf("create %d: answered user %s again, want a new one", n, user.ID)
+				}
+			}
+		})
+	}
+
+	// once the window is over, or the user is gone, the body creates again
+	r := newTestRouter(t, map[string]string{"DEDUPE_WINDOW": "100ms", "UNIQUE_FIELDS": ""})
+	first := createUser(t, r, "Ada", "ada@example.com")
+	time.Sleep(150 * time.Millisecond)
+	later := createUser(t, r, "Ada", "ada@example.com")
+	if later.ID == first.ID {
+		t.Errorf("create after the window answered user %s again", first.ID)
+	}
+	serve(r, request{method: http.MethodDelete, path: "/users/" + string(later.ID)})
+	if again := createUser(t, r, "Ada", "ada@example.com"); again.ID == later.ID {
+		t.Errorf("create after a delete answered the deleted user %s", later.ID)
+	}
+	if n := db.CountUsers(false); n != 2 {
+		t.Errorf("%d users, want the first and the last", n)
+	}
+}
+
+func TestEmailDomains(t *testing.T) {
+	const (
+		post  = http.MethodPost
+		patch = http.MethodPatch
+	)
+	tests := []struct {
+		name        string
+		allow, deny string
+		steps       []step
+	}{
+		{"allowed", "example.com,*.Corp.example", "", []step{
+			{"allowed", post, "/users", `{"name":"Ada","email":"ada@example.com"}`, http.StatusCreated, ""},
+			{"allowed in upper case", post, "/users", `{"name":"Bob","email":"bob@EXAMPLE.com"}`, http.StatusCreated, ""},
+			{"a subdomain without a wildcard", post, "/users", `{"name":"Eve","email":"eve@mail.example.com"}`, http.StatusUnprocessableEntity, `email domain "mail.example.com" is not in the allowed domains`},
+			{"a subdomain of the wildcard", post, "/users", `{"name":"Cy","email":"cy@eu.corp.example"}`, http.StatusCreated, ""},
+			{"a deeper subdomain of the wildcard", post, "/users", `{"name":"Dan","email":"dan@a.eu.Corp.Example"}`, http.StatusCreated, ""},
+			{"the wildcard's own domain", post, "/users", `{"name":"Eve","email":"eve@corp.example"}`, http.StatusUnprocessableEntity, `email domain "corp.example" is not in the allowed domains`},
+			{"a domain ending like it", post, "/users", `{"name":"Eve","email":"eve@badexample.com"}`, http.StatusUnprocessableEntity, `email domain "badexample.com" is not in the allowed domains`},
+			{"update to another domain", patch, "/users/{Ada}", `{"email":"ada@other.org"}`, http.StatusUnprocessableEntity, `email domain "other.org" is not in the allowed domains`},
+			{"update of another field", patch, "/users/{Ada}", `{"name":"Ada L"}`, http.StatusOK, ""},
+		}},
+		{"denied", "", "spam.test,*.Temp.test", []step{
+			{"not denied", post, "/users", `{"name":"Ada","email":"ada@example.com"}`, http.StatusCreated, ""},
+			{"denied", post, "/users", `{"name":"Eve","email":"eve@spam.test"}`, http.StatusUnprocessableEntity, `email domain "spam.test" is not allowed`},
+			{"denied in mixed case", post, "/users", `{"name":"Eve","email":"eve@SpAm.Test"}`, http.StatusUnprocessableEntity, `email domain "spam.test" is not allowed`},
+			{"a subdomain without a wildcard", post, "/users", `{"name":"Bob","email":"bob@mail.spam.test"}`, http.StatusCreated, ""},
+			{"a subdomain of the wildcard", post, "/users", `{"name":"Eve","email":"eve@x.temp.test"}`, http.StatusUnprocessableEntity, `email domain "x.temp.test" is not allowed`},
+			{"the wildcard's own domain", post, "/users", `{"name":"Cy","email":"cy@temp.test"}`, http.StatusCreated, ""},
+			{"update to a denied domain", patch, "/users/{Ada}", `{"email":"ada@spam.test"}`, http.StatusUnprocessableEntity, `email domain "spam.test" is not allowed`},
+		}},
+		{"both, denied first", "*.example.com", "spam.example.com", []step{
+			{"allowed", post, "/users", `{"name":"Ada","email":"ada@eu.example.com"}`, http.StatusCreated, ""},
+			{"allowed and denied", post, "/users", `{"name":"Eve","email":"eve@spam.example.com"}`, http.StatusUnprocessableEntity, `email domain "spam.example.com" is not allowed`},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			play(t, newTestRouter(t, map[string]string{"ALLOWED_EMAIL_DOMAINS": tt.allow, "DENIED_EMAIL_DOMAINS": tt.deny}), tt.steps)
+		})
+	}
+}
+
+func TestMaxLengths(t *testing.T) {
+	const (
+		post  = http.MethodPost
+		patch = http.MethodPatch
+		put   = http.MethodPut
+	)
+	r := newTestRouter(t, map[string]string{"MAX_NAME_LENGTH": "5", "MAX_EMAIL_LENGTH": "20"})
+	play(t, r, []step{
+		{"at the limits", post, "/users", `{"name":"Adela","email":"abcdefgh@example.com"}`, http.StatusCreated, ""},
+		{"a name too long", post, "/users", `{"name":"Adelai","email":"ada@example.com"}`, http.StatusUnprocessableEntity, "name must be at most 5 characters, got 6"},
+		{"a multibyte name at the limit", post, "/users", `{"name":"Zoëëë","email":"zoe@example.com"}`, http.StatusCreated, ""},
+		{"a multibyte name too long", post, "/users", `{"name":"Zoëëëë","email":"zoe2@example.com"}`, http.StatusUnprocessableEntity, "name must be at most 5 characters, got 6"},
+		{"a name at the limit once trimmed", post, "/users", `{"name":"  Bo   Li ","email":"bob@example.com"}`, http.StatusCreated, ""},
+		{"an email too long", post, "/users", `{"name":"Cy","email":"abcdefghi@example.com"}`, http.StatusUnprocessableEntity, "email must be at most 20 characters, got 21"},
+		{"both too long", post, "/users", `{"name":"Adelai","email":"abcdefghi@example.com"}`, http.StatusUnprocessableEntity, "name must be at most 5 characters, got 6, email must be at most 20 characters, got 21"},
+		{"patch to a name too long", patch, "/users/{Adela}", `{"name":"Adelai"}`, http.StatusUnprocessableEntity, "name must be at most 5 characters, got 6"},
+		{"put of an email too long", put, "/users/{Adela}", `{"name":"Ada","email":"abcdefghi@example.com"}`, http.StatusUnprocessableEntity, "email must be at most 20 characters, got 21"},
+		{"patch at the limit", patch, "/users/{Adela}", `{"name":"Ädelä"}`, http.StatusOK, ""},
+	})
+
+	// each field and its limit in the details
+	w := serve(r, request{method: http.MethodPost, path: "/users", body: `{"name":"Adelai","email":"abcdefghi@example.com"}`})
+	var body struct {
+		Details struct {
+			Fields []struct {
+				Field, Reason string
+			} `json:"fields"`
+		} `json:"details"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if got := body.Details.Fields; len(got) != 2 || got[0].Field != "name" || got[0].Reason != "must be at most 5 characters, got 6" || got[1].Field != "email" || got[1].Reason != "must be at most 20 characters, got 21" {
+		t.Errorf("fields %+v", got)
+	}
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"MAX_BATCH_SIZE": "2"})
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+	cy := createUser(t, r, "Cy", "cy@example.com")
+	two := `{"ids":[` + string(ada.ID) + `,` + string(bob.ID) + `]}`
+	three := `{"ids":[` + string(ada.ID) + `,` + string(bob.ID) + `,` + string(cy.ID) + `]}`
+	csv := map[string]string{"Content-Type": "text/csv"}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		// the status at or under the limit, 400 over it
+		want int
+	}{
+		{"create at the limit", http.MethodPost, "/users/batch", `[{"name":"Dan","email":"dan@example.com"},{"name":"Eve","email":"eve@example.com"}]`, nil, http.StatusMultiStatus},
+		{"create over the limit", http.MethodPost, "/users/batch", `[{"name":"Fay","email":"fay@example.com"},{"name":"Gus","email":"gus@example.com"},{"name":"Hal","email":"hal@example.com"}]`, nil, http.StatusBadRequest},
+		{"atomic create over the limit", http.MethodPost, "/users/bulk?atomic=true", `[{"name":"Fay","email":"fay@example.com"},{"name":"Gus","email":"gus@example.com"},{"name":"Hal","email":"hal@example.com"}]`, nil, http.StatusBadRequest},
+		{"import at the limit", http.MethodPost, "/users/import", "name,email\nFay,fay@example.com\nGus,gus@example.com\n", csv, http.StatusMultiStatus},
+		{"import over the limit", http.MethodPost, "/users/import", "name,email\nHal,hal@example.com\nIda,ida@example.com\nJo,jo@example.com\n", csv, http.StatusBadRequest},
+		{"reorder at the limit", http.MethodPut, "/users/reorder", two, nil, http.StatusOK},
+		{"reorder over the limit", http.MethodPut, "/users/reorder", three, nil, http.StatusBadRequest},
+		{"touch at the limit", http.MethodPost, "/users/touch", two, nil, http.StatusOK},
+		{"touch over the limit", http.MethodPost, "/users/touch", three, nil, http.StatusBadRequest},
+		{"delete over the limit", http.MethodDelete, "/users", three, nil, http.StatusBadRequest},
+		{"delete at the limit", http.MethodDelete, "/users", two, nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := serve(r, request{method: http.MethodGet, path: "/users"}).Body.String()
+			w := serve(r, request{method: tt.method, path: tt.path, body: tt.body, header: tt.header})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusBadRequest {
+				return
+			}
+			var body struct {
+				Error   string `json:"error"`
+				Details struct {
+					Limit int `json:"limit"`
+				} `json:"details"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body.Error != "3 items, at most 2 are allowed" || body.Details.Limit != 2 {
+				t.Errorf("answer %s, want the limit of 2", w.Body)
+			}
+			if after := serve(r, request{method: http.MethodGet, path: "/users"}).Body.String(); after != before {
+				t.Errorf("users %s after the rejected batch, were %s", after, before)
+			}
+		})
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	// the status and error of each row
+	type result struct {
+		Row    int    `json:"row"`
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}
+	tests := []struct {
+		name string
+		file string
+		want int
+		// the rows reported and the names stored
+		results []result
+		stored  []string
+	}{
+		{"a header", "name,email,priority\nAda,ada@example.com,2\n\"Bob, Jr\",bob@example.com,0\n", http.StatusMultiStatus,
+			[]result{{2, http.StatusCreated, ""}, {3, http.StatusCreated, ""}}, []string{"Ada", "Bob, Jr"}},
+		{"columns in another order", "Email, Name\nada@example.com,Ada\n", http.StatusMultiStatus,
+			[]result{{2, http.StatusCreated, ""}}, []string{"Ada"}},
+		{"no header", "Ada,ada@example.com,ada,,1\nBob,bob@example.com,,,\n", http.StatusMultiStatus,
+			[]result{{1, http.StatusCreated, ""}, {2, http.StatusCreated, ""}}, []string{"Ada", "Bob"}},
+		{"errors by row", "name,email,priority\nAda,ada@example.com,1\nBob,bob@example.com\nCy,cy@example.com,high\nEve,ada@example.com,0\nDan,not an email,0\nFay,fay@example.com,3\n", http.StatusMultiStatus,
+			[]result{
+				{2, http.StatusCreated, ""},
+				{3, http.StatusBadRequest, "expected 3 fields, got 2"},
+				{4, http.StatusBadRequest, `priority "high" is not a number`},
+				{5, http.StatusConflict, `unique constraint "email" violated`},
+				{6, http.StatusUnprocessableEntity, "email is not a valid email address"},
+				{7, http.StatusCreated, ""},
+			}, []string{"Ada", "Fay"}},
+		{"a bad quote", "name,email\nAda,ada@example.com\n\"Bob,bob@example.com\n", http.StatusMultiStatus,
+			[]result{{2, http.StatusCreated, ""}, {3, http.StatusBadRequest, "extraneous or missing \" in quoted-field"}}, []string{"Ada"}},
+		{"an unknown column in the header", "name,email,nickname\nAda,ada@example.com,ada\n", http.StatusMultiStatus,
+			[]result{{1, http.StatusBadRequest, "expected 5 fields, got 3"}, {2, http.StatusBadRequest, "expected 5 fields, got 3"}}, nil},
+		{"a column twice in the header", "name,email,email\nAda,ada@example.com,ada@example.com\n", http.StatusMultiStatus,
+			[]result{{1, http.StatusBadRequest, "expected 5 fields, got 3"}, {2, http.StatusBadRequest, "expected 5 fields, got 3"}}, nil},
+		{"no email column", "name\nAda\n", http.StatusMultiStatus,
+			[]result{{2, http.StatusUnprocessableEntity, "email is required"}}, nil},
+		{"a header alone", "name,email\n", http.StatusMultiStatus, []result{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t, nil)
+			w := serve(r, request{method: http.MethodPost, path: "/users/import", body: tt.file, header: map[string]string{"Content-Type": "text/csv"}})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			var report struct {
+				Results  []result `json:"results"`
+				Imported int      `json:"imported"`
+				Failed   int      `json:"failed"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(report.Results, tt.results) {
+				t.Errorf("results %+v, want %+v", report.Results, tt.results)
+			}
+			if report.Imported != len(tt.stored) || report.Failed != len(tt.results)-len(tt.stored) {
+				t.Errorf("%d imported and %d failed, want %d of %d rows imported", report.Imported, report.Failed, len(tt.stored), len(tt.results))
+			}
+			var names []string
+			users, _ := db.GetUsers(db.UserQuery{})
+			for _, u := range users {
+				names = append(names, u.Name)
+			}
+			if !slices.Equal(names, tt.stored) {
+				t.Errorf("stored %q, want %q", names, tt.stored)
+			}
+		})
+	}
+}
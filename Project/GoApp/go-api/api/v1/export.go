@@ -0,0 +1,291 @@
+package v1
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/db"
+	"go-api/logging"
+	"go-api/middleware"
+	"go-api/models"
+	"go-api/pagination"
+	"go-api/usercsv"
+)
+
+// upload a JSON snapshot of all users to the backup bucket, soft-deleted
+// ones included so a restore can still bring them back
+func backupUsersHandler(c *gin.Context) {
+	users, _, err := store.GetUsers(c.Request.Context(), db.UserQuery{IncludeDeleted: true})
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	body, err := json.Marshal(users)
+
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	key := conf.S3Prefix + "users-" + time.Now().UTC().Format("20060102T150405Z") + ".json"
+
+	if err := uploader.Upload(c.Request.Context(), key, "application/json", body); err != nil {
+		logging.From(c).Error("backup upload failed", "key", key, "error", err)
+		respondError(c, http.StatusBadGateway, "upload to object storage failed")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"bucket": uploader.Bucket(), "key": key, "size": len(body), "users": len(users)})
+}
+
+// content types of the ?format= of an export
+var exportTypes = map[string]string{
+	"ndjson": "application/x-ndjson",
+	"json":   "application/json",
+	"csv":    middleware.MIMECSV,
+}
+
+// users an export reads from the store at a time, and writes before it
+// flushes them to the client
+const exportPageSize = 500
+
+// all users, inactive ones included, by ascending id: one JSON object a line,
+// or with ?format=json a JSON array and with ?format=csv the CSV an import
+// takes, written out a page at a time. A client resumes a broken download
+// with a byte Range, checked with If-Range against the ETag, or with
+// ?from_id= and the last id it got, which answers the users after it as 206
+// with a "users" Content-Range.
+func exportUsersHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "ndjson")
+	contentType, ok := exportTypes[format]
+
+	if !ok {
+		respondError(c, http.StatusBadRequest, "format must be ndjson, json or csv")
+		return
+	}
+
+	var after models.ID
+
+	if from := c.Query("from_id"); from != "" {
+		id, err := db.ParseID(from)
+
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid from_id")
+			return
+		}
+
+		after = id
+	}
+
+	// read before the users: a change made while they are read moves it,
+	// so the ETag of a body with the change is never that of one without
+	modified, err := store.LastModified(c.Request.Context())
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	page, rest, err := store.GetUsers(c.Request.Context(), exportQuery(after))
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	total := rest
+
+	if after != "" {
+		_, total, err = store.GetUsers(c.Request.Context(), db.UserQuery{Page: pagination.Page{Limit: 1}})
+
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+	}
+
+	// strong, as If-Range needs: every change to the store moves its last
+	// modification, so the same one gives the same bytes
+	h := sha256.New()
+	io.WriteString(h, c.Request.URL.RawQuery)
+	io.WriteString(h, c.GetHeader("X-Timezone"))
+	fmt.Fprintf(h, "\x00%d\x00%d", modified.UnixNano(), total)
+	etag := `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	c.Header("ETag", etag)
+	c.Header("Content-Type", contentType)
+
+	// a byte range is cut from the whole body, so only then is it built in
+	// memory; it applies to the users after from_id when both are given
+	if c.GetHeader("Range") != "" {
+		var body bytes.Buffer
+		ew := newExportWriter(&body, format)
+
+		if err := exportPages(c, page, ew.write); err == nil {
+			err = ew.close()
+		}
+
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		http.ServeContent(c.Writer, c.Request, "", modified, bytes.NewReader(body.Bytes()))
+		return
+	}
+
+	// HTTP dates have whole seconds, compare at that resolution
+	modified = modified.UTC().Truncate(time.Second)
+	c.Header("Last-Modified", modified.Format(http.TimeFormat))
+	c.Header("Accept-Ranges", "bytes")
+
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if noneMatch(c.GetHeader("If-None-Match"), etag) || err == nil && c.GetHeader("If-None-Match") == "" && !modified.After(since) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	status := http.StatusOK
+	if after != "" {
+		status = http.StatusPartialContent
+		if rest > 0 {
+			c.Header("Content-Range", fmt.Sprintf("users %d-%d/%d", total-rest, total-1, total))
+		} else {
+			c.Header("Content-Range", fmt.Sprintf("users */%d", total))
+		}
+	}
+	c.Status(status)
+
+	if c.Request.Method == http.MethodHead {
+		return
+	}
+
+	// the download may outlast the server write timeout, lift it as the
+	// event stream does
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	// the status is out, a failure from here can only cut the body short.
+	// Each page is flushed, which also lets it past middleware.Watchdog
+	// rather than held there until the export is done.
+	w := bufio.NewWriter(c.Writer)
+	ew := newExportWriter(w, format)
+	flushed := func(users []models.User) error {
+		if err := ew.write(users); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	err = exportPages(c, page, flushed)
+	if err == nil {
+		err = ew.close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		logging.From(c).Error("export cut short", "error", err)
+	}
+}
+
+// the page of an export after the user with id, from the first user when
+// id is empty
+func exportQuery(id models.ID) db.UserQuery {
+	return db.UserQuery{After: id, Page: pagination.Page{Limit: exportPageSize}}
+}
+
+// hand each page of an export to write, in the time zone of the request,
+// from page, the first one, until the store has no users after the last
+func exportPages(c *gin.Context, page []models.User, write func([]models.User) error) error {
+	for {
+		if err := write(localize(c, page).([]models.User)); err != nil {
+			return err
+		}
+		if len(page) < exportPageSize {
+			return nil
+		}
+		var err error
+		page, _, err = store.GetUsers(c.Request.Context(), exportQuery(page[len(page)-1].ID))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// exportWriter writes an export in format, a key of exportTypes, a page of
+// users at a time
+type exportWriter struct {
+	w      io.Writer
+	format string
+	csv    *usercsv.Writer
+	// what comes before the next user of a JSON array
+	sep string
+}
+
+func newExportWriter(w io.Writer, format string) *exportWriter {
+	ew := &exportWriter{w: w, format: format, sep: "["}
+	if format == "csv" {
+		ew.csv = usercsv.NewWriter(w)
+	}
+	return ew
+}
+
+// write the users after those already written
+func (ew *exportWriter) write(users []models.User) error {
+	switch ew.format {
+	case "json":
+		// the bytes of json.Marshal of all users, a user at a time
+		for _, u := range users {
+			data, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(ew.w, ew.sep); err != nil {
+				return err
+			}
+			if _, err := ew.w.Write(data); err != nil {
+				return err
+			}
+			ew.sep = ","
+		}
+		return nil
+	case "csv":
+		return ew.csv.Write(users)
+	}
+	enc := json.NewEncoder(ew.w)
+	for _, u := range users {
+		if err := enc.Encode(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// end the export after its last page
+func (ew *exportWriter) close() error {
+	switch ew.format {
+	case "json":
+		end := "]"
+		if ew.sep == "[" {
+			end = "[]"
+		}
+		_, err := io.WriteString(ew.w, end)
+		return err
+	case "csv":
+		return ew.csv.Close()
+	}
+	return nil
+}
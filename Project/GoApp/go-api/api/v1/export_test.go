@@ -0,0 +1,333 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go-api/db"
+	"go-api/models"
+)
+
+var itoa = strconv.Itoa
+
+// a router with the users named, created in that order
+func exportRouter(t *testing.T, names ...string) (http.Handler, []models.User) {
+	t.Helper()
+	r := newTestRouter(t, nil)
+	var users []models.User
+	for _, name := range names {
+		users = append(users, createUser(t, r, name, strings.ToLower(name)+"@example.com"))
+	}
+	return r, users
+}
+
+// the names of the users of an export body in format
+func exportedNames(t *testing.T, format string, body []byte) []string {
+	t.Helper()
+	var names []string
+	switch format {
+	case "json":
+		var users []models.User
+		if err := json.Unmarshal(body, &users); err != nil {
+			t.Fatalf("export %q: %v", body, err)
+		}
+		for _, u := range users {
+			names = append(names, u.Name)
+		}
+	case "csv":
+		rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+		if err != nil || len(rows) == 0 || rows[0][1] != "name" {
+			t.Fatalf("export %q: %v, want a header row", body, err)
+		}
+		for _, row := range rows[1:] {
+			names = append(names, row[1])
+		}
+	default:
+		for _, line := range strings.Split(strings.TrimSuffix(string(body), "\n"), "\n") {
+			if line == "" {
+				continue
+			}
+			var u models.User
+			if err := json.Unmarshal([]byte(line), &u); err != nil {
+				t.Fatalf("export line %q: %v", line, err)
+			}
+			names = append(names, u.Name)
+		}
+	}
+	return names
+}
+
+func TestExportFormats(t *testing.T) {
+	r, _ := exportRouter(t, "Ada", "Bob", "Cy")
+	tests := []struct {
+		format      string
+		contentType string
+	}{
+		{"", "application/x-ndjson"},
+		{"ndjson", "application/x-ndjson"},
+		{"json", "application/json"},
+		{"csv", "text/csv"},
+	}
+	for _, tt := range tests {
+		t.Run("format "+tt.format, func(t *testing.T) {
+			path := "/users/export"
+			if tt.format != "" {
+				path += "?format=" + tt.format
+			}
+			w := serve(r, request{method: http.MethodGet, path: path})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type %s, want %s", got, tt.contentType)
+			}
+			if got := strings.Join(exportedNames(t, tt.format, w.Body.Bytes()), ","); got != "Ada,Bob,Cy" {
+				t.Errorf("exported %s, want Ada,Bob,Cy", got)
+			}
+		})
+	}
+
+	if w := serve(r, request{method: http.MethodGet, path: "/users/export?format=xml"}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d, want 400", w.Code)
+	}
+}
+
+func TestExportOfNoUsers(t *testing.T) {
+	r, _ := exportRouter(t)
+	w := serve(r, request{method: http.MethodGet, path: "/users/export?format=json"})
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("status %d, body %q, want an empty array", w.Code, w.Body)
+	}
+}
+
+// the streamed export is conditional as a buffered one would be
+func TestExportNotModified(t *testing.T) {
+	r, users := exportRouter(t, "Ada", "Bob")
+	w := serve(r, request{method: http.MethodGet, path: "/users/export"})
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"same ETag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"other ETag", map[string]string{"If-None-Match": `"x"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": modified}, http.StatusNotModified},
+		{"other ETag wins over the date", map[string]string{"If-None-Match": `"x"`, "If-Modified-Since": modified}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: "/users/export", header: tt.header})
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusNotModified && w.Body.Len() > 0 {
+				t.Errorf("304 with a body %q", w.Body)
+			}
+		})
+	}
+
+	serve(r, request{method: http.MethodPatch, path: "/users/" + string(users[0].ID), body: `{"name":"Ada L"}`})
+	if w := serve(r, request{method: http.MethodGet, path: "/users/export", header: map[string]string{"If-None-Match": etag}}); w.Code != http.StatusOK {
+		t.Errorf("status %d after a change, want 200", w.Code)
+	}
+}
+
+func TestExportRanges(t *testing.T) {
+	r, users := exportRouter(t, "Ada", "Bob", "Cy")
+	full := serve(r, request{method: http.MethodGet, path: "/users/export"})
+	body, etag := full.Body.String(), full.Header().Get("ETag")
+	// the byte offset of Bob's line
+	offset := strings.Index(body, "\n") + 1
+	rest := len(body) - offset
+
+	tests := []struct {
+		name         string
+		header       map[string]string
+		want         int
+		wantBody     string
+		contentRange string
+	}{
+		{"whole body as a range", map[string]string{"Range": "bytes=0-"}, http.StatusPartialContent, body, "bytes 0-" + itoa(len(body)-1) + "/" + itoa(len(body))},
+		{"from an offset", map[string]string{"Range": "bytes=" + itoa(offset) + "-"}, http.StatusPartialContent, body[offset:], "bytes " + itoa(offset) + "-" + itoa(len(body)-1) + "/" + itoa(len(body))},
+		{"last bytes", map[string]string{"Range": "bytes=-" + itoa(rest)}, http.StatusPartialContent, body[offset:], "bytes " + itoa(offset) + "-" + itoa(len(body)-1) + "/" + itoa(len(body))},
+		{"If-Range of the same export", map[string]string{"Range": "bytes=" + itoa(offset) + "-", "If-Range": etag}, http.StatusPartialContent, body[offset:], ""},
+		{"If-Range of another export", map[string]string{"Range": "bytes=" + itoa(offset) + "-", "If-Range": `"x"`}, http.StatusOK, body, ""},
+		{"past the end", map[string]string{"Range": "bytes=" + itoa(len(body)+10) + "-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */" + itoa(len(body))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: "/users/export", header: tt.header})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body %q, want %q", w.Body, tt.wantBody)
+			}
+			if tt.contentRange != "" && w.Header().Get("Content-Range") != tt.contentRange {
+				t.Errorf("Content-Range %s, want %s", w.Header().Get("Content-Range"), tt.contentRange)
+			}
+		})
+	}
+
+	// the users after from_id, and a byte range of just them
+	from := "/users/export?from_id=" + string(users[0].ID)
+	after := serve(r, request{method: http.MethodGet, path: from})
+	w := serve(r, request{method: http.MethodGet, path: from, header: map[string]string{"Range": "bytes=0-"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != after.Body.String() {
+		t.Errorf("range of the users after from_id: status %d, body %q, want 206 with %q", w.Code, w.Body, after.Body)
+	}
+}
+
+func TestExportFromID(t *testing.T) {
+	r, users := exportRouter(t, "Ada", "Bob", "Cy")
+	tests := []struct {
+		name         string
+		format       string
+		from         string
+		want         string
+		contentRange string
+	}{
+		{"after the first", "ndjson", string(users[0].ID), "Bob,Cy", "users 1-2/3"},
+		{"after the second", "ndjson", string(users[1].ID), "Cy", "users 2-2/3"},
+		{"after the last", "ndjson", string(users[2].ID), "", "users */3"},
+		{"as JSON", "json", string(users[0].ID), "Bob,Cy", "users 1-2/3"},
+		{"as CSV", "csv", string(users[1].ID), "Cy", "users 2-2/3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: "/users/export?format=" + tt.format + "&from_id=" + tt.from})
+			if w.Code != http.StatusPartialContent {
+				t.Fatalf("status %d, want 206: %s", w.Code, w.Body)
+			}
+			if got := strings.Join(exportedNames(t, tt.format, w.Body.Bytes()), ","); got != tt.want {
+				t.Errorf("exported %q, want %q", got, tt.want)
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range %s, want %s", got, tt.contentRange)
+			}
+		})
+	}
+
+	if w := serve(r, request{method: http.MethodGet, path: "/users/export?from_id=x"}); w.Code != http.StatusBadRequest {
+		t.Errorf("malformed from_id: status %d, want 400", w.Code)
+	}
+}
+
+// an export of more than a page of users reads on from the last user of each
+func TestExportPages(t *testing.T) {
+	r := newTestRouter(t, nil)
+	var ids []models.ID
+	for n := range exportPageSize + 2 {
+		user, err := db.AddUser(models.User{Name: "user " + itoa(n), Email: "user" + itoa(n) + "@example.com"}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, user.ID)
+	}
+	tests := []struct {
+		name         string
+		format       string
+		from         models.ID
+		want         int
+		contentRange string
+	}{
+		{"ndjson", "ndjson", "", exportPageSize + 2, ""},
+		{"json", "json", "", exportPageSize + 2, ""},
+		{"csv", "csv", "", exportPageSize + 2, ""},
+		{"from the end of the first page", "json", ids[exportPageSize-1], 2, "users 500-501/502"},
+		{"from within the last page", "csv", ids[exportPageSize], 1, "users 501-501/502"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/users/export?format=" + tt.format
+			if tt.from != "" {
+				path += "&from_id=" + string(tt.from)
+			}
+			w := serve(r, request{method: http.MethodGet, path: path})
+			names := exportedNames(t, tt.format, w.Body.Bytes())
+			if len(names) != tt.want {
+				t.Fatalf("status %d, %d users exported, want %d", w.Code, len(names), tt.want)
+			}
+			// by ascending id, each user once
+			for n, name := range names {
+				if want := "user " + itoa(len(ids)-tt.want+n); name != want {
+					t.Fatalf("user %d is %q, want %q", n, name, want)
+				}
+			}
+			if got := w.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range %q, want %q", got, tt.contentRange)
+			}
+		})
+	}
+}
+
+// an Uploader keeping what it is handed, failing with err when set
+type fakeUploader struct {
+	key, contentType string
+	body             []byte
+	err              error
+}
+
+func (u *fakeUploader) Upload(_ context.Context, key, contentType string, body []byte) error {
+	u.key, u.contentType, u.body = key, contentType, body
+	return u.err
+}
+
+func (u *fakeUploader) Bucket() string { return "backups" }
+
+func (u *fakeUploader) Ping(context.Context) error { return nil }
+
+func TestBackup(t *testing.T) {
+	up := &fakeUploader{}
+	r := backupRouter(t, map[string]string{"S3_PREFIX": "api/"}, up)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+	if w := serve(r, request{method: http.MethodDelete, path: "/users/" + string(bob.ID)}); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+
+	w := serve(r, request{method: http.MethodPost, path: "/users/backup"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var answer struct {
+		Bucket, Key string
+		Size, Users int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.Bucket != "backups" || answer.Key != up.key || answer.Size != len(up.body) || answer.Users != 2 {
+		t.Errorf("answered %+v, uploaded %s of %d bytes", answer, up.key, len(up.body))
+	}
+	if !strings.HasPrefix(up.key, "api/users-") || !strings.HasSuffix(up.key, ".json") || up.contentType != "application/json" {
+		t.Errorf("uploaded %s as %s", up.key, up.contentType)
+	}
+	// the deleted user is in the snapshot, deleted
+	var users []models.User
+	if err := json.Unmarshal(up.body, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].ID != ada.ID || users[0].DeletedAt != nil || users[1].ID != bob.ID || users[1].DeletedAt == nil {
+		t.Errorf("snapshot %s, want ada and the deleted bob", up.body)
+	}
+
+	up.err = errors.New("connection refused")
+	w = serve(r, request{method: http.MethodPost, path: "/users/backup"})
+	if w.Code != http.StatusBadGateway || errorMessage(w) != "upload to object storage failed" {
+		t.Errorf("failed upload: status %d %s, want 502", w.Code, w.Body)
+	}
+
+	if w := serve(newTestRouter(t, nil), request{method: http.MethodPost, path: "/users/backup"}); w.Code != http.StatusNotFound {
+		t.Errorf("without object storage: status %d, want 404", w.Code)
+	}
+}
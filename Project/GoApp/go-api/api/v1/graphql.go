@@ -0,0 +1,318 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/auth"
+	"go-api/db"
+	"go-api/graphql"
+	"go-api/models"
+	"go-api/pagination"
+	"go-api/validation"
+)
+
+// the operations of graphql/schema.graphql over the store, as the REST
+// routes serve them: the same checks, email confirmation and If-Match rule,
+// a version argument standing for the ETag. Queries need a signed-in caller
+// and mutations the admin role while JWT_SECRET is set, as GET and writes
+// of /users do.
+func graphqlHandler(c *gin.Context) {
+	var req graphql.Request
+
+	switch c.Request.Method {
+	case http.MethodGet:
+		req.Query, req.OperationName = c.Query("query"), c.Query("operationName")
+		if vars := c.Query("variables"); vars != "" {
+			if err := decodeJSON([]byte(vars), &req.Variables); err != nil {
+				respondGraphQL(c, http.StatusBadRequest, graphqlError("variables must be a JSON object"))
+				return
+			}
+		}
+	default:
+		body, err := c.GetRawData()
+
+		if err != nil || decodeJSON(body, &req) != nil {
+			respondGraphQL(c, http.StatusBadRequest, graphqlError("the body must be a JSON object with a query"))
+			return
+		}
+	}
+
+	op, err := graphql.Parse(req.Query, req.OperationName)
+
+	if err != nil {
+		respondGraphQL(c, http.StatusBadRequest, graphqlError(err.Error()))
+		return
+	}
+
+	// a GET must not change anything, caches and prefetchers send them
+	if op.Type == "mutation" && c.Request.Method == http.MethodGet {
+		c.Header("Allow", http.MethodPost)
+		respondGraphQL(c, http.StatusMethodNotAllowed, graphqlError("mutations take POST"))
+		return
+	}
+
+	if tokens != nil {
+		role := auth.Role(c)
+		switch {
+		case role == "":
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			respondGraphQL(c, http.StatusUnauthorized, graphqlError("authentication required"))
+			return
+		case op.Type == "mutation" && role != auth.Admin:
+			respondGraphQL(c, http.StatusForbidden, graphqlError(auth.Admin+" role required"))
+			return
+		}
+	}
+
+	respondGraphQL(c, http.StatusOK, graphqlSchema(c).Execute(c.Request.Context(), op, req.Variables))
+}
+
+// decode data into v with its numbers kept exact, as ids and versions are
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func graphqlError(message string) graphql.Response {
+	return graphql.Response{Errors: []graphql.Error{{Message: message}}}
+}
+
+func respondGraphQL(c *gin.Context, status int, resp graphql.Response) {
+	c.JSON(status, resp)
+}
+
+// the resolvers of the request c, whose caller the changes are attributed to
+func graphqlSchema(c *gin.Context) graphql.Schema {
+	return graphql.Schema{
+		Query: map[string]graphql.Resolver{
+			"user": func(ctx context.Context, args graphql.Args) (any, error) {
+				id, err := graphqlID(args)
+				if err != nil {
+					return nil, err
+				}
+				// with PRIVATE_READS, others are not found, as with ownUser
+				if caller, ok := auth.UserID(c); conf.PrivateReads && auth.Role(c) != auth.Admin && (!ok || caller != id) {
+					return nil, nil
+				}
+				user, err := store.GetUser(ctx, id)
+				if errors.Is(err, db.ErrNotFound) {
+					return nil, nil
+				}
+				if err != nil {
+					return nil, graphqlStoreError(err)
+				}
+				return userObject(*user), nil
+			},
+			"users": func(ctx context.Context, args graphql.Args) (any, error) {
+				q, err := graphqlUserQuery(args)
+				if err != nil {
+					return nil, err
+				}
+				users, _, err := store.GetUsers(ctx, q)
+				if err != nil {
+					return nil, graphqlStoreError(err)
+				}
+				list := make([]graphql.Object, len(users))
+				for i, user := range users {
+					list[i] = userObject(user)
+				}
+				return list, nil
+			},
+		},
+		Mutation: map[string]graphql.Resolver{
+			"createUser": func(ctx context.Context, args graphql.Args) (any, error) {
+				var user models.User
+				if err := graphqlInput(args, &user); err != nil {
+					return nil, err
+				}
+				user.Normalize()
+				if errs := CheckUser(user); errs != nil {
+					return nil, errs
+				}
+				added, err := store.AddUser(ctx, user, Actor(c))
+				if err != nil {
+					return nil, graphqlStoreError(err)
+				}
+				return userObject(*added), nil
+			},
+			// replace the fields of the input, as PUT /users/:id does; a
+			// new email is only pending until it is confirmed
+			"updateUser": func(ctx context.Context, args graphql.Args) (any, error) {
+				id, err := graphqlID(args)
+				if err != nil {
+					return nil, err
+				}
+				version, err := graphqlVersion(args)
+				if err != nil {
+					return nil, err
+				}
+				var input models.User
+				if err := graphqlInput(args, &input); err != nil {
+					return nil, err
+				}
+				updated, token, err := store.PatchUser(ctx, id, func(user *models.User) error {
+					if version != 0 && user.Version != version {
+						return db.ErrStale
+					}
+					user.Name, user.Email, user.Username, user.Phone, user.Priority = input.Name, input.Email, input.Username, input.Phone, input.Priority
+					user.Normalize()
+					if errs := CheckUser(*user); errs != nil {
+						return errs
+					}
+					user.PendingEmail = user.Email
+					return nil
+				}, conf.EmailTokenTTL, Actor(c))
+				if err != nil {
+					return nil, graphqlStoreError(err)
+				}
+				if err := SendEmailConfirmation(ctx, *updated, token, Actor(c)); err != nil {
+					return nil, err
+				}
+				return userObject(*updated), nil
+			},
+			"deleteUser": func(ctx context.Context, args graphql.Args) (any, error) {
+				id, err := graphqlID(args)
+				if err != nil {
+					return nil, err
+				}
+				version, err := graphqlVersion(args)
+				if err != nil {
+					return nil, err
+				}
+				err = store.DeleteUser(ctx, id, version, Actor(c))
+				if errors.Is(err, db.ErrNotFound) {
+					return false, nil
+				}
+				if err != nil {
+					return nil, graphqlStoreError(err)
+				}
+				return true, nil
+			},
+		},
+	}
+}
+
+// the User of schema.graphql
+func userObject(u models.User) graphql.Object {
+	return graphql.Object{
+		"__typename":   "User",
+		"id":           string(u.ID),
+		"name":         u.Name,
+		"email":        u.Email,
+		"username":     optional(u.Username),
+		"phone":        optional(u.Phone),
+		"priority":     u.Priority,
+		"pendingEmail": optional(u.PendingEmail),
+		"welcomedAt":   u.WelcomedAt,
+		"active":       u.Active,
+		"createdAt":    u.CreatedAt,
+		"updatedAt":    u.UpdatedAt,
+		"version":      u.Version,
+	}
+}
+
+// null for an empty string, as the REST api leaves the field out
+func optional(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func graphqlID(args graphql.Args) (models.ID, error) {
+	s, err := args.ID("id")
+	if err != nil {
+		return "", err
+	}
+	return db.ParseID(s)
+}
+
+// the version a write is made from, 0 for any; required as If-Match is
+func graphqlVersion(args graphql.Args) (int64, error) {
+	version, err := args.Int("version", 0)
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 && conf.RequireIfMatch {
+		return 0, errors.New("version is required, send the version of the user")
+	}
+	return int64(version), nil
+}
+
+// read the UserInput argument input into user
+func graphqlInput(args graphql.Args, user *models.User) error {
+	input, err := args.Object("input")
+	if err != nil {
+		return err
+	}
+	if input == nil {
+		return errors.New("argument input is required")
+	}
+	for _, f := range []struct {
+		name string
+		into *string
+	}{
+		{"name", &user.Name},
+		{"email", &user.Email},
+		{"username", &user.Username},
+		{"phone", &user.Phone},
+	} {
+		if *f.into, err = input.String(f.name); err != nil {
+			return err
+		}
+	}
+	user.Priority, err = input.Int("priority", 0)
+	return err
+}
+
+// the query of the users field: its filter of the filterable fields, and
+// limit and offset as a page of GET /users
+func graphqlUserQuery(args graphql.Args) (db.UserQuery, error) {
+	q := db.UserQuery{Filters: map[string]string{}, ActiveOnly: true}
+	filter, err := args.Object("filter")
+	if err != nil {
+		return q, err
+	}
+	for name, v := range filter {
+		if _, ok := models.FilterFields[name]; !ok {
+			return q, errors.New("cannot filter on " + name)
+		}
+		// a null field filters nothing, as a query parameter left out
+		if v == nil {
+			continue
+		}
+		if q.Filters[name], err = filter.String(name); err != nil {
+			return q, err
+		}
+	}
+	if v, ok := args["includeInactive"].(bool); ok {
+		q.ActiveOnly = !v
+	}
+	if q.Page.Limit, err = args.Int("limit", pagination.DefaultLimit); err != nil {
+		return q, err
+	}
+	if q.Page.Offset, err = args.Int("offset", 0); err != nil {
+		return q, err
+	}
+	if q.Page.Limit < 1 || q.Page.Limit > pagination.MaxLimit || q.Page.Offset < 0 {
+		return q, fmt.Errorf("limit must be between 1 and %d and offset at least 0", pagination.MaxLimit)
+	}
+	return q, nil
+}
+
+// what an error of the store says in the errors of a response
+func graphqlStoreError(err error) error {
+	var errs validation.Errors
+	if errors.As(err, &errs) {
+		return errs
+	}
+	return errors.New(storeErrorMessage(err))
+}
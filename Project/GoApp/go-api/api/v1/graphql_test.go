@@ -0,0 +1,325 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"go-api/auth"
+)
+
+// an answer of /graphql, its data as sent
+type graphqlReply struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+		Path    []any  `json:"path"`
+	} `json:"errors"`
+}
+
+// POST the query with the variables to r, failing the test unless the
+// answer is a GraphQL response
+func graphqlPost(t *testing.T, r http.Handler, query string, variables map[string]any, header map[string]string) (int, graphqlReply) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"query": query, "variables": variables})
+	w := serve(r, request{method: http.MethodPost, path: "/graphql", body: string(body), header: header})
+	var reply graphqlReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("answer %q: %v", w.Body, err)
+	}
+	return w.Code, reply
+}
+
+// the compact form of a JSON document
+func compactJSON(t *testing.T, doc []byte) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := json.Compact(&b, doc); err != nil {
+		t.Fatalf("data %q: %v", doc, err)
+	}
+	return b.String()
+}
+
+func TestGraphQLQueries(t *testing.T) {
+	r := newTestRouter(t, nil)
+	createUser(t, r, "Ada", "ada@example.com")
+	createUser(t, r, "Bob", "bob@example.com")
+	eve := createUser(t, r, "Eve", "eve@example.com")
+	if w := serve(r, request{method: http.MethodPost, path: "/users/" + string(eve.ID) + "/deactivate"}); w.Code != http.StatusOK {
+		t.Fatalf("deactivate: status %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]any
+		want      string
+		errors    []string
+	}{
+		{
+			name:  "user",
+			query: `{ user(id: 1) { id name email pendingEmail active version } }`,
+			want:  `{"user":{"id":"1","name":"Ada","email":"ada@example.com","pendingEmail":null,"active":true,"version":1}}`,
+		},
+		{
+			name:  "aliases and typename",
+			query: `query Two { first: user(id: "1") { __typename name } second: user(id: 2) { name } }`,
+			want:  `{"first":{"__typename":"User","name":"Ada"},"second":{"name":"Bob"}}`,
+		},
+		{
+			name:      "variables",
+			query:     `query ($id: ID!, $full: Boolean = false) { user(id: $id) { name email @include(if: $full) } }`,
+			variables: map[string]any{"id": 2},
+			want:      `{"user":{"name":"Bob"}}`,
+		},
+		{
+			name:  "missing user",
+			query: `{ user(id: 999) { name } }`,
+			want:  `{"user":null}`,
+		},
+		{
+			name:   "malformed id",
+			query:  `{ user(id: "x") { name } }`,
+			want:   `{"user":null}`,
+			errors: []string{`invalid id "x"`},
+		},
+		{
+			name:  "users",
+			query: `{ users { name } }`,
+			want:  `{"users":[{"name":"Ada"},{"name":"Bob"}]}`,
+		},
+		{
+			name:  "users with inactive ones",
+			query: `{ users(includeInactive: true) { name active } }`,
+			want:  `{"users":[{"name":"Ada","active":true},{"name":"Bob","active":true},{"name":"Eve","active":false}]}`,
+		},
+		{
+			name:  "users filtered",
+			query: `{ users(filter: {email: "BOB@example.com", name: null}) { name } }`,
+			want:  `{"users":[{"name":"Bob"}]}`,
+		},
+		{
+			name:      "users paged",
+			query:     `query ($limit: Int) { users(limit: $limit, offset: 1) { name } }`,
+			variables: map[string]any{"limit": 1},
+			want:      `{"users":[{"name":"Bob"}]}`,
+		},
+		{
+			name:   "users past the largest limit",
+			query:  `{ users(limit: 501) { name } ada: user(id: 1) { name } }`,
+			want:   `{"users":null,"ada":{"name":"Ada"}}`,
+			errors: []string{"limit must be between 1 and 500 and offset at least 0"},
+		},
+		{
+			name:   "filter on an unknown field",
+			query:  `{ users(filter: {phone: "1"}) { name } }`,
+			want:   `{"users":null}`,
+			errors: []string{"cannot filter on phone"},
+		},
+		{
+			name:   "unknown field of a user",
+			query:  `{ user(id: 1) { name password } }`,
+			want:   `{"user":{"name":"Ada","password":null}}`,
+			errors: []string{`cannot query field "password" on type User`},
+		},
+		{
+			name:   "user without a selection",
+			query:  `{ user(id: 1) }`,
+			want:   `{"user":null}`,
+			errors: []string{`field "user" of type User must have a selection of subfields`},
+		},
+		{
+			name:   "unknown root field",
+			query:  `{ user(id: 1) { name } secrets }`,
+			want:   `null`,
+			errors: []string{`cannot query field "secrets" on type Query`},
+		},
+		{
+			name:   "missing variable",
+			query:  `query ($id: ID!) { user(id: $id) { name } }`,
+			want:   `null`,
+			errors: []string{"variable $id of a non-null type is missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reply := graphqlPost(t, r, tt.query, tt.variables, nil)
+			if code != http.StatusOK {
+				t.Fatalf("status %d, want 200", code)
+			}
+			if got := compactJSON(t, reply.Data); got != tt.want {
+				t.Errorf("data %s, want %s", got, tt.want)
+			}
+			var errors []string
+			for _, e := range reply.Errors {
+				errors = append(errors, e.Message)
+			}
+			if !slices.Equal(errors, tt.errors) {
+				t.Errorf("errors %q, want %q", errors, tt.errors)
+			}
+		})
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	r := newTestRouter(t, nil)
+	mails := &recordingSender{}
+	useSender(t, mails)
+
+	const user = `id name email pendingEmail version`
+	steps := []struct {
+		name      string
+		query     string
+		variables map[string]any
+		want      string
+		errors    []string
+	}{
+		{
+			name:      "create",
+			query:     `mutation ($input: UserInput!) { createUser(input: $input) { ` + user + ` } }`,
+			variables: map[string]any{"input": map[string]any{"name": " Ada ", "email": "ada@example.com"}},
+			want:      `{"createUser":{"id":"1","name":"Ada","email":"ada@example.com","pendingEmail":null,"version":1}}`,
+		},
+		{
+			name:   "create with an email taken",
+			query:  `mutation { createUser(input: {name: "Eve", email: "ada@example.com"}) { id } }`,
+			want:   `{"createUser":null}`,
+			errors: []string{`unique constraint "email" violated`},
+		},
+		{
+			name:   "create of an invalid user",
+			query:  `mutation { createUser(input: {name: "", email: "not an email"}) { id } }`,
+			want:   `{"createUser":null}`,
+			errors: []string{"name is required, email is not a valid email address"},
+		},
+		{
+			name:  "update",
+			query: `mutation { updateUser(id: 1, version: 1, input: {name: "Ada L", email: "lovelace@example.com"}) { ` + user + ` } }`,
+			want:  `{"updateUser":{"id":"1","name":"Ada L","email":"ada@example.com","pendingEmail":"lovelace@example.com","version":2}}`,
+		},
+		{
+			name:   "update of a stale version",
+			query:  `mutation { updateUser(id: 1, version: 1, input: {name: "Ada", email: "ada@example.com"}) { id } }`,
+			want:   `{"updateUser":null}`,
+			errors: []string{"user was changed since this version"},
+		},
+		{
+			name:   "update of a missing user",
+			query:  `mutation { updateUser(id: 999, input: {name: "Ada", email: "ada@example.com"}) { id } }`,
+			want:   `{"updateUser":null}`,
+			errors: []string{"user not found"},
+		},
+		{
+			name:   "delete of a stale version",
+			query:  `mutation { deleteUser(id: 1, version: 1) }`,
+			want:   `{"deleteUser":null}`,
+			errors: []string{"user was changed since this version"},
+		},
+		{
+			name:  "delete",
+			query: `mutation { deleteUser(id: 1, version: 2) }`,
+			want:  `{"deleteUser":true}`,
+		},
+		{
+			name:  "delete again",
+			query: `mutation { deleteUser(id: 1) }`,
+			want:  `{"deleteUser":false}`,
+		},
+	}
+	for _, step := range steps {
+		code, reply := graphqlPost(t, r, step.query, step.variables, nil)
+		if code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", step.name, code)
+		}
+		if got := compactJSON(t, reply.Data); got != step.want {
+			t.Errorf("%s: data %s, want %s", step.name, got, step.want)
+		}
+		var errors []string
+		for _, e := range reply.Errors {
+			errors = append(errors, e.Message)
+		}
+		if !slices.Equal(errors, step.errors) {
+			t.Errorf("%s: errors %q, want %q", step.name, errors, step.errors)
+		}
+	}
+
+	if len(mails.tokens) != 1 {
+		t.Errorf("%d email confirmations sent, want 1 for the update", len(mails.tokens))
+	}
+	if w := serve(r, request{method: http.MethodGet, path: "/users/1"}); w.Code != http.StatusNotFound {
+		t.Errorf("deleted user read with status %d, want 404", w.Code)
+	}
+}
+
+func TestGraphQLRequireVersion(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"REQUIRE_IF_MATCH": "true"})
+	createUser(t, r, "Ada", "ada@example.com")
+
+	_, reply := graphqlPost(t, r, `mutation { deleteUser(id: 1) }`, nil, nil)
+	if len(reply.Errors) != 1 || reply.Errors[0].Message != "version is required, send the version of the user" {
+		t.Errorf("errors %+v, want the version required", reply.Errors)
+	}
+	if _, reply := graphqlPost(t, r, `mutation { deleteUser(id: 1, version: 1) }`, nil, nil); compactJSON(t, reply.Data) != `{"deleteUser":true}` {
+		t.Errorf("delete of the current version answered %s", reply.Data)
+	}
+}
+
+func TestGraphQLRequests(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"JWT_SECRET": "test-jwt-secret"})
+	adminJWT, _, err := tokens.Issue("", auth.Admin, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	userJWT, _, err := tokens.Issue("1", auth.User, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	asAdmin := map[string]string{"Authorization": "Bearer " + adminJWT}
+	asUser := map[string]string{"Authorization": "Bearer " + userJWT}
+	if code, reply := graphqlPost(t, r, `mutation { createUser(input: {name: "Ada", email: "ada@example.com"}) { id } }`, nil, asAdmin); code != http.StatusOK || reply.Errors != nil {
+		t.Fatalf("create: status %d, errors %+v", code, reply.Errors)
+	}
+
+	get := func(query string) string {
+		return "/graphql?" + url.Values{"query": {query}, "variables": {`{"id": 1}`}}.Encode()
+	}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		want   int
+	}{
+		{"query", http.MethodPost, "/graphql", `{"query": "{ user(id: 1) { name } }"}`, asUser, http.StatusOK},
+		{"query over GET", http.MethodGet, get(`query ($id: ID!) { user(id: $id) { name } }`), "", asUser, http.StatusOK},
+		{"anonymous query", http.MethodPost, "/graphql", `{"query": "{ users { name } }"}`, nil, http.StatusUnauthorized},
+		{"mutation of a user", http.MethodPost, "/graphql", `{"query": "mutation { deleteUser(id: 1) }"}`, asUser, http.StatusForbidden},
+		{"mutation over GET", http.MethodGet, get(`mutation { deleteUser(id: 1) }`), "", asAdmin, http.StatusMethodNotAllowed},
+		{"document that does not parse", http.MethodPost, "/graphql", `{"query": "{ user(id: 1) { name }"}`, asUser, http.StatusBadRequest},
+		{"fragment", http.MethodPost, "/graphql", `{"query": "{ user(id: 1) { ...u } } fragment u on User { name }"}`, asUser, http.StatusBadRequest},
+		{"unknown operation", http.MethodPost, "/graphql", `{"query": "query A { users { name } }", "operationName": "B"}`, asUser, http.StatusBadRequest},
+		{"body not JSON", http.MethodPost, "/graphql", `query`, asUser, http.StatusBadRequest},
+		{"variables not JSON", http.MethodGet, "/graphql?query=%7Busers%7Bname%7D%7D&variables=x", "", asUser, http.StatusBadRequest},
+		{"mutation of an admin", http.MethodPost, "/graphql", `{"query": "mutation { deleteUser(id: 1) }"}`, asAdmin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: tt.method, path: tt.path, body: tt.body, header: tt.header})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			var reply graphqlReply
+			if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+				t.Fatalf("answer %q: %v", w.Body, err)
+			}
+			if (w.Code == http.StatusOK) != (reply.Errors == nil) {
+				t.Errorf("status %d with errors %+v", w.Code, reply.Errors)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package v1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+	"go-api/db"
+	"go-api/jobs"
+	"go-api/models"
+	"go-api/pagination"
+	"go-api/projection"
+)
+
+// write a user as protobuf for clients accepting it, JSON otherwise
+func respondUser(c *gin.Context, status int, user models.User) {
+	// the tag of the new version, for the next If-Match
+	if c.NegotiateFormat(gin.MIMEJSON, models.MIMEProtobuf) == models.MIMEProtobuf {
+		c.Header("ETag", variantETag(c, userETag(user), models.MIMEProtobuf))
+		c.Data(status, models.MIMEProtobuf, user.MarshalProto())
+		return
+	}
+	contentType := gin.MIMEJSON
+	if wantsMsgpack(c) {
+		contentType = models.MIMEMsgpack
+	}
+	c.Header("ETag", variantETag(c, userETag(user), contentType))
+	respondData(c, status, user)
+}
+
+// timestamps are stored in UTC and rendered in the zone named by ?tz= or
+// else the X-Timezone header, e.g. "America/New_York"; unknown zones are a
+// 400
+func DisplayZone(c *gin.Context) {
+	name := c.Query("tz")
+	if name == "" {
+		name = c.GetHeader("X-Timezone")
+	}
+	if name == "" {
+		c.Next()
+		return
+	}
+	// "Local" would be the zone of the server, which clients cannot know
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("unknown time zone %q", name))
+		c.Abort()
+		return
+	}
+	c.Set("tz", loc)
+	c.Next()
+}
+
+// data with its timestamps in the zone of the request, when it asked for one
+func localize(c *gin.Context, data any) any {
+	loc, ok := c.Value("tz").(*time.Location)
+	if !ok {
+		return data
+	}
+	switch v := data.(type) {
+	case models.User:
+		return v.In(loc)
+	case *models.User:
+		if v == nil {
+			return v
+		}
+		u := v.In(loc)
+		return &u
+	case []models.User:
+		out := make([]models.User, len(v))
+		for n, u := range v {
+			out[n] = u.In(loc)
+		}
+		return out
+	case []batchResult:
+		out := slices.Clone(v)
+		for n := range out {
+			out[n].User = localize(c, out[n].User).(*models.User)
+		}
+		return out
+	case []importResult:
+		out := slices.Clone(v)
+		for n := range out {
+			out[n].User = localize(c, out[n].User).(*models.User)
+		}
+		return out
+	case importReport:
+		v.Results = localize(c, v.Results).([]importResult)
+		return v
+	case jobs.Job:
+		v.CreatedAt = v.CreatedAt.In(loc)
+		if v.FinishedAt != nil {
+			at := v.FinishedAt.In(loc)
+			v.FinishedAt = &at
+		}
+		v.Result = localize(c, v.Result)
+		return v
+	case []db.HistoryEntry:
+		out := slices.Clone(v)
+		for n := range out {
+			out[n].Time = out[n].Time.In(loc)
+		}
+		return out
+
+	case []db.AuditEntry:
+		out := slices.Clone(v)
+		for n := range out {
+			out[n].Time = out[n].Time.In(loc)
+		}
+		return out
+	}
+	return data
+}
+
+// write users and lists of users, wrapped as {"data": ...} when the
+// X-Response-Envelope header or else RESPONSE_ENVELOPE asks for it
+func respondData(c *gin.Context, status int, data any) {
+	if !wantsMsgpack(c) {
+		c.JSON(status, envelope(c, localize(c, data)))
+		return
+	}
+
+	body, err := json.Marshal(envelope(c, localize(c, data)))
+
+	if err == nil {
+		body, err = models.JSONToMsgpack(body)
+	}
+
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.Data(status, models.MIMEMsgpack, body)
+}
+
+// answer items, the page of total ones, as the list of users is answered:
+// bare or in the envelope, with X-Total-Count and the Link header of the
+// pages
+func respondPage[T any](c *gin.Context, items []T, total int, page pagination.Page) {
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.Writer.Header().Add("Link", pageLinks(c, page, total))
+	respondData(c, http.StatusOK, items)
+}
+
+// users and lists of users are sent as MessagePack to clients that accept it
+// rather than JSON, e.g. mobile clients saving bandwidth; JSON stays the
+// default
+func wantsMsgpack(c *gin.Context) bool {
+	return c.NegotiateFormat(gin.MIMEJSON, models.MIMEMsgpack) == models.MIMEMsgpack
+}
+
+func envelope(c *gin.Context, data any) any {
+	if wrapped(c) {
+		return gin.H{"data": data}
+	}
+	return data
+}
+
+// report whether data of the response of c goes in a {"data": ...} envelope
+func wrapped(c *gin.Context) bool {
+	if v, err := strconv.ParseBool(c.GetHeader("X-Response-Envelope")); err == nil {
+		return v
+	}
+	return conf.ResponseEnvelope
+}
+
+// answer a user or list of users with only the ?fields= selected, dotted for
+// nested fields as in ?fields=name,address.city. The response is tagged with
+// etag when given, made particular to the representation when strong, see
+// variantETag, else with a strong ETag of its exact bytes, and is a 304 when
+// If-None-Match has the tag already.
+func respondProjected(c *gin.Context, data any, etag string) {
+	fields, err := projection.Parse(c.Query("fields"), reflect.TypeOf(models.User{}), "completeness")
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	projected, err := fields.Apply(localize(c, data))
+
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	body, err := json.Marshal(envelope(c, projected))
+
+	contentType := gin.MIMEJSON
+	if err == nil && wantsMsgpack(c) {
+		body, err = models.JSONToMsgpack(body)
+		contentType = models.MIMEMsgpack
+	}
+
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch {
+	case etag == "":
+		sum := sha256.Sum256(body)
+		etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	case !strings.HasPrefix(etag, "W/"):
+		etag = variantETag(c, etag, contentType)
+	}
+	c.Header("ETag", etag)
+
+	if noneMatch(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	if contentType == gin.MIMEJSON {
+		contentType = "application/json; charset=utf-8"
+	}
+	c.Data(http.StatusOK, contentType, body)
+}
+
+// weak ETag of a list of users: the same users at the same versions are the
+// same list, whatever the fields computed from them on the way out
+func listETag(c *gin.Context, users []models.User) string {
+	h := sha256.New()
+	io.WriteString(h, c.Request.URL.RawQuery)
+	io.WriteString(h, c.GetHeader("X-Response-Envelope"))
+	fmt.Fprint(h, wantsMsgpack(c), displayZone(c))
+	for _, u := range users {
+		fmt.Fprintf(h, "\x00%s\x00%d", u.ID, u.Version)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// report whether an If-None-Match header lists etag, compared weakly as
+// GET requests are
+func noneMatch(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// report whether the request carries "If-Match: *"
+func ifMatchAny(c *gin.Context) bool {
+	return strings.TrimSpace(c.GetHeader("If-Match")) == "*"
+}
+
+// strong ETag of a user: its version, which every change moves on. It tags
+// the plain JSON of the user, see variantETag for the other representations.
+func userETag(user models.User) string {
+	return `"` + strconv.FormatInt(user.Version, 10) + `"`
+}
+
+// the strong ETag etag of a resource for the response of c in contentType:
+// etag itself for JSON of every field in UTC without an envelope, which
+// writes compare If-Match with, else etag with a hash of what makes the
+// bytes differ appended, e.g. "3-5f1c9a0e2b7d4c18", so that no two
+// representations share a strong tag. If-Match takes either for the version.
+func variantETag(c *gin.Context, etag, contentType string) string {
+	variant := []string{contentType, c.Query("fields"), displayZone(c), strconv.FormatBool(wrapped(c))}
+	if variant[0] == gin.MIMEJSON && variant[1] == "" && variant[2] == "" && variant[3] == "false" {
+		return etag
+	}
+	sum := sha256.Sum256([]byte(strings.Join(variant, "\x00")))
+	return strings.TrimSuffix(etag, `"`) + "-" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// name of the zone the timestamps of the response are in, "" for UTC
+func displayZone(c *gin.Context) string {
+	if loc, ok := c.Value("tz").(*time.Location); ok {
+		return loc.String()
+	}
+	return ""
+}
+
+// version of current a write must be made from, as If-Match names it: that
+// of current when If-Match lists its ETag, or 0 for any with "If-Match: *"
+// and, with REQUIRE_IF_MATCH off, without If-Match. Otherwise it answers 428
+// or 412 and returns false. The store checks the version again under its
+// lock, so a write racing this one still fails.
+func ifMatchVersion(c *gin.Context, current models.User) (int64, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+
+	switch {
+	case header == "*":
+		return 0, true
+	case header == "" && conf.RequireIfMatch:
+		respondError(c, http.StatusPreconditionRequired, "If-Match is required, send the ETag of the user")
+		return 0, false
+	case header == "":
+		return 0, true
+	}
+
+	// compared strongly, a weak tag never matches; the tag of any
+	// representation of the version does
+	etag := userETag(current)
+	variant := strings.TrimSuffix(etag, `"`) + "-"
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == etag || strings.HasPrefix(tag, variant) && strings.HasSuffix(tag, `"`) {
+			return current.Version, true
+		}
+	}
+
+	respondStoreError(c, db.ErrStale)
+	return 0, false
+}
+
+// write the error body every failing handler uses
+func respondError(c *gin.Context, status int, message string) {
+	apierror.Respond(c, apierror.New(status, message))
+}
+
+// map errors of the db package to responses. A store refusing calls for
+// now may say for how long, which is the Retry-After then.
+func respondStoreError(c *gin.Context, err error) {
+	storeRetryAfter(c, err)
+	apierror.Respond(c, storeError(err))
+}
+
+// set the Retry-After of a store refusing calls to the wait it asks for, the
+// default of apierror left to the other 503s
+func storeRetryAfter(c *gin.Context, err error) {
+	var refused interface{ RetryAfter() time.Duration }
+	if errors.As(err, &refused) {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(refused.RetryAfter().Seconds()))))
+	}
+}
+
+// the API error answering an error of the db package
+func storeError(err error) *apierror.Error {
+	return apierror.New(storeErrorStatus(err), storeErrorMessage(err))
+}
+
+// status answering an error of the db package
+func storeErrorStatus(err error) int {
+	var conflict *db.ConflictError
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrStale):
+		return http.StatusPreconditionFailed
+	case errors.As(err, &conflict):
+		return http.StatusConflict
+	case db.Unavailable(err):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// message answering an error of the db package
+func storeErrorMessage(err error) string {
+	var conflict *db.ConflictError
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return "user not found"
+	case errors.As(err, &conflict):
+		return conflict.Error()
+	case errors.Is(err, db.ErrNotSaved):
+		return db.ErrNotSaved.Error()
+	case errors.Is(err, db.ErrUnavailable):
+		return db.ErrUnavailable.Error() + ", try again later"
+	default:
+		return err.Error()
+	}
+}
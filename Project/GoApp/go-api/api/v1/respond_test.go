@@ -0,0 +1,361 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-api/db"
+	"go-api/models"
+
+	"github.com/ugorji/go/codec"
+)
+
+// representations of a user or list, each tagged differently
+var representations = []struct {
+	name   string
+	query  string
+	header map[string]string
+}{
+	{"plain JSON", "", nil},
+	{"some fields", "?fields=id,name", nil},
+	{"in a zone", "?tz=Europe/Paris", nil},
+	{"zone from a header", "", map[string]string{"X-Timezone": "America/New_York"}},
+	{"MessagePack", "", map[string]string{"Accept": models.MIMEMsgpack}},
+	{"in an envelope", "", map[string]string{"X-Response-Envelope": "true"}},
+}
+
+// a GET with If-None-Match and the status it wants
+type conditionalGet struct {
+	name        string
+	ifNoneMatch string
+	want        int
+}
+
+// the tags of every representation of path, failing the test unless they
+// are all different
+func representationTags(t *testing.T, r http.Handler, path string) map[string]string {
+	t.Helper()
+	tags := map[string]string{}
+	seen := map[string]string{}
+	for _, rep := range representations {
+		w := serve(r, request{method: http.MethodGet, path: path + rep.query, header: rep.header})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", rep.name, w.Code, w.Body)
+		}
+		tag := w.Header().Get("ETag")
+		if other, ok := seen[tag]; ok {
+			t.Errorf("%s and %s share the ETag %s", rep.name, other, tag)
+		}
+		tags[rep.name], seen[tag] = tag, rep.name
+	}
+	return tags
+}
+
+func TestUserETags(t *testing.T) {
+	r := newTestRouter(t, nil)
+	user := createUser(t, r, "Ada", "ada@example.com")
+	path := "/users/" + string(user.ID)
+	tags := representationTags(t, r, path)
+	if tags["plain JSON"] != `"1"` {
+		t.Errorf("plain JSON tagged %s, want the version", tags["plain JSON"])
+	}
+
+	for _, rep := range representations {
+		tag := tags[rep.name]
+		if strings.HasPrefix(tag, "W/") {
+			t.Errorf("%s tagged %s, want a strong ETag", rep.name, tag)
+		}
+		tests := []conditionalGet{
+			{"own tag", tag, http.StatusNotModified},
+			{"own tag, weak", "W/" + tag, http.StatusNotModified},
+			{"own tag in a list", `"x", ` + tag, http.StatusNotModified},
+			{"any", "*", http.StatusNotModified},
+			{"another version", `"2"`, http.StatusOK},
+		}
+		if rep.name != "plain JSON" {
+			tests = append(tests, conditionalGet{"tag of plain JSON", tags["plain JSON"], http.StatusOK})
+		}
+		for _, tt := range tests {
+			t.Run(rep.name+", "+tt.name, func(t *testing.T) {
+				header := map[string]string{"If-None-Match": tt.ifNoneMatch}
+				for k, v := range rep.header {
+					header[k] = v
+				}
+				w := serve(r, request{method: http.MethodGet, path: path + rep.query, header: header})
+				if w.Code != tt.want {
+					t.Errorf("status %d, want %d", w.Code, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// the tag of any representation of the current version names it in If-Match
+func TestIfMatchTakesARepresentationTag(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"REQUIRE_IF_MATCH": "true"})
+	user := createUser(t, r, "Ada", "ada@example.com")
+	path := "/users/" + string(user.ID)
+	tag := serve(r, request{method: http.MethodGet, path: path + "?fields=name"}).Header().Get("ETag")
+
+	w := serve(r, request{method: http.MethodPatch, path: path, body: `{"name":"Ada L"}`, header: map[string]string{"If-Match": tag}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d with If-Match %s: %s", w.Code, tag, w.Body)
+	}
+	w = serve(r, request{method: http.MethodPatch, path: path, body: `{"name":"Ada"}`, header: map[string]string{"If-Match": tag}})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("status %d with the tag of the old version, want 412", w.Code)
+	}
+}
+
+func TestListETags(t *testing.T) {
+	r := newTestRouter(t, nil)
+	createUser(t, r, "Ada", "ada@example.com")
+	tags := representationTags(t, r, "/users")
+	for name, tag := range tags {
+		if !strings.HasPrefix(tag, `W/"`) {
+			t.Errorf("%s tagged %s, want a weak ETag", name, tag)
+		}
+	}
+
+	tag := tags["plain JSON"]
+	tests := []conditionalGet{
+		{"own tag", tag, http.StatusNotModified},
+		{"own tag, strong", strings.TrimPrefix(tag, "W/"), http.StatusNotModified},
+		{"tag of another representation", tags["some fields"], http.StatusOK},
+		{"another tag", `W/"x"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: "/users", header: map[string]string{"If-None-Match": tt.ifNoneMatch}})
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// a new user changes the list, and so its tag
+	createUser(t, r, "Bob", "bob@example.com")
+	w := serve(r, request{method: http.MethodGet, path: "/users", header: map[string]string{"If-None-Match": tag}})
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == tag {
+		t.Errorf("status %d, ETag %s after a change, want 200 with a new tag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+// a clock a second further on at each reading, so every write is at a
+// later HTTP date
+type tickingClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(time.Second)
+	return c.now
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func TestListLastModified(t *testing.T) {
+	db.SetClock(&tickingClock{now: time.Date(2026, 3, 1, 9, 0, 0, 500, time.UTC)})
+	t.Cleanup(func() { db.SetClock(systemClock{}) })
+	r := newTestRouter(t, nil)
+	createUser(t, r, "Ada", "ada@example.com")
+	// the Last-Modified of the list
+	modified := func() time.Time {
+		t.Helper()
+		sent := serve(r, request{method: http.MethodGet, path: "/users"}).Header().Get("Last-Modified")
+		at, err := http.ParseTime(sent)
+		if err != nil {
+			t.Fatalf("Last-Modified %q: %v", sent, err)
+		}
+		return at
+	}
+	if at := modified(); !at.Equal(db.LastModified().Truncate(time.Second)) {
+		t.Fatalf("Last-Modified %s, want the last write at %s", at, db.LastModified())
+	}
+	// the If-Modified-Since of the Last-Modified before a step moved by d
+	at := func(d time.Duration) func(time.Time) string {
+		return func(before time.Time) string { return before.Add(d).Format(http.TimeFormat) }
+	}
+
+	// a bob created by a step, to delete in a later one
+	var bob models.User
+	steps := []struct {
+		name string
+		// a write before the GET
+		write       func()
+		since       func(before time.Time) string
+		ifNoneMatch string
+		want        int
+	}{
+		{"unchanged", nil, at(0), "", http.StatusNotModified},
+		{"since later", nil, at(time.Hour), "", http.StatusNotModified},
+		{"since earlier", nil, at(-time.Second), "", http.StatusOK},
+		{"not a date", nil, func(time.Time) string { return "yesterday" }, "", http.StatusOK},
+		{"with another ETag", nil, at(0), `W/"x"`, http.StatusOK},
+		{"after a failed create", func() {
+			serve(r, request{method: http.MethodPost, path: "/users", body: `{"name":"Eve","email":"ada@example.com"}`})
+		}, at(0), "", http.StatusNotModified},
+		{"after a create", func() { bob = createUser(t, r, "Bob", "bob@example.com") }, at(0), "", http.StatusOK},
+		{"after a delete", func() { serve(r, request{method: http.MethodDelete, path: "/users/" + string(bob.ID)}) }, at(0), "", http.StatusOK},
+		{"unchanged since the delete", nil, at(0), "", http.StatusNotModified},
+	}
+	for _, s := range steps {
+		before := modified()
+		if s.write != nil {
+			s.write()
+		}
+		header := map[string]string{"If-Modified-Since": s.since(before)}
+		if s.ifNoneMatch != "" {
+			header["If-None-Match"] = s.ifNoneMatch
+		}
+		w := serve(r, request{method: http.MethodGet, path: "/users", header: header})
+		if w.Code != s.want {
+			t.Fatalf("%s: status %d, want %d", s.name, w.Code, s.want)
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s: body %q of a 304", s.name, w.Body)
+		}
+		if w.Header().Get("Last-Modified") == "" {
+			t.Errorf("%s: no Last-Modified", s.name)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	createUser(t, r, "Bob", "bob@example.com")
+	tag := serve(r, request{method: http.MethodGet, path: "/users/" + string(ada.ID)}).Header().Get("ETag")
+
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		want   int
+	}{
+		{"list", "/users", nil, http.StatusOK},
+		{"a page of the list", "/users?per_page=1&fields=id,name", nil, http.StatusOK},
+		{"user", "/users/" + string(ada.ID), nil, http.StatusOK},
+		{"user in a zone", "/users/" + string(ada.ID) + "?tz=Europe/Paris", nil, http.StatusOK},
+		{"user not modified", "/users/" + string(ada.ID), map[string]string{"If-None-Match": tag}, http.StatusNotModified},
+		{"missing user", "/users/999", nil, http.StatusNotFound},
+		{"malformed id", "/users/x", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get := serve(r, request{method: http.MethodGet, path: tt.path, header: tt.header})
+			head := serve(r, request{method: http.MethodHead, path: tt.path, header: tt.header})
+			if get.Code != tt.want || head.Code != tt.want {
+				t.Fatalf("GET %d, HEAD %d, want %d", get.Code, head.Code, tt.want)
+			}
+			if head.Body.Len() != 0 {
+				t.Errorf("HEAD body %q", head.Body)
+			}
+			if tt.want == http.StatusOK && head.Header().Get("ETag") == "" {
+				t.Error("HEAD without an ETag")
+			}
+			if got, want := head.Header().Get("Content-Length"), strconv.Itoa(get.Body.Len()); got != want {
+				t.Errorf("HEAD Content-Length %s, want the %s bytes of the GET body", got, want)
+			}
+			for _, name := range []string{"Content-Type", "ETag", "Last-Modified", "X-Total-Count", "Link", "Vary"} {
+				if got, want := head.Header().Values(name), get.Header().Values(name); !slices.Equal(got, want) {
+					t.Errorf("HEAD %s %q, GET %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// the JSON of a MessagePack body, to compare with the JSON answer
+func msgpackJSON(t *testing.T, body []byte) []byte {
+	t.Helper()
+	h := &codec.MsgpackHandle{}
+	h.RawToString = true
+	var v any
+	if err := codec.NewDecoderBytes(body, h).Decode(&v); err != nil {
+		t.Fatalf("decoding MessagePack: %v", err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestMsgpack(t *testing.T) {
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	createUser(t, r, "Bob", "bob@example.com")
+
+	tests := []struct {
+		name string
+		path string
+		// the Accept header, none if empty, and whether it gets MessagePack
+		accept  string
+		msgpack bool
+	}{
+		{"user", "/users/" + string(ada.ID), models.MIMEMsgpack, true},
+		{"list", "/users", models.MIMEMsgpack, true},
+		{"some fields of the list", "/users?fields=id,name,completeness", models.MIMEMsgpack, true},
+		{"preferred to JSON", "/users", models.MIMEMsgpack + ", application/json;q=0.5", true},
+		{"JSON preferred", "/users", "application/json, " + models.MIMEMsgpack + ";q=0.5", false},
+		{"no Accept", "/users", "", false},
+		{"any", "/users", "*/*", false},
+		{"JSON", "/users/" + string(ada.ID), "application/json", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := map[string]string{}
+			if tt.accept != "" {
+				header["Accept"] = tt.accept
+			}
+			w := serve(r, request{method: http.MethodGet, path: tt.path, header: header})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			contentType := w.Header().Get("Content-Type")
+			if !tt.msgpack {
+				if !strings.HasPrefix(contentType, "application/json") || !json.Valid(w.Body.Bytes()) {
+					t.Errorf("Content-Type %s, body %s, want JSON", contentType, w.Body)
+				}
+				return
+			}
+			if contentType != models.MIMEMsgpack {
+				t.Fatalf("Content-Type %s, want %s", contentType, models.MIMEMsgpack)
+			}
+			// the same document as the JSON one, field for field
+			var got, want any
+			json.Unmarshal(msgpackJSON(t, w.Body.Bytes()), &got)
+			plain := serve(r, request{method: http.MethodGet, path: tt.path})
+			json.Unmarshal(plain.Body.Bytes(), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("MessagePack %v, JSON %v", got, want)
+			}
+			if w.Body.Len() >= plain.Body.Len() {
+				t.Errorf("MessagePack of %d bytes, JSON of %d", w.Body.Len(), plain.Body.Len())
+			}
+		})
+	}
+
+	// decoded back to the users created
+	w := serve(r, request{method: http.MethodGet, path: "/users", header: map[string]string{"Accept": models.MIMEMsgpack}})
+	var users []models.User
+	if err := json.Unmarshal(msgpackJSON(t, w.Body.Bytes()), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].ID != ada.ID || users[0].Email != "ada@example.com" || !users[0].CreatedAt.Equal(ada.CreatedAt) || users[1].Name != "Bob" {
+		t.Errorf("users %+v", users)
+	}
+}
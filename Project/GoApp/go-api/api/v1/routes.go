@@ -0,0 +1,74 @@
+package v1
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/auth"
+	"go-api/config"
+	"go-api/middleware"
+)
+
+// Routes registers the routes of version 1 with route, relative to Prefix;
+// the router also serves them at the unversioned paths while LEGACY_ROUTES
+// is on
+func Routes(cfg config.Config, route func(method, path, name string, handlers ...gin.HandlerFunc)) {
+	route(http.MethodGet, "/users", "list_users", getUsersHandler)
+	route(http.MethodHead, "/users", "list_users", middleware.Head(), getUsersHandler)
+	route(http.MethodGet, "/users/stats", "user_stats", userStatsHandler)
+	route(http.MethodGet, "/users/count", "count_users", countUsersHandler)
+	route(http.MethodGet, "/users/search", "search_users", searchUsersHandler)
+	route(http.MethodGet, "/users/events", "user_events", userEventsHandler)
+	route(http.MethodGet, "/users/export", "export_users", exportUsersHandler)
+	route(http.MethodGet, "/users/me", "get_me", auth.Required(), getMeHandler)
+	route(http.MethodGet, "/users/:id", "get_user", ownUser, getUserHandler)
+	route(http.MethodHead, "/users/:id", "get_user", middleware.Head(), ownUser, getUserHandler)
+	route(http.MethodPost, "/users", "create_user", createUserHandler)
+	route(http.MethodPost, "/users/batch", "create_users", createUsersHandler)
+	route(http.MethodPost, "/users/bulk", "bulk_create_users", createUsersHandler)
+	route(http.MethodDelete, "/users", "bulk_delete_users", deleteUsersHandler)
+	route(http.MethodPost, "/users/import", "import_users", importUsersHandler)
+	route(http.MethodGet, "/jobs/:id", "get_job", getJobHandler)
+	route(http.MethodPut, "/users/reorder", "reorder_users", reorderUsersHandler)
+	route(http.MethodPost, "/users/touch", "touch_users", touchUsersHandler)
+	route(http.MethodPut, "/users/:id", "update_user", updateUserHandler)
+	route(http.MethodPatch, "/users/:id", "patch_user", patchUserHandler)
+	route(http.MethodDelete, "/users/:id", "delete_user", deleteUserHandler)
+	route(http.MethodPost, "/users/:id/restore", "restore_user", restoreUserHandler)
+	route(http.MethodPost, "/users/:id/send-welcome", "send_welcome", sendWelcomeHandler)
+	route(http.MethodGet, "/users/:id/confirm-email", "confirm_email", confirmEmailHandler)
+	route(http.MethodGet, "/users/:id/history", "user_history", ownUser, userHistoryHandler)
+	route(http.MethodGet, "/users/:id/avatar", "get_avatar", ownUser, getAvatarHandler)
+	route(http.MethodPost, "/users/:id/merge/:other_id", "merge_users", mergeUsersHandler)
+	// minting the first key of a user needs an admin, so it is off when
+	// there is no way to be one
+	if tokens != nil || cfg.AdminToken != "" {
+		route(http.MethodPost, "/users/:id/api-keys", "create_api_key", createAPIKeyHandler)
+	}
+	route(http.MethodGet, "/users/:id/api-keys", "list_api_keys", listAPIKeysHandler)
+	route(http.MethodDelete, "/users/:id/api-keys/:key_id", "revoke_api_key", revokeAPIKeyHandler)
+	route(http.MethodPost, "/users/:id/deactivate", "deactivate_user", setActiveHandler(false))
+	route(http.MethodPost, "/users/:id/activate", "activate_user", setActiveHandler(true))
+	route(http.MethodPost, "/graphql", "graphql", graphqlHandler)
+	route(http.MethodGet, "/graphql", "graphql_query", graphqlHandler)
+
+	if uploader != nil {
+		route(http.MethodPost, "/users/backup", "backup_users", backupUsersHandler)
+	}
+
+	if tokens != nil {
+		route(http.MethodPost, "/auth/login", "login", loginHandler)
+	}
+
+	if cfg.WebhookSecret != "" {
+		route(http.MethodPost, "/webhooks", "receive_webhook", receiveWebhookHandler)
+	}
+
+	// maintenance routes need the admin token and are off without one
+	if cfg.AdminToken != "" {
+		admin := middleware.AdminToken(cfg.AdminToken)
+		route(http.MethodPost, "/admin/compact", "compact_users", admin, compactUsersHandler)
+		route(http.MethodGet, "/admin/audit", "audit_log", admin, auditLogHandler)
+	}
+}
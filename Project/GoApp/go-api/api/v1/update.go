@@ -0,0 +1,645 @@
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/db"
+	"go-api/logging"
+	"go-api/models"
+	"go-api/validation"
+)
+
+func updateUserHandler(c *gin.Context) {
+	idStr := c.Param("id")
+
+	id, err := db.ParseID(idStr)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	// existence is checked before the body is looked at, so a missing user is
+	// always a 404 and only an existing one can fail with 422 for its body
+	current, err := store.GetUser(c.Request.Context(), id)
+
+	// "If-Match: *" asks for an existing resource, whatever its version
+	if errors.Is(err, db.ErrNotFound) && ifMatchAny(c) {
+		respondError(c, http.StatusPreconditionFailed, "user does not exist")
+		return
+	}
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	version, ok := ifMatchVersion(c, *current)
+
+	if !ok {
+		return
+	}
+
+	if rejectEmptyBody(c) {
+		return
+	}
+
+	if rejectUserType(c, gin.MIMEMultipartPOSTForm) {
+		return
+	}
+
+	var user models.User
+	var avatar *db.AvatarImage
+
+	// multipart updates carry the user as JSON in a "user" part and may
+	// replace the avatar with an "avatar" file part in the same request
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		avatar, err = bindUserForm(c, &user)
+	} else {
+		err = bindUser(c, &user)
+	}
+
+	if err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	user.Normalize()
+
+	if errs := CheckUser(user); errs != nil {
+		respondInvalid(c, errs)
+		return
+	}
+
+	// the whole update, new email included, must pass the unique
+	// constraints before anything is written
+	user.ID = id
+	if err := store.CheckUnique(c.Request.Context(), user); err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	// a new email only takes effect once confirmed, it is pending until then
+	// and written in the same version as the rest
+	user.PendingEmail = user.Email
+
+	// the version in the body is ignored, If-Match says which one this is
+	user.Version = version
+
+	token, err := store.UpdateUser(c.Request.Context(), id, user, avatar, conf.EmailTokenTTL, Actor(c))
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	updated, err := store.GetUser(c.Request.Context(), id)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	if !confirmEmail(c, *updated, token) {
+		return
+	}
+
+	respondUser(c, http.StatusOK, *updated)
+}
+
+// content types of a PATCH body, a JSON merge patch (RFC 7396) either way
+var patchTypes = []string{gin.MIMEJSON, "application/merge-patch+json"}
+
+// change only the fields the JSON body has, merged into the stored user:
+// left out fields keep their value and the result is checked as a PUT
+// would check it. A new email waits for confirmation as with PUT. Unlike
+// RFC 7396, null does not clear a field, "" does.
+func patchUserHandler(c *gin.Context) {
+	id, err := db.ParseID(c.Param("id"))
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	current, err := store.GetUser(c.Request.Context(), id)
+
+	if errors.Is(err, db.ErrNotFound) && ifMatchAny(c) {
+		respondError(c, http.StatusPreconditionFailed, "user does not exist")
+		return
+	}
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	version, ok := ifMatchVersion(c, *current)
+
+	if !ok {
+		return
+	}
+
+	if rejectEmptyBody(c) {
+		return
+	}
+
+	if !slices.Contains(patchTypes, c.ContentType()) {
+		respondError(c, http.StatusUnsupportedMediaType, "PATCH takes a JSON merge patch")
+		return
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var fields map[string]json.RawMessage
+
+	if err := json.Unmarshal(body, &fields); err != nil {
+		respondError(c, http.StatusBadRequest, "PATCH body must be a JSON object")
+		return
+	}
+
+	// "{}" has no more changes than an empty body
+	if len(fields) == 0 {
+		answer := emptyBodyErrors[http.MethodPatch]
+		respondError(c, answer.status, answer.message)
+		return
+	}
+
+	if err := json.Unmarshal(body, &models.User{}); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	// the merge and its checks run on the stored user under the store lock
+	updated, token, err := store.PatchUser(c.Request.Context(), id, func(user *models.User) error {
+		if version != 0 && user.Version != version {
+			return db.ErrStale
+		}
+		pending := user.PendingEmail
+		if err := json.Unmarshal(body, user); err != nil {
+			return err
+		}
+		user.Normalize()
+		if errs := CheckUser(*user); errs != nil {
+			return errs
+		}
+		// a pending email change is only touched by a patch with an email
+		user.PendingEmail = pending
+		if _, ok := fields["email"]; ok {
+			user.PendingEmail = user.Email
+		}
+		return nil
+	}, conf.EmailTokenTTL, Actor(c))
+
+	var errs validation.Errors
+	if errors.As(err, &errs) {
+		respondInvalid(c, errs)
+		return
+	}
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	if !confirmEmail(c, *updated, token) {
+		return
+	}
+
+	respondUser(c, http.StatusOK, *updated)
+}
+
+// mail the confirmation token of the pending email of user, if the update
+// made one, and tell whether the request may go on
+func confirmEmail(c *gin.Context, user models.User, token string) bool {
+	err := SendEmailConfirmation(c.Request.Context(), user, token, Actor(c))
+
+	if errors.Is(err, errConfirmationNotSent) {
+		respondError(c, http.StatusBadGateway, err.Error())
+		return false
+	}
+
+	if err != nil {
+		respondStoreError(c, err)
+		return false
+	}
+	return true
+}
+
+var errConfirmationNotSent = errors.New("failed to send email confirmation")
+
+// confirmEmail without the responses, for the gRPC service too. A change
+// whose confirmation email cannot be sent is dropped again.
+func SendEmailConfirmation(ctx context.Context, user models.User, token, by string) error {
+	if token == "" {
+		return nil
+	}
+	if err := sender.SendEmailConfirmation(user, user.PendingEmail, token); err != nil {
+		if err := store.CancelEmailChange(ctx, user.ID, by); err != nil {
+			log.Printf("dropping the email change of user %s: %v", user.ID, err)
+		}
+		return errConfirmationNotSent
+	}
+	return nil
+}
+
+// answers to a PUT or PATCH without a body: a replacement needs every
+// field, a partial update at least one
+var emptyBodyErrors = map[string]struct {
+	status  int
+	message string
+}{
+	http.MethodPut:   {http.StatusUnprocessableEntity, "all fields required"},
+	http.MethodPatch: {http.StatusBadRequest, "no changes provided"},
+}
+
+// answer the error of emptyBodyErrors for the request method when the body
+// is empty or only whitespace, instead of the EOF a decoder would report,
+// and tell whether it did. The body stays readable for the handler.
+func rejectEmptyBody(c *gin.Context) bool {
+	answer, ok := emptyBodyErrors[c.Request.Method]
+	if !ok {
+		return false
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return true
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) > 0 {
+		return false
+	}
+	respondError(c, answer.status, answer.message)
+	return true
+}
+
+// answer 415 to a user body that is neither JSON nor protobuf, nor one of
+// the other content types, true when it did; a body without a content type
+// is taken as JSON
+func rejectUserType(c *gin.Context, other ...string) bool {
+	types := append([]string{gin.MIMEJSON, models.MIMEProtobuf}, other...)
+	if ct := c.ContentType(); ct == "" || slices.Contains(types, ct) {
+		return false
+	}
+	last := len(types) - 1
+	respondError(c, http.StatusUnsupportedMediaType, "content type must be "+strings.Join(types[:last], ", ")+" or "+types[last])
+	return true
+}
+
+// decode a user body as JSON or, when sent as application/x-protobuf, as a
+// users.v1.User message
+func bindUser(c *gin.Context, user *models.User) error {
+	if c.ContentType() != models.MIMEProtobuf {
+		return c.ShouldBindJSON(user)
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	return user.UnmarshalProto(body)
+}
+
+// image types accepted as avatars, sniffed from the content
+var avatarTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// read the "user" JSON part of a multipart update and the optional "avatar"
+// file, which is checked here so a bad image fails before anything is stored
+func bindUserForm(c *gin.Context, user *models.User) (*db.AvatarImage, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if v := form.Value["user"]; len(v) > 0 {
+		data = []byte(v[0])
+	} else if f := form.File["user"]; len(f) > 0 {
+		if data, err = readPart(f[0], -1); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("multipart update needs a \"user\" part")
+	}
+	if err := json.Unmarshal(data, user); err != nil {
+		return nil, err
+	}
+	files := form.File["avatar"]
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if files[0].Size > conf.MaxAvatarBytes {
+		return nil, fmt.Errorf("avatar is larger than %d bytes", conf.MaxAvatarBytes)
+	}
+	image, err := readPart(files[0], conf.MaxAvatarBytes)
+	if err != nil {
+		return nil, err
+	}
+	contentType := http.DetectContentType(image)
+	if !slices.Contains(avatarTypes, contentType) {
+		return nil, fmt.Errorf("avatar must be one of %s, not %s", strings.Join(avatarTypes, ", "), contentType)
+	}
+	return &db.AvatarImage{ContentType: contentType, Data: image}, nil
+}
+
+// the content of an uploaded part, at most limit bytes unless it is negative
+func readPart(header *multipart.FileHeader, limit int64) ([]byte, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if limit >= 0 {
+		r = io.LimitReader(f, limit+1)
+	}
+	data, err := io.ReadAll(r)
+	if err == nil && limit >= 0 && int64(len(data)) > limit {
+		err = fmt.Errorf("%s is larger than %d bytes", header.Filename, limit)
+	}
+	return data, err
+}
+
+// reassign priorities from an ordered list of ids in one go
+func reorderUsersHandler(c *gin.Context) {
+	var body struct {
+		IDs []models.ID `json:"ids" binding:"required"`
+	}
+
+	if rejectEmptyBody(c) {
+		return
+	}
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !checkBatchSize(c, len(body.IDs)) {
+		return
+	}
+
+	if len(body.IDs) > conf.MaxPriority {
+		respondError(c, http.StatusUnprocessableEntity, fmt.Sprintf("at most %d ids can be ordered", conf.MaxPriority))
+		return
+	}
+
+	if err := store.Reorder(c.Request.Context(), body.IDs, Actor(c)); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"ids": body.IDs})
+}
+
+// bump updated_at of a list of users so caches keyed by their versions
+// refetch them, reporting the ids that are not users
+func touchUsersHandler(c *gin.Context) {
+	var body struct {
+		IDs []models.ID `json:"ids" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !checkBatchSize(c, len(body.IDs)) {
+		return
+	}
+
+	touched, err := store.TouchUsers(c.Request.Context(), body.IDs, Actor(c))
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	notFound := []models.ID{}
+	for _, id := range body.IDs {
+		if !slices.Contains(touched, id) && !slices.Contains(notFound, id) {
+			notFound = append(notFound, id)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"touched": touched, "not_found": notFound})
+}
+
+// soft-delete a list of users in one go, reporting the ids that are not
+// users
+func deleteUsersHandler(c *gin.Context) {
+	var body struct {
+		IDs []models.ID `json:"ids" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !checkBatchSize(c, len(body.IDs)) {
+		return
+	}
+
+	deleted, err := store.DeleteUsers(c.Request.Context(), body.IDs, Actor(c))
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	notFound := []models.ID{}
+	for _, id := range body.IDs {
+		if !slices.Contains(deleted, id) && !slices.Contains(notFound, id) {
+			notFound = append(notFound, id)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted, "not_found": notFound})
+}
+
+func deleteUserHandler(c *gin.Context) {
+	idStr := c.Param("id")
+
+	id, err := db.ParseID(idStr)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	current, err := store.GetUser(c.Request.Context(), id)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	version, ok := ifMatchVersion(c, *current)
+
+	if !ok {
+		return
+	}
+
+	if err := store.DeleteUser(c.Request.Context(), id, version, Actor(c)); err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
+}
+
+// undo a soft delete, 404 when there is no deleted user with the id, e.g.
+// because Compact purged it
+func restoreUserHandler(c *gin.Context) {
+	id, err := db.ParseID(c.Param("id"))
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	user, err := store.RestoreUser(c.Request.Context(), id, Actor(c))
+
+	if errors.Is(err, db.ErrNotDeleted) {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	respondData(c, http.StatusOK, user)
+}
+
+func sendWelcomeHandler(c *gin.Context) {
+	idStr := c.Param("id")
+
+	id, err := db.ParseID(idStr)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	// record the send first so concurrent calls cannot both send
+	user, err := store.MarkWelcomed(c.Request.Context(), id, Actor(c))
+
+	if errors.Is(err, db.ErrNotFound) {
+		respondError(c, http.StatusNotFound, "user not found")
+		return
+	}
+	if errors.Is(err, db.ErrAlreadyWelcomed) {
+		respondError(c, http.StatusConflict, "user already welcomed")
+		return
+	}
+
+	if err := sender.SendWelcome(*user); err != nil {
+		if err := store.UnmarkWelcomed(c.Request.Context(), id, Actor(c)); err != nil {
+			logging.From(c).Error("clearing the welcome mark failed", "error", err)
+		}
+		respondError(c, http.StatusBadGateway, "failed to send welcome email")
+		return
+	}
+
+	respondData(c, http.StatusOK, user)
+}
+
+func confirmEmailHandler(c *gin.Context) {
+	idStr := c.Param("id")
+
+	id, err := db.ParseID(idStr)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	user, err := store.ConfirmEmail(c.Request.Context(), id, c.Query("token"), userActor(id))
+
+	if errors.Is(err, db.ErrNotFound) {
+		respondError(c, http.StatusNotFound, "user not found")
+		return
+	}
+	if errors.Is(err, db.ErrInvalidToken) {
+		respondError(c, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	respondData(c, http.StatusOK, user)
+}
+
+// merge the duplicate :other_id into :id, which is answered merged; the
+// duplicate is soft-deleted
+func mergeUsersHandler(c *gin.Context) {
+	id, err := db.ParseID(c.Param("id"))
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	sourceID, err := db.ParseID(c.Param("other_id"))
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid other id")
+		return
+	}
+
+	merged, err := store.MergeUsers(c.Request.Context(), id, sourceID, Actor(c))
+
+	if errors.Is(err, db.ErrSelfMerge) {
+		respondError(c, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	respondUser(c, http.StatusOK, *merged)
+}
+
+// activate or deactivate the user, repeated calls answer the same
+func setActiveHandler(active bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := db.ParseID(c.Param("id"))
+
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid id")
+			return
+		}
+
+		user, err := store.SetActive(c.Request.Context(), id, active, Actor(c))
+
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		respondData(c, http.StatusOK, user)
+	}
+}
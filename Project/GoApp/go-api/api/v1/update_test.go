@@ -0,0 +1,722 @@
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go-api/db"
+	"go-api/mailer"
+	"go-api/models"
+)
+
+// a sender keeping the email confirmation tokens it is asked to send, or
+// failing with err
+type recordingSender struct {
+	mailer.LogSender
+	err    error
+	tokens []string
+}
+
+func (s *recordingSender) SendEmailConfirmation(_ models.User, _, token string) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.tokens = append(s.tokens, token)
+	return nil
+}
+
+// replace the sender of the handlers for the test
+func useSender(t *testing.T, s mailer.Sender) {
+	old := sender
+	sender = s
+	t.Cleanup(func() { sender = old })
+}
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		require bool
+		method  string
+		ifMatch string
+		want    int
+	}{
+		{"patch without If-Match", false, http.MethodPatch, "", http.StatusOK},
+		{"patch without a required If-Match", true, http.MethodPatch, "", http.StatusPreconditionRequired},
+		{"patch of the current version", true, http.MethodPatch, `"1"`, http.StatusOK},
+		{"patch of any version", true, http.MethodPatch, "*", http.StatusOK},
+		{"patch of a stale version", false, http.MethodPatch, `"0"`, http.StatusPreconditionFailed},
+		{"patch of a weak tag", false, http.MethodPatch, `W/"1"`, http.StatusPreconditionFailed},
+		{"put without If-Match", false, http.MethodPut, "", http.StatusOK},
+		{"put without a required If-Match", true, http.MethodPut, "", http.StatusPreconditionRequired},
+		{"put of a stale version", true, http.MethodPut, `"2"`, http.StatusPreconditionFailed},
+		{"delete without If-Match", false, http.MethodDelete, "", http.StatusOK},
+		{"delete without a required If-Match", true, http.MethodDelete, "", http.StatusPreconditionRequired},
+		{"delete of the current version", true, http.MethodDelete, `"1"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{}
+			if tt.require {
+				env["REQUIRE_IF_MATCH"] = "true"
+			}
+			r := newTestRouter(t, env)
+			user := createUser(t, r, "Ada", "ada@example.com")
+			req := request{method: tt.method, path: "/users/" + string(user.ID), body: `{"name":"Ada L","email":"ada@example.com"}`}
+			if tt.ifMatch != "" {
+				req.header = map[string]string{"If-Match": tt.ifMatch}
+			}
+			if w := serve(r, req); w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+// writes without If-Match answer 428 unless REQUIRE_IF_MATCH turns it off
+func TestIfMatchRequiredByDefault(t *testing.T) {
+	tests := []struct {
+		name    string
+		require string
+		method  string
+		want    int
+	}{
+		{"put", "", http.MethodPut, http.StatusPreconditionRequired},
+		{"patch", "", http.MethodPatch, http.StatusPreconditionRequired},
+		{"delete", "", http.MethodDelete, http.StatusPreconditionRequired},
+		{"put, turned off", "false", http.MethodPut, http.StatusOK},
+		{"patch, turned off", "false", http.MethodPatch, http.StatusOK},
+		{"delete, turned off", "false", http.MethodDelete, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// empty is unset, which leaves the default
+			r := newTestRouter(t, map[string]string{"REQUIRE_IF_MATCH": tt.require})
+			user := createUser(t, r, "Ada", "ada@example.com")
+			w := serve(r, request{method: tt.method, path: "/users/" + string(user.ID), body: `{"name":"Ada L","email":"ada@example.com"}`})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code == http.StatusPreconditionRequired && errorMessage(w) != "If-Match is required, send the ETag of the user" {
+				t.Errorf("message %q", errorMessage(w))
+			}
+		})
+	}
+}
+
+// "If-Match: *" asks for an existing user, whatever its version
+func TestIfMatchAny(t *testing.T) {
+	tests := []struct {
+		name    string
+		require bool
+		method  string
+		ifMatch string
+		// the user is created, first, and changed once since
+		exists  bool
+		want    int
+		message string
+	}{
+		{"put of an existing user", false, http.MethodPut, "*", true, http.StatusOK, ""},
+		{"patch of an existing user", false, http.MethodPatch, "*", true, http.StatusOK, ""},
+		{"patch with If-Match required", true, http.MethodPatch, "*", true, http.StatusOK, ""},
+		{"patch with blanks around", false, http.MethodPatch, " * ", true, http.StatusOK, ""},
+		{"put of a missing user", false, http.MethodPut, "*", false, http.StatusPreconditionFailed, "user does not exist"},
+		{"patch of a missing user", false, http.MethodPatch, "*", false, http.StatusPreconditionFailed, "user does not exist"},
+		{"patch of a missing user with If-Match required", true, http.MethodPatch, "*", false, http.StatusPreconditionFailed, "user does not exist"},
+		{"patch of a missing user without If-Match", false, http.MethodPatch, "", false, http.StatusNotFound, "user not found"},
+		{"patch of a missing user at a version", false, http.MethodPatch, `"1"`, false, http.StatusNotFound, "user not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{}
+			if tt.require {
+				env["REQUIRE_IF_MATCH"] = "true"
+			}
+			r := newTestRouter(t, env)
+			id := models.ID("999")
+			if tt.exists {
+				user := createUser(t, r, "Ada", "ada@example.com")
+				id = user.ID
+				if w := serve(r, request{method: http.MethodPatch, path: "/users/" + string(id), body: `{"name":"Ada L"}`, header: map[string]string{"If-Match": `"1"`}}); w.Code != http.StatusOK {
+					t.Fatalf("patch: status %d: %s", w.Code, w.Body)
+				}
+			}
+			req := request{method: tt.method, path: "/users/" + string(id), body: `{"name":"Ada B","email":"ada@example.com"}`}
+			if tt.ifMatch != "" {
+				req.header = map[string]string{"If-Match": tt.ifMatch}
+			}
+			w := serve(r, req)
+			if w.Code != tt.want || errorMessage(w) != tt.message {
+				t.Fatalf("status %d %q, want %d %q: %s", w.Code, errorMessage(w), tt.want, tt.message, w.Body)
+			}
+			if w.Code == http.StatusOK && w.Header().Get("ETag") != `"3"` {
+				t.Errorf("ETag %s, want the version after the change", w.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+// a new email is written in the same version as the rest of the update, so
+// the ETag answered is the one of the stored user
+func TestEmailChangeIsOneWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		body   string
+	}{
+		{"patch", http.MethodPatch, `{"name":"Ada L","email":"lovelace@example.com"}`},
+		{"put", http.MethodPut, `{"name":"Ada L","email":"lovelace@example.com"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t, map[string]string{"REQUIRE_IF_MATCH": "true"})
+			mails := &recordingSender{}
+			useSender(t, mails)
+			user := createUser(t, r, "Ada", "ada@example.com")
+			path := "/users/" + string(user.ID)
+
+			w := serve(r, request{method: tt.method, path: path, body: tt.body, header: map[string]string{"If-Match": `"1"`}})
+			if w.Code != http.StatusOK {
+				t.Fatalf("update: status %d: %s", w.Code, w.Body)
+			}
+			var updated models.User
+			json.Unmarshal(w.Body.Bytes(), &updated)
+			if updated.Version != 2 || updated.Name != "Ada L" || updated.Email != "ada@example.com" || updated.PendingEmail != "lovelace@example.com" {
+				t.Errorf("updated to %+v, want version 2 with the new email pending", updated)
+			}
+			etag := w.Header().Get("ETag")
+			if got := serve(r, request{method: http.MethodGet, path: path}).Header().Get("ETag"); got != etag {
+				t.Errorf("update answered ETag %s, the stored user has %s", etag, got)
+			}
+			if len(mails.tokens) != 1 {
+				t.Fatalf("%d confirmations sent, want 1", len(mails.tokens))
+			}
+
+			// the ETag answered is good for the next write
+			w = serve(r, request{method: http.MethodPatch, path: path, body: `{"phone":"+15550100"}`, header: map[string]string{"If-Match": etag}})
+			if w.Code != http.StatusOK {
+				t.Fatalf("write after the update: status %d: %s", w.Code, w.Body)
+			}
+			json.Unmarshal(w.Body.Bytes(), &updated)
+			if updated.PendingEmail != "lovelace@example.com" || len(mails.tokens) != 1 {
+				t.Errorf("a patch without an email left pending %q after %d confirmations", updated.PendingEmail, len(mails.tokens))
+			}
+
+			w = serve(r, request{method: http.MethodGet, path: path + "/confirm-email?token=" + mails.tokens[0]})
+			if w.Code != http.StatusOK {
+				t.Fatalf("confirm: status %d: %s", w.Code, w.Body)
+			}
+			var confirmed models.User
+			json.Unmarshal(w.Body.Bytes(), &confirmed)
+			if confirmed.Email != "lovelace@example.com" || confirmed.PendingEmail != "" {
+				t.Errorf("confirmed to %q, %q pending", confirmed.Email, confirmed.PendingEmail)
+			}
+		})
+	}
+}
+
+func TestEmailChangeNotSent(t *testing.T) {
+	r := newTestRouter(t, nil)
+	useSender(t, &recordingSender{err: errors.New("smtp down")})
+	user := createUser(t, r, "Ada", "ada@example.com")
+	path := "/users/" + string(user.ID)
+
+	w := serve(r, request{method: http.MethodPatch, path: path, body: `{"email":"lovelace@example.com"}`})
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502: %s", w.Code, w.Body)
+	}
+	var stored models.User
+	json.Unmarshal(serve(r, request{method: http.MethodGet, path: path}).Body.Bytes(), &stored)
+	if stored.Email != "ada@example.com" || stored.PendingEmail != "" {
+		t.Errorf("stored %q with %q pending, want the change dropped", stored.Email, stored.PendingEmail)
+	}
+}
+
+// a sender keeping the users it welcomes, or failing with err
+type welcomingSender struct {
+	mailer.LogSender
+	err      error
+	welcomed []models.ID
+}
+
+func (s *welcomingSender) SendWelcome(user models.User) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.welcomed = append(s.welcomed, user.ID)
+	return nil
+}
+
+func TestSendWelcome(t *testing.T) {
+	r := newTestRouter(t, nil)
+	s := &welcomingSender{}
+	useSender(t, s)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+
+	steps := []struct {
+		name string
+		id   models.ID
+		// the error of the sender
+		err     error
+		want    int
+		message string
+	}{
+		{"send", ada.ID, nil, http.StatusOK, ""},
+		{"second send", ada.ID, nil, http.StatusConflict, "user already welcomed"},
+		{"missing user", "999", nil, http.StatusNotFound, "user not found"},
+		{"malformed id", "x", nil, http.StatusBadRequest, "invalid id"},
+		{"failed send", bob.ID, errors.New("smtp down"), http.StatusBadGateway, "failed to send welcome email"},
+		{"send after a failure", bob.ID, nil, http.StatusOK, ""},
+	}
+	for _, step := range steps {
+		s.err = step.err
+		w := serve(r, request{method: http.MethodPost, path: "/users/" + string(step.id) + "/send-welcome"})
+		if w.Code != step.want || errorMessage(w) != step.message {
+			t.Fatalf("%s: status %d %q, want %d %q", step.name, w.Code, errorMessage(w), step.want, step.message)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var user models.User
+		if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != step.id || user.WelcomedAt == nil {
+			t.Errorf("%s: answered %+v, want user %s welcomed", step.name, user, step.id)
+		}
+	}
+	if len(s.welcomed) != 2 || s.welcomed[0] != ada.ID || s.welcomed[1] != bob.ID {
+		t.Errorf("welcomed %v, want %s then %s once each", s.welcomed, ada.ID, bob.ID)
+	}
+}
+
+// a missing user is a 404 whatever the body, and only an existing one has
+// its body checked
+func TestUpdateOfAMissingUser(t *testing.T) {
+	r := newTestRouter(t, nil)
+	user := createUser(t, r, "Ada", "ada@example.com")
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		// the answers for the existing user and for a missing one
+		want, wantMissing int
+	}{
+		{"put of malformed JSON", http.MethodPut, `{"name":`, http.StatusUnprocessableEntity, http.StatusNotFound},
+		{"put of a field of the wrong type", http.MethodPut, `{"name":5,"email":"ada@example.com"}`, http.StatusUnprocessableEntity, http.StatusNotFound},
+		{"put of an invalid user", http.MethodPut, `{"name":"","email":"not-an-email"}`, http.StatusUnprocessableEntity, http.StatusNotFound},
+		{"put without a body", http.MethodPut, "", http.StatusUnprocessableEntity, http.StatusNotFound},
+		{"patch of malformed JSON", http.MethodPatch, `{"name":`, http.StatusBadRequest, http.StatusNotFound},
+		{"patch of a field of the wrong type", http.MethodPatch, `{"name":5}`, http.StatusUnprocessableEntity, http.StatusNotFound},
+		{"patch of an invalid email", http.MethodPatch, `{"email":"not-an-email"}`, http.StatusUnprocessableEntity, http.StatusNotFound},
+		{"patch without a body", http.MethodPatch, "", http.StatusBadRequest, http.StatusNotFound},
+		{"valid put", http.MethodPut, `{"name":"Ada L","email":"ada@example.com"}`, http.StatusOK, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for id, want := range map[models.ID]int{user.ID: tt.want, "999": tt.wantMissing, "x": http.StatusBadRequest} {
+				w := serve(r, request{method: tt.method, path: "/users/" + string(id), body: tt.body})
+				if w.Code != want {
+					t.Errorf("user %s: status %d, want %d: %s", id, w.Code, want, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyBody(t *testing.T) {
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	path := "/users/" + string(ada.ID)
+	jsonType := map[string]string{"Content-Type": "application/json"}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header map[string]string
+		want   int
+		// the error answered, none if empty
+		message string
+	}{
+		{"PUT", http.MethodPut, path, "", nil, http.StatusUnprocessableEntity, "all fields required"},
+		{"PUT of JSON", http.MethodPut, path, "", jsonType, http.StatusUnprocessableEntity, "all fields required"},
+		{"PUT of whitespace", http.MethodPut, path, " \n\t", jsonType, http.StatusUnprocessableEntity, "all fields required"},
+		{"PUT of a missing user", http.MethodPut, "/users/999", "", nil, http.StatusNotFound, ""},
+		{"PATCH", http.MethodPatch, path, "", nil, http.StatusBadRequest, "no changes provided"},
+		{"PATCH of a merge patch", http.MethodPatch, path, "", map[string]string{"Content-Type": "application/merge-patch+json"}, http.StatusBadRequest, "no changes provided"},
+		{"PATCH of whitespace", http.MethodPatch, path, "\n", jsonType, http.StatusBadRequest, "no changes provided"},
+		{"PATCH of an empty object", http.MethodPatch, path, "{}", nil, http.StatusBadRequest, "no changes provided"},
+		{"PATCH of a missing user", http.MethodPatch, "/users/999", "", nil, http.StatusNotFound, ""},
+		{"reorder", http.MethodPut, "/users/reorder", "", nil, http.StatusUnprocessableEntity, "all fields required"},
+		// not an empty body: the decoders answer it
+		{"PUT of null", http.MethodPut, path, "null", nil, http.StatusUnprocessableEntity, ""},
+		{"PATCH of an array", http.MethodPatch, path, "[]", nil, http.StatusBadRequest, "PATCH body must be a JSON object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: tt.method, path: tt.path, body: tt.body, header: tt.header})
+			if w.Code != tt.want || (tt.message != "" && errorMessage(w) != tt.message) {
+				t.Errorf("status %d %q, want %d %q", w.Code, errorMessage(w), tt.want, tt.message)
+			}
+			if strings.Contains(w.Body.String(), "EOF") {
+				t.Errorf("answered the decoder error %s", w.Body)
+			}
+		})
+	}
+
+	// none of them changed the user
+	var got models.User
+	json.Unmarshal(serve(r, request{method: http.MethodGet, path: path}).Body.Bytes(), &got)
+	if got.Version != ada.Version || got.Name != "Ada" {
+		t.Errorf("user %+v after the empty bodies, want it unchanged", got)
+	}
+}
+
+func TestSetActive(t *testing.T) {
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	createUser(t, r, "Bob", "bob@example.com")
+	gone := createUser(t, r, "Cy", "cy@example.com")
+	serve(r, request{method: http.MethodDelete, path: "/users/" + string(gone.ID)})
+
+	// the names of the users listed with query
+	listed := func(query string) []string {
+		t.Helper()
+		var users []models.User
+		json.Unmarshal(serve(r, request{method: http.MethodGet, path: "/users" + query}).Body.Bytes(), &users)
+		names := []string{}
+		for _, u := range users {
+			names = append(names, u.Name)
+		}
+		return names
+	}
+
+	steps := []struct {
+		name    string
+		path    string
+		want    int
+		message string
+		// the state and version answered, and the users listed after
+		active  bool
+		version int64
+		list    []string
+	}{
+		{"deactivate", "/users/" + string(ada.ID) + "/deactivate", http.StatusOK, "", false, 2, []string{"Bob"}},
+		{"deactivate again", "/users/" + string(ada.ID) + "/deactivate", http.StatusOK, "", false, 2, []string{"Bob"}},
+		{"activate", "/users/" + string(ada.ID) + "/activate", http.StatusOK, "", true, 3, []string{"Ada", "Bob"}},
+		{"activate again", "/users/" + string(ada.ID) + "/activate", http.StatusOK, "", true, 3, []string{"Ada", "Bob"}},
+		{"deactivate a missing user", "/users/999/deactivate", http.StatusNotFound, "user not found", false, 0, []string{"Ada", "Bob"}},
+		{"activate a deleted user", "/users/" + string(gone.ID) + "/activate", http.StatusNotFound, "user not found", false, 0, []string{"Ada", "Bob"}},
+		{"deactivate a malformed id", "/users/x/deactivate", http.StatusBadRequest, "invalid id", false, 0, []string{"Ada", "Bob"}},
+		{"deactivate once more", "/users/" + string(ada.ID) + "/deactivate", http.StatusOK, "", false, 4, []string{"Bob"}},
+	}
+	for _, s := range steps {
+		w := serve(r, request{method: http.MethodPost, path: s.path})
+		if w.Code != s.want || errorMessage(w) != s.message {
+			t.Fatalf("%s: status %d %q, want %d %q", s.name, w.Code, errorMessage(w), s.want, s.message)
+		}
+		if w.Code == http.StatusOK {
+			var user models.User
+			if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+				t.Fatal(err)
+			}
+			if user.ID != ada.ID || user.Active != s.active || user.Version != s.version {
+				t.Errorf("%s: answered %+v, want active %v at version %d", s.name, user, s.active, s.version)
+			}
+		}
+		if got := listed(""); !slices.Equal(got, s.list) {
+			t.Errorf("%s: listed %v, want %v", s.name, got, s.list)
+		}
+	}
+
+	// hidden from the list, not gone
+	if got := listed("?include_inactive=true"); !slices.Equal(got, []string{"Ada", "Bob"}) {
+		t.Errorf("listed with the inactive %v", got)
+	}
+	if w := serve(r, request{method: http.MethodGet, path: "/users/" + string(ada.ID)}); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"active":false`) {
+		t.Errorf("read of the deactivated user: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestReorder(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"MAX_PRIORITY": "3"})
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+	cy := createUser(t, r, "Cy", "cy@example.com")
+	// a reorder body of the ids of users
+	ids := func(users ...models.User) string {
+		var list []models.ID
+		for _, u := range users {
+			list = append(list, u.ID)
+		}
+		body, _ := json.Marshal(map[string]any{"ids": list})
+		return string(body)
+	}
+
+	// the names of the users by priority
+	ordered := func() []string {
+		t.Helper()
+		var users []models.User
+		json.Unmarshal(serve(r, request{method: http.MethodGet, path: "/users?sort=priority"}).Body.Bytes(), &users)
+		names := []string{}
+		for _, u := range users {
+			names = append(names, u.Name)
+		}
+		return names
+	}
+
+	steps := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		want    int
+		message string
+		// the names by priority after
+		order []string
+	}{
+		{"reorder", http.MethodPut, "/users/reorder", ids(cy, ada, bob), http.StatusOK, "", []string{"Cy", "Ada", "Bob"}},
+		{"reorder again", http.MethodPut, "/users/reorder", ids(bob, cy, ada), http.StatusOK, "", []string{"Bob", "Cy", "Ada"}},
+		{"an unknown id", http.MethodPut, "/users/reorder", `{"ids":["` + string(ada.ID) + `","999"]}`, http.StatusUnprocessableEntity, "user not found: 999", []string{"Bob", "Cy", "Ada"}},
+		{"an id twice", http.MethodPut, "/users/reorder", ids(ada, cy, ada), http.StatusUnprocessableEntity, "user " + string(ada.ID) + " listed twice", []string{"Bob", "Cy", "Ada"}},
+		{"more ids than priorities", http.MethodPut, "/users/reorder", ids(ada, bob, cy, ada), http.StatusUnprocessableEntity, "at most 3 ids can be ordered", []string{"Bob", "Cy", "Ada"}},
+		{"no ids", http.MethodPut, "/users/reorder", `{}`, http.StatusBadRequest, "", []string{"Bob", "Cy", "Ada"}},
+		{"above the highest", http.MethodPatch, "/users/" + string(ada.ID), `{"priority":4}`, http.StatusUnprocessableEntity, "priority must be between 0 and 3", []string{"Bob", "Cy", "Ada"}},
+		{"below 0", http.MethodPatch, "/users/" + string(bob.ID), `{"priority":-1}`, http.StatusUnprocessableEntity, "priority must be between 0 and 3", []string{"Bob", "Cy", "Ada"}},
+		// equal priorities keep the order of the ids
+		{"the highest priority", http.MethodPatch, "/users/" + string(bob.ID), `{"priority":3}`, http.StatusOK, "", []string{"Cy", "Ada", "Bob"}},
+		{"the lowest priority", http.MethodPatch, "/users/" + string(ada.ID), `{"priority":0}`, http.StatusOK, "", []string{"Ada", "Cy", "Bob"}},
+	}
+	for _, s := range steps {
+		w := serve(r, request{method: s.method, path: s.path, body: s.body})
+		if w.Code != s.want || (s.message != "" && errorMessage(w) != s.message) {
+			t.Fatalf("%s: status %d %q, want %d %q", s.name, w.Code, errorMessage(w), s.want, s.message)
+		}
+		if got := ordered(); !slices.Equal(got, s.order) {
+			t.Errorf("%s: ordered %v, want %v", s.name, got, s.order)
+		}
+	}
+}
+
+func TestTouchUsers(t *testing.T) {
+	db.SetClock(&tickingClock{now: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)})
+	t.Cleanup(func() { db.SetClock(systemClock{}) })
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+	cy := createUser(t, r, "Cy", "cy@example.com")
+	// the stored users by id
+	users := func() map[models.ID]models.User {
+		t.Helper()
+		var list []models.User
+		json.Unmarshal(serve(r, request{method: http.MethodGet, path: "/users"}).Body.Bytes(), &list)
+		byID := map[models.ID]models.User{}
+		for _, u := range list {
+			byID[u.ID] = u
+		}
+		return byID
+	}
+	before := users()
+
+	body := `{"ids":[` + string(ada.ID) + `,999,` + string(cy.ID) + `,` + string(ada.ID) + `]}`
+	w := serve(r, request{method: http.MethodPost, path: "/users/touch", body: body})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var reply struct {
+		Touched  []models.ID `json:"touched"`
+		NotFound []models.ID `json:"not_found"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	if !slices.Equal(reply.Touched, []models.ID{ada.ID, cy.ID}) || !slices.Equal(reply.NotFound, []models.ID{"999"}) {
+		t.Errorf("reply %s, want ada and cy touched once, 999 not found", w.Body)
+	}
+
+	after := users()
+	for _, u := range []models.User{ada, cy} {
+		old, got := before[u.ID], after[u.ID]
+		if !got.UpdatedAt.After(old.UpdatedAt) || got.Version != old.Version+1 {
+			t.Errorf("%s: updated at %s, version %d, want both past %s and %d", u.Name, got.UpdatedAt, got.Version, old.UpdatedAt, old.Version)
+		}
+		// nothing else changes
+		got.UpdatedAt, got.Version = old.UpdatedAt, old.Version
+		if !reflect.DeepEqual(got, old) {
+			t.Errorf("%s touched to %+v, was %+v", u.Name, got, old)
+		}
+	}
+	if !reflect.DeepEqual(after[bob.ID], before[bob.ID]) {
+		t.Errorf("bob changed to %+v, was %+v", after[bob.ID], before[bob.ID])
+	}
+	if tag := serve(r, request{method: http.MethodGet, path: "/users/" + string(ada.ID)}).Header().Get("ETag"); tag != `"2"` {
+		t.Errorf("ETag of ada %s, want the touched version", tag)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"no ids", `{}`, http.StatusBadRequest},
+		{"only unknown ids", `{"ids":[999]}`, http.StatusOK},
+		{"malformed", `{"ids":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := serve(r, request{method: http.MethodPost, path: "/users/touch", body: tt.body}); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+	if got := users(); !reflect.DeepEqual(got, after) {
+		t.Errorf("users changed by the failed touches: %+v", got)
+	}
+}
+
+// a multipart body of the fields and files given, and its content type
+func multipartBody(t *testing.T, fields, files map[string]string) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, v := range fields {
+		mw.WriteField(name, v)
+	}
+	for name, v := range files {
+		part, err := mw.CreateFormFile(name, name+".bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(v))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), mw.FormDataContentType()
+}
+
+func TestMultipartUpdate(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"MAX_AVATAR_BYTES": "1024"})
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	path := "/users/" + string(ada.ID)
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("p", 100)
+	gif := "GIF89a" + strings.Repeat("g", 1018)
+
+	steps := []struct {
+		name          string
+		fields, files map[string]string
+		want          int
+		message       string
+		// the name and the avatar stored after, "" for none
+		stored, avatar string
+	}{
+		{"fields and an avatar", map[string]string{"user": `{"name":"Ada L","email":"ada@example.com"}`}, map[string]string{"avatar": png}, http.StatusOK, "", "Ada L", png},
+		{"fields alone", map[string]string{"user": `{"name":"Ada M","email":"ada@example.com"}`}, nil, http.StatusOK, "", "Ada M", png},
+		{"the user as a file", nil, map[string]string{"user": `{"name":"Ada N","email":"ada@example.com"}`, "avatar": gif}, http.StatusOK, "", "Ada N", gif},
+		{"an avatar too large", map[string]string{"user": `{"name":"Ada O","email":"ada@example.com"}`}, map[string]string{"avatar": gif + "g"}, http.StatusUnprocessableEntity, "avatar is larger than 1024 bytes", "Ada N", gif},
+		{"an avatar not an image", map[string]string{"user": `{"name":"Ada O","email":"ada@example.com"}`}, map[string]string{"avatar": "hello"}, http.StatusUnprocessableEntity, "avatar must be one of image/png, image/jpeg, image/gif, image/webp, not text/plain; charset=utf-8", "Ada N", gif},
+		{"an invalid user with an avatar", map[string]string{"user": `{"name":"Ada O","email":"not an email"}`}, map[string]string{"avatar": png}, http.StatusUnprocessableEntity, "email is not a valid email address", "Ada N", gif},
+		{"no user part", nil, map[string]string{"avatar": png}, http.StatusUnprocessableEntity, `multipart update needs a "user" part`, "Ada N", gif},
+		{"a user part not JSON", map[string]string{"user": "name=Ada"}, nil, http.StatusUnprocessableEntity, "", "Ada N", gif},
+	}
+	for _, s := range steps {
+		body, contentType := multipartBody(t, s.fields, s.files)
+		w := serve(r, request{method: http.MethodPut, path: path, body: body, header: map[string]string{"Content-Type": contentType}})
+		if w.Code != s.want || (s.message != "" && errorMessage(w) != s.message) {
+			t.Fatalf("%s: status %d %q, want %d %q", s.name, w.Code, errorMessage(w), s.want, s.message)
+		}
+		if w.Code == http.StatusOK {
+			var user models.User
+			json.Unmarshal(w.Body.Bytes(), &user)
+			if user.Avatar == nil || user.Avatar.Size != len(s.avatar) {
+				t.Errorf("%s: answered the avatar %+v, want one of %d bytes", s.name, user.Avatar, len(s.avatar))
+			}
+		}
+		if got := db.GetUser(ada.ID); got.Name != s.stored {
+			t.Errorf("%s: stored the name %q, want %q", s.name, got.Name, s.stored)
+		}
+		if w := serve(r, request{method: http.MethodGet, path: path + "/avatar"}); w.Body.String() != s.avatar {
+			t.Errorf("%s: avatar of %d bytes as %s, want %d bytes", s.name, w.Body.Len(), w.Header().Get("Content-Type"), len(s.avatar))
+		}
+	}
+}
+
+func TestMergeUsers(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"ADMIN_TOKEN": testAdminToken})
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	w := serve(r, request{method: http.MethodPost, path: "/users", body: `{"name":"Ada L","email":"ada.l@example.com","username":"ada","phone":"+14155550100","priority":3}`})
+	var dup models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &dup); w.Code != http.StatusCreated || err != nil {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	keyID, key := createKey(t, r, string(dup.ID))
+	merge := "/users/" + string(ada.ID) + "/merge/" + string(dup.ID)
+
+	w = serve(r, request{method: http.MethodPost, path: merge})
+	var merged models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &merged); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("merge: status %d: %s", w.Code, w.Body)
+	}
+	// the fields of ada kept, the empty ones taken from the duplicate
+	if merged.ID != ada.ID || merged.Name != "Ada" || merged.Email != "ada@example.com" || merged.Username != "ada" || merged.Phone != "+14155550100" || merged.Priority != 3 || merged.Version != 2 {
+		t.Errorf("merged %+v", merged)
+	}
+
+	// the duplicate soft-deleted, its email free and its key ada's
+	if w := serve(r, request{method: http.MethodGet, path: "/users/" + string(dup.ID)}); w.Code != http.StatusNotFound {
+		t.Errorf("read of the merged duplicate: status %d", w.Code)
+	}
+	if users, _ := db.GetUsers(db.UserQuery{IncludeDeleted: true}); len(users) != 2 || users[1].DeletedAt == nil {
+		t.Errorf("stored %+v, want the duplicate kept as deleted", users)
+	}
+	if w := serve(r, request{method: http.MethodGet, path: "/users/" + string(ada.ID) + "/api-keys", header: map[string]string{"X-API-Key": key}}); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), keyID) {
+		t.Errorf("keys of ada with the duplicate's key: status %d: %s", w.Code, w.Body)
+	}
+	createUser(t, r, "Eve", "ada.l@example.com")
+
+	// the merge in the audit log of both, and the duplicate's history ada's
+	if got, want := auditOf(t, r, ada.ID), []string{"updated by anonymous", "created by anonymous"}; !slices.Equal(got, want) {
+		t.Errorf("audit log of ada %q, want %q", got, want)
+	}
+	if got, want := auditOf(t, r, dup.ID), []string{"deleted by anonymous", "api_key_created by anonymous", "created by anonymous"}; !slices.Equal(got, want) {
+		t.Errorf("audit log of the duplicate %q, want %q", got, want)
+	}
+	var entries []db.HistoryEntry
+	json.Unmarshal(serve(r, request{method: http.MethodGet, path: "/users/" + string(ada.ID) + "/history"}).Body.Bytes(), &entries)
+	var types []string
+	for _, e := range entries {
+		types = append(types, e.Type)
+	}
+	if want := []string{"deleted", "updated", "api_key_created", "created", "created"}; !slices.Equal(types, want) {
+		t.Errorf("history of ada %q, want %q", types, want)
+	}
+
+	tests := []struct {
+		name, path string
+		want       int
+		message    string
+	}{
+		{"into itself", "/users/" + string(ada.ID) + "/merge/" + string(ada.ID), http.StatusUnprocessableEntity, "cannot merge a user into itself"},
+		{"a merged source", merge, http.StatusNotFound, "user not found: " + string(dup.ID)},
+		{"a missing source", "/users/" + string(ada.ID) + "/merge/999", http.StatusNotFound, "user not found: 999"},
+		{"into a missing user", "/users/999/merge/" + string(ada.ID), http.StatusNotFound, "user not found: 999"},
+		{"a malformed source", "/users/" + string(ada.ID) + "/merge/x", http.StatusBadRequest, "invalid other id"},
+		{"into a malformed id", "/users/x/merge/" + string(ada.ID), http.StatusBadRequest, "invalid id"},
+	}
+	for _, tt := range tests {
+		w := serve(r, request{method: http.MethodPost, path: tt.path})
+		if w.Code != tt.want || errorMessage(w) != tt.message {
+			t.Errorf("%s: status %d %q, want %d %q", tt.name, w.Code, errorMessage(w), tt.want, tt.message)
+		}
+	}
+	if got := db.GetUser(ada.ID); got == nil || got.Version != 2 {
+		t.Errorf("ada after the refused merges %+v", got)
+	}
+}
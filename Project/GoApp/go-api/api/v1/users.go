@@ -0,0 +1,396 @@
+package v1
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/auth"
+	"go-api/db"
+	"go-api/events"
+	"go-api/models"
+	"go-api/pagination"
+)
+
+func getUsersHandler(c *gin.Context) {
+	modified, err := store.LastModified(c.Request.Context())
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	// HTTP dates have whole seconds, compare at that resolution
+	modified = modified.UTC().Truncate(time.Second)
+	c.Header("Last-Modified", modified.Format(http.TimeFormat))
+	// If-None-Match, checked against the ETag below, wins over the date
+	since, err := http.ParseTime(c.GetHeader("If-Modified-Since"))
+	if err == nil && c.GetHeader("If-None-Match") == "" && !modified.After(since) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	q, err := userQuery(c)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	users, total, err := store.GetUsers(c.Request.Context(), q)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.Writer.Header().Add("Link", pageLinks(c, q.Page, total))
+
+	respondProjected(c, users, listETag(c, users))
+}
+
+// users whose name or email match ?q=, best first, taking the ?page=,
+// ?sort= and filters of GET /users; the sort only orders equal matches
+func searchUsersHandler(c *gin.Context) {
+	text := strings.TrimSpace(c.Query("q"))
+
+	if text == "" {
+		respondError(c, http.StatusBadRequest, "q is required")
+		return
+	}
+
+	q, err := userQuery(c)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	users, total, err := store.SearchUsers(c.Request.Context(), text, q)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.Writer.Header().Add("Link", pageLinks(c, q.Page, total))
+
+	respondProjected(c, users, "")
+}
+
+// the listing a GET /users asks for: a ?page= of ?per_page= users in ?sort=
+// order, deactivated users only with ?include_inactive=true, and only users
+// with the value given for any field of models.FilterFields, e.g. ?email=
+func userQuery(c *gin.Context) (db.UserQuery, error) {
+	page, err := pagination.ParsePage(c.Query("page"), c.Query("per_page"))
+	if err != nil {
+		return db.UserQuery{}, err
+	}
+
+	order := c.Query("sort")
+	if order == "" {
+		order = conf.DefaultSort
+	}
+	less, err := UserOrder(order)
+	if err != nil {
+		return db.UserQuery{}, err
+	}
+
+	filters := map[string]string{}
+	for field := range models.FilterFields {
+		if value, ok := c.GetQuery(field); ok {
+			filters[field] = value
+		}
+	}
+
+	return db.UserQuery{
+		Filters:    filters,
+		ActiveOnly: c.Query("include_inactive") != "true",
+		Less:       less,
+		Page:       page,
+	}, nil
+}
+
+// Link header with the first, prev, next and last pages of a listing of
+// total items, as the request with its ?page= changed
+func pageLinks(c *gin.Context, p pagination.Page, total int) string {
+	link := func(n int, rel string) string {
+		query := c.Request.URL.Query()
+		query.Set("page", strconv.Itoa(n))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, c.Request.URL.Path, query.Encode(), rel)
+	}
+
+	current, last := p.Number(), p.Pages(total)
+	links := []string{link(1, "first")}
+	if current > 1 {
+		links = append(links, link(min(current-1, last), "prev"))
+	}
+	if current < last {
+		links = append(links, link(current+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+	return strings.Join(links, ", ")
+}
+
+// ordering of a ?sort= value, a field of models.SortFields with "-" in
+// front for descending. Ties are broken by ascending id either way, so every
+// order is fully deterministic.
+func UserOrder(order string) (func(a, b models.User) bool, error) {
+	field, desc := strings.CutPrefix(order, "-")
+	compare, ok := models.SortFields[field]
+	if !ok {
+		return nil, fmt.Errorf("cannot sort by %q", order)
+	}
+	return func(a, b models.User) bool {
+		n := compare(a, b)
+		if desc {
+			n = -n
+		}
+		if n != 0 {
+			return n < 0
+		}
+		return a.ID.Less(b.ID)
+	}, nil
+}
+
+// number of users, ?include_deleted=true adds the soft-deleted ones
+func countUsersHandler(c *gin.Context) {
+	includeDeleted := c.Query("include_deleted") == "true"
+	count, err := store.CountUsers(c.Request.Context(), includeDeleted)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"count": count, "include_deleted": includeDeleted})
+}
+
+func userStatsHandler(c *gin.Context) {
+	stats, err := store.GetStats(c.Request.Context())
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// stream user changes as server-sent events until the client goes away
+// stream the events of the types of ?types=, all of them by default. A
+// client reconnecting with Last-Event-ID, or ?last_event_id=, first gets
+// the events it missed, or a "reset" event when they are no longer kept
+// and it should read the users again.
+func userEventsHandler(c *gin.Context) {
+	types := events.Types
+
+	if list := c.Query("types"); list != "" {
+		types = strings.Split(list, ",")
+	}
+
+	for _, t := range types {
+		if !slices.Contains(events.Types, t) {
+			respondError(c, http.StatusBadRequest, fmt.Sprintf("unknown event type %q", t))
+			return
+		}
+	}
+
+	lastID := c.GetHeader("Last-Event-ID")
+
+	if lastID == "" {
+		lastID = c.Query("last_event_id")
+	}
+
+	var after uint64
+
+	if lastID != "" {
+		var err error
+		after, err = strconv.ParseUint(lastID, 10, 64)
+
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "invalid last event id")
+			return
+		}
+	}
+
+	ch, missed, complete, cancel := events.SubscribeAfter(after)
+	defer cancel()
+
+	// the stream is long lived, lift the server write timeout for it
+	http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+	heartbeat := time.NewTicker(conf.SSEHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	// send the headers right away, the first event may take a while
+	c.Status(http.StatusOK)
+
+	if !complete {
+		fmt.Fprint(c.Writer, "event:reset\ndata:{\"type\":\"reset\"}\n\n")
+	}
+
+	for _, ev := range missed {
+		if slices.Contains(types, ev.Type) {
+			writeEvent(c.Writer, ev)
+		}
+	}
+	c.Writer.Flush()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-shuttingDown:
+			return false
+		case ev := <-ch:
+			if slices.Contains(types, ev.Type) {
+				writeEvent(w, ev)
+			}
+			return true
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			return true
+		}
+	})
+}
+
+// write ev as a server-sent event with its id, so clients can resume after it
+func writeEvent(w io.Writer, ev events.Event) {
+	data, err := json.Marshal(ev)
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "id:%d\nevent:%s\ndata:%s\n\n", ev.ID, ev.Type, data)
+}
+
+func getUserHandler(c *gin.Context) {
+	idStr := c.Param("id")
+
+	id, err := db.ParseID(idStr)
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	user, err := store.GetUser(c.Request.Context(), id)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	// the ETag is the version, with the representation mixed in
+	c.Header("Vary", "Accept, X-Timezone, X-Response-Envelope")
+	respondProjected(c, user, userETag(*user))
+}
+
+// changes of the user, newest first, a ?page= at a time
+func userHistoryHandler(c *gin.Context) {
+	id, err := db.ParseID(c.Param("id"))
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	page, err := pagination.ParsePage(c.Query("page"), c.Query("per_page"))
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	entries, err := store.History(c.Request.Context(), id)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	respondPage(c, pagination.Apply(entries, page), len(entries), page)
+}
+
+// the user the request is authenticated as
+func getMeHandler(c *gin.Context) {
+	id, ok := auth.UserID(c)
+
+	// an admin signed in with ADMIN_TOKEN is no user
+	if !ok {
+		respondError(c, http.StatusNotFound, "not signed in as a user")
+		return
+	}
+
+	user, err := store.GetUser(c.Request.Context(), id)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	respondProjected(c, user, "")
+}
+
+// with PRIVATE_READS, let a read by id through only for the user the
+// request is authenticated as, 401 without an API key. Any other id answers
+// exactly what a missing user does, without looking it up, so neither the
+// answer nor its timing tells whether the user exists.
+func ownUser(c *gin.Context) {
+	if !conf.PrivateReads || auth.Role(c) == auth.Admin {
+		return
+	}
+
+	caller, ok := auth.UserID(c)
+
+	if !ok {
+		c.Header("WWW-Authenticate", `Bearer realm="api"`)
+		respondError(c, http.StatusUnauthorized, "authentication required")
+		c.Abort()
+		return
+	}
+
+	// a malformed id is a 400 from the handler, whoever asks
+	if id, err := db.ParseID(c.Param("id")); err == nil && id != caller {
+		respondStoreError(c, db.ErrNotFound)
+		c.Abort()
+	}
+}
+
+// serve the avatar image of the user, 404 when it has none
+func getAvatarHandler(c *gin.Context) {
+	id, err := db.ParseID(c.Param("id"))
+
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	avatar, err := store.GetAvatar(c.Request.Context(), id)
+
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	if avatar == nil {
+		respondError(c, http.StatusNotFound, "user has no avatar")
+		return
+	}
+
+	c.Data(http.StatusOK, avatar.ContentType, avatar.Data)
+}
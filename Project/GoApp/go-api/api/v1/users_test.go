@@ -0,0 +1,784 @@
+package v1
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go-api/auth"
+	"go-api/db"
+	"go-api/events"
+	"go-api/fieldcrypt"
+	"go-api/models"
+)
+
+func TestPrivateReads(t *testing.T) {
+	r := newTestRouter(t, map[string]string{
+		"ADMIN_TOKEN":   testAdminToken,
+		"JWT_SECRET":    "test-jwt-secret",
+		"PRIVATE_READS": "true",
+	})
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+	_, adaKey := createKey(t, r, string(ada.ID))
+	adminJWT, _, err := tokens.Issue("", auth.Admin, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asAda := map[string]string{"X-API-Key": adaKey}
+	asAdmin := map[string]string{"Authorization": "Bearer " + adminJWT}
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		want   int
+	}{
+		{"anonymous read", "/users/" + string(bob.ID), nil, http.StatusUnauthorized},
+		{"anonymous read of a missing user", "/users/999", nil, http.StatusUnauthorized},
+		{"own read", "/users/" + string(ada.ID), asAda, http.StatusOK},
+		{"own history", "/users/" + string(ada.ID) + "/history", asAda, http.StatusOK},
+		{"me", "/users/me", asAda, http.StatusOK},
+		{"read of another user", "/users/" + string(bob.ID), asAda, http.StatusNotFound},
+		{"read of a missing user", "/users/999", asAda, http.StatusNotFound},
+		{"history of another user", "/users/" + string(bob.ID) + "/history", asAda, http.StatusNotFound},
+		{"avatar of another user", "/users/" + string(bob.ID) + "/avatar", asAda, http.StatusNotFound},
+		{"malformed id", "/users/x", asAda, http.StatusBadRequest},
+		{"admin read", "/users/" + string(bob.ID), asAdmin, http.StatusOK},
+		{"admin read of a missing user", "/users/999", asAdmin, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: tt.path, header: tt.header})
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+
+	// another user's id is answered exactly as an id no user has
+	other := serve(r, request{method: http.MethodGet, path: "/users/" + string(bob.ID), header: asAda})
+	missing := serve(r, request{method: http.MethodGet, path: "/users/999", header: asAda})
+	if errorMessage(other) != errorMessage(missing) || other.Header().Get("Content-Type") != missing.Header().Get("Content-Type") {
+		t.Errorf("another user answered %q (%s), a missing one %q (%s)",
+			errorMessage(other), other.Header().Get("Content-Type"), errorMessage(missing), missing.Header().Get("Content-Type"))
+	}
+}
+
+func TestPublicReads(t *testing.T) {
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"read by id", "/users/" + string(ada.ID), http.StatusOK},
+		{"missing user", "/users/999", http.StatusNotFound},
+		{"malformed id", "/users/x", http.StatusBadRequest},
+		{"me without a key", "/users/me", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(r, request{method: http.MethodGet, path: tt.path}); w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+// the history and the audit log come a page at a time, newest first, as the
+// list of users does
+func TestHistoryPages(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"ADMIN_TOKEN": testAdminToken})
+	user := createUser(t, r, "Ada", "ada@example.com")
+	for _, name := range []string{"v1", "v2", "v3", "v4"} {
+		w := serve(r, request{method: http.MethodPatch, path: "/users/" + string(user.ID), body: `{"name":"` + name + `"}`})
+		if w.Code != http.StatusOK {
+			t.Fatalf("patch: status %d: %s", w.Code, w.Body)
+		}
+	}
+	admin := map[string]string{"Authorization": "Bearer " + testAdminToken}
+
+	sources := []struct {
+		name   string
+		path   string
+		header map[string]string
+	}{
+		{"history", "/users/" + string(user.ID) + "/history", nil},
+		{"audit log", "/admin/audit?user_id=" + string(user.ID), admin},
+	}
+	pages := []struct {
+		page      string
+		want      []string
+		wantLinks []string
+	}{
+		{"1", []string{"v4", "v3"}, []string{`rel="first"`, `rel="next"`, `rel="last"`}},
+		{"2", []string{"v2", "v1"}, []string{`rel="first"`, `rel="prev"`, `rel="next"`, `rel="last"`}},
+		{"3", []string{"created"}, []string{`rel="first"`, `rel="prev"`, `rel="last"`}},
+		{"4", nil, []string{`rel="first"`, `rel="prev"`, `rel="last"`}},
+	}
+	for _, src := range sources {
+		for _, p := range pages {
+			t.Run(src.name+", page "+p.page, func(t *testing.T) {
+				sep := "?"
+				if strings.Contains(src.path, "?") {
+					sep = "&"
+				}
+				w := serve(r, request{method: http.MethodGet, path: src.path + sep + "per_page=2&page=" + p.page, header: src.header})
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				if got := w.Header().Get("X-Total-Count"); got != "5" {
+					t.Errorf("X-Total-Count %s, want 5", got)
+				}
+				links := w.Header().Get("Link")
+				if n := strings.Count(links, "rel="); n != len(p.wantLinks) {
+					t.Errorf("Link %s, want %d links", links, len(p.wantLinks))
+				}
+				for _, rel := range p.wantLinks {
+					if !strings.Contains(links, rel) {
+						t.Errorf("Link %s lacks %s", links, rel)
+					}
+				}
+
+				var entries []db.HistoryEntry
+				if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, e := range entries {
+					if e.Type == "created" {
+						got = append(got, e.Type)
+					} else {
+						got = append(got, fmt.Sprint(e.Changes["name"].New))
+					}
+				}
+				if !slices.Equal(got, p.want) {
+					t.Errorf("entries %v, want %v", got, p.want)
+				}
+			})
+		}
+	}
+}
+
+func TestHistoryPageErrors(t *testing.T) {
+	r := newTestRouter(t, nil)
+	user := createUser(t, r, "Ada", "ada@example.com")
+	for _, query := range []string{"page=0", "page=x", "per_page=0", "per_page=501"} {
+		if w := serve(r, request{method: http.MethodGet, path: "/users/" + string(user.ID) + "/history?" + query}); w.Code != http.StatusBadRequest {
+			t.Errorf("?%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	r := newTestRouter(t, nil)
+	for _, name := range []string{"Cy", "ada", "Bob", "Eve", "Dan"} {
+		createUser(t, r, name, strings.ToLower(name)+"@example.com")
+	}
+	deactivated := createUser(t, r, "Fay", "fay@example.com")
+	if w := serve(r, request{method: http.MethodPost, path: "/users/" + string(deactivated.ID) + "/deactivate"}); w.Code != http.StatusOK {
+		t.Fatalf("deactivate: status %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+		total string
+		// rel of each page of the Link header
+		links []string
+	}{
+		{"defaults", "", []string{"Cy", "ada", "Bob", "Eve", "Dan"}, "5", []string{"first", "last"}},
+		{"first page", "?per_page=2", []string{"Cy", "ada"}, "5", []string{"first", "next", "last"}},
+		{"middle page", "?per_page=2&page=2", []string{"Bob", "Eve"}, "5", []string{"first", "prev", "next", "last"}},
+		{"last page", "?per_page=2&page=3", []string{"Dan"}, "5", []string{"first", "prev", "last"}},
+		{"past the last page", "?per_page=2&page=4", []string{}, "5", []string{"first", "prev", "last"}},
+		{"by name", "?sort=name", []string{"ada", "Bob", "Cy", "Dan", "Eve"}, "5", []string{"first", "last"}},
+		{"by name descending", "?sort=-name&per_page=2", []string{"Eve", "Dan"}, "5", []string{"first", "next", "last"}},
+		{"by id descending", "?sort=-id", []string{"Dan", "Eve", "Bob", "ada", "Cy"}, "5", []string{"first", "last"}},
+		{"by email", "?email=BOB@example.com", []string{"Bob"}, "1", []string{"first", "last"}},
+		{"by a name no one has", "?name=Zed", []string{}, "0", []string{"first", "last"}},
+		{"with the inactive", "?include_inactive=true&sort=name", []string{"ada", "Bob", "Cy", "Dan", "Eve", "Fay"}, "6", []string{"first", "last"}},
+		{"filter, sort and page", "?include_inactive=true&sort=-name&per_page=1&page=2&email=fay@example.com", []string{}, "1", []string{"first", "prev", "last"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: "/users" + tt.query})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var users []struct {
+				Name string `json:"name"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, u := range users {
+				got = append(got, u.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("users %v, want %v", got, tt.want)
+			}
+			if total := w.Header().Get("X-Total-Count"); total != tt.total {
+				t.Errorf("X-Total-Count %s, want %s", total, tt.total)
+			}
+			links := w.Header().Get("Link")
+			if n := strings.Count(links, "rel="); n != len(tt.links) {
+				t.Errorf("Link %s, want %d links", links, len(tt.links))
+			}
+			for _, rel := range tt.links {
+				if !strings.Contains(links, `rel="`+rel+`"`) {
+					t.Errorf("Link %s lacks %s", links, rel)
+				}
+			}
+		})
+	}
+}
+
+func TestListUsersErrors(t *testing.T) {
+	r := newTestRouter(t, nil)
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"page=0", "page must be 1 or more"},
+		{"page=x", "page must be 1 or more"},
+		{"per_page=0", "per_page must be between 1 and 500"},
+		{"per_page=501", "per_page must be between 1 and 500"},
+		{"sort=phone", `cannot sort by "phone"`},
+		{"sort=-", `cannot sort by "-"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: "/users?" + tt.query})
+			if w.Code != http.StatusBadRequest || errorMessage(w) != tt.want {
+				t.Errorf("status %d %q, want 400 %q", w.Code, errorMessage(w), tt.want)
+			}
+		})
+	}
+}
+
+// a server-sent event, or a comment when Type is empty
+type sseEvent struct {
+	ID, Type, Data, Comment string
+}
+
+// the next event or comment of a stream
+func nextEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return ev
+		}
+		field, value, _ := strings.Cut(line, ":")
+		switch field {
+		case "":
+			ev.Comment = strings.TrimSpace(value)
+		case "id":
+			ev.ID = value
+		case "event":
+			ev.Type = value
+		case "data":
+			ev.Data = value
+		}
+	}
+}
+
+// open the event stream of srv at query, closed with the test
+func openEvents(t *testing.T, srv *httptest.Server, query string, header map[string]string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+Prefix+"/users/events"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewReader(resp.Body)
+}
+
+func TestUserEvents(t *testing.T) {
+	r := newTestRouter(t, map[string]string{"SSE_HEARTBEAT": "50ms"})
+	// streams ended by the server, to tell a disconnect was noticed
+	ended := make(chan struct{}, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.ServeHTTP(w, req)
+		if strings.HasSuffix(req.URL.Path, "/events") {
+			ended <- struct{}{}
+		}
+	}))
+	// registered first, so it runs once the streams are closed
+	t.Cleanup(srv.Close)
+
+	resp, stream := openEvents(t, srv, "?types=created,deleted", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d as %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if ev := nextEvent(t, stream); ev.Comment != "heartbeat" {
+		t.Fatalf("first of an idle stream %+v, want a heartbeat", ev)
+	}
+
+	user := createUser(t, r, "Ada", "ada@example.com")
+	if w := serve(r, request{method: http.MethodPatch, path: "/users/" + string(user.ID), body: `{"name":"Ada L"}`}); w.Code != http.StatusOK {
+		t.Fatalf("patch: status %d: %s", w.Code, w.Body)
+	}
+	if w := serve(r, request{method: http.MethodDelete, path: "/users/" + string(user.ID)}); w.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+
+	// the update is not of the types asked for
+	var got []events.Event
+	for len(got) < 2 {
+		ev := nextEvent(t, stream)
+		if ev.Comment == "heartbeat" {
+			continue
+		}
+		var e events.Event
+		if err := json.Unmarshal([]byte(ev.Data), &e); err != nil {
+			t.Fatalf("event %+v: %v", ev, err)
+		}
+		if ev.Type != e.Type || ev.ID != strconv.FormatUint(e.ID, 10) {
+			t.Errorf("event %+v with data of %s %d", ev, e.Type, e.ID)
+		}
+		got = append(got, e)
+	}
+	if got[0].Type != events.Created || got[0].User.Name != "Ada" || got[1].Type != events.Deleted || got[1].ID != got[0].ID+2 {
+		t.Errorf("events %+v, want Ada created, then deleted after the update", got)
+	}
+
+	// a client resuming after the create gets what it missed, of every type
+	_, resumed := openEvents(t, srv, "", map[string]string{"Last-Event-ID": strconv.FormatUint(got[0].ID, 10)})
+	for _, want := range []string{events.Updated, events.Deleted} {
+		if ev := nextEvent(t, resumed); ev.Type != want {
+			t.Errorf("resumed with %+v, want %s", ev, want)
+		}
+	}
+
+	// both streams end once their clients go
+	srv.CloseClientConnections()
+	for range 2 {
+		select {
+		case <-ended:
+		case <-time.After(time.Second):
+			t.Fatal("stream still served after its client went")
+		}
+	}
+}
+
+func TestUserEventsErrors(t *testing.T) {
+	r := newTestRouter(t, nil)
+	tests := []struct {
+		name   string
+		query  string
+		header map[string]string
+		want   string
+	}{
+		{"unknown type", "?types=created,renamed", nil, `unknown event type "renamed"`},
+		{"malformed Last-Event-ID", "", map[string]string{"Last-Event-ID": "x"}, "invalid last event id"},
+		{"malformed last_event_id", "?last_event_id=-1", nil, "invalid last event id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, request{method: http.MethodGet, path: "/users/events" + tt.query, header: tt.header})
+			if w.Code != http.StatusBadRequest || errorMessage(w) != tt.want {
+				t.Errorf("status %d %q, want 400 %q", w.Code, errorMessage(w), tt.want)
+			}
+		})
+	}
+}
+
+// with a keyring the data file holds the email and phone encrypted, and the
+// handlers answer them in plaintext, across a rotation of the key too
+func TestEncryptedAtRest(t *testing.T) {
+	key := func(id string, b byte) string {
+		return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+	}
+	specs := []struct {
+		name string
+		keys string
+		// the key id the file is written under once opened
+		active string
+	}{
+		{"first key", key("2024-06", 1), "2024-06"},
+		{"rotated key", key("2025-01", 2) + "," + key("2024-06", 1), "2025-01"},
+		{"old key dropped", key("2025-01", 2), "2025-01"},
+	}
+	r := newTestRouter(t, nil)
+	t.Cleanup(db.Reset)
+	path := filepath.Join(t.TempDir(), "users.json")
+	var id models.ID
+	for n, spec := range specs {
+		t.Run(spec.name, func(t *testing.T) {
+			keys, err := fieldcrypt.Parse(spec.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Reset()
+			if err := db.Open(path, keys); err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				w := serve(r, request{method: http.MethodPost, path: "/users", body: `{"name":"Ada","email":"ada@example.com","phone":"+15550100"}`})
+				if w.Code != http.StatusCreated {
+					t.Fatalf("create: status %d: %s", w.Code, w.Body)
+				}
+				var user models.User
+				if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+					t.Fatal(err)
+				}
+				id = user.ID
+			}
+
+			w := serve(r, request{method: http.MethodGet, path: "/users/" + string(id)})
+			if w.Code != http.StatusOK {
+				t.Fatalf("read: status %d: %s", w.Code, w.Body)
+			}
+			for _, plain := range []string{`"email":"ada@example.com"`, `"phone":"+15550100"`} {
+				if !strings.Contains(w.Body.String(), plain) {
+					t.Errorf("answered %s, want %s", w.Body, plain)
+				}
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, plain := range []string{"ada@example.com", "+15550100"} {
+				if bytes.Contains(data, []byte(plain)) {
+					t.Errorf("%s in plaintext in the data file", plain)
+				}
+			}
+			if !bytes.Contains(data, []byte("enc:"+spec.active+":")) {
+				t.Errorf("data file not encrypted under %s: %s", spec.active, data)
+			}
+			if spec.active != "2024-06" && bytes.Contains(data, []byte("enc:2024-06:")) {
+				t.Errorf("data file still holds values under the old key: %s", data)
+			}
+		})
+	}
+}
+
+func TestUserStats(t *testing.T) {
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   db.Stats
+	}{
+		{"two created", "", "", "", db.Stats{Current: 2, CreatedTotal: 2}},
+		{"delete", http.MethodDelete, "/users/" + string(ada.ID), "", db.Stats{Current: 1, CreatedTotal: 2, DeletedTotal: 1}},
+		{"create after the delete", http.MethodPost, "/users", `{"name":"Cy","email":"cy@example.com"}`, db.Stats{Current: 2, CreatedTotal: 3, DeletedTotal: 1}},
+		{"failed create", http.MethodPost, "/users", `{"name":"Eve","email":"cy@example.com"}`, db.Stats{Current: 2, CreatedTotal: 3, DeletedTotal: 1}},
+		{"restore", http.MethodPost, "/users/" + string(ada.ID) + "/restore", "", db.Stats{Current: 3, CreatedTotal: 3, DeletedTotal: 1}},
+		{"batch create", http.MethodPost, "/users/batch", `[{"name":"Dan","email":"dan@example.com"},{"name":"Eve","email":"eve@example.com"}]`, db.Stats{Current: 5, CreatedTotal: 5, DeletedTotal: 1}},
+		{"delete of the restored user", http.MethodDelete, "/users/" + string(ada.ID), "", db.Stats{Current: 4, CreatedTotal: 5, DeletedTotal: 2}},
+		{"delete of another", http.MethodDelete, "/users/" + string(bob.ID), "", db.Stats{Current: 3, CreatedTotal: 5, DeletedTotal: 3}},
+		{"delete of a deleted user", http.MethodDelete, "/users/" + string(bob.ID), "", db.Stats{Current: 3, CreatedTotal: 5, DeletedTotal: 3}},
+	}
+	var last db.Stats
+	for _, s := range steps {
+		if s.method != "" {
+			serve(r, request{method: s.method, path: s.path, body: s.body})
+		}
+		w := serve(r, request{method: http.MethodGet, path: "/users/stats"})
+		var got db.Stats
+		if err := json.Unmarshal(w.Body.Bytes(), &got); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("%s: status %d, %v", s.name, w.Code, err)
+		}
+		if got != s.want {
+			t.Errorf("%s: stats %+v, want %+v", s.name, got, s.want)
+		}
+		if got.CreatedTotal < last.CreatedTotal || got.DeletedTotal < last.DeletedTotal {
+			t.Errorf("%s: counters went down from %+v to %+v", s.name, last, got)
+		}
+		last = got
+	}
+}
+
+func TestCountUsers(t *testing.T) {
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	bob := createUser(t, r, "Bob", "bob@example.com")
+	createUser(t, r, "Cy", "cy@example.com")
+
+	steps := []struct {
+		name string
+		// a change before the counts, none when empty
+		req request
+		// the counts without and with the soft-deleted users
+		active, all int
+	}{
+		{"created", request{}, 3, 3},
+		{"deactivated, still counted", request{method: http.MethodPost, path: "/users/" + string(bob.ID) + "/deactivate"}, 3, 3},
+		{"deleted", request{method: http.MethodDelete, path: "/users/" + string(ada.ID)}, 2, 3},
+		{"deleted again", request{method: http.MethodDelete, path: "/users/" + string(bob.ID)}, 1, 3},
+		{"restored", request{method: http.MethodPost, path: "/users/" + string(ada.ID) + "/restore"}, 2, 3},
+		{"created after", request{method: http.MethodPost, path: "/users", body: `{"name":"Dan","email":"dan@example.com"}`}, 3, 4},
+	}
+	for _, s := range steps {
+		if s.req.method != "" {
+			if w := serve(r, s.req); w.Code >= 300 {
+				t.Fatalf("%s: status %d: %s", s.name, w.Code, w.Body)
+			}
+		}
+		for _, tt := range []struct {
+			query string
+			want  int
+			// the flag answered
+			deleted bool
+		}{
+			{"", s.active, false},
+			{"?include_deleted=false", s.active, false},
+			{"?include_deleted=true", s.all, true},
+		} {
+			w := serve(r, request{method: http.MethodGet, path: "/users/count" + tt.query})
+			var body struct {
+				Count          int  `json:"count"`
+				IncludeDeleted bool `json:"include_deleted"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); w.Code != http.StatusOK || err != nil {
+				t.Fatalf("%s: count%s: status %d: %s", s.name, tt.query, w.Code, w.Body)
+			}
+			if body.Count != tt.want || body.IncludeDeleted != tt.deleted {
+				t.Errorf("%s: count%s %+v, want %d", s.name, tt.query, body, tt.want)
+			}
+		}
+		// the included count is the size of the store
+		if stored, _ := db.GetUsers(db.UserQuery{IncludeDeleted: true}); len(stored) != s.all {
+			t.Errorf("%s: %d users stored, counted %d", s.name, len(stored), s.all)
+		}
+	}
+}
+
+func TestCompleteness(t *testing.T) {
+	r := newTestRouter(t, nil)
+	// a completeness in the body is computed over, not stored
+	w := serve(r, request{method: http.MethodPost, path: "/users", body: `{"name":"Ada","email":"ada@example.com","completeness":100}`})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	path := "/users/1"
+
+	// the completeness of the user as read and as listed
+	completeness := func() (int, int) {
+		t.Helper()
+		var user struct {
+			Completeness int `json:"completeness"`
+		}
+		json.Unmarshal(serve(r, request{method: http.MethodGet, path: path}).Body.Bytes(), &user)
+		var list []struct {
+			Completeness int `json:"completeness"`
+		}
+		json.Unmarshal(serve(r, request{method: http.MethodGet, path: "/users"}).Body.Bytes(), &list)
+		if len(list) != 1 {
+			t.Fatalf("listed %d users", len(list))
+		}
+		return user.Completeness, list[0].Completeness
+	}
+
+	steps := []struct {
+		name  string
+		patch string
+		want  int
+	}{
+		{"name and email", "", 50},
+		{"a username", `{"username":"ada"}`, 75},
+		{"a phone", `{"phone":"+14155550100"}`, 100},
+		{"a renamed user", `{"name":"Ada L"}`, 100},
+		{"no username", `{"username":""}`, 75},
+		{"no phone", `{"phone":""}`, 50},
+	}
+	for _, s := range steps {
+		if s.patch != "" {
+			w := serve(r, request{method: http.MethodPatch, path: path, body: s.patch})
+			var patched struct {
+				Completeness int `json:"completeness"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &patched); w.Code != http.StatusOK || err != nil {
+				t.Fatalf("%s: status %d: %s", s.name, w.Code, w.Body)
+			}
+			if patched.Completeness != s.want {
+				t.Errorf("%s: answered the completeness %d, want %d", s.name, patched.Completeness, s.want)
+			}
+		}
+		if read, listed := completeness(); read != s.want || listed != s.want {
+			t.Errorf("%s: completeness %d read and %d listed, want %d", s.name, read, listed, s.want)
+		}
+	}
+}
+
+func TestUpdateEventChanges(t *testing.T) {
+	r := newTestRouter(t, nil)
+	ada := createUser(t, r, "Ada", "ada@example.com")
+	path := "/users/" + string(ada.ID)
+	ch, cancel := events.Subscribe()
+	defer cancel()
+
+	steps := []struct {
+		name string
+		req  request
+		// the changes of the update event as sent, none for no event
+		changes string
+	}{
+		{"rename", request{method: http.MethodPatch, path: path, body: `{"name":"Ada L"}`}, `{"name":{"old":"Ada","new":"Ada L"}}`},
+		{"two fields", request{method: http.MethodPatch, path: path, body: `{"username":"ada","priority":2}`}, `{"priority":{"old":0,"new":2},"username":{"old":"","new":"ada"}}`},
+		{"a field and the same value", request{method: http.MethodPatch, path: path, body: `{"name":"Ada L","phone":"+14155550100"}`}, `{"phone":{"old":"","new":"+14155550100"}}`},
+		{"deactivate", request{method: http.MethodPost, path: path + "/deactivate"}, `{"active":{"old":true,"new":false}}`},
+		{"a field cleared", request{method: http.MethodPatch, path: path, body: `{"username":""}`}, `{"username":{"old":"ada","new":""}}`},
+	}
+	for _, s := range steps {
+		if w := serve(r, s.req); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", s.name, w.Code, w.Body)
+		}
+		var ev events.Event
+		select {
+		case ev = <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no event", s.name)
+		}
+		if ev.Type != events.Updated {
+			t.Fatalf("%s: %s event, want an update", s.name, ev.Type)
+		}
+		// the changes as a webhook or stream carries them: updated_at and
+		// version, which move on every write, are left out
+		data, _ := json.Marshal(ev)
+		var sent struct {
+			Changes json.RawMessage `json:"changes"`
+		}
+		json.Unmarshal(data, &sent)
+		if string(sent.Changes) != s.changes {
+			t.Errorf("%s: changes %s, want %s", s.name, sent.Changes, s.changes)
+		}
+	}
+}
+
+func TestSortFields(t *testing.T) {
+	// the fields of models.User tagged sortable:"true"
+	tagged := []string{"created_at", "email", "id", "name", "priority", "updated_at", "username"}
+	if got := slices.Sorted(maps.Keys(models.SortFields)); !slices.Equal(got, tagged) {
+		t.Fatalf("sortable fields %q, want the tagged ones %q", got, tagged)
+	}
+	// untagged fields, and names that are no field
+	untagged := []string{"phone", "active", "-version", "pending_email", "deleted_at", "avatar", "Name", "nope"}
+
+	r := newTestRouter(t, nil)
+	createUser(t, r, "Ada", "ada@example.com")
+	for _, field := range tagged {
+		for _, sort := range []string{field, "-" + field} {
+			if w := serve(r, request{method: http.MethodGet, path: "/users?sort=" + sort}); w.Code != http.StatusOK {
+				t.Errorf("sort by %s: status %d: %s", sort, w.Code, w.Body)
+			}
+		}
+	}
+	for _, sort := range untagged {
+		w := serve(r, request{method: http.MethodGet, path: "/users?sort=" + sort})
+		if want := fmt.Sprintf("cannot sort by %q", sort); w.Code != http.StatusBadRequest || errorMessage(w) != want {
+			t.Errorf("sort by %s: status %d %q, want 400 %q", sort, w.Code, errorMessage(w), want)
+		}
+		if _, err := UserOrder(sort); err == nil {
+			t.Errorf("%s taken as DEFAULT_SORT", sort)
+		}
+	}
+}
+
+func TestSortTieBreaker(t *testing.T) {
+	tests := []struct {
+		name, defaultSort, query string
+		// the users listed by their index in the creates below
+		want []int
+	}{
+		{"by id", "id", "", []int{0, 1, 2, 3, 4, 5}},
+		{"by name", "id", "?sort=name", []int{1, 3, 4, 2, 5, 0}},
+		// ties stay in ascending id order when the field is descending
+		{"by name descending", "id", "?sort=-name", []int{0, 2, 5, 1, 3, 4}},
+		{"by priority", "id", "?sort=priority", []int{1, 2, 4, 0, 3, 5}},
+		{"by priority descending", "id", "?sort=-priority", []int{3, 5, 0, 1, 2, 4}},
+		{"by name by default", "name", "", []int{1, 3, 4, 2, 5, 0}},
+		{"by priority descending by default", "-priority", "", []int{3, 5, 0, 1, 2, 4}},
+		{"?sort= over the default", "name", "?sort=id", []int{0, 1, 2, 3, 4, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t, map[string]string{"DEFAULT_SORT": tt.defaultSort})
+			var ids []models.ID
+			for n, u := range []struct {
+				name     string
+				priority int
+			}{{"Cy", 1}, {"ada", 0}, {"Bob", 0}, {"ADA", 2}, {"Ada", 0}, {"bob", 2}} {
+				body := fmt.Sprintf(`{"name":%q,"email":"user%d@example.com","priority":%d}`, u.name, n, u.priority)
+				w := serve(r, request{method: http.MethodPost, path: "/users", body: body})
+				var user models.User
+				if err := json.Unmarshal(w.Body.Bytes(), &user); w.Code != http.StatusCreated || err != nil {
+					t.Fatalf("create %s: status %d: %s", u.name, w.Code, w.Body)
+				}
+				ids = append(ids, user.ID)
+			}
+			var want []models.ID
+			for _, n := range tt.want {
+				want = append(want, ids[n])
+			}
+
+			// the ids of a listing, whole or a page at a time
+			listed := func(query string) []models.ID {
+				t.Helper()
+				var users []models.User
+				json.Unmarshal(serve(r, request{method: http.MethodGet, path: "/users" + query}).Body.Bytes(), &users)
+				var got []models.ID
+				for _, u := range users {
+					got = append(got, u.ID)
+				}
+				return got
+			}
+			sep := "?"
+			if tt.query != "" {
+				sep = "&"
+			}
+			for read := range 2 {
+				if got := listed(tt.query); !slices.Equal(got, want) {
+					t.Fatalf("read %d: listed %v, want %v", read, got, want)
+				}
+			}
+			var paged []models.ID
+			for page := 1; page <= 3; page++ {
+				paged = append(paged, listed(fmt.Sprintf("%s%spage=%d&per_page=2", tt.query, sep, page))...)
+			}
+			if !slices.Equal(paged, want) {
+				t.Errorf("listed a page at a time %v, want %v", paged, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Package v1 serves version 1 of the api: the handlers of the routes
+// under Prefix and what they share.
+package v1
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"go-api/auth"
+	"go-api/config"
+	"go-api/db"
+	"go-api/dedupe"
+	"go-api/jobs"
+	"go-api/mailer"
+	"go-api/models"
+	"go-api/objectstore"
+	"go-api/webhook"
+)
+
+// Prefix is the path of the routes of version 1 of the api, under
+// BASE_PATH. A v2 gets its own package and prefix, registered next to this
+// one by the router.
+const Prefix = "/api/v1"
+
+// Deps are what the handlers serve from, given to Setup
+type Deps struct {
+	Config config.Config
+	// users read and written by the handlers
+	Store db.Store
+	// target of user backups, nil when no bucket is configured
+	Uploader objectstore.Uploader
+	// issues JWTs at /auth/login, nil unless JWT_SECRET is set
+	Tokens *auth.Signer
+	// checks inbound webhooks, nil unless WEBHOOK_SECRET is set
+	Webhooks *webhook.Verifier
+	// async imports and other background work
+	Jobs *jobs.Registry
+	// recent creates by body, nil unless DEDUPE_WINDOW is set
+	Creates *dedupe.Window
+	// closed once the server starts shutting down, ending event streams
+	ShuttingDown <-chan struct{}
+}
+
+// what the handlers run with, set by Setup
+var (
+	conf         config.Config
+	store        db.Store
+	uploader     objectstore.Uploader
+	tokens       *auth.Signer
+	webhooks     *webhook.Verifier
+	background   *jobs.Registry
+	creates      *dedupe.Window
+	shuttingDown <-chan struct{}
+)
+
+// sender used for user emails, replaceable in tests
+var sender mailer.Sender = mailer.LogSender{}
+
+// Setup gives the handlers what they serve from; call it before Routes
+func Setup(d Deps) {
+	conf, store, uploader = d.Config, d.Store, d.Uploader
+	tokens, webhooks = d.Tokens, d.Webhooks
+	background, creates = d.Jobs, d.Creates
+	shuttingDown = d.ShuttingDown
+	apiDoc = newAPIDoc(d.Config.BasePath + Prefix)
+}
+
+// remember the prefix the route of the request is served under, for the
+// links responses make to other routes
+func ServedUnder(prefix string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("prefix", prefix)
+		c.Next()
+	}
+}
+
+// the prefix of the route of the request, see ServedUnder
+func routePrefix(c *gin.Context) string {
+	if prefix, ok := c.Value("prefix").(string); ok {
+		return prefix
+	}
+	return conf.BasePath + Prefix
+}
+
+// who the request is authenticated as, for the history and audit log:
+// "admin", "user:<id>", or "anonymous" when it is not authenticated
+func Actor(c *gin.Context) string {
+	if id, ok := auth.UserID(c); ok {
+		return userActor(id)
+	}
+	if role := auth.Role(c); role != "" {
+		return role
+	}
+	return "anonymous"
+}
+
+// the actor of the user id, also of email confirmations: their token
+// proves the user holds the mailbox
+func userActor(id models.ID) string {
+	return "user:" + string(id)
+}
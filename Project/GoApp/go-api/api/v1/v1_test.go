@@ -0,0 +1,141 @@
+package v1
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+	"go-api/auth"
+	"go-api/config"
+	"go-api/db"
+	"go-api/dedupe"
+	"go-api/jobs"
+	"go-api/models"
+	"go-api/objectstore"
+	"go-api/webhook"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// the handlers log through the default logger, and the log sender writes
+	// every email to it
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// a router serving the routes at Prefix over an empty store, with the
+// authentication of the main router, for the settings of env on top of the
+// defaults
+func newTestRouter(t *testing.T, env map[string]string) *gin.Engine {
+	t.Helper()
+	return backupRouter(t, env, nil)
+}
+
+// newTestRouter with backups to up, and their route, unless it is nil
+func backupRouter(t *testing.T, env map[string]string, up objectstore.Uploader) *gin.Engine {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	// most tests write without If-Match, the ones about it require it again
+	t.Setenv("REQUIRE_IF_MATCH", "false")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Reset()
+	if err := db.SetUniqueFields(cfg.UniqueFields); err != nil {
+		t.Fatal(err)
+	}
+	models.IDAsString = cfg.IDAsString
+
+	var signer *auth.Signer
+	var creates *dedupe.Window
+	if cfg.DedupeWindow > 0 {
+		creates = dedupe.New(cfg.DedupeWindow)
+	}
+	var webhooks *webhook.Verifier
+	if cfg.WebhookSecret != "" {
+		webhooks = webhook.NewVerifier([]byte(cfg.WebhookSecret), cfg.WebhookTolerance)
+	}
+	r := gin.New()
+	r.Use(apierror.Handler(), DisplayZone, auth.APIKeys(db.APIKeyPrefix, db.Memory{}.AuthenticateAPIKey))
+	if cfg.JWTSecret != "" {
+		signer = auth.NewSigner([]byte(cfg.JWTSecret), cfg.JWTTTL)
+		r.Use(auth.JWT(signer))
+	}
+	Setup(Deps{
+		Config:       cfg,
+		Store:        db.Memory{},
+		Tokens:       signer,
+		Jobs:         jobs.New(cfg.JobTTL),
+		Uploader:     up,
+		Webhooks:     webhooks,
+		Creates:      creates,
+		ShuttingDown: make(chan struct{}),
+	})
+	api := r.Group(Prefix, ServedUnder(Prefix))
+	Routes(cfg, func(method, path, _ string, handlers ...gin.HandlerFunc) {
+		api.Handle(method, path, handlers...)
+	})
+	return r
+}
+
+// a request of a test, with a JSON body unless body is empty
+type request struct {
+	method string
+	path   string
+	body   string
+	header map[string]string
+}
+
+// answer of r to req, its path relative to Prefix
+func serve(r http.Handler, req request) *httptest.ResponseRecorder {
+	var body io.Reader
+	if req.body != "" {
+		body = strings.NewReader(req.body)
+	}
+	hr := httptest.NewRequest(req.method, Prefix+req.path, body)
+	if req.body != "" {
+		hr.Header.Set("Content-Type", gin.MIMEJSON)
+	}
+	for k, v := range req.header {
+		hr.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, hr)
+	return w
+}
+
+// create a user through the api, failing the test unless it is created
+func createUser(t *testing.T, r http.Handler, name, email string) models.User {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"name": name, "email": email})
+	w := serve(r, request{method: http.MethodPost, path: "/users", body: string(body)})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create %s: status %d: %s", email, w.Code, w.Body)
+	}
+	var user models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// the "error" of an error answer
+func errorMessage(w *httptest.ResponseRecorder) string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return body.Error
+}
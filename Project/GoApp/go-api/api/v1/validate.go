@@ -0,0 +1,90 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+	"go-api/models"
+	"go-api/validation"
+)
+
+// rules a user must meet on create and update: the validate tags of
+// models.User, then the limits of the config. Every failing field is listed,
+// a field failing its tags is not checked against the config.
+func CheckUser(user models.User) validation.Errors {
+	errs := validation.Struct(user)
+	if reason := checkPriority(user.Priority); reason != "" {
+		errs = errs.Add("priority", reason)
+	}
+	if reason := checkLength(user.Name, conf.MaxNameLength); reason != "" {
+		errs = errs.Add("name", reason)
+	}
+	if reason := checkLength(user.Email, conf.MaxEmailLength); reason != "" && !errs.Has("email") {
+		errs = errs.Add("email", reason)
+	}
+	if reason := checkEmailDomain(user.Email); reason != "" && !errs.Has("email") {
+		errs = errs.Add("email", reason)
+	}
+	return errs
+}
+
+// answer 422 with every invalid field and why in the "fields" detail, and
+// the same as one message in "error"
+func respondInvalid(c *gin.Context, errs validation.Errors) {
+	apierror.Respond(c, apierror.New(http.StatusUnprocessableEntity, errs.Error()).With("fields", errs))
+}
+
+// lengths are counted in characters, not bytes, so "Zoë" is 3 long
+func checkLength(value string, max int) string {
+	if n := utf8.RuneCountInString(value); n > max {
+		return fmt.Sprintf("must be at most %d characters, got %d", max, n)
+	}
+	return ""
+}
+
+// emails must be in ALLOWED_EMAIL_DOMAINS, when set, and never in
+// DENIED_EMAIL_DOMAINS
+func checkEmailDomain(email string) string {
+	email = strings.TrimSpace(email)
+	if email == "" || (len(conf.AllowedEmailDomains) == 0 && len(conf.DeniedEmailDomains) == 0) {
+		return ""
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	domain = strings.ToLower(domain)
+	for _, pattern := range conf.DeniedEmailDomains {
+		if domainMatches(pattern, domain) {
+			return fmt.Sprintf("domain %q is not allowed", domain)
+		}
+	}
+	if len(conf.AllowedEmailDomains) == 0 {
+		return ""
+	}
+	for _, pattern := range conf.AllowedEmailDomains {
+		if domainMatches(pattern, domain) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("domain %q is not in the allowed domains", domain)
+}
+
+// "example.com" matches only itself, "*.example.com" any subdomain of it
+func domainMatches(pattern, domain string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(domain, "."+suffix)
+	}
+	return domain == pattern
+}
+
+// priorities must stay between 0 and MAX_PRIORITY
+func checkPriority(priority int) string {
+	if priority < 0 || priority > conf.MaxPriority {
+		return fmt.Sprintf("must be between 0 and %d", conf.MaxPriority)
+	}
+	return ""
+}
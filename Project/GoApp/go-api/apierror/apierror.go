@@ -0,0 +1,176 @@
+package apierror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// header a request id is taken from and answered in
+const RequestIDHeader = "X-Request-ID"
+
+// gin context key of the request id, for loggers reading the keys
+const RequestIDKey = "apierror.request_id"
+
+// wait suggested in the Retry-After header of a 503 answer that did not set
+// its own, see config RetryAfter
+var RetryAfter = 5 * time.Second
+
+// request ids a client may choose: short and printable, so they are safe in
+// logs and headers
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Error is an error answered to the client with its status as
+//
+//	{"error": message, "code": code, "details": {...}, "request_id": id}
+//
+// The code is the status text in snake case unless set otherwise, e.g.
+// "not_found", and details are left out when there are none.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Details map[string]any
+}
+
+func New(status int, message string) *Error {
+	return &Error{Status: status, Code: CodeOf(status), Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// With sets a detail of the error and returns it
+func (e *Error) With(key string, value any) *Error {
+	if e.Details == nil {
+		e.Details = map[string]any{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+// CodeOf is the code of errors with status, e.g. "unprocessable_entity"
+func CodeOf(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+type envelope struct {
+	Message   string         `json:"error"`
+	Code      string         `json:"code"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+}
+
+// lift any error to an *Error, other errors being a 500 with their message
+func from(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return New(http.StatusInternalServerError, err.Error())
+}
+
+// SetRetryAfter sets the Retry-After header of a 503 answer to RetryAfter,
+// unless the handler set a wait of its own
+func SetRetryAfter(h http.Header) {
+	if h.Get("Retry-After") == "" {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(RetryAfter.Seconds()))))
+	}
+}
+
+// Respond answers err and aborts the request. A 503 carries a Retry-After
+// so well-behaved clients back off before trying again.
+func Respond(c *gin.Context, err error) {
+	e := from(err)
+	if e.Status == http.StatusServiceUnavailable {
+		SetRetryAfter(c.Writer.Header())
+	}
+	c.AbortWithStatusJSON(e.Status, envelope{Message: e.Message, Code: e.Code, Details: e.Details, RequestID: RequestID(c)})
+}
+
+// Write answers e outside gin, as from a net/http wrapper, with the request
+// id the client sent if any, and a Retry-After like Respond
+func Write(w http.ResponseWriter, r *http.Request, e *Error) {
+	body, _ := json.Marshal(envelope{Message: e.Message, Code: e.Code, Details: e.Details, RequestID: clientID(r)})
+	if e.Status == http.StatusServiceUnavailable {
+		SetRetryAfter(w.Header())
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
+
+// RequestID is the id Handler gave the request
+func RequestID(c *gin.Context) string {
+	return c.GetString(RequestIDKey)
+}
+
+// Handler gives every request an id, the one in its X-Request-ID header
+// when that is a short printable one, and answers it in the same header.
+// When a handler wrote nothing but attached errors with c.Error, the last
+// one is answered; a panic is logged with its stack and answered as a 500
+// without its value.
+func Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := clientID(c.Request)
+		if id == "" {
+			id = newID()
+		}
+		c.Set(RequestIDKey, id)
+		c.Header(RequestIDHeader, id)
+
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			// the server's own way to abort a response
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			slog.Error("panic serving request", "method", c.Request.Method, "path", c.Request.URL.Path, "request_id", id, "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			Respond(c, New(http.StatusInternalServerError, "internal server error"))
+		}()
+
+		c.Next()
+
+		if last := c.Errors.Last(); last != nil && !c.Writer.Written() {
+			Respond(c, last.Err)
+		}
+	}
+}
+
+func clientID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		return ""
+	}
+	return id
+}
+
+func newID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+	"go-api/models"
+)
+
+// roles a caller can have
+const (
+	Admin = "admin"
+	User  = "user"
+)
+
+// gin context keys of the authenticated user id and role
+const (
+	userKey = "auth.user"
+	roleKey = "auth.role"
+)
+
+// KeyLookup resolves an API key to the user it belongs to, for the request
+// ctx is the context of; err is for keys that could not be looked up
+type KeyLookup func(ctx context.Context, key string) (id models.ID, ok bool, err error)
+
+// APIKeys authenticates requests carrying an API key, sent as
+// "Authorization: Bearer <key>" or "X-API-Key: <key>" and recognized by its
+// prefix. Requests without one go through unauthenticated, a key that is
+// wrong or revoked is a 401 and one that could not be looked up a 503. Other bearer tokens, such as the admin token,
+// are left to the routes that take them.
+func APIKeys(prefix string, lookup KeyLookup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("X-API-Key")
+		if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && strings.HasPrefix(bearer, prefix) {
+			key = bearer
+		}
+		if key == "" {
+			c.Next()
+			return
+		}
+		id, ok, err := lookup(c.Request.Context(), key)
+		if err != nil {
+			apierror.Respond(c, apierror.New(http.StatusServiceUnavailable, "api key could not be checked"))
+			return
+		}
+		if !ok {
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			apierror.Respond(c, apierror.New(http.StatusUnauthorized, "invalid api key"))
+			return
+		}
+		c.Set(userKey, id)
+		c.Set(roleKey, User)
+		c.Next()
+	}
+}
+
+// JWT authenticates requests carrying "Authorization: Bearer <jwt>" signed
+// by signer, as the user and role of its claims. Requests without one go
+// through unauthenticated and a bad or expired token is a 401. Bearer
+// values that are not three dot-separated parts, such as API keys and the
+// admin token, are left alone.
+func JWT(signer *Signer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || strings.Count(token, ".") != 2 {
+			c.Next()
+			return
+		}
+		claims, err := signer.Parse(token, time.Now())
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			apierror.Respond(c, apierror.New(http.StatusUnauthorized, err.Error()))
+			return
+		}
+		if claims.Subject != "" {
+			c.Set(userKey, models.ID(claims.Subject))
+		}
+		c.Set(roleKey, claims.Role)
+		c.Next()
+	}
+}
+
+// Required answers 401 to requests that are not authenticated
+func Required() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if Role(c) == "" {
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			apierror.Respond(c, apierror.New(http.StatusUnauthorized, "authentication required"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireRole answers 401 to requests that are not authenticated and 403 to
+// those authenticated with another role
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch Role(c) {
+		case role:
+			c.Next()
+		case "":
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			apierror.Respond(c, apierror.New(http.StatusUnauthorized, "authentication required"))
+		default:
+			apierror.Respond(c, apierror.New(http.StatusForbidden, role+" role required"))
+		}
+	}
+}
+
+// Role reports the role the request is authenticated with, "" when it is
+// not authenticated
+func Role(c *gin.Context) string {
+	role, _ := c.Value(roleKey).(string)
+	return role
+}
+
+// UserID reports the user the request is authenticated as
+func UserID(c *gin.Context) (models.ID, bool) {
+	id, ok := c.Value(userKey).(models.ID)
+	return id, ok
+}
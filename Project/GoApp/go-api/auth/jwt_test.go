@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var issued = time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+
+// a token of header and payload, both JSON, signed by s
+func forge(s *Signer, header, payload string) string {
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return unsigned + "." + s.sign(unsigned)
+}
+
+func TestJWT(t *testing.T) {
+	s := NewSigner([]byte("secret"), time.Hour)
+	token, claims, err := s.Issue("42", User, issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer != Issuer || claims.ExpiresAt != issued.Add(time.Hour).Unix() {
+		t.Fatalf("claims %+v", claims)
+	}
+	head, body, _ := strings.Cut(token, ".")
+	payload, _, _ := strings.Cut(body, ".")
+	// the claims of token, to forge others from
+	valid := `{"iss":"go-api","sub":"42","role":"user","iat":` + strconv.FormatInt(issued.Unix(), 10) +
+		`,"exp":` + strconv.FormatInt(issued.Add(time.Hour).Unix(), 10) + `}`
+
+	tests := []struct {
+		name  string
+		token string
+		at    time.Duration
+		ok    bool
+	}{
+		{"issued", token, 0, true},
+		{"a moment before the expiry", token, time.Hour - time.Second, true},
+		{"expired", token, time.Hour, false},
+		{"signed by another secret", forge(NewSigner([]byte("other"), time.Hour), `{"alg":"HS256","typ":"JWT"}`, valid), 0, false},
+		{"signature changed", token[:len(token)-2] + "AA", 0, false},
+		{"payload changed", head + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"go-api","sub":"42","role":"admin","exp":9999999999}`)) + "." + strings.SplitN(token, ".", 3)[2], 0, false},
+		{"unsigned", head + "." + payload + ".", 0, false},
+		{"alg none", forge(s, `{"alg":"none","typ":"JWT"}`, valid), 0, false},
+		{"alg none, no signature", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + payload + ".", 0, false},
+		{"alg HS512", forge(s, `{"alg":"HS512","typ":"JWT"}`, valid), 0, false},
+		{"forged with the header", forge(s, `{"alg":"HS256","typ":"JWT"}`, valid), 0, true},
+		{"wrong issuer", forge(s, `{"alg":"HS256","typ":"JWT"}`, strings.Replace(valid, `"go-api"`, `"other"`, 1)), 0, false},
+		{"no issuer", forge(s, `{"alg":"HS256","typ":"JWT"}`, strings.Replace(valid, `"iss":"go-api",`, "", 1)), 0, false},
+		{"unknown role", forge(s, `{"alg":"HS256","typ":"JWT"}`, strings.Replace(valid, `"user"`, `"root"`, 1)), 0, false},
+		{"payload not JSON", forge(s, `{"alg":"HS256","typ":"JWT"}`, "nope"), 0, false},
+		{"two parts", head + "." + payload, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := s.Parse(tt.token, issued.Add(tt.at))
+			if tt.ok {
+				if err != nil || claims.Subject != "42" || claims.Role != User {
+					t.Errorf("claims %+v, %v", claims, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrToken) {
+				t.Errorf("claims %+v, error %v, want ErrToken", claims, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// build details, set at link time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// commit and buildTime fall back to what the go command stamped from the
+// checkout, see buildSettings
+var (
+	version   = ""
+	commit    = ""
+	buildTime = ""
+)
+
+// the version set at link time, the module version of go install, or "dev"
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// commit and build time, from the link flags or else from the vcs.revision
+// and vcs.time the go command records when building in a git checkout
+func buildSettings() (string, string) {
+	rev, at := commit, buildTime
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return rev, at
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && rev == "":
+			rev = s.Value
+		case s.Key == "vcs.time" && at == "":
+			at = s.Value
+		}
+	}
+	return rev, at
+}
+
+// what is running, for deploys to check; served at the root as the probes
+func versionHandler(c *gin.Context) {
+	rev, at := buildSettings()
+	c.JSON(http.StatusOK, gin.H{
+		"version":    buildVersion(),
+		"commit":     rev,
+		"build_time": at,
+		"go_version": runtime.Version(),
+	})
+}
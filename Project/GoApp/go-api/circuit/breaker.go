@@ -0,0 +1,120 @@
+package circuit
+
+import (
+	"sync"
+	"time"
+)
+
+// states of a Breaker
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half_open"
+)
+
+// Breaker is a circuit breaker over calls to something that can degrade,
+// such as the store. After threshold failed calls in a row it opens and
+// refuses every call for the cooldown, then lets a single probe through: its
+// success closes the breaker, its failure opens it again.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	trips     int64
+	now       func() time.Time
+}
+
+func New(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, cooldown: cooldown, state: Closed, now: time.Now}
+}
+
+// OpenError is what Do fails with while the breaker refuses calls
+type OpenError struct {
+	wait time.Duration
+}
+
+func (e *OpenError) Error() string { return "circuit breaker open" }
+
+// RetryAfter is how long until the breaker lets a probe through
+func (e *OpenError) RetryAfter() time.Duration { return e.wait }
+
+// State reports the current state, for diagnostics
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == Open && b.now().Sub(b.openedAt) >= b.cooldown {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Trips reports how many times the breaker opened
+func (b *Breaker) Trips() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.trips
+}
+
+// Do makes call unless the breaker refuses it with an *OpenError, and
+// returns its error. failed tells the errors that count against the breaker
+// from those that are the caller's, such as a missing user; a call that
+// panics counts as failed.
+func (b *Breaker) Do(call func() error, failed func(err error) bool) error {
+	probe, wait, ok := b.allow()
+	if !ok {
+		return &OpenError{wait: wait}
+	}
+	failure := true
+	defer func() { b.done(probe, failure) }()
+	err := call()
+	failure = failed(err)
+	return err
+}
+
+// decide whether a call may go through, reporting whether it is the
+// half-open probe and, when refused, how long until the next probe
+func (b *Breaker) allow() (probe bool, wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Closed:
+		return false, 0, true
+	case Open:
+		if left := b.cooldown - b.now().Sub(b.openedAt); left > 0 {
+			return false, left, false
+		}
+		b.state = HalfOpen
+	}
+	if b.probing {
+		return false, b.cooldown, false
+	}
+	b.probing = true
+	return true, 0, true
+}
+
+func (b *Breaker) done(probe, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	switch {
+	case !failed && (probe || b.state == Closed):
+		b.state, b.failures = Closed, 0
+	case failed && probe:
+		b.trip()
+	case failed && b.state == Closed:
+		if b.failures++; b.failures >= b.threshold {
+			b.trip()
+		}
+	}
+}
+
+func (b *Breaker) trip() {
+	b.state, b.openedAt, b.failures = Open, b.now(), 0
+	b.trips++
+}
@@ -0,0 +1,99 @@
+package circuit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("down")
+
+func failed(err error) bool { return errors.Is(err, errDown) }
+
+func TestBreaker(t *testing.T) {
+	// steps: "f" a failing call, "s" a succeeding one, "w" the cooldown
+	// passing; "r" marks a call the breaker should refuse
+	tests := []struct {
+		name      string
+		steps     string
+		wantState string
+		wantTrips int64
+	}{
+		{"closed while calls succeed", "ssss", Closed, 0},
+		{"failures below the threshold", "ffsff", Closed, 0},
+		{"opens at the threshold", "fff", Open, 1},
+		{"refuses while open", "fffrr", Open, 1},
+		{"half open after the cooldown", "fffw", HalfOpen, 1},
+		{"a successful probe closes it", "fffwsss", Closed, 1},
+		{"a failed probe opens it again", "fffwfr", Open, 2},
+		{"counts start again once closed", "fffwsffsff", Closed, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(0, 0)
+			b := New(3, time.Minute)
+			b.now = func() time.Time { return now }
+
+			for i, step := range tt.steps {
+				var calls int
+				var err error
+				switch step {
+				case 'w':
+					now = now.Add(time.Minute)
+					continue
+				case 'f', 'r':
+					err = b.Do(func() error { calls++; return errDown }, failed)
+				case 's':
+					err = b.Do(func() error { calls++; return nil }, failed)
+				}
+				var open *OpenError
+				refused := errors.As(err, &open)
+				if refused != (step == 'r') || refused == (calls == 1) {
+					t.Fatalf("step %d (%c): refused %v after %d calls", i, step, refused, calls)
+				}
+			}
+			if got := b.State(); got != tt.wantState {
+				t.Errorf("state %s, want %s", got, tt.wantState)
+			}
+			if got := b.Trips(); got != tt.wantTrips {
+				t.Errorf("%d trips, want %d", got, tt.wantTrips)
+			}
+		})
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := New(1, time.Minute)
+	b.now = func() time.Time { return now }
+	b.Do(func() error { return errDown }, failed)
+
+	var open *OpenError
+	err := b.Do(func() error { return nil }, failed)
+	if !errors.As(err, &open) || open.RetryAfter() != time.Minute {
+		t.Fatalf("open breaker: %v, want an OpenError to retry after 1m", err)
+	}
+
+	// while the probe runs every other call is refused
+	now = now.Add(time.Minute)
+	b.Do(func() error {
+		if err := b.Do(func() error { return nil }, failed); !errors.As(err, &open) {
+			t.Errorf("call during the probe: %v, want an OpenError", err)
+		}
+		return nil
+	}, failed)
+	if got := b.State(); got != Closed {
+		t.Errorf("state %s after the probe, want closed", got)
+	}
+}
+
+func TestBreakerPanic(t *testing.T) {
+	b := New(1, time.Minute)
+	func() {
+		defer func() { recover() }()
+		b.Do(func() error { panic("boom") }, failed)
+	}()
+	if got := b.State(); got != Open {
+		t.Errorf("state %s after a panicking call, want open", got)
+	}
+}
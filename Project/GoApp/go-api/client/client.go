@@ -0,0 +1,240 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// errors matching the status of an Error with errors.Is
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrInvalid    = errors.New("invalid")
+	ErrStale      = errors.New("stale")
+)
+
+// Error is an error response of the api with its status: the message, code,
+// details and request id of {"error", "code", "details", "request_id"}
+type Error struct {
+	Status    int
+	Message   string
+	Code      string
+	Details   map[string]any
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// Is maps the status to ErrBadRequest, ErrNotFound, ErrConflict, ErrInvalid
+// or ErrStale (412), so callers need not compare statuses
+func (e *Error) Is(target error) bool {
+	switch e.Status {
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusUnprocessableEntity:
+		return target == ErrInvalid
+	case http.StatusPreconditionFailed:
+		return target == ErrStale
+	}
+	return false
+}
+
+// the version of the api the client speaks, under BaseURL
+const apiPrefix = "/api/v1"
+
+// Client calls the user api at BaseURL, e.g. "http://users:8000" or with
+// the BASE_PATH of the server, "http://gateway/api"
+type Client struct {
+	BaseURL string
+	// http.DefaultClient when nil
+	HTTPClient *http.Client
+	// sent as X-API-Key when set
+	APIKey string
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// list the active users, by as many pages of the largest size as they take
+func (c *Client) GetUsers(ctx context.Context) ([]models.User, error) {
+	var users []models.User
+	for page := 1; ; page++ {
+		var batch []models.User
+		path := fmt.Sprintf("/users?page=%d&per_page=%d", page, pagination.MaxLimit)
+		if err := c.do(ctx, http.MethodGet, path, nil, &batch); err != nil {
+			return nil, err
+		}
+		users = append(users, batch...)
+		if len(batch) < pagination.MaxLimit {
+			return users, nil
+		}
+	}
+}
+
+func (c *Client) GetUser(ctx context.Context, id models.ID) (*models.User, error) {
+	var user models.User
+	if err := c.do(ctx, http.MethodGet, "/users/"+url.PathEscape(string(id)), nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// create a user, returning it as stored with its id
+func (c *Client) CreateUser(ctx context.Context, user models.User) (*models.User, error) {
+	var created models.User
+	if err := c.do(ctx, http.MethodPost, "/users", user, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// BulkResult is the outcome of one user of CreateUsers: Status 201 and the
+// stored User, or the status and Error of its rejection
+type BulkResult struct {
+	Index  int          `json:"index"`
+	Status int          `json:"status"`
+	User   *models.User `json:"user,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// create several users in one request, each on its own; the error is for
+// the request as a whole
+func (c *Client) CreateUsers(ctx context.Context, users []models.User) ([]BulkResult, error) {
+	var out struct {
+		Results []BulkResult `json:"results"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/users/bulk", users, &out); err != nil {
+		return nil, err
+	}
+	return out.Results, nil
+}
+
+// replace a user; a new email only shows up as pending_email until confirmed.
+// It fails with ErrStale when the user has changed since user.Version, 0
+// replaces whatever version there is.
+func (c *Client) UpdateUser(ctx context.Context, id models.ID, user models.User) (*models.User, error) {
+	var updated models.User
+	if err := c.send(ctx, http.MethodPut, "/users/"+url.PathEscape(string(id)), ifMatch(user.Version), user, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// change only the given fields of a user, by json name, e.g.
+// map[string]any{"priority": 3}, if it is still at version, as UpdateUser
+func (c *Client) PatchUser(ctx context.Context, id models.ID, version int64, fields map[string]any) (*models.User, error) {
+	var patched models.User
+	if err := c.send(ctx, http.MethodPatch, "/users/"+url.PathEscape(string(id)), ifMatch(version), fields, &patched); err != nil {
+		return nil, err
+	}
+	return &patched, nil
+}
+
+// soft-delete a user if it is still at version, as UpdateUser
+func (c *Client) DeleteUser(ctx context.Context, id models.ID, version int64) error {
+	return c.send(ctx, http.MethodDelete, "/users/"+url.PathEscape(string(id)), ifMatch(version), nil, nil)
+}
+
+// soft-delete several users in one request, returning the ids deleted and
+// the ones that are not users
+func (c *Client) DeleteUsers(ctx context.Context, ids []models.ID) (deleted, notFound []models.ID, err error) {
+	var out struct {
+		Deleted  []models.ID `json:"deleted"`
+		NotFound []models.ID `json:"not_found"`
+	}
+	if err := c.do(ctx, http.MethodDelete, "/users", map[string]any{"ids": ids}, &out); err != nil {
+		return nil, nil, err
+	}
+	return out.Deleted, out.NotFound, nil
+}
+
+// If-Match header of a write made from version, any version for 0
+func ifMatch(version int64) http.Header {
+	if version == 0 {
+		return http.Header{"If-Match": {"*"}}
+	}
+	return http.Header{"If-Match": {fmt.Sprintf(`"%d"`, version)}}
+}
+
+// send body as JSON and decode a 2xx answer into out, or return an *Error
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	return c.send(ctx, method, path, nil, body, out)
+}
+
+// do with header added to the request
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+apiPrefix+path, r)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	// whatever RESPONSE_ENVELOPE the server runs with
+	req.Header.Set("X-Response-Envelope", "false")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		apiErr := &Error{Status: resp.StatusCode}
+		var envelope struct {
+			Error     string         `json:"error"`
+			Code      string         `json:"code"`
+			Details   map[string]any `json:"details"`
+			RequestID string         `json:"request_id"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &envelope) == nil && envelope.Error != "" {
+			apiErr.Message, apiErr.Code = envelope.Error, envelope.Code
+			apiErr.Details, apiErr.RequestID = envelope.Details, envelope.RequestID
+		} else {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,430 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the runtime settings of the api, read from the environment
+type Config struct {
+	// "production" runs gin in release mode, quiet; "test" in test mode;
+	// anything else in debug mode with route and warning output
+	AppEnv string
+	// serialize user ids as JSON strings so javascript clients keep precision
+	IDAsString bool
+	// how new user ids are made: sequential, uuid or ulid
+	IDStrategy string
+	// prefix for every route, e.g. "/api" behind a gateway
+	BasePath string
+	// also serve the routes at their unversioned paths, without /api/v1,
+	// answered with a Sunset header of LegacySunset until they are removed
+	LegacyRoutes bool
+	LegacySunset time.Time
+	// what a trailing slash does: redirect, strict or ignore
+	TrailingSlash string
+	// order of GET /users without ?sort=, e.g. "name" or "-created_at"
+	DefaultSort string
+	// wrap user and user list responses in {"data": ...}
+	ResponseEnvelope bool
+	// where /docs loads the swagger-ui-dist scripts and styles from
+	DocsAssetsURL string
+
+	// address the server listens on, ":8000" unless ADDR or PORT is set
+	Addr string
+	// address of the gRPC UserService, off when empty, and the bearer token
+	// its callers must send, none when empty
+	GRPCAddr  string
+	GRPCToken string
+	// how long a SIGINT or SIGTERM waits for requests and jobs in flight
+	// before the remaining connections are closed
+	ShutdownTimeout time.Duration
+
+	// http server hardening, see newServer in main.go
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// add the request headers to access log lines, sensitive ones redacted
+	LogHeaders bool
+	// log lines as "json" objects or "text" key=value pairs, of LogLevel
+	// and above
+	LogFormat string
+	LogLevel  string
+	// OpenTelemetry collector the spans of requests and store calls are
+	// sent to over OTLP/HTTP, e.g. "http://localhost:4318", no tracing when
+	// empty; ServiceName is the service.name they are reported under
+	OTLPEndpoint string
+	ServiceName  string
+
+	// JSON file keeping the users across restarts, in memory only when empty
+	DataFile string
+	// database keeping the users instead of DataFile, off when DatabaseURL
+	// is empty; the driver is "sqlite" or "pgx" (Postgres)
+	DatabaseDriver string
+	DatabaseURL    string
+	// "id:base64key,..." AES keys encrypting PII in DataFile or the
+	// database, first is active
+	EncryptionKeys string
+	// refuse to start when the store fails its integrity check at boot,
+	// instead of logging the problems
+	StrictIntegrity bool
+	// log each change to DataFile + ".wal" and rewrite DataFile only every
+	// SnapshotEvery changes, instead of on each of them
+	DataWAL       bool
+	SnapshotEvery int
+	// users kept by id in front of the store, no cache when 0, and those
+	// loaded into it at start: "off", "all" or a number of the most
+	// recently created
+	CacheSize   int
+	CacheWarmup string
+
+	// highest priority a user may be given, the lowest is 0
+	MaxPriority int
+
+	// longest name and email accepted, in characters
+	MaxNameLength  int
+	MaxEmailLength int
+
+	// email domains users may have, any when empty, and domains they may not;
+	// "*.example.com" matches the subdomains of example.com
+	AllowedEmailDomains []string
+	DeniedEmailDomains  []string
+
+	// fields, or "+" joined field sets, that must be unique across users
+	UniqueFields []string
+
+	// most items a bulk request may carry: users of a batch or import, ids
+	// of a reorder or touch
+	MaxBatchSize int
+
+	// largest avatar image accepted by a multipart PUT /users/:id
+	MaxAvatarBytes int64
+
+	// largest body of a write, and of a multipart or CSV upload; 0 is no
+	// limit, see middleware.BodyLimit
+	MaxBodyBytes   int64
+	MaxUploadBytes int64
+
+	// endpoint names that are not registered at all, see features
+	DisabledEndpoints []string
+
+	// interval of the keep-alive comment on /users/events
+	SSEHeartbeat time.Duration
+
+	// S3-compatible bucket for POST /users/backup, off when S3Bucket is empty
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Prefix    string
+
+	// extra attempts for store reads failing while it is unavailable, and the
+	// first wait between them, see db.RetryReads
+	ReadRetries      int
+	ReadRetryBackoff time.Duration
+
+	// requests a second and burst allowed per client IP, 0 is off; new
+	// clients start at RateWarmupStart of both, reaching the full limits
+	// after RateWarmup, see middleware.RateLimiter
+	RateLimit       float64
+	RateBurst       int
+	RateWarmup      time.Duration
+	RateWarmupStart float64
+	// proxies whose X-Forwarded-For is the client IP, gin trusts any when empty
+	TrustedProxies []string
+
+	// consecutive store-like failures (500, 503, 504) that open the circuit
+	// breaker, 0 is off, and how long it stays open before a probe
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// hard limit of a request, store calls included, before it answers 503;
+	// 0 is off, see middleware.Watchdog
+	RequestTimeout time.Duration
+
+	// wait suggested to clients in the Retry-After header of 503 responses
+	RetryAfter time.Duration
+
+	// time each /readiness check gets before it counts as failed
+	ReadinessTimeout time.Duration
+
+	// how long an email change confirmation token stays valid
+	EmailTokenTTL time.Duration
+
+	// how long a finished background job stays readable at /jobs/:id
+	JobTTL time.Duration
+
+	// identical creates within this window answer the first user, 0 is off
+	DedupeWindow time.Duration
+
+	// shared secret of inbound webhooks, POST /webhooks is off when empty,
+	// and how far a delivery's timestamp may be from now
+	WebhookSecret    string
+	WebhookTolerance time.Duration
+
+	// HMAC secret of the JWTs POST /auth/login issues, and how long they are
+	// valid. When set, reads of users need a signed-in caller and writes
+	// the admin role; the api is open while it is empty.
+	JWTSecret string
+	JWTTTL    time.Duration
+
+	// answer reads of a user by id only to that user's API keys, with any
+	// other id a 404 like a missing user, so ids cannot be enumerated
+	PrivateReads bool
+
+	// answer 428 to a PUT, PATCH or DELETE of a user without If-Match, so a
+	// client cannot overwrite changes it has not seen; on unless turned off
+	RequireIfMatch bool
+
+	// bearer token of the /admin routes, which are off when it is empty
+	AdminToken string
+	// how long soft-deleted users are kept before /admin/compact purges them
+	CompactAfter time.Duration
+	// most entries kept in the audit log, the oldest going first; 0 keeps
+	// them all
+	AuditMaxEntries int
+}
+
+// values of the file named by CONFIG_FILE, read by Load; the environment
+// wins over them
+var fileValues map[string]string
+
+// load the config from environment variables, then from the KEY=VALUE lines
+// of CONFIG_FILE when it is set, falling back to defaults. Only reading the
+// file can fail. Load is called again on SIGHUP, with the new file contents.
+func Load() (Config, error) {
+	values, err := readFile(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return Config{}, err
+	}
+	fileValues = values
+	return Config{
+		AppEnv:           getString("APP_ENV", "development"),
+		IDAsString:       getBool("ID_AS_STRING", false),
+		IDStrategy:       getString("ID_STRATEGY", "sequential"),
+		BasePath:         basePath(getString("BASE_PATH", "")),
+		LegacyRoutes:     getBool("LEGACY_ROUTES", true),
+		LegacySunset:     getDate("LEGACY_SUNSET", time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)),
+		TrailingSlash:    getString("TRAILING_SLASH", "redirect"),
+		ResponseEnvelope: getBool("RESPONSE_ENVELOPE", false),
+		DefaultSort:      getString("DEFAULT_SORT", "id"),
+		DocsAssetsURL:    strings.TrimSuffix(getString("DOCS_ASSETS_URL", "https://unpkg.com/swagger-ui-dist@5"), "/"),
+
+		Addr:            getString("ADDR", ":"+getString("PORT", "8000")),
+		GRPCAddr:        getString("GRPC_ADDR", ""),
+		GRPCToken:       getString("GRPC_TOKEN", ""),
+		ShutdownTimeout: getDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		ReadTimeout:       getDuration("READ_TIMEOUT", 10*time.Second),
+		ReadHeaderTimeout: getDuration("READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:      getDuration("WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:       getDuration("IDLE_TIMEOUT", 60*time.Second),
+		MaxHeaderBytes:    getInt("MAX_HEADER_BYTES", 1<<20),
+
+		LogHeaders: getBool("LOG_HEADERS", false),
+		LogFormat:  getString("LOG_FORMAT", "json"),
+		LogLevel:   getString("LOG_LEVEL", "info"),
+
+		OTLPEndpoint: getString("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		ServiceName:  getString("OTEL_SERVICE_NAME", "go-api"),
+
+		DataFile:        getString("DATA_FILE", ""),
+		DatabaseDriver:  getString("DATABASE_DRIVER", "sqlite"),
+		DatabaseURL:     getString("DATABASE_URL", ""),
+		EncryptionKeys:  getString("ENCRYPTION_KEYS", ""),
+		StrictIntegrity: getBool("STRICT_INTEGRITY", false),
+		DataWAL:         getBool("DATA_WAL", false),
+		SnapshotEvery:   getInt("SNAPSHOT_EVERY", 1000),
+		CacheSize:       getInt("CACHE_SIZE", 0),
+		CacheWarmup:     getString("CACHE_WARMUP", "off"),
+
+		MaxPriority: getInt("MAX_PRIORITY", 1000),
+
+		MaxNameLength:  getInt("MAX_NAME_LENGTH", 200),
+		MaxEmailLength: getInt("MAX_EMAIL_LENGTH", 254),
+
+		AllowedEmailDomains: getList("ALLOWED_EMAIL_DOMAINS", ""),
+		DeniedEmailDomains:  getList("DENIED_EMAIL_DOMAINS", ""),
+
+		MaxBatchSize: getInt("MAX_BATCH_SIZE", 1000),
+
+		MaxAvatarBytes: int64(getInt("MAX_AVATAR_BYTES", 1<<20)),
+
+		MaxBodyBytes:   int64(getInt("MAX_BODY_BYTES", 1<<20)),
+		MaxUploadBytes: int64(getInt("MAX_UPLOAD_BYTES", 32<<20)),
+
+		UniqueFields:      getList("UNIQUE_FIELDS", "email"),
+		DisabledEndpoints: getList("DISABLED_ENDPOINTS", ""),
+
+		SSEHeartbeat: getDuration("SSE_HEARTBEAT", 15*time.Second),
+
+		S3Endpoint:  getString("S3_ENDPOINT", "https://s3.amazonaws.com"),
+		S3Region:    getString("S3_REGION", "us-east-1"),
+		S3Bucket:    getString("S3_BUCKET", ""),
+		S3AccessKey: getString("S3_ACCESS_KEY", ""),
+		S3SecretKey: getString("S3_SECRET_KEY", ""),
+		S3Prefix:    getString("S3_PREFIX", "backups/"),
+
+		ReadRetries:      getInt("READ_RETRIES", 0),
+		ReadRetryBackoff: getDuration("READ_RETRY_BACKOFF", 50*time.Millisecond),
+
+		RateLimit:       getFloat("RATE_LIMIT", 0),
+		RateBurst:       getInt("RATE_BURST", 20),
+		RateWarmup:      getDuration("RATE_WARMUP", 0),
+		RateWarmupStart: getFloat("RATE_WARMUP_START", 0.1),
+		TrustedProxies:  getList("TRUSTED_PROXIES", ""),
+
+		BreakerThreshold: getInt("BREAKER_THRESHOLD", 0),
+		BreakerCooldown:  getDuration("BREAKER_COOLDOWN", 30*time.Second),
+
+		RequestTimeout: getDuration("REQUEST_TIMEOUT", 0),
+
+		RetryAfter: getDuration("RETRY_AFTER", 5*time.Second),
+
+		ReadinessTimeout: getDuration("READINESS_TIMEOUT", 2*time.Second),
+
+		EmailTokenTTL: getDuration("EMAIL_TOKEN_TTL", 24*time.Hour),
+
+		JobTTL: getDuration("JOB_TTL", time.Hour),
+
+		DedupeWindow: getDuration("DEDUPE_WINDOW", 0),
+
+		WebhookSecret:    getString("WEBHOOK_SECRET", ""),
+		WebhookTolerance: getDuration("WEBHOOK_TOLERANCE", 5*time.Minute),
+
+		JWTSecret: getString("JWT_SECRET", ""),
+		JWTTTL:    getDuration("JWT_TTL", time.Hour),
+
+		PrivateReads: getBool("PRIVATE_READS", false),
+
+		RequireIfMatch: getBool("REQUIRE_IF_MATCH", true),
+
+		AdminToken:      getString("ADMIN_TOKEN", ""),
+		CompactAfter:    getDuration("COMPACT_AFTER", 30*24*time.Hour),
+		AuditMaxEntries: getInt("AUDIT_MAX_ENTRIES", 100000),
+	}, nil
+}
+
+// names of the fields that differ between two configs
+func Changed(old, new Config) []string {
+	var names []string
+	a, b := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			names = append(names, a.Type().Field(i).Name)
+		}
+	}
+	return names
+}
+
+// parse an env file: KEY=VALUE lines, blank ones and "#" comments skipped,
+// an optional "export " in front and quotes around the value dropped. An
+// empty path is no file.
+func readFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: want KEY=VALUE", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, scanner.Err()
+}
+
+func getString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	if v, ok := fileValues[key]; ok {
+		return v
+	}
+	return fallback
+}
+
+func getBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(getString(key, ""))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getInt(key string, fallback int) int {
+	v, err := strconv.Atoi(getString(key, ""))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+func getFloat(key string, fallback float64) float64 {
+	v, err := strconv.ParseFloat(getString(key, ""), 64)
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// durations use time.ParseDuration syntax, e.g. "30s" or "2m"
+func getDuration(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(getString(key, ""))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// dates are YYYY-MM-DD, midnight UTC
+func getDate(key string, fallback time.Time) time.Time {
+	v, err := time.Parse(time.DateOnly, getString(key, ""))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// comma separated values, blanks are dropped
+func getList(key, fallback string) []string {
+	var out []string
+	for _, v := range strings.Split(getString(key, fallback), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// normalize a route prefix to "/prefix", or "" for the root
+func basePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"go-api/models"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// prefix of every API key, so they are told apart from other bearer tokens
+const APIKeyPrefix = "uk_"
+
+// APIKey is what is shown of a user's API key; the key itself is only known
+// to the user
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// on-disk and in-memory form of a key, with the hash of the key
+type storedKey struct {
+	APIKey
+	UserID models.ID `json:"user_id"`
+	Hash   string    `json:"hash"`
+}
+
+// API keys by key id; guarded by the userStore lock and kept in the data file
+var apiKeys = map[string]storedKey{}
+
+// create an API key for the user, returning it in plaintext this once.
+// Keys look like "uk_<id>_<secret>"; only a SHA-256 of the key is stored,
+// which is enough for 256 random bits.
+func CreateAPIKey(userID models.ID, name, by string) (*APIKey, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	keyID := make([]byte, 8)
+	if _, err := rand.Read(keyID); err != nil {
+		return nil, "", err
+	}
+	key := APIKeyPrefix + hex.EncodeToString(keyID) + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	userStore.Lock()
+	defer userStore.Unlock()
+	if indexOf(userID) < 0 {
+		return nil, "", ErrNotFound
+	}
+	cp := begin(userID)
+	stored := storedKey{
+		APIKey: APIKey{ID: hex.EncodeToString(keyID), Name: name, CreatedAt: clock.Now()},
+		UserID: userID,
+		Hash:   hashKey(key),
+	}
+	apiKeys[stored.ID] = stored
+	record(userID, HistoryEntry{Type: APIKeyCreated, Time: stored.CreatedAt, Actor: by, Changes: map[string]models.Change{
+		"api_key": {New: stored.ID},
+	}})
+	if err := cp.commit(userID); err != nil {
+		return nil, "", err
+	}
+	return &stored.APIKey, key, nil
+}
+
+// list the API keys of the user, oldest first
+func APIKeys(userID models.ID) ([]APIKey, error) {
+	userStore.RLock()
+	defer userStore.RUnlock()
+	if indexOf(userID) < 0 {
+		return nil, ErrNotFound
+	}
+	keys := []APIKey{}
+	for _, k := range apiKeys {
+		if k.UserID == userID {
+			keys = append(keys, k.APIKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+// revoke an API key of the user, it stops working right away
+func RevokeAPIKey(userID models.ID, keyID, by string) error {
+	userStore.Lock()
+	defer userStore.Unlock()
+	if indexOf(userID) < 0 {
+		return ErrNotFound
+	}
+	if k, ok := apiKeys[keyID]; !ok || k.UserID != userID {
+		return ErrAPIKeyNotFound
+	}
+	cp := begin(userID)
+	delete(apiKeys, keyID)
+	record(userID, HistoryEntry{Type: APIKeyRevoked, Time: clock.Now(), Actor: by, Changes: map[string]models.Change{
+		"api_key": {Old: keyID},
+	}})
+	if err := cp.commit(userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// the user a plaintext API key belongs to, as long as both the key and an
+// active user are still there
+func AuthenticateAPIKey(key string) (models.ID, bool) {
+	rest, ok := strings.CutPrefix(key, APIKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	keyID, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return "", false
+	}
+	userStore.RLock()
+	defer userStore.RUnlock()
+	k, ok := apiKeys[keyID]
+	if !ok || subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashKey(key))) != 1 {
+		return "", false
+	}
+	if i := indexOf(k.UserID); i < 0 || !userStore.users[i].Active {
+		return "", false
+	}
+	return k.UserID, true
+}
+
+// drop the keys of a user that is deleted; callers hold the lock
+func revokeAPIKeys(userID models.ID) {
+	for id, k := range apiKeys {
+		if k.UserID == userID {
+			delete(apiKeys, id)
+		}
+	}
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,30 @@
+package db
+
+import (
+	"go-api/models"
+)
+
+// image bytes of the avatars by user id, the metadata is on models.User;
+// guarded by the userStore lock and kept in the data file
+var avatars = map[models.ID][]byte{}
+
+// AvatarImage is an avatar to store with an update
+type AvatarImage struct {
+	ContentType string
+	Data        []byte
+}
+
+// get the avatar of the user, nil when it has none
+func GetAvatar(id models.ID) (*AvatarImage, error) {
+	userStore.RLock()
+	defer userStore.RUnlock()
+	i := indexOf(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	meta := userStore.users[i].Avatar
+	if meta == nil {
+		return nil, nil
+	}
+	return &AvatarImage{ContentType: meta.ContentType, Data: avatars[id]}, nil
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"fmt"
+
+	"go-api/events"
+	"go-api/models"
+)
+
+// BatchError reports which user of a batch failed and why
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("user %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// add several users under one lock, with ids from the id generator. Each
+// user is checked against the store and the users before it in the batch.
+//
+// With atomic set the batch behaves like a transaction: the first failure
+// rolls back the users added so far and is returned as a *BatchError, and
+// nothing is stored. Otherwise every valid user is stored and errs holds the
+// error of each user, nil for the stored ones. Either way the users stored
+// are written to the database in one transaction, and all of them are
+// undone with an error wrapping ErrNotSaved when the database refuses one.
+func AddUsers(users []models.User, atomic bool, by string) (added []models.User, errs []error, err error) {
+	userStore.Lock()
+	defer userStore.Unlock()
+
+	cp := begin()
+	start := len(userStore.users)
+	rollback := func() {
+		for _, user := range added {
+			unindexUser(user)
+			delete(userStore.positions, user.ID)
+		}
+		userStore.users = userStore.users[:start]
+	}
+	errs = make([]error, len(users))
+	now := clock.Now()
+	for n, user := range users {
+		user.Normalize()
+		var err error
+		if user.ID, err = idGenerator.NewID(); err != nil {
+			rollback()
+			return nil, nil, err
+		}
+		user.Active = true
+		user.CreatedAt = now
+		user.UpdatedAt = now
+		user.Version = 1
+		user.WelcomedAt = nil
+		user.PendingEmail = ""
+		user.DeletedAt = nil
+		user.DeletedBy = ""
+		user.Avatar = nil
+		if errs[n] = checkUnique(user); errs[n] != nil {
+			if atomic {
+				rollback()
+				return nil, nil, &BatchError{Index: n, Err: errs[n]}
+			}
+			continue
+		}
+		appendUser(user)
+		added = append(added, user)
+	}
+
+	if len(added) == 0 {
+		return added, errs, nil
+	}
+	createdTotal.Add(int64(len(added)))
+	ids := make([]models.ID, len(added))
+	for n, user := range added {
+		ids[n] = user.ID
+	}
+	for _, user := range added {
+		notify(events.Created, user, by)
+	}
+	if err := cp.commit(ids...); err != nil {
+		return nil, nil, err
+	}
+	return added, errs, nil
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+
+	"go-api/models"
+)
+
+func TestAddUsers(t *testing.T) {
+	// ada is stored before each batch
+	batch := []models.User{
+		{Name: "Bob", Email: "bob@example.com"},
+		{Name: "Ada 2", Email: "ADA@example.com"},
+		{Name: "Cy", Email: "cy@example.com"},
+		{Name: "Bob 2", Email: "bob@example.com"},
+	}
+	tests := []struct {
+		name   string
+		atomic bool
+		// the index of the user a failed batch reports
+		failed int
+		// the emails stored, and of each user of the batch whether it failed
+		stored []string
+		errs   []bool
+	}{
+		{"all or nothing", true, 1, []string{"ada@Example.com"}, nil},
+		{"per item", false, 0, []string{"ada@Example.com", "bob@example.com", "cy@example.com"}, []bool{false, true, false, true}},
+	}
+	for _, backend := range []string{"memory", "sqlite"} {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				var conn *sql.DB
+				if backend == "sqlite" {
+					conn = openSQLite(t, nil)
+				} else {
+					Reset()
+					t.Cleanup(Reset)
+				}
+				addTestUser(t, "ada")
+
+				added, errs, err := AddUsers(batch, tt.atomic, "test")
+				var batchErr *BatchError
+				var conflict *ConflictError
+				if tt.atomic {
+					if !errors.As(err, &batchErr) || batchErr.Index != tt.failed || !errors.As(err, &conflict) {
+						t.Fatalf("error %v, want a conflict of user %d", err, tt.failed)
+					}
+					if added != nil {
+						t.Errorf("added %v of a failed batch", added)
+					}
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				for n, want := range tt.errs {
+					if failed := errors.As(errs[n], &conflict); failed != want {
+						t.Errorf("user %d: error %v, want a conflict %v", n, errs[n], want)
+					}
+				}
+
+				check := func(step string) {
+					t.Helper()
+					var emails []string
+					users, _ := GetUsers(UserQuery{})
+					for _, u := range users {
+						emails = append(emails, u.Email)
+					}
+					if !slices.Equal(emails, tt.stored) {
+						t.Errorf("%s: stored %q, want %q", step, emails, tt.stored)
+					}
+					if stats := GetStats(); stats.CreatedTotal != int64(len(tt.stored)) {
+						t.Errorf("%s: %d created, want %d", step, stats.CreatedTotal, len(tt.stored))
+					}
+				}
+				check("stored")
+				if conn != nil {
+					if rows := sqlRows(t, conn); len(rows) != len(tt.stored) {
+						t.Errorf("%d rows, want %d", len(rows), len(tt.stored))
+					}
+					reopenSQL(t, conn, nil)
+					check("reopened")
+				}
+			})
+		}
+	}
+}
+
+func TestAddUsersTransaction(t *testing.T) {
+	conn := openSQLite(t, nil)
+	addTestUser(t, "ada")
+	// a row the store does not know holding the email of the last user: the
+	// database refuses it and the transaction of the batch rolls back
+	if _, err := conn.Exec(`INSERT INTO users (id, email, record) VALUES ('x', 'cy@example.com', '{}')`); err != nil {
+		t.Fatal(err)
+	}
+	batch := []models.User{{Name: "Bob", Email: "bob@example.com"}, {Name: "Cy", Email: "cy@example.com"}}
+	for _, atomic := range []bool{true, false} {
+		if _, _, err := AddUsers(batch, atomic, "test"); !errors.Is(err, ErrNotSaved) {
+			t.Errorf("atomic %v: error %v, want ErrNotSaved", atomic, err)
+		}
+		if n := CountUsers(true); n != 1 {
+			t.Errorf("atomic %v: %d users, want ada alone", atomic, n)
+		}
+		if rows := sqlRows(t, conn); len(rows) != 2 {
+			t.Errorf("atomic %v: %d rows, want ada's and the unknown one", atomic, len(rows))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// Cache is a store with up to size users kept by id in front of it, the
+// least recently read dropped first: GetUser answers from it when it can,
+// and every change made through it drops the users it may have changed,
+// all of them for a change of several. Warm fills it ahead of the first
+// requests.
+type Cache struct {
+	Store
+	size int
+
+	mu    sync.Mutex
+	users map[models.ID]*list.Element
+	// most recently read first, of models.User
+	order *list.List
+	// counts the changes, so a read that raced one does not keep what it
+	// read
+	generation   uint64
+	hits, misses int64
+}
+
+// Cached is store behind a Cache of size users
+func Cached(store Store, size int) *Cache {
+	c := &Cache{size: size, users: map[models.ID]*list.Element{}, order: list.New()}
+	c.Store = Intercept(store, func(ctx context.Context, op Operation, call func(ctx context.Context) error) error {
+		err := call(ctx)
+		if !op.Read {
+			c.drop(op.ID)
+		}
+		return err
+	})
+	return c
+}
+
+func (c *Cache) GetUser(ctx context.Context, id models.ID) (*models.User, error) {
+	c.mu.Lock()
+	if e, ok := c.users[id]; ok {
+		c.order.MoveToFront(e)
+		c.hits++
+		user := e.Value.(models.User).Clone()
+		c.mu.Unlock()
+		return &user, nil
+	}
+	c.misses++
+	generation := c.generation
+	c.mu.Unlock()
+
+	user, err := c.Store.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		c.put(*user)
+	}
+	c.mu.Unlock()
+	return user, nil
+}
+
+// the source is changed too: it is deleted
+func (c *Cache) MergeUsers(ctx context.Context, id, sourceID models.ID, by string) (*models.User, error) {
+	user, err := c.Store.MergeUsers(ctx, id, sourceID, by)
+	c.drop(sourceID)
+	return user, err
+}
+
+// Warm loads the limit most recently created users into the cache, all of
+// them while limit is 0, up to its size, and reports how many it loaded
+func (c *Cache) Warm(ctx context.Context, limit int) (int, error) {
+	if limit <= 0 || limit > c.size {
+		limit = c.size
+	}
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	users, _, err := c.Store.GetUsers(ctx, UserQuery{
+		Less: func(a, b models.User) bool { return a.CreatedAt.After(b.CreatedAt) },
+		Page: pagination.Page{Limit: limit},
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return 0, nil
+	}
+	// the most recent end up read last, the last to be dropped
+	for i := len(users) - 1; i >= 0; i-- {
+		c.put(users[i])
+	}
+	return len(users), nil
+}
+
+// Len reports how many users the cache holds
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// Stats reports the reads of a user the cache answered and those it passed
+// on to the store
+func (c *Cache) Stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// keep user as the most recently read; callers hold c.mu
+func (c *Cache) put(user models.User) {
+	if e, ok := c.users[user.ID]; ok {
+		e.Value = user.Clone()
+		c.order.MoveToFront(e)
+		return
+	}
+	c.users[user.ID] = c.order.PushFront(user.Clone())
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.users, last.Value.(models.User).ID)
+	}
+}
+
+// forget the user id, or every user for ""
+func (c *Cache) drop(id models.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if id == "" {
+		clear(c.users)
+		c.order.Init()
+		return
+	}
+	if e, ok := c.users[id]; ok {
+		c.order.Remove(e)
+		delete(c.users, id)
+	}
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"go-api/models"
+)
+
+func TestCacheDropsChangedUsers(t *testing.T) {
+	Reset()
+	t.Cleanup(Reset)
+	ctx := context.Background()
+	cache := Cached(Memory{}, 10)
+	ada, _ := AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test")
+	bob, _ := AddUser(models.User{Name: "Bob", Email: "bob@example.com"}, "test")
+	if n, err := cache.Warm(ctx, 0); n != 2 || err != nil {
+		t.Fatalf("warmed %d users: %v", n, err)
+	}
+
+	steps := []struct {
+		name   string
+		change func() error
+		// the name of the user id read after the change
+		id   models.ID
+		want string
+	}{
+		{"cached", func() error { return nil }, ada.ID, "Ada"},
+		{"change through the cache", func() error {
+			_, _, err := cache.PatchUser(ctx, ada.ID, func(u *models.User) error { u.Name = "Ada L"; return nil }, 0, "test")
+			return err
+		}, ada.ID, "Ada L"},
+		{"change of another user", func() error {
+			_, err := cache.SetActive(ctx, bob.ID, false, "test")
+			return err
+		}, ada.ID, "Ada L"},
+		{"change of several users", func() error {
+			_, err := cache.TouchUsers(ctx, []models.ID{ada.ID, bob.ID}, "test")
+			return err
+		}, bob.ID, "Bob"},
+		{"merge into another user", func() error {
+			_, err := cache.MergeUsers(ctx, bob.ID, ada.ID, "test")
+			return err
+		}, ada.ID, ""},
+	}
+	for _, step := range steps {
+		if err := step.change(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		user, err := cache.GetUser(ctx, step.id)
+		switch {
+		case step.want == "" && err != ErrNotFound:
+			t.Errorf("%s: read %+v, %v, want the user gone", step.name, user, err)
+		case step.want != "" && (err != nil || user.Name != step.want):
+			t.Errorf("%s: read %+v, %v, want %s", step.name, user, err, step.want)
+		}
+	}
+
+	if hits, misses := cache.Stats(); hits != 2 || misses != 3 {
+		t.Errorf("%d hits and %d misses, want 2 and 3", hits, misses)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	Reset()
+	t.Cleanup(Reset)
+	ctx := context.Background()
+	cache := Cached(Memory{}, 2)
+	var ids []models.ID
+	for _, name := range []string{"a", "b", "c"} {
+		user, _ := AddUser(models.User{Name: name, Email: name + "@example.com"}, "test")
+		ids = append(ids, user.ID)
+	}
+	for _, id := range []models.ID{ids[0], ids[1], ids[0], ids[2]} {
+		cache.GetUser(ctx, id)
+	}
+	// the second user, read least recently, was dropped for the third
+	cache.GetUser(ctx, ids[0])
+	cache.GetUser(ctx, ids[2])
+	cache.GetUser(ctx, ids[1])
+	if hits, misses := cache.Stats(); cache.Len() != 2 || hits != 3 || misses != 4 {
+		t.Errorf("%d users cached after %d hits and %d misses, want 2 after 3 and 4", cache.Len(), hits, misses)
+	}
+}
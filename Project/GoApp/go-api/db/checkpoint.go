@@ -0,0 +1,122 @@
+package db
+
+import "go-api/models"
+
+// state of some users before a change, to put back when the change cannot
+// be saved: every record of them, soft-deleted ones included, their
+// avatars, API keys, email changes and the length of their history, the
+// audit log and the counters
+type checkpoint struct {
+	ids     map[models.ID]bool
+	size    int
+	records map[int]models.User
+	avatars map[models.ID][]byte
+	keys    []storedKey
+	emails  map[models.ID]emailChange
+	history map[models.ID]int
+
+	createdTotal, deletedTotal, purgedID, auditSeq int64
+}
+
+// take a checkpoint of the users ids before changing them; users the change
+// adds go after the last record and need not be named. Callers hold the
+// lock.
+func begin(ids ...models.ID) *checkpoint {
+	cp := &checkpoint{
+		ids:          make(map[models.ID]bool, len(ids)),
+		size:         len(userStore.users),
+		records:      map[int]models.User{},
+		avatars:      map[models.ID][]byte{},
+		emails:       map[models.ID]emailChange{},
+		history:      map[models.ID]int{},
+		createdTotal: createdTotal.Load(),
+		deletedTotal: deletedTotal.Load(),
+		purgedID:     purgedID,
+		auditSeq:     auditSeq,
+	}
+	for _, id := range ids {
+		cp.ids[id] = true
+		if data, ok := avatars[id]; ok {
+			cp.avatars[id] = data
+		}
+		if ch, ok := emailChanges[id]; ok {
+			cp.emails[id] = ch
+		}
+		cp.history[id] = len(history[id])
+	}
+	if len(ids) == 0 {
+		return cp
+	}
+	for i, u := range userStore.users {
+		if cp.ids[u.ID] {
+			cp.records[i] = u.Clone()
+		}
+	}
+	for _, k := range apiKeys {
+		if cp.ids[k.UserID] {
+			cp.keys = append(cp.keys, k)
+		}
+	}
+	return cp
+}
+
+// save the change to the users ids as persist does, putting the state of
+// the checkpoint back when that fails, and publish its events when it does
+// not; callers hold the lock
+func (cp *checkpoint) commit(ids ...models.ID) error {
+	if err := persist(ids...); err != nil {
+		cp.rollback()
+		return err
+	}
+	for _, publish := range unpublished {
+		publish()
+	}
+	unpublished = nil
+	return nil
+}
+
+// undo everything changed since the checkpoint; callers hold the lock
+func (cp *checkpoint) rollback() {
+	// users added since are dropped, ids handed out to them are not reused
+	for _, u := range userStore.users[cp.size:] {
+		delete(history, u.ID)
+	}
+	clear(userStore.users[cp.size:])
+	userStore.users = userStore.users[:cp.size]
+	for i, u := range cp.records {
+		userStore.users[i] = u
+	}
+	for id := range cp.ids {
+		delete(avatars, id)
+		delete(emailChanges, id)
+	}
+	// entries are only added to the history before a change is saved
+	for id, n := range cp.history {
+		if n == 0 {
+			delete(history, id)
+		} else {
+			clear(history[id][n:])
+			history[id] = history[id][:n]
+		}
+	}
+	for id, data := range cp.avatars {
+		avatars[id] = data
+	}
+	for id, ch := range cp.emails {
+		emailChanges[id] = ch
+	}
+	for keyID, k := range apiKeys {
+		if cp.ids[k.UserID] {
+			delete(apiKeys, keyID)
+		}
+	}
+	for _, k := range cp.keys {
+		apiKeys[k.ID] = k
+	}
+	createdTotal.Store(cp.createdTotal)
+	deletedTotal.Store(cp.deletedTotal)
+	purgedID = cp.purgedID
+	dropAuditAfter(cp.auditSeq)
+	unpublished = nil
+	reindex()
+}
@@ -0,0 +1,32 @@
+package db
+
+import "time"
+
+// Clock is where the db package reads the time for timestamps and token
+// expiry; swap it with SetClock to get exact values in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// utcClock keeps every stored timestamp in UTC whatever the clock's zone;
+// responses can still render them in another, see ?tz= in main.go
+type utcClock struct {
+	Clock
+}
+
+func (c utcClock) Now() time.Time {
+	return c.Clock.Now().UTC()
+}
+
+var clock Clock = utcClock{realClock{}}
+
+// replace the clock, not safe while requests are being served
+func SetClock(c Clock) {
+	clock = utcClock{c}
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"go-api/events"
+	"go-api/models"
+)
+
+// a clock standing still until set
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// an empty store reading the time from a fake clock, the real one put back
+// after the test
+func useFakeClock(t *testing.T, now time.Time) *fakeClock {
+	t.Helper()
+	c := &fakeClock{now: now}
+	SetClock(c)
+	Reset()
+	t.Cleanup(func() {
+		SetClock(realClock{})
+		Reset()
+	})
+	return c
+}
+
+func TestTimestamps(t *testing.T) {
+	// a clock in another zone, stored in UTC all the same
+	berlin := time.FixedZone("CET", 3600)
+	c := useFakeClock(t, time.Date(2026, 3, 1, 10, 0, 0, 0, berlin))
+	t0 := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) time.Time { return t0.Add(d) }
+
+	user, err := AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(step string, created, updated time.Time) {
+		t.Helper()
+		got := GetUser(user.ID)
+		if got == nil {
+			t.Fatalf("%s: user gone", step)
+		}
+		if got.CreatedAt != created || got.UpdatedAt != updated {
+			t.Errorf("%s: created at %v, updated at %v, want %v and %v", step, got.CreatedAt, got.UpdatedAt, created, updated)
+		}
+	}
+	if user.CreatedAt != at(0) || user.UpdatedAt != at(0) {
+		t.Errorf("created user at %v, updated at %v, want %v", user.CreatedAt, user.UpdatedAt, at(0))
+	}
+	check("create", at(0), at(0))
+
+	c.advance(time.Minute)
+	if _, _, err := PatchUser(user.ID, func(u *models.User) error { u.Name = "Ada L"; return nil }, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	check("update", at(0), at(time.Minute))
+
+	c.advance(time.Minute)
+	if _, err := SetActive(user.ID, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	check("deactivate", at(0), at(2*time.Minute))
+
+	c.advance(time.Minute)
+	if _, err := TouchUsers([]models.ID{user.ID}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	check("touch", at(0), at(3*time.Minute))
+
+	c.advance(time.Minute)
+	if err := DeleteUser(user.ID, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	c.advance(time.Minute)
+	restored, err := RestoreUser(user.ID, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.DeletedAt != nil {
+		t.Errorf("restored user deleted at %v", restored.DeletedAt)
+	}
+	check("restore", at(0), at(5*time.Minute))
+
+	entries, err := History(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// newest first
+	want := []HistoryEntry{
+		{Type: events.Restored, Time: at(5 * time.Minute)},
+		{Type: events.Deleted, Time: at(4 * time.Minute)},
+		{Type: events.Updated, Time: at(3 * time.Minute)},
+		{Type: events.Updated, Time: at(2 * time.Minute)},
+		{Type: events.Updated, Time: at(time.Minute)},
+		{Type: events.Created, Time: at(0)},
+	}
+	if !slices.EqualFunc(entries, want, func(a, b HistoryEntry) bool { return a.Type == b.Type && a.Time == b.Time }) {
+		t.Errorf("history %+v, want %+v", entries, want)
+	}
+}
+
+func TestEmailChangeExpiry(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	stage := func(name string) (models.ID, string) {
+		t.Helper()
+		user, err := AddUser(models.User{Name: name, Email: name + "@example.com"}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, token, err := PatchUser(user.ID, func(u *models.User) error { u.PendingEmail = name + "@example.org"; return nil }, time.Hour, "test")
+		if err != nil || token == "" {
+			t.Fatalf("staging the email of %s: token %q, %v", name, token, err)
+		}
+		return user.ID, token
+	}
+	ada, adaToken := stage("ada")
+	bob, bobToken := stage("bob")
+
+	// the token holds up to its expiry, not a moment after
+	c.advance(time.Hour)
+	if _, err := ConfirmEmail(ada, adaToken, "test"); err != nil {
+		t.Errorf("confirming at the expiry: %v", err)
+	}
+	c.advance(time.Nanosecond)
+	if _, err := ConfirmEmail(bob, bobToken, "test"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("confirming after the expiry: error %v, want ErrInvalidToken", err)
+	}
+
+	// an expired change to the same address gets a new token
+	_, token, err := PatchUser(bob, func(u *models.User) error { u.PendingEmail = "bob@example.org"; return nil }, time.Hour, "test")
+	if err != nil || token == "" || token == bobToken {
+		t.Fatalf("staging again after the expiry: token %q, %v", token, err)
+	}
+	if user, err := ConfirmEmail(bob, token, "test"); err != nil || user.Email != "bob@example.org" {
+		t.Errorf("confirming the new token: %+v, %v", user, err)
+	}
+}
+
+func TestCompactAge(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	var ids []models.ID
+	for _, name := range []string{"ada", "bob"} {
+		user, err := AddUser(models.User{Name: name, Email: name + "@example.com"}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, user.ID)
+	}
+	if err := DeleteUser(ids[0], 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	c.advance(time.Hour)
+	if err := DeleteUser(ids[1], 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleted exactly the age ago is not older than it
+	if n, err := Compact(time.Hour, "test"); err != nil || n != 0 {
+		t.Errorf("compact at the age: purged %d, %v", n, err)
+	}
+	c.advance(time.Nanosecond)
+	if n, err := Compact(time.Hour, "test"); err != nil || n != 1 {
+		t.Errorf("compact past the age: purged %d, %v, want only the first user", n, err)
+	}
+	if _, err := RestoreUser(ids[1], "test"); err != nil {
+		t.Errorf("restore of the user deleted later: %v", err)
+	}
+	if _, err := RestoreUser(ids[0], "test"); !errors.Is(err, ErrNotDeleted) {
+		t.Errorf("restore of the purged user: error %v, want ErrNotDeleted", err)
+	}
+}
@@ -0,0 +1,43 @@
+package db
+
+import "time"
+
+// highest sequential id purged by Compact, so Sequential never hands it out
+// again; guarded by the userStore lock and kept in the data file
+var purgedID int64
+
+// permanently remove users soft-deleted more than age ago and rewrite the
+// data file, returning how many were removed. Their history goes with them,
+// the audit log keeps it and records the purge by by. When the file cannot
+// be written the users stay removed from memory, the next save drops them
+// from the file, and the error wraps ErrNotSaved.
+func Compact(age time.Duration, by string) (int, error) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	now := clock.Now()
+	cutoff := now.Add(-age)
+	kept := userStore.users[:0]
+	purged := 0
+	for _, u := range userStore.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(cutoff) {
+			if n, ok := u.ID.Int(); ok && n > purgedID {
+				purgedID = n
+			}
+			delete(history, u.ID)
+			delete(avatars, u.ID)
+			appendAudit(AuditEntry{UserID: u.ID, HistoryEntry: HistoryEntry{Type: Purged, Time: now, Actor: by}})
+			purged++
+			continue
+		}
+		kept = append(kept, u)
+	}
+	if purged == 0 {
+		return 0, nil
+	}
+	// clear the tail so purged users are not kept alive by the array
+	clear(userStore.users[len(kept):])
+	userStore.users = kept
+	reposition()
+	lastModified = now
+	return purged, saved(save())
+}
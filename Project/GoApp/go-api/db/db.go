@@ -1,62 +1,544 @@
 package db
 
 import (
-	"sync"
+	"errors"
+	"fmt"
+	"go-api/events"
 	"go-api/models"
+	"go-api/pagination"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
+
+var (
+	ErrNotFound        = errors.New("user not found")
+	ErrAlreadyWelcomed = errors.New("user already welcomed")
+	ErrNotDeleted      = errors.New("no deleted user with this id")
+	ErrStale           = errors.New("user was changed since this version")
+)
+
 var userStore = struct {
 	sync.RWMutex
 	users []models.User
-}{}
+	// position in users of each user not soft-deleted, see indexOf
+	positions map[models.ID]int
+}{positions: map[models.ID]int{}}
+
+// lifetime counters, never decremented
+var (
+	createdTotal atomic.Int64
+	deletedTotal atomic.Int64
+)
+
+// lookups by id found in the positions index and not, see GetIndexStats
+var (
+	indexHits   atomic.Int64
+	indexMisses atomic.Int64
+)
+
+// time of the last mutation, the start of the process until the first one;
+// guarded by the userStore lock and set by persist
+var lastModified = time.Now()
+
+// Stats reports the current store size next to the lifetime counters
+type Stats struct {
+	Current      int   `json:"current"`
+	CreatedTotal int64 `json:"created_total"`
+	DeletedTotal int64 `json:"deleted_total"`
+}
+
+// get the users q selects, soft-deleted ones excluded unless
+// q.IncludeDeleted, and how many match before q.Page is applied. Users returned by the db package are copies the
+// caller may change, see models.User.Clone.
+func GetUsers(q UserQuery) ([]models.User, int) {
+	userStore.RLock()
+	defer userStore.RUnlock()
+	users := make([]models.User, 0, len(userStore.users))
+	for _, user := range userStore.users {
+		if (user.DeletedAt == nil || q.IncludeDeleted) && q.matches(user) {
+			users = append(users, user)
+		}
+	}
+	less := q.Less
+	if less == nil {
+		less = func(a, b models.User) bool { return a.ID.Less(b.ID) }
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return less(users[i], users[j])
+	})
+	total := len(users)
+	if q.Page.Limit > 0 {
+		users = pagination.Apply(users, q.Page)
+	}
+	// only the users answered are copied
+	for i := range users {
+		users[i] = users[i].Clone()
+	}
+	return users, total
+}
 
-// get all users
-func GetUsers() []models.User {
+// get user by id, soft-deleted users are not found
+func GetUser(id models.ID) *models.User {
 	userStore.RLock()
 	defer userStore.RUnlock()
-	return userStore.users
+	if i := indexOf(id); i >= 0 {
+		user := userStore.users[i].Clone()
+		return &user
+	}
+	return nil
 }
 
-// get user by id
-func GetUser(id int) *models.User {
+// count users, soft-deleted ones only when includeDeleted is set
+func CountUsers(includeDeleted bool) int {
 	userStore.RLock()
 	defer userStore.RUnlock()
+	if includeDeleted {
+		return len(userStore.users)
+	}
+	n := 0
 	for _, user := range userStore.users {
-		if user.ID == id {
-			return &user
+		if user.DeletedAt == nil {
+			n++
 		}
-	}	
-	return nil 
+	}
+	return n
 }
 
-// add user
-func AddUser(user models.User) {
+// add user as active with an id from the id generator and return it as
+// stored. String fields are normalized first and it fails with a
+// ConflictError when a unique field is taken.
+func AddUser(user models.User, by string) (*models.User, error) {
+	user.Normalize()
+	user.Active = true
+	user.CreatedAt = clock.Now()
+	user.UpdatedAt = user.CreatedAt
+	user.Version = 1
+	user.WelcomedAt = nil
+	user.PendingEmail = ""
+	user.DeletedAt = nil
+	user.DeletedBy = ""
+	user.Avatar = nil
 	userStore.Lock()
 	defer userStore.Unlock()
-	userStore.users = append(userStore.users, user)
+	var err error
+	if user.ID, err = idGenerator.NewID(); err != nil {
+		return nil, err
+	}
+	if err := checkUnique(user); err != nil {
+		return nil, err
+	}
+	cp := begin()
+	appendUser(user)
+	createdTotal.Add(1)
+	notify(events.Created, user, by)
+	if err := cp.commit(user.ID); err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-// update user
-func UpdateUser(id int, user models.User) bool{
+// update user, fields managed by the server are kept. A non-nil avatar
+// replaces the user's avatar in the same step, so either both or neither
+// are stored. A non-zero user.Version is the version the update was made
+// from and it fails with ErrStale when the user has moved on since. The
+// email is not changed: user.PendingEmail is the address the user asks to
+// change it to, staged in the same write with a token valid for emailTTL,
+// see stageEmail. The token is returned when a new one was made.
+func UpdateUser(id models.ID, user models.User, avatar *AvatarImage, emailTTL time.Duration, by string) (string, error) {
+	user.Normalize()
 	userStore.Lock()
 	defer userStore.Unlock()
+	i := indexOf(id)
+	if i < 0 {
+		return "", ErrNotFound
+	}
+	if user.Version != 0 && user.Version != userStore.users[i].Version {
+		return "", ErrStale
+	}
+	return replaceUser(i, user, avatar, emailTTL, by)
+}
+
+// PatchUser changes the user by calling patch on a copy of it and storing
+// the result as UpdateUser does, all under the lock so concurrent patches of
+// other fields are not lost. An error of patch is returned as is and leaves
+// the user untouched. As with UpdateUser, a patch changes the email by
+// setting PendingEmail, and leaving it alone keeps a pending change.
+func PatchUser(id models.ID, patch func(user *models.User) error, emailTTL time.Duration, by string) (*models.User, string, error) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	i := indexOf(id)
+	if i < 0 {
+		return nil, "", ErrNotFound
+	}
+	user := userStore.users[i].Clone()
+	if err := patch(&user); err != nil {
+		return nil, "", err
+	}
+	user.Normalize()
+	token, err := replaceUser(i, user, nil, emailTTL, by)
+	if err != nil {
+		return nil, "", err
+	}
+	patched := userStore.users[i].Clone()
+	return &patched, token, nil
+}
+
+// store user as the new version of userStore.users[i], keeping the fields
+// managed by the server and staging its pending email, in one write and
+// one version; callers hold the lock
+func replaceUser(i int, user models.User, avatar *AvatarImage, emailTTL time.Duration, by string) (string, error) {
+	u := userStore.users[i]
+	user.ID = u.ID
+	user.Email = u.Email
+	user.WelcomedAt = u.WelcomedAt
+	user.Active = u.Active
+	user.CreatedAt = u.CreatedAt
+	user.Version = u.Version
+	now := clock.Now()
+	touch(&user, now)
+	user.DeletedAt = nil
+	user.DeletedBy = ""
+	user.Avatar = u.Avatar
+	if err := checkUnique(user); err != nil {
+		return "", err
+	}
+	cp := begin(u.ID)
+	token, err := stageEmail(&user, emailTTL, now)
+	if err != nil {
+		cp.rollback()
+		return "", err
+	}
+	if avatar != nil {
+		user.Avatar = &models.Avatar{ContentType: avatar.ContentType, Size: len(avatar.Data), UpdatedAt: user.UpdatedAt}
+		avatars[u.ID] = avatar.Data
+	}
+	userStore.users[i] = user
+	unindexUser(u)
+	indexUser(user)
+	notifyUpdate(u, user, by)
+	if err := cp.commit(u.ID); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// soft-delete user: the record stays in the store marked with deleted_at
+// and is hidden from every other function. A non-zero version must be the
+// version of the user, else it fails with ErrStale.
+func DeleteUser(id models.ID, version int64, by string) error {
+	userStore.Lock()
+	defer userStore.Unlock()
+	i := indexOf(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	if version != 0 && version != userStore.users[i].Version {
+		return ErrStale
+	}
+	cp := begin(id)
+	softDelete(i, clock.Now(), by)
+	notify(events.Deleted, userStore.users[i], by)
+	if err := cp.commit(id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// soft-delete several users under one lock and in one write, so the batch
+// is saved, to a single transaction with SQL, and announced together. It
+// returns the ids deleted in the order given, unknown and repeated ones left
+// out.
+func DeleteUsers(ids []models.ID, by string) ([]models.ID, error) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	cp := begin(ids...)
+	now := clock.Now()
+	deleted := []models.ID{}
+	var positions []int
+	for _, id := range ids {
+		i := indexOf(id)
+		if i < 0 {
+			continue
+		}
+		softDelete(i, now, by)
+		deleted = append(deleted, id)
+		positions = append(positions, i)
+	}
+	if len(deleted) == 0 {
+		return deleted, nil
+	}
+	for _, i := range positions {
+		notify(events.Deleted, userStore.users[i], by)
+	}
+	if err := cp.commit(deleted...); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// undo the soft delete of the user, which must not have been purged by
+// Compact. It fails with a ConflictError when a unique field was taken
+// meanwhile. API keys revoked by the delete stay revoked.
+func RestoreUser(id models.ID, by string) (*models.User, error) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	i := -1
+	for n, u := range userStore.users {
+		if u.ID == id && u.DeletedAt != nil {
+			i = n
+			break
+		}
+	}
+	if i < 0 {
+		return nil, ErrNotDeleted
+	}
+	if err := checkUnique(userStore.users[i]); err != nil {
+		return nil, err
+	}
+	cp := begin(id)
+	userStore.users[i].DeletedAt = nil
+	userStore.users[i].DeletedBy = ""
+	touch(&userStore.users[i], clock.Now())
+	userStore.positions[id] = i
+	indexUser(userStore.users[i])
+	notify(events.Restored, userStore.users[i], by)
+	if err := cp.commit(id); err != nil {
+		return nil, err
+	}
+	user := userStore.users[i].Clone()
+	return &user, nil
+}
+
+// record a change to u made at now: a new updated_at and the next version;
+// callers hold the lock
+func touch(u *models.User, now time.Time) {
+	u.UpdatedAt = now
+	u.Version++
+}
+
+// mark the user at i deleted at now by by, dropping what only a live user
+// has; callers hold the lock and persist
+func softDelete(i int, now time.Time, by string) {
+	unindexUser(userStore.users[i])
+	delete(userStore.positions, userStore.users[i].ID)
+	userStore.users[i].DeletedAt = &now
+	userStore.users[i].DeletedBy = by
+	userStore.users[i].PendingEmail = ""
+	delete(emailChanges, userStore.users[i].ID)
+	revokeAPIKeys(userStore.users[i].ID)
+	deletedTotal.Add(1)
+}
+
+// time of the last change to any user
+func LastModified() time.Time {
+	userStore.RLock()
+	defer userStore.RUnlock()
+	return lastModified
+}
+
+// check the store can be used: it blocks while the lock is held and fails
+// while changes cannot be saved to the data file or the database, or the
+// database does not answer
+func Ping() error {
+	userStore.RLock()
+	conn, err := sqlDB, saveErr
+	if err != nil {
+		err = fmt.Errorf("saving to %s: %w", storage(), err)
+	}
+	userStore.RUnlock()
+	if err == nil && conn != nil {
+		err = conn.Ping()
+	}
+	return err
+}
+
+// get user counts
+func GetStats() Stats {
+	return Stats{
+		Current:      CountUsers(false),
+		CreatedTotal: createdTotal.Load(),
+		DeletedTotal: deletedTotal.Load(),
+	}
+}
+
+// IndexStats counts the lookups of users by id since the start, by whether
+// the id was in the index
+type IndexStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+func GetIndexStats() IndexStats {
+	return IndexStats{Hits: indexHits.Load(), Misses: indexMisses.Load()}
+}
+
+// position of the user in the store or -1, soft-deleted users are skipped;
+// callers hold the lock
+func indexOf(id models.ID) int {
+	i, ok := userStore.positions[id]
+	if !ok {
+		indexMisses.Add(1)
+		return -1
+	}
+	indexHits.Add(1)
+	return i
+}
+
+// add a new user at the end of the store and to the indexes; callers hold
+// the lock
+func appendUser(user models.User) {
+	userStore.users = append(userStore.users, user)
+	if user.DeletedAt == nil {
+		if _, ok := userStore.positions[user.ID]; !ok {
+			userStore.positions[user.ID] = len(userStore.users) - 1
+		}
+	}
+	indexUser(user)
+}
+
+// rebuild the positions from the store, after users moved; the first live
+// record wins in a store with an id twice, see CheckIntegrity. Callers hold
+// the lock.
+func reposition() {
+	userStore.positions = make(map[models.ID]int, len(userStore.users))
 	for i, u := range userStore.users {
-		if u.ID == id {
-			userStore.users[i] = user
-			return true
+		if _, ok := userStore.positions[u.ID]; !ok && u.DeletedAt == nil {
+			userStore.positions[u.ID] = i
+		}
+	}
+}
+
+// mark user as welcomed, fails if the welcome was already recorded
+func MarkWelcomed(id models.ID, by string) (*models.User, error) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	i := indexOf(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	if userStore.users[i].WelcomedAt != nil {
+		return nil, ErrAlreadyWelcomed
+	}
+	cp := begin(id)
+	old := userStore.users[i]
+	at := clock.Now()
+	userStore.users[i].WelcomedAt = &at
+	touch(&userStore.users[i], at)
+	user := userStore.users[i].Clone()
+	notifyUpdate(old, user, by)
+	if err := cp.commit(id); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// clear the welcome mark, used when sending the email failed
+func UnmarkWelcomed(id models.ID, by string) error {
+	userStore.Lock()
+	defer userStore.Unlock()
+	i := indexOf(id)
+	if i < 0 {
+		return nil
+	}
+	cp := begin(id)
+	old := userStore.users[i]
+	userStore.users[i].WelcomedAt = nil
+	touch(&userStore.users[i], clock.Now())
+	notifyUpdate(old, userStore.users[i], by)
+	if err := cp.commit(id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// activate or deactivate user, setting the current state again is a no-op
+func SetActive(id models.ID, active bool, by string) (*models.User, error) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	i := indexOf(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	if old := userStore.users[i]; old.Active != active {
+		cp := begin(id)
+		userStore.users[i].Active = active
+		touch(&userStore.users[i], clock.Now())
+		notifyUpdate(old, userStore.users[i], by)
+		if err := cp.commit(id); err != nil {
+			return nil, err
+		}
+	}
+	user := userStore.users[i].Clone()
+	return &user, nil
+}
+
+// give the users priorities 1, 2, 3... in the order of ids, all at once or
+// not at all when an id is unknown or repeated
+func Reorder(ids []models.ID, by string) error {
+	userStore.Lock()
+	defer userStore.Unlock()
+	positions := make([]int, len(ids))
+	seen := map[models.ID]bool{}
+	for n, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("user %s listed twice", id)
 		}
+		seen[id] = true
+		if positions[n] = indexOf(id); positions[n] < 0 {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+	}
+	cp := begin(ids...)
+	now := clock.Now()
+	old := make([]models.User, len(positions))
+	for n, i := range positions {
+		old[n] = userStore.users[i]
+		userStore.users[i].Priority = n + 1
+		touch(&userStore.users[i], now)
+	}
+	for n, i := range positions {
+		notifyUpdate(old[n], userStore.users[i], by)
+	}
+	if err := cp.commit(ids...); err != nil {
+		return err
 	}
-	return false
+	return nil
 }
 
-// delete user
-func DeleteUser(id int) bool {
+// bump updated_at and the version of the users, and so their ETags, without
+// changing anything else or checking them. It returns the ids touched in the
+// order given, unknown and repeated ones left out, and publishes an update
+// with no changes for each so caches drop them.
+func TouchUsers(ids []models.ID, by string) ([]models.ID, error) {
 	userStore.Lock()
 	defer userStore.Unlock()
-	for i, user := range userStore.users {
-		if user.ID == id {
-			userStore.users = append(userStore.users[:i], userStore.users[i+1:]...)
-			return true
+	cp := begin(ids...)
+	now := clock.Now()
+	touched := []models.ID{}
+	var old []models.User
+	var positions []int
+	seen := map[models.ID]bool{}
+	for _, id := range ids {
+		i := indexOf(id)
+		if i < 0 || seen[id] {
+			continue
 		}
+		seen[id] = true
+		old = append(old, userStore.users[i])
+		touch(&userStore.users[i], now)
+		touched = append(touched, id)
+		positions = append(positions, i)
 	}
-	return false
-}
\ No newline at end of file
+	if len(touched) == 0 {
+		return touched, nil
+	}
+	for n, i := range positions {
+		notifyUpdate(old[n], userStore.users[i], by)
+	}
+	if err := cp.commit(touched...); err != nil {
+		return nil, err
+	}
+	return touched, nil
+}
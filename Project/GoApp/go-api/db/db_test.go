@@ -0,0 +1,102 @@
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go-api/models"
+)
+
+// the ids GetUsers lists with no order asked for
+func listedIDs(q UserQuery) []models.ID {
+	users, _ := GetUsers(q)
+	ids := []models.ID{}
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+func TestGetUsersOrder(t *testing.T) {
+	for _, backend := range []string{"memory", "sqlite"} {
+		t.Run(backend, func(t *testing.T) {
+			var conn *sql.DB
+			if backend == "sqlite" {
+				conn = openSQLite(t, nil)
+			} else {
+				Reset()
+				t.Cleanup(Reset)
+			}
+			// past 9, so string order would put 10 before 2
+			var ids []models.ID
+			for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"} {
+				ids = append(ids, addTestUser(t, name).ID)
+			}
+			for _, n := range []int{0, 4, 9} {
+				if err := DeleteUser(ids[n], 0, "test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := RestoreUser(ids[4], "test"); err != nil {
+				t.Fatal(err)
+			}
+			// ULIDs come after the numbers, in the order they were made
+			SetIDGenerator(&ULID{})
+			t.Cleanup(func() { SetIDGenerator(Sequential{}) })
+			ulids := []models.ID{addTestUser(t, "m").ID, addTestUser(t, "n").ID}
+
+			want := append(slices.Concat(ids[1:9], ids[10:]), ulids...)
+			for read := range 3 {
+				if got := listedIDs(UserQuery{}); !slices.Equal(got, want) {
+					t.Fatalf("read %d: listed %v, want %v", read, got, want)
+				}
+			}
+			// rows load in no particular order
+			if conn != nil {
+				reopenSQL(t, conn, nil)
+				if got := listedIDs(UserQuery{}); !slices.Equal(got, want) {
+					t.Fatalf("reopened: listed %v, want %v", got, want)
+				}
+			}
+			all := append(slices.Concat(ids[:9], ids[10:]), ulids...)
+			all = slices.Insert(all, 9, ids[9])
+			if got := listedIDs(UserQuery{IncludeDeleted: true}); !slices.Equal(got, all) {
+				t.Errorf("listed with the deleted %v, want %v", got, all)
+			}
+		})
+	}
+}
+
+func TestGetUsersOrderOfAFile(t *testing.T) {
+	Reset()
+	t.Cleanup(Reset)
+	// a file written by hand or by an older version, out of id order
+	path := filepath.Join(t.TempDir(), "users.json")
+	data := `{"users":[
+		{"id":"10","name":"j","email":"j@example.com"},
+		{"id":"2","name":"b","email":"b@example.com"},
+		{"id":"01J0000000000000000000000A","name":"u","email":"u@example.com"},
+		{"id":"1","name":"a","email":"a@example.com"}
+	]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Open(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []models.ID{"1", "2", "10", "01J0000000000000000000000A"}
+	if got := listedIDs(UserQuery{}); !slices.Equal(got, want) {
+		t.Errorf("listed %v, want %v", got, want)
+	}
+	// a new user follows the highest number, the store appends it
+	if user := addTestUser(t, "k"); user.ID != "11" {
+		t.Fatalf("new user %s, want 11", user.ID)
+	}
+	want = slices.Insert(want, 3, "11")
+	if got := listedIDs(UserQuery{}); !slices.Equal(got, want) {
+		t.Errorf("listed %v after a create, want %v", got, want)
+	}
+}
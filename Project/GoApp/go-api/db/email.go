@@ -0,0 +1,160 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"go-api/models"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// email changes waiting for confirmation, keyed by user id and guarded by
+// the userStore lock; saved with the users, see storedEmailChange
+var emailChanges = map[models.ID]emailChange{}
+
+type emailChange struct {
+	email string
+	// SHA-256 of the token, as for API keys
+	hash    string
+	expires time.Time
+}
+
+// on-disk form of an email change, kept with its user: the address is the
+// user's pending email, so it is encrypted with it
+type storedEmailChange struct {
+	TokenHash string    `json:"token_hash"`
+	Expires   time.Time `json:"expires"`
+}
+
+// the email change of the user to save, nil for none; callers hold the lock
+func storedEmailChangeOf(id models.ID) *storedEmailChange {
+	ch, ok := emailChanges[id]
+	if !ok {
+		return nil
+	}
+	return &storedEmailChange{TokenHash: ch.hash, Expires: ch.expires}
+}
+
+// put back the email change of the loaded user u from its saved form;
+// callers hold the lock
+func loadEmailChange(u models.User, stored *storedEmailChange) {
+	if stored == nil || u.PendingEmail == "" {
+		delete(emailChanges, u.ID)
+		return
+	}
+	emailChanges[u.ID] = emailChange{email: u.PendingEmail, hash: stored.TokenHash, expires: stored.Expires}
+}
+
+// clear the pending email of loaded users without a saved change, as in
+// files written before changes were saved: no token can confirm it. It
+// returns how many there were; callers hold the lock.
+func dropUnconfirmable() int {
+	n := 0
+	for i, u := range userStore.users {
+		if _, ok := emailChanges[u.ID]; u.PendingEmail != "" && !ok {
+			userStore.users[i].PendingEmail = ""
+			n++
+		}
+	}
+	return n
+}
+
+// stage the email change user asks for with PendingEmail, user being the
+// new version of a stored one: an address other than its email gets a new
+// token valid for ttl, unless an unexpired change to the same address is
+// pending, and "" or its own email drops the pending change. It returns the
+// new token, if any, and fails with a ConflictError when the address is
+// taken. Callers hold the lock and have taken a checkpoint of the user.
+func stageEmail(user *models.User, ttl time.Duration, now time.Time) (string, error) {
+	email := strings.TrimSpace(user.PendingEmail)
+	if email == "" || email == user.Email {
+		user.PendingEmail = ""
+		delete(emailChanges, user.ID)
+		return "", nil
+	}
+	user.PendingEmail = email
+	if ch, ok := emailChanges[user.ID]; ok && ch.email == email && now.Before(ch.expires) {
+		return "", nil
+	}
+	pending := *user
+	pending.Email = email
+	if err := checkUnique(pending); err != nil {
+		return "", err
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	emailChanges[user.ID] = emailChange{email: email, hash: hashKey(token), expires: now.Add(ttl)}
+	return token, nil
+}
+
+// drop the pending email change of the user, if any, as when the
+// confirmation could not be sent
+func CancelEmailChange(id models.ID, by string) error {
+	userStore.Lock()
+	defer userStore.Unlock()
+	cp := begin(id)
+	delete(emailChanges, id)
+	i := indexOf(id)
+	if i < 0 {
+		return nil
+	}
+	old := userStore.users[i]
+	userStore.users[i].PendingEmail = ""
+	touch(&userStore.users[i], clock.Now())
+	unindexUser(old)
+	indexUser(userStore.users[i])
+	notifyUpdate(old, userStore.users[i], by)
+	if err := cp.commit(id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// promote the pending email to the user's email when the token matches
+func ConfirmEmail(id models.ID, token, by string) (*models.User, error) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	i := indexOf(id)
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	ch, ok := emailChanges[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(ch.hash), []byte(hashKey(token))) != 1 || clock.Now().After(ch.expires) {
+		return nil, ErrInvalidToken
+	}
+	// the address may have been taken since the change was requested
+	confirmed := userStore.users[i]
+	confirmed.Email = ch.email
+	if err := checkUnique(confirmed); err != nil {
+		return nil, err
+	}
+	cp := begin(id)
+	delete(emailChanges, id)
+	old := userStore.users[i]
+	userStore.users[i].Email = ch.email
+	userStore.users[i].PendingEmail = ""
+	touch(&userStore.users[i], clock.Now())
+	unindexUser(old)
+	indexUser(userStore.users[i])
+	user := userStore.users[i].Clone()
+	notifyUpdate(old, user, by)
+	if err := cp.commit(id); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-api/models"
+)
+
+// stage a new email of a user created in the store opened at path, then
+// reopen it as after a restart and return the user and the token
+func stageAndReopen(t *testing.T, path string, wal bool) (models.ID, string) {
+	t.Helper()
+	open := func() {
+		if err := Open(path, nil); err != nil {
+			t.Fatal(err)
+		}
+		if wal {
+			if err := UseWAL(100); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	Reset()
+	t.Cleanup(Reset)
+	open()
+	user, err := AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.PendingEmail = "lovelace@example.com"
+	token, err := UpdateUser(user.ID, *user, nil, time.Hour, "test")
+	if err != nil || token == "" {
+		t.Fatalf("staging the email: token %q, %v", token, err)
+	}
+	Reset()
+	open()
+	return user.ID, token
+}
+
+func TestEmailChangeSurvivesARestart(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		name := "data file"
+		if wal {
+			name = "write-ahead log"
+		}
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			id, token := stageAndReopen(t, path, wal)
+
+			if got := GetUser(id); got == nil || got.PendingEmail != "lovelace@example.com" {
+				t.Fatalf("reopened user %+v, want the email pending", got)
+			}
+			if _, err := ConfirmEmail(id, "not-the-token", "test"); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("wrong token: error %v, want ErrInvalidToken", err)
+			}
+			user, err := ConfirmEmail(id, token, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Email != "lovelace@example.com" || user.PendingEmail != "" {
+				t.Errorf("confirmed %q with %q pending", user.Email, user.PendingEmail)
+			}
+		})
+	}
+}
+
+func TestEmailChangeTokenNotSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	_, token := stageAndReopen(t, path, false)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.EmailChanges) != 1 {
+		t.Fatalf("%d email changes saved, want 1", len(snap.EmailChanges))
+	}
+	for _, ch := range snap.EmailChanges {
+		if ch.TokenHash != hashKey(token) {
+			t.Errorf("saved %q, want the hash of the token", ch.TokenHash)
+		}
+	}
+}
+
+// a data file written before email changes were saved has pending emails
+// that nothing can confirm any more
+func TestPendingEmailWithoutAChangeIsDropped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	data, _ := json.Marshal(snapshot{Users: []models.User{
+		{ID: "1", Name: "Ada", Email: "ada@example.com", PendingEmail: "lovelace@example.com", Version: 2},
+	}, CreatedTotal: 1})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	Reset()
+	t.Cleanup(Reset)
+	if err := Open(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := GetUser("1"); got == nil || got.PendingEmail != "" {
+		t.Errorf("loaded %+v, want no pending email", got)
+	}
+}
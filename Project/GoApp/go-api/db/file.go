@@ -0,0 +1,332 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go-api/fieldcrypt"
+	"go-api/models"
+)
+
+// file persistence, off while dataFile is empty; guarded by the userStore lock
+var (
+	dataFile string
+	keyring  *fieldcrypt.Keyring
+	// error of the last save, reported by Ping until a save succeeds
+	saveErr error
+)
+
+// ErrNotSaved is wrapped by the errors of changes that could not be written
+// to the data file or the database, see persist
+var ErrNotSaved = errors.New("change not saved")
+
+// on-disk form of the store
+type snapshot struct {
+	Users        []models.User `json:"users"`
+	CreatedTotal int64         `json:"created_total"`
+	DeletedTotal int64         `json:"deleted_total"`
+	PurgedID     int64         `json:"purged_id,omitempty"`
+	// avatar images by user id, base64 in the file
+	Avatars map[models.ID][]byte `json:"avatars,omitempty"`
+	// hashed API keys by key id
+	APIKeys map[string]storedKey `json:"api_keys,omitempty"`
+	// pending email changes by user id
+	EmailChanges map[models.ID]storedEmailChange `json:"email_changes,omitempty"`
+	// the audit log, oldest entry first
+	Audit []auditRecord `json:"audit,omitempty"`
+}
+
+// keep the store in a JSON file at path, loading what it already holds and
+// replaying the write-ahead log a crash may have left next to it. With a
+// keyring, email, pending email and phone are encrypted in the file and only
+// ever plaintext in memory.
+func Open(path string, keys *fieldcrypt.Keyring) error {
+	userStore.Lock()
+	defer userStore.Unlock()
+	if sqlDB != nil {
+		return errors.New("the store is already kept in a database")
+	}
+	dataFile, keyring = path, keys
+
+	stale, err := load(path)
+	if err != nil {
+		return err
+	}
+	replayed, logged, err := replayWAL(walPath())
+	if err != nil {
+		return err
+	}
+	if replayed > 0 {
+		log.Printf("db: replayed %d changes from %s", replayed, walPath())
+	}
+	dropped := dropUnconfirmable()
+	if dropped > 0 {
+		log.Printf("db: dropped %d pending emails without a confirmation token", dropped)
+	}
+	reindex()
+	trimAudit()
+
+	// rewrite values still under an old key (or in plaintext) right away,
+	// and fold the replayed changes into the file, emptying the log
+	if stale || logged || dropped > 0 {
+		return save()
+	}
+	return nil
+}
+
+// read the data file into the store, reporting whether values are under an
+// old key; callers hold the lock
+func load(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return false, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	stale := false
+	for i := range snap.Users {
+		// files written before timestamps were kept in UTC
+		snap.Users[i] = snap.Users[i].In(time.UTC)
+		if keyring == nil {
+			continue
+		}
+		plain, rotate, err := decryptUser(snap.Users[i])
+		if err != nil {
+			return false, fmt.Errorf("read %s: user %s: %w", path, snap.Users[i].ID, err)
+		}
+		snap.Users[i], stale = plain, stale || rotate
+	}
+	userStore.users, seqKnown = snap.Users, false
+	createdTotal.Store(snap.CreatedTotal)
+	deletedTotal.Store(snap.DeletedTotal)
+	purgedID = snap.PurgedID
+	if snap.Avatars != nil {
+		avatars = snap.Avatars
+	}
+	if snap.APIKeys != nil {
+		apiKeys = snap.APIKeys
+	}
+	emailChanges = map[models.ID]emailChange{}
+	for _, u := range snap.Users {
+		if ch, ok := snap.EmailChanges[u.ID]; ok {
+			loadEmailChange(u, &ch)
+		}
+	}
+	for _, rec := range snap.Audit {
+		if keyring != nil {
+			var rotate bool
+			var err error
+			if rec, rotate, err = decryptAudit(rec); err != nil {
+				return false, fmt.Errorf("read %s: audit entry %d: %w", path, rec.Seq, err)
+			}
+			stale = stale || rotate
+		}
+		loadAudit(rec)
+	}
+	return stale, nil
+}
+
+// write the store to the data file, or all of it to the database; callers
+// hold the lock
+func save() error {
+	if sqlDB != nil {
+		return writeSQL(nil, true)
+	}
+	trimAudit()
+	if dataFile == "" {
+		return nil
+	}
+	snap := snapshot{
+		Users:        make([]models.User, len(userStore.users)),
+		CreatedTotal: createdTotal.Load(),
+		DeletedTotal: deletedTotal.Load(),
+		PurgedID:     purgedID,
+		Avatars:      avatars,
+		APIKeys:      apiKeys,
+		EmailChanges: map[models.ID]storedEmailChange{},
+	}
+	for i, u := range userStore.users {
+		if ch := storedEmailChangeOf(u.ID); ch != nil {
+			snap.EmailChanges[u.ID] = *ch
+		}
+		if keyring != nil {
+			var err error
+			if u, err = encryptUser(u); err != nil {
+				return err
+			}
+		}
+		snap.Users[i] = u
+	}
+	var err error
+	if snap.Audit, err = storedAudit(audit); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write next to the target and rename so a crash never leaves half a file
+	tmp, err := os.CreateTemp(filepath.Dir(dataFile), filepath.Base(dataFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dataFile); err != nil {
+		return err
+	}
+	return truncateWAL()
+}
+
+// record a mutation of the users ids and save it, to their database rows or
+// the write-ahead log when there is one. A failed write wraps ErrNotSaved
+// and is reported by Ping until a later one succeeds; see checkpoint to
+// undo the change then. Callers hold the lock.
+func persist(ids ...models.ID) error {
+	trimAudit()
+	var err error
+	switch {
+	case sqlDB != nil:
+		err = writeSQL(ids, false)
+	case walFile != nil && dataFile != "":
+		err = appendWAL(ids)
+	default:
+		err = save()
+	}
+	if err = saved(err); err == nil {
+		lastModified = clock.Now()
+	}
+	return err
+}
+
+// record the outcome of a write for Ping, wrapping a failure in
+// ErrNotSaved; callers hold the lock
+func saved(err error) error {
+	saveErr = err
+	if err != nil {
+		log.Printf("db: saving to %s: %v", storage(), err)
+		return fmt.Errorf("%w to %s: %w", ErrNotSaved, storage(), err)
+	}
+	unsavedAudit = nil
+	return nil
+}
+
+// where the store is saved, for messages; callers hold the lock
+func storage() string {
+	if sqlDB != nil {
+		return "the database"
+	}
+	return dataFile
+}
+
+// fields of models.User that are encrypted at rest
+func sensitiveFields(u *models.User) []*string {
+	return []*string{&u.Email, &u.PendingEmail, &u.Phone}
+}
+
+func encryptUser(u models.User) (models.User, error) {
+	for _, f := range sensitiveFields(&u) {
+		var err error
+		if *f, err = keyring.Encrypt(*f); err != nil {
+			return u, err
+		}
+	}
+	return u, nil
+}
+
+// decrypt the sensitive fields, also reporting whether any of them was not
+// written under the active key
+func decryptUser(u models.User) (models.User, bool, error) {
+	stale := false
+	for _, f := range sensitiveFields(&u) {
+		stale = stale || keyring.Stale(*f)
+		var err error
+		if *f, err = keyring.Decrypt(*f); err != nil {
+			return u, false, err
+		}
+	}
+	return u, stale, nil
+}
+
+// keys of the changes in the audit log holding sensitive fields
+var sensitiveChanges = []string{"email", "pending_email", "phone"}
+
+// entries of the audit log as they are saved, their sensitive changes
+// encrypted with the keyring if there is one; callers hold the lock
+func storedAudit(entries []auditRecord) ([]auditRecord, error) {
+	if keyring == nil {
+		return entries, nil
+	}
+	out := make([]auditRecord, len(entries))
+	for i, rec := range entries {
+		var err error
+		if out[i], _, err = cryptAudit(rec, func(v string) (string, bool, error) {
+			enc, err := keyring.Encrypt(v)
+			return enc, false, err
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// decrypt the sensitive changes of a saved entry of the audit log, also
+// reporting whether any of them was not written under the active key
+func decryptAudit(rec auditRecord) (auditRecord, bool, error) {
+	return cryptAudit(rec, func(v string) (string, bool, error) {
+		plain, err := keyring.Decrypt(v)
+		return plain, keyring.Stale(v), err
+	})
+}
+
+// rec with crypt applied to the string values of its sensitive changes, in
+// a copy of its changes so the entry in memory is left alone
+func cryptAudit(rec auditRecord, crypt func(string) (string, bool, error)) (auditRecord, bool, error) {
+	stale := false
+	copied := false
+	for _, key := range sensitiveChanges {
+		ch, ok := rec.Changes[key]
+		if !ok {
+			continue
+		}
+		if !copied {
+			rec.Changes, copied = maps.Clone(rec.Changes), true
+		}
+		for _, v := range []*any{&ch.Old, &ch.New} {
+			s, ok := (*v).(string)
+			if !ok {
+				continue
+			}
+			out, rotate, err := crypt(s)
+			if err != nil {
+				return rec, false, err
+			}
+			*v, stale = out, stale || rotate
+		}
+		rec.Changes[key] = ch
+	}
+	return rec, stale, nil
+}
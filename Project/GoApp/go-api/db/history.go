@@ -0,0 +1,190 @@
+package db
+
+import (
+	"cmp"
+	"slices"
+	"time"
+
+	"go-api/events"
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// entry types of changes that are not events of the user itself
+const (
+	APIKeyCreated = "api_key_created"
+	APIKeyRevoked = "api_key_revoked"
+	Purged        = "purged"
+)
+
+// HistoryEntry is one change of a user, made by Actor: who the api
+// authenticated, e.g. "admin" or "user:42"
+type HistoryEntry struct {
+	Type    string                   `json:"type"`
+	Time    time.Time                `json:"time"`
+	Actor   string                   `json:"actor,omitempty"`
+	Changes map[string]models.Change `json:"changes,omitempty"`
+}
+
+// AuditEntry is a HistoryEntry of the user UserID in the audit log
+type AuditEntry struct {
+	UserID models.ID `json:"user_id"`
+	HistoryEntry
+}
+
+// changes of every user, oldest first, kept in memory only; guarded by the
+// userStore lock
+var history = map[models.ID][]HistoryEntry{}
+
+// the audit log: every change of every user, oldest first, saved with the
+// changes and guarded by the userStore lock. Unlike history it outlives
+// merges and purges.
+var (
+	audit []auditRecord
+	// sequence number of the last entry recorded
+	auditSeq int64
+	// sequence numbers of the entries of each user, oldest first
+	auditByUser = map[models.ID][]int64{}
+	// entries recorded since the last successful write, for the next one
+	unsavedAudit []auditRecord
+	// most entries kept, 0 for all of them
+	auditLimit int
+)
+
+// an entry of the audit log as it is saved, numbered so that an entry read
+// twice, as from a replayed write-ahead log, is only added once
+type auditRecord struct {
+	Seq int64 `json:"seq"`
+	AuditEntry
+}
+
+// keep at most n entries in the audit log, the oldest going first as new
+// ones are saved, or all of them for 0; call it before Open or OpenSQL
+func SetAuditLimit(n int) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	auditLimit = max(n, 0)
+}
+
+// history of the user, newest entry first
+func History(id models.ID) ([]HistoryEntry, error) {
+	userStore.RLock()
+	defer userStore.RUnlock()
+	if indexOf(id) < 0 {
+		return nil, ErrNotFound
+	}
+	entries := history[id]
+	out := make([]HistoryEntry, len(entries))
+	for i, e := range entries {
+		out[len(entries)-1-i] = e
+	}
+	return out, nil
+}
+
+// a page of the audit log, newest entry first, only of the user id when it
+// is set, and how many entries there are in all; purged users are still in
+// it
+func Audit(id models.ID, page pagination.Page) ([]AuditEntry, int) {
+	userStore.RLock()
+	defer userStore.RUnlock()
+	out := []AuditEntry{}
+	if id == "" {
+		for i := len(audit) - 1 - page.Offset; i >= 0 && len(out) < page.Limit; i-- {
+			out = append(out, audit[i].AuditEntry)
+		}
+		return out, len(audit)
+	}
+	seqs := auditByUser[id]
+	for n := len(seqs) - 1 - page.Offset; n >= 0 && len(out) < page.Limit; n-- {
+		i, _ := slices.BinarySearchFunc(audit, seqs[n], func(r auditRecord, seq int64) int {
+			return cmp.Compare(r.Seq, seq)
+		})
+		out = append(out, audit[i].AuditEntry)
+	}
+	return out, len(seqs)
+}
+
+// add entry to the history of the user id and to the audit log, both saved
+// or undone with the change; callers hold the lock and commit
+func record(id models.ID, entry HistoryEntry) {
+	history[id] = append(history[id], entry)
+	appendAudit(AuditEntry{UserID: id, HistoryEntry: entry})
+}
+
+// add entry to the audit log, to be saved with the next write; callers hold
+// the lock
+func appendAudit(entry AuditEntry) {
+	auditSeq++
+	rec := auditRecord{Seq: auditSeq, AuditEntry: entry}
+	audit = append(audit, rec)
+	auditByUser[entry.UserID] = append(auditByUser[entry.UserID], rec.Seq)
+	unsavedAudit = append(unsavedAudit, rec)
+}
+
+// add a saved entry to the audit log unless it is there already; callers
+// hold the lock
+func loadAudit(rec auditRecord) {
+	if rec.Seq <= auditSeq {
+		return
+	}
+	auditSeq = rec.Seq
+	audit = append(audit, rec)
+	auditByUser[rec.UserID] = append(auditByUser[rec.UserID], rec.Seq)
+}
+
+// drop the entries recorded after seq, those of a change that is undone;
+// callers hold the lock
+func dropAuditAfter(seq int64) {
+	for len(audit) > 0 && audit[len(audit)-1].Seq > seq {
+		last := audit[len(audit)-1]
+		seqs := auditByUser[last.UserID]
+		if seqs = seqs[:len(seqs)-1]; len(seqs) == 0 {
+			delete(auditByUser, last.UserID)
+		} else {
+			auditByUser[last.UserID] = seqs
+		}
+		audit[len(audit)-1] = auditRecord{}
+		audit = audit[:len(audit)-1]
+	}
+	for len(unsavedAudit) > 0 && unsavedAudit[len(unsavedAudit)-1].Seq > seq {
+		unsavedAudit = unsavedAudit[:len(unsavedAudit)-1]
+	}
+	auditSeq = min(auditSeq, seq)
+}
+
+// drop the oldest entries beyond auditLimit, before a write saves the
+// rest; callers hold the lock
+func trimAudit() {
+	if auditLimit == 0 || len(audit) <= auditLimit {
+		return
+	}
+	drop := len(audit) - auditLimit
+	for _, rec := range audit[:drop] {
+		if seqs := auditByUser[rec.UserID][1:]; len(seqs) == 0 {
+			delete(auditByUser, rec.UserID)
+		} else {
+			auditByUser[rec.UserID] = seqs
+		}
+	}
+	// the array is copied when it grows, leaving the dropped entries behind
+	clear(audit[:drop])
+	audit = audit[drop:]
+}
+
+// events of the change being made, published once it is saved; guarded by
+// the userStore lock
+var unpublished []func()
+
+// add a created, deleted or restored user to its history and publish the
+// event once the change is saved; callers hold the lock and commit
+func notify(eventType string, user models.User, by string) {
+	record(user.ID, HistoryEntry{Type: eventType, Time: clock.Now(), Actor: by})
+	unpublished = append(unpublished, func() { events.Publish(eventType, user) })
+}
+
+// add an update from old to user to the history and publish it once the
+// change is saved; callers hold the lock and commit
+func notifyUpdate(old, user models.User, by string) {
+	record(user.ID, HistoryEntry{Type: events.Updated, Time: clock.Now(), Actor: by, Changes: models.Diff(old, user)})
+	unpublished = append(unpublished, func() { events.PublishUpdate(old, user) })
+}
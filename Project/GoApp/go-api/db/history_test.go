@@ -0,0 +1,229 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go-api/fieldcrypt"
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// open the store at path, with the write-ahead log if wal is set
+func openAt(t *testing.T, path string, wal bool, keys *fieldcrypt.Keyring) {
+	t.Helper()
+	if err := Open(path, keys); err != nil {
+		t.Fatal(err)
+	}
+	if wal {
+		if err := UseWAL(100); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// the types of the entries of a page of the audit log, and the total
+func auditTypes(id models.ID, page pagination.Page) ([]string, int) {
+	entries, total := Audit(id, page)
+	types := []string{}
+	for _, e := range entries {
+		types = append(types, e.Type)
+	}
+	return types, total
+}
+
+var allAudit = pagination.Page{Limit: pagination.MaxLimit}
+
+// create, update and delete a user, returning its id
+func auditedChanges(t *testing.T) models.ID {
+	t.Helper()
+	user, err := AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := PatchUser(user.ID, func(u *models.User) error { u.Name = "Ada L"; return nil }, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(user.ID, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	return user.ID
+}
+
+func TestAuditSurvivesARestart(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		name := "data file"
+		if wal {
+			name = "write-ahead log"
+		}
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			Reset()
+			t.Cleanup(Reset)
+			openAt(t, path, wal, nil)
+			id := auditedChanges(t)
+
+			if wal {
+				// a record replayed twice adds its entries once
+				data, err := os.ReadFile(walPath())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(walPath(), bytes.Repeat(data, 2), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			Reset()
+			openAt(t, path, wal, nil)
+
+			want := []string{"deleted", "updated", "created"}
+			if got, total := auditTypes("", allAudit); !slices.Equal(got, want) || total != 3 {
+				t.Errorf("audit log %v of %d, want %v", got, total, want)
+			}
+			if got, _ := auditTypes(id, allAudit); !slices.Equal(got, want) {
+				t.Errorf("audit log of the user %v, want %v", got, want)
+			}
+
+			// entries made after the restart follow the loaded ones
+			if _, err := AddUser(models.User{Name: "Bob", Email: "bob@example.com"}, "test"); err != nil {
+				t.Fatal(err)
+			}
+			if got, total := auditTypes("", pagination.Page{Limit: 1}); !slices.Equal(got, []string{"created"}) || total != 4 {
+				t.Errorf("newest entry %v of %d, want created of 4", got, total)
+			}
+		})
+	}
+}
+
+func TestAuditLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	Reset()
+	t.Cleanup(Reset)
+	SetAuditLimit(2)
+	openAt(t, path, false, nil)
+	id := auditedChanges(t)
+
+	want := []string{"deleted", "updated"}
+	if got, total := auditTypes("", allAudit); !slices.Equal(got, want) || total != 2 {
+		t.Errorf("audit log %v of %d, want %v", got, total, want)
+	}
+	if got, _ := auditTypes(id, allAudit); !slices.Equal(got, want) {
+		t.Errorf("audit log of the user %v, want %v", got, want)
+	}
+
+	Reset()
+	SetAuditLimit(2)
+	openAt(t, path, false, nil)
+	if got, _ := auditTypes("", allAudit); !slices.Equal(got, want) {
+		t.Errorf("reopened audit log %v, want %v", got, want)
+	}
+}
+
+func TestAuditOfAUser(t *testing.T) {
+	Reset()
+	t.Cleanup(Reset)
+	ada, _ := AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test")
+	bob, _ := AddUser(models.User{Name: "Bob", Email: "bob@example.com"}, "test")
+	for _, name := range []string{"a1", "a2", "a3"} {
+		PatchUser(ada.ID, func(u *models.User) error { u.Name = name; return nil }, 0, "test")
+		SetActive(bob.ID, name != "a2", "test")
+	}
+
+	tests := []struct {
+		name  string
+		id    models.ID
+		page  pagination.Page
+		want  []string
+		total int
+	}{
+		{"first page of a user", ada.ID, pagination.Page{Limit: 2}, []string{"a3", "a2"}, 4},
+		{"last page of a user", ada.ID, pagination.Page{Limit: 2, Offset: 2}, []string{"a1", "created"}, 4},
+		{"past the end", ada.ID, pagination.Page{Limit: 2, Offset: 4}, []string{}, 4},
+		{"the other user", bob.ID, allAudit, []string{"active", "active", "created"}, 3},
+		{"unknown user", "999", allAudit, []string{}, 0},
+		{"everyone", "", pagination.Page{Limit: 3}, []string{"active", "a3", "active"}, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, total := Audit(tt.id, tt.page)
+			got := []string{}
+			for _, e := range entries {
+				switch {
+				case e.Type == "created":
+					got = append(got, e.Type)
+				case e.Changes["name"].New != nil:
+					got = append(got, e.Changes["name"].New.(string))
+				default:
+					got = append(got, "active")
+				}
+			}
+			if !slices.Equal(got, tt.want) || total != tt.total {
+				t.Errorf("entries %v of %d, want %v of %d", got, total, tt.want, tt.total)
+			}
+		})
+	}
+}
+
+// an entry is saved or undone with its change
+func TestAuditOfAChangeNotSaved(t *testing.T) {
+	dir := t.TempDir()
+	Reset()
+	t.Cleanup(Reset)
+	openAt(t, filepath.Join(dir, "data", "users.json"), false, nil)
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	user, err := AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.RemoveAll(filepath.Join(dir, "data"))
+	if err := DeleteUser(user.ID, 0, "test"); !errors.Is(err, ErrNotSaved) {
+		t.Fatalf("error %v, want ErrNotSaved", err)
+	}
+	if got, total := auditTypes(user.ID, allAudit); !slices.Equal(got, []string{"created"}) || total != 1 {
+		t.Errorf("audit log %v of %d, want only the create", got, total)
+	}
+	if entries, _ := History(user.ID); len(entries) != 1 {
+		t.Errorf("%d history entries, want only the create", len(entries))
+	}
+}
+
+func TestAuditEncrypted(t *testing.T) {
+	keys, err := fieldcrypt.Parse("k1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users.json")
+	Reset()
+	t.Cleanup(Reset)
+	openAt(t, path, false, keys)
+	user, _ := AddUser(models.User{Name: "Ada", Email: "ada@example.com", Phone: "+15550100"}, "test")
+	PatchUser(user.ID, func(u *models.User) error { u.Phone = "+15550199"; return nil }, 0, "test")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plain := range []string{"+15550100", "+15550199"} {
+		if bytes.Contains(data, []byte(plain)) {
+			t.Errorf("%s in plaintext in the data file", plain)
+		}
+	}
+
+	Reset()
+	openAt(t, path, false, keys)
+	entries, _ := Audit(user.ID, allAudit)
+	if len(entries) != 2 {
+		t.Fatalf("%d entries, want 2", len(entries))
+	}
+	if ch := entries[0].Changes["phone"]; ch.Old != "+15550100" || ch.New != "+15550199" {
+		t.Errorf("reopened change %+v, want the phone numbers in plaintext", ch)
+	}
+}
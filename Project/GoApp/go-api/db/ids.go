@@ -0,0 +1,167 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"go-api/models"
+)
+
+// IDGenerator gives new users their ids
+type IDGenerator interface {
+	// NewID returns an id no earlier call returned; callers hold the
+	// userStore lock
+	NewID() (models.ID, error)
+}
+
+// id strategies accepted by NewIDGenerator
+const (
+	IDSequential = "sequential"
+	IDUUID       = "uuid"
+	IDULID       = "ulid"
+)
+
+// generator used by AddUser and AddUsers; guarded by the userStore lock
+var idGenerator IDGenerator = Sequential{}
+
+// make the generator of a strategy, one of IDSequential, IDUUID and IDULID
+func NewIDGenerator(strategy string) (IDGenerator, error) {
+	switch strategy {
+	case IDSequential:
+		return Sequential{}, nil
+	case IDUUID:
+		return UUID{}, nil
+	case IDULID:
+		return &ULID{}, nil
+	}
+	return nil, fmt.Errorf("unknown id strategy %q", strategy)
+}
+
+// replace the id generator, ids already given out are kept
+func SetIDGenerator(g IDGenerator) {
+	userStore.Lock()
+	defer userStore.Unlock()
+	idGenerator = g
+}
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	ulidPattern = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+)
+
+// read an id from a path. Ids of every strategy are accepted, so a store that
+// changed strategy keeps its older users reachable.
+func ParseID(s string) (models.ID, error) {
+	id := models.ID(s)
+	if n, ok := id.Int(); (ok && n > 0) || uuidPattern.MatchString(s) || ulidPattern.MatchString(s) {
+		return id, nil
+	}
+	return "", fmt.Errorf("invalid id %q", s)
+}
+
+// highest sequential id in the store or handed out, known once the first
+// NewID after a load has scanned for it; guarded by the userStore lock
+var (
+	lastSeq  int64
+	seqKnown bool
+)
+
+// Sequential numbers users 1, 2, 3... following the highest numeric id in
+// the store, soft-deleted and compacted users included so their ids are
+// never reused. Only the first id after a load scans the store, later ones
+// count on from it, also past ids of a rolled back batch.
+type Sequential struct{}
+
+func (Sequential) NewID() (models.ID, error) {
+	if !seqKnown {
+		lastSeq = purgedID
+		for _, u := range userStore.users {
+			if n, ok := u.ID.Int(); ok && n > lastSeq {
+				lastSeq = n
+			}
+		}
+		seqKnown = true
+	}
+	lastSeq++
+	return models.ID(strconv.FormatInt(lastSeq, 10)), nil
+}
+
+// UUID gives random (version 4) UUIDs
+type UUID struct{}
+
+func (UUID) NewID() (models.ID, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return models.ID(h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]), nil
+}
+
+// ULID gives ULIDs: a millisecond timestamp from the db clock followed by
+// randomness. Ids made within the same millisecond increment the random part
+// of the previous one, so the ids of one process sort in creation order.
+type ULID struct {
+	mu   sync.Mutex
+	ms   uint64
+	rand [10]byte
+}
+
+// Crockford's base32, the ULID alphabet
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func (g *ULID) NewID() (models.ID, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(clock.Now().UnixMilli())
+	if ms > g.ms {
+		g.ms = ms
+		if _, err := rand.Read(g.rand[:]); err != nil {
+			return "", err
+		}
+	} else if !increment(g.rand[:]) {
+		// 2^80 ids within one millisecond, move on to the next one
+		g.ms++
+		if _, err := rand.Read(g.rand[:]); err != nil {
+			return "", err
+		}
+	}
+
+	var b [16]byte
+	binary.BigEndian.PutUint16(b[0:2], uint16(g.ms>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(g.ms))
+	copy(b[6:], g.rand[:])
+	return models.ID(encodeULID(b)), nil
+}
+
+// add one to a big-endian number, false when it wrapped around
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 128 bits as 26 base32 characters, the first one carrying the top 3 bits
+func encodeULID(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[0:8])
+	lo := binary.BigEndian.Uint64(b[8:16])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"go-api/models"
+)
+
+// n ids of g, made as AddUser makes them, under the store lock
+func newIDs(t *testing.T, g IDGenerator, n int) []models.ID {
+	t.Helper()
+	userStore.Lock()
+	defer userStore.Unlock()
+	ids := make([]models.ID, n)
+	for i := range ids {
+		id, err := g.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	return ids
+}
+
+func TestIDGenerators(t *testing.T) {
+	tests := []struct {
+		strategy string
+		// whether an id has the form of the strategy
+		valid func(models.ID) bool
+	}{
+		{IDSequential, func(id models.ID) bool { n, ok := id.Int(); return ok && n > 0 }},
+		{IDUUID, func(id models.ID) bool {
+			// version 4, variant 10
+			return uuidPattern.MatchString(string(id)) && id[14] == '4' && strings.ContainsRune("89ab", rune(id[19]))
+		}},
+		{IDULID, func(id models.ID) bool { return ulidPattern.MatchString(string(id)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			Reset()
+			t.Cleanup(Reset)
+			g, err := NewIDGenerator(tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := map[models.ID]bool{}
+			for _, id := range newIDs(t, g, 2000) {
+				if !tt.valid(id) {
+					t.Fatalf("id %q is not a %s", id, tt.strategy)
+				}
+				if parsed, err := ParseID(string(id)); err != nil || parsed != id {
+					t.Fatalf("parsing %q: %q, %v", id, parsed, err)
+				}
+				if seen[id] {
+					t.Fatalf("id %q given twice", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+	if _, err := NewIDGenerator("snowflake"); err == nil {
+		t.Error("made a generator of an unknown strategy")
+	}
+}
+
+func TestULIDOrder(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	g := &ULID{}
+	var ids []models.ID
+	steps := []struct {
+		name string
+		// a clock change before the ids
+		by time.Duration
+		n  int
+	}{
+		{"within a millisecond", 0, 500},
+		{"a millisecond on", time.Millisecond, 10},
+		{"an hour on", time.Hour, 10},
+		{"the clock set back", -time.Minute, 10},
+	}
+	for _, s := range steps {
+		c.advance(s.by)
+		for _, id := range newIDs(t, g, s.n) {
+			if len(ids) > 0 && !ids[len(ids)-1].Less(id) {
+				t.Fatalf("%s: id %s after %s", s.name, id, ids[len(ids)-1])
+			}
+			ids = append(ids, id)
+		}
+	}
+	// the first 10 characters are the millisecond of the clock, from the
+	// last reading on once it was set back
+	prefix := func(at time.Time) string {
+		ms := uint64(at.UnixMilli())
+		var b [16]byte
+		binary.BigEndian.PutUint16(b[0:2], uint16(ms>>32))
+		binary.BigEndian.PutUint32(b[2:6], uint32(ms))
+		return encodeULID(b)[:10]
+	}
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	for n, want := range map[int]time.Time{
+		0:   start,
+		499: start,
+		500: start.Add(time.Millisecond),
+		510: start.Add(time.Hour + time.Millisecond),
+		529: start.Add(time.Hour + time.Millisecond),
+	} {
+		if got := string(ids[n][:10]); got != prefix(want) {
+			t.Errorf("id %d %s, want the timestamp %s of %s", n, ids[n], prefix(want), want)
+		}
+	}
+}
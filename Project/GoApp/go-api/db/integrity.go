@@ -0,0 +1,89 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go-api/models"
+)
+
+// IntegrityReport lists what CheckIntegrity found wrong with the store
+type IntegrityReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Problems  []string  `json:"problems"`
+}
+
+func (r IntegrityReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// check the store for what the api never writes but a hand-edited or
+// damaged data file can hold: empty or duplicate ids, users breaking the
+// unique constraints, and API keys or avatars of users that are gone
+func CheckIntegrity() IntegrityReport {
+	userStore.RLock()
+	defer userStore.RUnlock()
+	report := IntegrityReport{CheckedAt: clock.Now(), Problems: []string{}}
+	problem := func(format string, args ...any) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	users := map[models.ID]models.User{}
+	for n, u := range userStore.users {
+		if u.ID == "" {
+			problem("user at position %d has no id", n)
+			continue
+		}
+		if _, ok := users[u.ID]; ok {
+			problem("duplicate id %s", u.ID)
+			continue
+		}
+		users[u.ID] = u
+	}
+
+	for _, fields := range uniqueFields {
+		holders := map[string][]models.ID{}
+		for _, u := range userStore.users {
+			if key, ok := uniqueKey(u, fields); ok && u.DeletedAt == nil {
+				holders[key] = append(holders[key], u.ID)
+			}
+		}
+		for _, ids := range holders {
+			if len(ids) > 1 {
+				problem("users %s share unique %q", joinIDs(ids), strings.Join(fields, "+"))
+			}
+		}
+	}
+
+	for keyID, k := range apiKeys {
+		if u, ok := users[k.UserID]; !ok || u.DeletedAt != nil {
+			problem("api key %s belongs to missing user %s", keyID, k.UserID)
+		}
+	}
+	for id := range avatars {
+		if u, ok := users[id]; !ok {
+			problem("avatar image of missing user %s", id)
+		} else if u.Avatar == nil {
+			problem("user %s has an avatar image but no avatar metadata", id)
+		}
+	}
+	for id, u := range users {
+		if _, ok := avatars[id]; u.Avatar != nil && !ok {
+			problem("user %s has avatar metadata but no image", id)
+		}
+	}
+
+	// map order would shuffle the report between runs
+	sort.Strings(report.Problems)
+	return report
+}
+
+func joinIDs(ids []models.ID) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = string(id)
+	}
+	return strings.Join(s, ", ")
+}
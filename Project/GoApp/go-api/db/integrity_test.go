@@ -0,0 +1,57 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	tests := []struct {
+		name string
+		// the users of the data file, then what else it holds
+		users string
+		rest  string
+		want  []string
+	}{
+		{"sound", `{"id":1,"name":"Ada","email":"ada@example.com"},{"id":2,"name":"Bob","email":"bob@example.com"}`, "", nil},
+		{"duplicate id", `{"id":1,"name":"Ada","email":"ada@example.com"},{"id":1,"name":"Bob","email":"bob@example.com"}`, "",
+			[]string{"duplicate id 1"}},
+		{"no id", `{"id":1,"name":"Ada","email":"ada@example.com"},{"name":"Bob","email":"bob@example.com"}`, "",
+			[]string{"user at position 1 has no id"}},
+		{"duplicate email", `{"id":1,"name":"Ada","email":"ada@example.com"},{"id":2,"name":"Ada 2","email":"ADA@example.com"}`, "",
+			[]string{`users 1, 2 share unique "email"`}},
+		{"duplicate email of a deleted user", `{"id":1,"name":"Ada","email":"ada@example.com"},{"id":2,"name":"Ada 2","email":"ada@example.com","deleted_at":"2026-03-01T09:00:00Z"}`, "", nil},
+		{"api key of a missing user", `{"id":1,"name":"Ada","email":"ada@example.com"}`, `"api_keys":{"k1":{"id":"k1","user_id":9,"hash":"x"}}`,
+			[]string{"api key k1 belongs to missing user 9"}},
+		{"avatar of a missing user", `{"id":1,"name":"Ada","email":"ada@example.com"}`, `"avatars":{"9":"aW1n"}`,
+			[]string{"avatar image of missing user 9"}},
+		{"avatar metadata without the image", `{"id":1,"name":"Ada","email":"ada@example.com","avatar":{"content_type":"image/png","size":3}}`, "",
+			[]string{"user 1 has avatar metadata but no image"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			data := `{"users":[` + tt.users + `]`
+			if tt.rest != "" {
+				data += "," + tt.rest
+			}
+			if err := os.WriteFile(path, []byte(data+"}"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			Reset()
+			t.Cleanup(Reset)
+			if err := Open(path, nil); err != nil {
+				t.Fatal(err)
+			}
+			report := CheckIntegrity()
+			if !slices.Equal(report.Problems, tt.want) {
+				t.Errorf("problems %q, want %q", report.Problems, tt.want)
+			}
+			if report.OK() != (len(tt.want) == 0) {
+				t.Errorf("ok %v with problems %q", report.OK(), report.Problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// ErrUnavailable is what calls fail with when the store cannot be reached
+// or is refusing calls for now
+var ErrUnavailable = errors.New("store unavailable")
+
+// Unavailable tells whether err is the store failing rather than the call
+// being wrong, so the same call may succeed later: the store could not be
+// reached, did not answer in time or could not save the change.
+func Unavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrNotSaved) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Operation is one call to a Store, as Intercept hands it to run
+type Operation struct {
+	// e.g. "get_user"
+	Name string
+	// the user the call is about, "" for none or several
+	ID models.ID
+	// the call changes nothing, so making it again is safe
+	Read bool
+}
+
+// Intercept wraps store so every call goes through run, which makes the call
+// with call, with ctx or another context, once, several times or not at all,
+// and returns the error the call should fail with. The results are those of
+// the last call made.
+func Intercept(store Store, run func(ctx context.Context, op Operation, call func(ctx context.Context) error) error) Store {
+	return intercepted{store, run}
+}
+
+// Instrumented wraps store so every call reports its operation, e.g.
+// "get_user", and how long it took to observe
+func Instrumented(store Store, observe func(operation string, took time.Duration)) Store {
+	return Intercept(store, func(ctx context.Context, op Operation, call func(ctx context.Context) error) error {
+		defer func(start time.Time) { observe(op.Name, time.Since(start)) }(time.Now())
+		return call(ctx)
+	})
+}
+
+type intercepted struct {
+	store Store
+	run   func(ctx context.Context, op Operation, call func(ctx context.Context) error) error
+}
+
+func read(name string, id models.ID) Operation  { return Operation{Name: name, ID: id, Read: true} }
+func write(name string, id models.ID) Operation { return Operation{Name: name, ID: id} }
+
+func (s intercepted) GetUsers(ctx context.Context, q UserQuery) (users []models.User, total int, err error) {
+	err = s.run(ctx, read("get_users", ""), func(ctx context.Context) error {
+		users, total, err = s.store.GetUsers(ctx, q)
+		return err
+	})
+	return users, total, err
+}
+
+func (s intercepted) GetUser(ctx context.Context, id models.ID) (user *models.User, err error) {
+	err = s.run(ctx, read("get_user", id), func(ctx context.Context) error {
+		user, err = s.store.GetUser(ctx, id)
+		return err
+	})
+	return user, err
+}
+
+func (s intercepted) SearchUsers(ctx context.Context, text string, q UserQuery) (users []models.User, total int, err error) {
+	err = s.run(ctx, read("search_users", ""), func(ctx context.Context) error {
+		users, total, err = s.store.SearchUsers(ctx, text, q)
+		return err
+	})
+	return users, total, err
+}
+
+func (s intercepted) CountUsers(ctx context.Context, includeDeleted bool) (n int, err error) {
+	err = s.run(ctx, read("count_users", ""), func(ctx context.Context) error {
+		n, err = s.store.CountUsers(ctx, includeDeleted)
+		return err
+	})
+	return n, err
+}
+
+func (s intercepted) GetStats(ctx context.Context) (stats Stats, err error) {
+	err = s.run(ctx, read("get_stats", ""), func(ctx context.Context) error {
+		stats, err = s.store.GetStats(ctx)
+		return err
+	})
+	return stats, err
+}
+
+func (s intercepted) LastModified(ctx context.Context) (at time.Time, err error) {
+	err = s.run(ctx, read("last_modified", ""), func(ctx context.Context) error {
+		at, err = s.store.LastModified(ctx)
+		return err
+	})
+	return at, err
+}
+
+func (s intercepted) CheckUnique(ctx context.Context, user models.User) error {
+	return s.run(ctx, read("check_unique", user.ID), func(ctx context.Context) error {
+		return s.store.CheckUnique(ctx, user)
+	})
+}
+
+func (s intercepted) GetAvatar(ctx context.Context, id models.ID) (avatar *AvatarImage, err error) {
+	err = s.run(ctx, read("get_avatar", id), func(ctx context.Context) error {
+		avatar, err = s.store.GetAvatar(ctx, id)
+		return err
+	})
+	return avatar, err
+}
+
+func (s intercepted) History(ctx context.Context, id models.ID) (entries []HistoryEntry, err error) {
+	err = s.run(ctx, read("history", id), func(ctx context.Context) error {
+		entries, err = s.store.History(ctx, id)
+		return err
+	})
+	return entries, err
+}
+
+func (s intercepted) Audit(ctx context.Context, id models.ID, page pagination.Page) (entries []AuditEntry, total int, err error) {
+	err = s.run(ctx, read("audit", id), func(ctx context.Context) error {
+		entries, total, err = s.store.Audit(ctx, id, page)
+		return err
+	})
+	return entries, total, err
+}
+
+func (s intercepted) APIKeys(ctx context.Context, userID models.ID) (keys []APIKey, err error) {
+	err = s.run(ctx, read("api_keys", userID), func(ctx context.Context) error {
+		keys, err = s.store.APIKeys(ctx, userID)
+		return err
+	})
+	return keys, err
+}
+
+func (s intercepted) AuthenticateAPIKey(ctx context.Context, key string) (id models.ID, ok bool, err error) {
+	err = s.run(ctx, read("authenticate_api_key", ""), func(ctx context.Context) error {
+		id, ok, err = s.store.AuthenticateAPIKey(ctx, key)
+		return err
+	})
+	return id, ok, err
+}
+
+func (s intercepted) AddUser(ctx context.Context, user models.User, by string) (added *models.User, err error) {
+	err = s.run(ctx, write("add_user", ""), func(ctx context.Context) error {
+		added, err = s.store.AddUser(ctx, user, by)
+		return err
+	})
+	return added, err
+}
+
+func (s intercepted) AddUsers(ctx context.Context, users []models.User, atomic bool, by string) (added []models.User, errs []error, err error) {
+	err = s.run(ctx, write("add_users", ""), func(ctx context.Context) error {
+		added, errs, err = s.store.AddUsers(ctx, users, atomic, by)
+		return err
+	})
+	return added, errs, err
+}
+
+func (s intercepted) UpdateUser(ctx context.Context, id models.ID, user models.User, avatar *AvatarImage, emailTTL time.Duration, by string) (token string, err error) {
+	err = s.run(ctx, write("update_user", id), func(ctx context.Context) error {
+		token, err = s.store.UpdateUser(ctx, id, user, avatar, emailTTL, by)
+		return err
+	})
+	return token, err
+}
+
+func (s intercepted) PatchUser(ctx context.Context, id models.ID, patch func(user *models.User) error, emailTTL time.Duration, by string) (user *models.User, token string, err error) {
+	err = s.run(ctx, write("patch_user", id), func(ctx context.Context) error {
+		user, token, err = s.store.PatchUser(ctx, id, patch, emailTTL, by)
+		return err
+	})
+	return user, token, err
+}
+
+func (s intercepted) DeleteUser(ctx context.Context, id models.ID, version int64, by string) error {
+	return s.run(ctx, write("delete_user", id), func(ctx context.Context) error {
+		return s.store.DeleteUser(ctx, id, version, by)
+	})
+}
+
+func (s intercepted) DeleteUsers(ctx context.Context, ids []models.ID, by string) (missing []models.ID, err error) {
+	err = s.run(ctx, write("delete_users", ""), func(ctx context.Context) error {
+		missing, err = s.store.DeleteUsers(ctx, ids, by)
+		return err
+	})
+	return missing, err
+}
+
+func (s intercepted) RestoreUser(ctx context.Context, id models.ID, by string) (user *models.User, err error) {
+	err = s.run(ctx, write("restore_user", id), func(ctx context.Context) error {
+		user, err = s.store.RestoreUser(ctx, id, by)
+		return err
+	})
+	return user, err
+}
+
+func (s intercepted) MergeUsers(ctx context.Context, id, sourceID models.ID, by string) (user *models.User, err error) {
+	err = s.run(ctx, write("merge_users", id), func(ctx context.Context) error {
+		user, err = s.store.MergeUsers(ctx, id, sourceID, by)
+		return err
+	})
+	return user, err
+}
+
+func (s intercepted) SetActive(ctx context.Context, id models.ID, active bool, by string) (user *models.User, err error) {
+	err = s.run(ctx, write("set_active", id), func(ctx context.Context) error {
+		user, err = s.store.SetActive(ctx, id, active, by)
+		return err
+	})
+	return user, err
+}
+
+func (s intercepted) Reorder(ctx context.Context, ids []models.ID, by string) error {
+	return s.run(ctx, write("reorder", ""), func(ctx context.Context) error {
+		return s.store.Reorder(ctx, ids, by)
+	})
+}
+
+func (s intercepted) TouchUsers(ctx context.Context, ids []models.ID, by string) (missing []models.ID, err error) {
+	err = s.run(ctx, write("touch_users", ""), func(ctx context.Context) error {
+		missing, err = s.store.TouchUsers(ctx, ids, by)
+		return err
+	})
+	return missing, err
+}
+
+func (s intercepted) MarkWelcomed(ctx context.Context, id models.ID, by string) (user *models.User, err error) {
+	err = s.run(ctx, write("mark_welcomed", id), func(ctx context.Context) error {
+		user, err = s.store.MarkWelcomed(ctx, id, by)
+		return err
+	})
+	return user, err
+}
+
+func (s intercepted) UnmarkWelcomed(ctx context.Context, id models.ID, by string) error {
+	return s.run(ctx, write("unmark_welcomed", id), func(ctx context.Context) error {
+		return s.store.UnmarkWelcomed(ctx, id, by)
+	})
+}
+
+func (s intercepted) CancelEmailChange(ctx context.Context, id models.ID, by string) error {
+	return s.run(ctx, write("cancel_email_change", id), func(ctx context.Context) error {
+		return s.store.CancelEmailChange(ctx, id, by)
+	})
+}
+
+func (s intercepted) ConfirmEmail(ctx context.Context, id models.ID, token, by string) (user *models.User, err error) {
+	err = s.run(ctx, write("confirm_email", id), func(ctx context.Context) error {
+		user, err = s.store.ConfirmEmail(ctx, id, token, by)
+		return err
+	})
+	return user, err
+}
+
+func (s intercepted) CreateAPIKey(ctx context.Context, userID models.ID, name, by string) (key *APIKey, secret string, err error) {
+	err = s.run(ctx, write("create_api_key", userID), func(ctx context.Context) error {
+		key, secret, err = s.store.CreateAPIKey(ctx, userID, name, by)
+		return err
+	})
+	return key, secret, err
+}
+
+func (s intercepted) RevokeAPIKey(ctx context.Context, userID models.ID, keyID, by string) error {
+	return s.run(ctx, write("revoke_api_key", userID), func(ctx context.Context) error {
+		return s.store.RevokeAPIKey(ctx, userID, keyID, by)
+	})
+}
+
+func (s intercepted) Compact(ctx context.Context, age time.Duration, by string) (n int, err error) {
+	err = s.run(ctx, write("compact", ""), func(ctx context.Context) error {
+		n, err = s.store.Compact(ctx, age, by)
+		return err
+	})
+	return n, err
+}
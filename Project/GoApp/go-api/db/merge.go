@@ -0,0 +1,99 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"go-api/events"
+	"go-api/models"
+)
+
+var ErrSelfMerge = errors.New("cannot merge a user into itself")
+
+// merge the duplicate user sourceID into id and soft-delete it, returning
+// the merged user. Fields empty on id are taken from the source, the
+// earliest welcome is kept, and the source's avatar (when id has none), API
+// keys and history move to id. Nothing changes when the merged user would
+// break a unique constraint.
+func MergeUsers(id, sourceID models.ID, by string) (*models.User, error) {
+	if id == sourceID {
+		return nil, ErrSelfMerge
+	}
+	userStore.Lock()
+	defer userStore.Unlock()
+	i, j := indexOf(id), indexOf(sourceID)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if j < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, sourceID)
+	}
+	old, source := userStore.users[i], userStore.users[j]
+	cp := begin(id, sourceID)
+
+	merged := old.Clone()
+	for _, f := range []struct{ into, from *string }{
+		{&merged.Name, &source.Name},
+		{&merged.Email, &source.Email},
+		{&merged.Username, &source.Username},
+		{&merged.Phone, &source.Phone},
+	} {
+		if *f.into == "" {
+			*f.into = *f.from
+		}
+	}
+	if merged.Priority == 0 {
+		merged.Priority = source.Priority
+	}
+	if source.WelcomedAt != nil && (merged.WelcomedAt == nil || source.WelcomedAt.Before(*merged.WelcomedAt)) {
+		at := *source.WelcomedAt
+		merged.WelcomedAt = &at
+	}
+	now := clock.Now()
+	touch(&merged, now)
+
+	// the source goes away in the same step, so its values are free
+	unindexUser(source)
+	if err := checkUnique(merged); err != nil {
+		indexUser(source)
+		return nil, err
+	}
+	userStore.users[j].DeletedAt = &now
+	userStore.users[j].DeletedBy = by
+	delete(userStore.positions, sourceID)
+	userStore.users[j].PendingEmail = ""
+	delete(emailChanges, sourceID)
+	deletedTotal.Add(1)
+
+	if merged.Avatar == nil && source.Avatar != nil {
+		a := *source.Avatar
+		merged.Avatar = &a
+		avatars[id] = avatars[sourceID]
+	}
+	delete(avatars, sourceID)
+	for keyID, k := range apiKeys {
+		if k.UserID == sourceID {
+			k.UserID = id
+			apiKeys[keyID] = k
+		}
+	}
+	userStore.users[i] = merged
+	unindexUser(old)
+	indexUser(merged)
+	notifyUpdate(old, merged, by)
+	notify(events.Deleted, userStore.users[j], by)
+	if err := cp.commit(id, sourceID); err != nil {
+		return nil, err
+	}
+
+	// the histories are only moved once the merge is saved, so a rollback
+	// has nothing to sort back
+	history[id] = append(history[id], history[sourceID]...)
+	sort.SliceStable(history[id], func(a, b int) bool {
+		return history[id][a].Time.Before(history[id][b].Time)
+	})
+	delete(history, sourceID)
+	merged = merged.Clone()
+	return &merged, nil
+}
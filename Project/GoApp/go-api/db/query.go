@@ -0,0 +1,43 @@
+package db
+
+import (
+	"strings"
+
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// UserQuery selects the users GetUsers answers. The zero value is every
+// user, deactivated ones included, by ascending id.
+type UserQuery struct {
+	// values users must have, by field of models.FilterFields, compared
+	// case-insensitively
+	Filters map[string]string
+	// leave deactivated users out
+	ActiveOnly bool
+	// order of the users, ascending id when nil
+	Less func(a, b models.User) bool
+	// window of the matching users to answer, all of them while Limit is 0
+	Page pagination.Page
+	// soft-deleted users too, as a backup needs them
+	IncludeDeleted bool
+	// only the users with ids after it, a cursor through the ascending id
+	// order that changes to the store do not shift as they do Page.Offset
+	After models.ID
+}
+
+func (q UserQuery) matches(u models.User) bool {
+	if q.ActiveOnly && !u.Active {
+		return false
+	}
+	if q.After != "" && !q.After.Less(u.ID) {
+		return false
+	}
+	for field, want := range q.Filters {
+		value, ok := models.FilterFields[field]
+		if !ok || !strings.EqualFold(value(u), want) {
+			return false
+		}
+	}
+	return true
+}
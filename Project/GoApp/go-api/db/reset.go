@@ -0,0 +1,33 @@
+package db
+
+import "go-api/models"
+
+// Reset empties the store as it is before Open or OpenSQL: no users,
+// avatars, history, audit log, API keys or email changes, the counters at
+// zero, no audit limit and nothing saved anywhere. It is for tests, which must not run it
+// while something else uses the store.
+func Reset() {
+	userStore.Lock()
+	defer userStore.Unlock()
+	if walFile != nil {
+		walFile.Close()
+	}
+	walFile, walEvery, walRecords = nil, 0, 0
+	dataFile, sqlDB, keyring, saveErr = "", nil, nil, nil
+
+	userStore.users = nil
+	avatars = map[models.ID][]byte{}
+	apiKeys = map[string]storedKey{}
+	emailChanges = map[models.ID]emailChange{}
+	history = map[models.ID][]HistoryEntry{}
+	audit, auditSeq, unsavedAudit, auditLimit = nil, 0, nil, 0
+	auditByUser = map[models.ID][]int64{}
+	unpublished = nil
+	createdTotal.Store(0)
+	deletedTotal.Store(0)
+	indexHits.Store(0)
+	indexMisses.Store(0)
+	purgedID, lastSeq, seqKnown = 0, 0, false
+	lastModified = clock.Now()
+	reindex()
+}
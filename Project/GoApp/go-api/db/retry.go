@@ -0,0 +1,33 @@
+package db
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryReads wraps store so a read failing because the store is unavailable
+// is made up to retries more times, waiting a jittered, doubling backoff in
+// between, so a flaky backend does not fail reads straight away. Writes are
+// never retried, and neither is a read whose ctx is done. retried is told
+// the operation of every extra attempt.
+func RetryReads(store Store, retries int, backoff time.Duration, retried func(op Operation)) Store {
+	if retries <= 0 {
+		return store
+	}
+	return Intercept(store, func(ctx context.Context, op Operation, call func(ctx context.Context) error) error {
+		err := call(ctx)
+		wait := backoff
+		for attempt := 0; attempt < retries && op.Read && Unavailable(err) && ctx.Err() == nil; attempt++ {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(wait/2 + rand.N(wait/2+1)):
+			}
+			wait *= 2
+			retried(op)
+			err = call(ctx)
+		}
+		return err
+	})
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go-api/models"
+)
+
+// a store whose user reads and creates fail with errs, one a call, then
+// succeed
+type flakyStore struct {
+	Memory
+	errs  []error
+	calls int
+}
+
+func (s *flakyStore) next() error {
+	s.calls++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *flakyStore) GetUser(context.Context, models.ID) (*models.User, error) {
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return &models.User{ID: "1"}, nil
+}
+
+func (s *flakyStore) AddUser(_ context.Context, user models.User, _ string) (*models.User, error) {
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func TestRetryReads(t *testing.T) {
+	tests := []struct {
+		name      string
+		write     bool
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{"read succeeding at once", false, nil, nil, 1},
+		{"read retried until it succeeds", false, []error{ErrUnavailable, ErrUnavailable}, nil, 3},
+		{"read retried on a store timeout", false, []error{context.DeadlineExceeded}, nil, 2},
+		{"read out of retries", false, []error{ErrUnavailable, ErrUnavailable, ErrUnavailable, ErrUnavailable}, ErrUnavailable, 3},
+		{"missing user not retried", false, []error{ErrNotFound}, ErrNotFound, 1},
+		{"write not retried", true, []error{ErrNotSaved}, ErrNotSaved, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &flakyStore{errs: tt.errs}
+			var retried []string
+			s := RetryReads(base, 2, time.Millisecond, func(op Operation) { retried = append(retried, op.Name) })
+
+			var err error
+			if tt.write {
+				_, err = s.AddUser(context.Background(), models.User{}, "test")
+			} else {
+				_, err = s.GetUser(context.Background(), "1")
+			}
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("error %v, want %v", err, tt.wantErr)
+			}
+			if base.calls != tt.wantCalls {
+				t.Errorf("%d calls, want %d", base.calls, tt.wantCalls)
+			}
+			if len(retried) != tt.wantCalls-1 {
+				t.Errorf("%d retries reported, want %d", len(retried), tt.wantCalls-1)
+			}
+			for _, name := range retried {
+				if name != "get_user" {
+					t.Errorf("retry of %s reported, want get_user", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryReadsStopsWithTheRequest(t *testing.T) {
+	base := &flakyStore{errs: []error{ErrUnavailable, ErrUnavailable}}
+	s := RetryReads(base, 5, time.Hour, func(Operation) {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.GetUser(ctx, "1"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("error %v, want the store's", err)
+	}
+	if base.calls != 1 {
+		t.Errorf("%d calls after the request ended, want 1", base.calls)
+	}
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// fields SearchUsers matches, by json name
+var searchFields = []string{"name", "email"}
+
+// inverted index of the words of searchFields to the users having them,
+// soft-deleted users left out, and the words each user is indexed under so
+// it can be taken out again. Guarded by the userStore lock and kept in step
+// with the unique index by indexUser, unindexUser and reindex.
+var (
+	searchIndex = map[string]map[models.ID]struct{}{}
+	searchWords = map[models.ID][]string{}
+)
+
+// how well a word of the index matches a word of a search
+const (
+	fuzzyMatch = iota + 1
+	prefixMatch
+	exactMatch
+)
+
+// words of s for the index and for searches: lower-cased runs of letters
+// and digits, so "Jo.Doe@Example.com" is jo, doe, example and com
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// index the words of user; callers hold the lock
+func indexSearch(user models.User) {
+	unindexSearch(user.ID)
+	var words []string
+	for _, f := range searchFields {
+		words = append(words, searchTerms(reflect.ValueOf(user).Field(stringFields[f]).String())...)
+	}
+	for _, w := range words {
+		if searchIndex[w] == nil {
+			searchIndex[w] = map[models.ID]struct{}{}
+		}
+		searchIndex[w][user.ID] = struct{}{}
+	}
+	searchWords[user.ID] = words
+}
+
+// take the user id out of the index; callers hold the lock
+func unindexSearch(id models.ID) {
+	for _, w := range searchWords[id] {
+		delete(searchIndex[w], id)
+		if len(searchIndex[w]) == 0 {
+			delete(searchIndex, w)
+		}
+	}
+	delete(searchWords, id)
+}
+
+// search the name and email of the users q selects for text and return those
+// matching every word of it, best first, and how many match before q.Page
+// is applied. Words match case-insensitively a word of the user exactly, as
+// its prefix, or fuzzily within one typo for words of 4 letters and up, two
+// for 8 and up. Ties keep the order of q.Less, ascending id when nil.
+func SearchUsers(text string, q UserQuery) ([]models.User, int) {
+	terms := searchTerms(text)
+	userStore.RLock()
+	defer userStore.RUnlock()
+	if len(terms) == 0 {
+		return []models.User{}, 0
+	}
+
+	// score of each user matching every term so far
+	var scores map[models.ID]int
+	for _, term := range terms {
+		best := map[models.ID]int{}
+		for word, ids := range searchIndex {
+			m := wordMatch(term, word)
+			if m == 0 {
+				continue
+			}
+			for id := range ids {
+				if (scores == nil || scores[id] > 0) && m > best[id] {
+					best[id] = m
+				}
+			}
+		}
+		for id, m := range best {
+			best[id] = m + scores[id]
+		}
+		scores = best
+		if len(scores) == 0 {
+			break
+		}
+	}
+
+	users := make([]models.User, 0, len(scores))
+	for _, user := range userStore.users {
+		if _, ok := scores[user.ID]; ok && user.DeletedAt == nil && q.matches(user) {
+			users = append(users, user)
+		}
+	}
+	less := q.Less
+	if less == nil {
+		less = func(a, b models.User) bool { return a.ID.Less(b.ID) }
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if si, sj := scores[users[i].ID], scores[users[j].ID]; si != sj {
+			return si > sj
+		}
+		return less(users[i], users[j])
+	})
+	total := len(users)
+	if q.Page.Limit > 0 {
+		users = pagination.Apply(users, q.Page)
+	}
+	for i := range users {
+		users[i] = users[i].Clone()
+	}
+	return users, total
+}
+
+// how the word of the index matches term, 0 for not at all
+func wordMatch(term, word string) int {
+	switch {
+	case word == term:
+		return exactMatch
+	case strings.HasPrefix(word, term):
+		return prefixMatch
+	}
+	typos := 0
+	switch n := len([]rune(term)); {
+	case n >= 8:
+		typos = 2
+	case n >= 4:
+		typos = 1
+	}
+	if typos > 0 && withinDistance(term, word, typos) {
+		return fuzzyMatch
+	}
+	return 0
+}
+
+// whether the Levenshtein distance of a and b is at most limit
+func withinDistance(a, b string, limit int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > limit || -d > limit {
+		return false
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return false
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)] <= limit
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"go-api/fieldcrypt"
+	"go-api/models"
+)
+
+// SQL persistence, off while sqlDB is nil; guarded by the userStore lock.
+// Statements use $n placeholders and ON CONFLICT, which SQLite and
+// Postgres both take.
+var sqlDB *sql.DB
+
+// longest a statement may take, the userStore lock is held meanwhile
+const sqlTimeout = 10 * time.Second
+
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS users (id TEXT PRIMARY KEY, email TEXT, deleted_at TEXT, record TEXT NOT NULL)`,
+	// a second line of defense behind the unique index in memory; NULLs,
+	// see sqlEmail, never collide
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_email ON users (email)`,
+	`CREATE TABLE IF NOT EXISTS store_state (name TEXT PRIMARY KEY, value TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS audit (seq INTEGER PRIMARY KEY, user_id TEXT NOT NULL, record TEXT NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS audit_user_id ON audit (user_id)`,
+}
+
+// the record column of a row of the users table: a user as the data file
+// keeps it, with its avatar image, hashed API keys and pending email change
+type sqlRecord struct {
+	User        models.User        `json:"user"`
+	Avatar      []byte             `json:"avatar,omitempty"`
+	APIKeys     []storedKey        `json:"api_keys,omitempty"`
+	EmailChange *storedEmailChange `json:"email_change,omitempty"`
+}
+
+// the counters row of the store_state table
+type sqlCounters struct {
+	CreatedTotal int64 `json:"created_total"`
+	DeletedTotal int64 `json:"deleted_total"`
+	PurgedID     int64 `json:"purged_id,omitempty"`
+}
+
+// keep the store in the users, store_state and audit tables of conn instead
+// of a data file, creating them when missing, and load what they hold. Every
+// change is written to its users' rows before it is answered, and undone
+// with an error wrapping ErrNotSaved when the write fails. With a keyring,
+// email, pending email and phone are encrypted in the rows, and the email
+// column holds a digest of the email.
+func OpenSQL(conn *sql.DB, keys *fieldcrypt.Keyring) error {
+	userStore.Lock()
+	defer userStore.Unlock()
+	if dataFile != "" {
+		return fmt.Errorf("the store is already kept in %s", dataFile)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	for _, stmt := range sqlSchema {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("create schema: %w", err)
+		}
+	}
+	sqlDB, keyring = conn, keys
+
+	stale, err := loadSQL(ctx)
+	if err != nil {
+		sqlDB = nil
+		return err
+	}
+	dropped := dropUnconfirmable()
+	if dropped > 0 {
+		log.Printf("db: dropped %d pending emails without a confirmation token", dropped)
+	}
+	reindex()
+	trimAudit()
+	// rewrite values still under an old key (or in plaintext) right away,
+	// and the users whose pending email was dropped
+	if stale || dropped > 0 {
+		return save()
+	}
+	return nil
+}
+
+// the email column of the row of u: the email as the unique constraint on
+// it compares emails, a digest of it with a keyring, or NULL for a
+// soft-deleted user, an empty email or when emails need not be unique;
+// callers hold the lock
+func sqlEmail(u models.User) *string {
+	if u.DeletedAt != nil || !slices.ContainsFunc(uniqueFields, func(fields []string) bool {
+		return slices.Equal(fields, []string{"email"})
+	}) {
+		return nil
+	}
+	key, ok := uniqueKey(u, []string{"email"})
+	if !ok {
+		return nil
+	}
+	if keyring != nil {
+		key = keyring.Digest(key)
+	}
+	return &key
+}
+
+// the deleted_at column of the row of u
+func sqlDeletedAt(u models.User) *string {
+	if u.DeletedAt == nil {
+		return nil
+	}
+	at := u.DeletedAt.UTC().Format(time.RFC3339Nano)
+	return &at
+}
+
+// read the tables into the store, reporting whether rows need rewriting:
+// values under an old key, or an email column out of step with the unique
+// constraints; callers hold the lock
+func loadSQL(ctx context.Context) (bool, error) {
+	rows, err := sqlDB.QueryContext(ctx, `SELECT email, record FROM users`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var users []models.User
+	loadedAvatars := map[models.ID][]byte{}
+	loadedKeys := map[string]storedKey{}
+	loadedChanges := map[models.ID]storedEmailChange{}
+	stale := false
+	for rows.Next() {
+		var data string
+		var email sql.NullString
+		var rec sqlRecord
+		if err := rows.Scan(&email, &data); err != nil {
+			return false, err
+		}
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			return false, fmt.Errorf("read users: %w", err)
+		}
+		u := rec.User.In(time.UTC)
+		if keyring != nil {
+			plain, rotate, err := decryptUser(u)
+			if err != nil {
+				return false, fmt.Errorf("read users: user %s: %w", u.ID, err)
+			}
+			u, stale = plain, stale || rotate
+		}
+		if want := sqlEmail(u); (want != nil) != email.Valid || want != nil && *want != email.String {
+			stale = true
+		}
+		users = append(users, u)
+		if rec.Avatar != nil {
+			loadedAvatars[u.ID] = rec.Avatar
+		}
+		for _, k := range rec.APIKeys {
+			loadedKeys[k.ID] = k
+		}
+		if rec.EmailChange != nil {
+			loadedChanges[u.ID] = *rec.EmailChange
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	var counters sqlCounters
+	var data string
+	err = sqlDB.QueryRowContext(ctx, `SELECT value FROM store_state WHERE name = 'counters'`).Scan(&data)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil {
+		if err := json.Unmarshal([]byte(data), &counters); err != nil {
+			return false, fmt.Errorf("read counters: %w", err)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID.Less(users[j].ID)
+	})
+	userStore.users, seqKnown = users, false
+	avatars, apiKeys = loadedAvatars, loadedKeys
+	emailChanges = map[models.ID]emailChange{}
+	for _, u := range users {
+		if ch, ok := loadedChanges[u.ID]; ok {
+			loadEmailChange(u, &ch)
+		}
+	}
+	createdTotal.Store(counters.CreatedTotal)
+	deletedTotal.Store(counters.DeletedTotal)
+	purgedID = counters.PurgedID
+
+	rotate, err := loadSQLAudit(ctx)
+	return stale || rotate, err
+}
+
+// read the audit table into the audit log, reporting whether values are
+// under an old key; callers hold the lock
+func loadSQLAudit(ctx context.Context) (bool, error) {
+	rows, err := sqlDB.QueryContext(ctx, `SELECT record FROM audit ORDER BY seq`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	stale := false
+	for rows.Next() {
+		var data string
+		var rec auditRecord
+		if err := rows.Scan(&data); err != nil {
+			return false, err
+		}
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			return false, fmt.Errorf("read audit: %w", err)
+		}
+		if keyring != nil {
+			var rotate bool
+			if rec, rotate, err = decryptAudit(rec); err != nil {
+				return false, fmt.Errorf("read audit: entry %d: %w", rec.Seq, err)
+			}
+			stale = stale || rotate
+		}
+		loadAudit(rec)
+	}
+	return stale, rows.Err()
+}
+
+// write the rows of the users ids and the unsaved entries of the audit log,
+// or every user and entry when all is set, in one transaction; callers hold
+// the lock
+func writeSQL(ids []models.ID, all bool) error {
+	if all {
+		ids = make([]models.ID, len(userStore.users))
+		for i, u := range userStore.users {
+			ids[i] = u.ID
+		}
+	}
+	rec, err := recordOf(ids)
+	if err != nil {
+		return err
+	}
+	entries := rec.Audit
+	if all {
+		if entries, err = storedAudit(audit); err != nil {
+			return err
+		}
+	}
+	// the users as in memory, rec holding them encrypted
+	plain := make(map[models.ID]models.User, len(ids))
+	for _, id := range ids {
+		plain[id] = models.User{}
+	}
+	for _, u := range userStore.users {
+		if _, ok := plain[u.ID]; ok {
+			plain[u.ID] = u
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+	tx, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a full write also drops the rows of users purged by Compact. Otherwise
+	// the emails of the rows written are cleared first, so one moving from
+	// a user to another within the change never collides on the way.
+	if all {
+		for _, stmt := range []string{`DELETE FROM users`, `DELETE FROM audit`} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, u := range rec.Users {
+			if _, err := tx.ExecContext(ctx, `UPDATE users SET email = NULL WHERE id = $1`, string(u.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, u := range rec.Users {
+		record := sqlRecord{User: u, Avatar: rec.Avatars[u.ID], APIKeys: rec.APIKeys[u.ID]}
+		if ch, ok := rec.EmailChanges[u.ID]; ok {
+			record.EmailChange = &ch
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO users (id, email, deleted_at, record) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (id) DO UPDATE SET email = excluded.email, deleted_at = excluded.deleted_at, record = excluded.record`,
+			string(u.ID), sqlEmail(plain[u.ID]), sqlDeletedAt(u), string(data)); err != nil {
+			return err
+		}
+	}
+	counters, err := json.Marshal(sqlCounters{CreatedTotal: rec.CreatedTotal, DeletedTotal: rec.DeletedTotal, PurgedID: rec.PurgedID})
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO store_state (name, value) VALUES ('counters', $1)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value`, string(counters)); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO audit (seq, user_id, record) VALUES ($1, $2, $3)
+			ON CONFLICT (seq) DO NOTHING`, entry.Seq, string(entry.UserID), string(data)); err != nil {
+			return err
+		}
+	}
+	// entries trimmed by the limit of the audit log
+	if auditLimit > 0 && len(audit) > 0 {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM audit WHERE seq < $1`, audit[0].Seq); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
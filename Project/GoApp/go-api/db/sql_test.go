@@ -0,0 +1,218 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-api/fieldcrypt"
+	"go-api/models"
+
+	_ "modernc.org/sqlite"
+)
+
+// an empty store kept in a SQLite database in a temporary directory,
+// returning the database to reopen the store from with reopenSQL
+func openSQLite(t *testing.T, keys *fieldcrypt.Keyring) *sql.DB {
+	t.Helper()
+	conn, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	Reset()
+	t.Cleanup(Reset)
+	if err := OpenSQL(conn, keys); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// drop the store as a restart does and load it again from conn
+func reopenSQL(t *testing.T, conn *sql.DB, keys *fieldcrypt.Keyring) {
+	t.Helper()
+	Reset()
+	if err := OpenSQL(conn, keys); err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+}
+
+// a row of the users table
+type sqlRow struct {
+	email, deletedAt sql.NullString
+	record           string
+}
+
+func sqlRows(t *testing.T, conn *sql.DB) map[models.ID]sqlRow {
+	t.Helper()
+	rows, err := conn.Query(`SELECT id, email, deleted_at, record FROM users`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[models.ID]sqlRow{}
+	for rows.Next() {
+		var id string
+		var row sqlRow
+		if err := rows.Scan(&id, &row.email, &row.deletedAt, &row.record); err != nil {
+			t.Fatal(err)
+		}
+		got[models.ID(id)] = row
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func addTestUser(t *testing.T, name string) *models.User {
+	t.Helper()
+	user, err := AddUser(models.User{Name: name, Email: name + "@Example.com"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestSQLRows(t *testing.T) {
+	conn := openSQLite(t, nil)
+	ada, bob := addTestUser(t, "ada"), addTestUser(t, "bob")
+	if _, _, err := PatchUser(ada.ID, func(u *models.User) error { u.Name = "Ada L"; return nil }, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(bob.ID, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := sqlRows(t, conn)
+	if len(rows) != 2 {
+		t.Fatalf("%d rows, want one per user: %v", len(rows), rows)
+	}
+	if row := rows[ada.ID]; row.email.String != "ada@example.com" || row.deletedAt.Valid || !strings.Contains(row.record, `"Ada L"`) {
+		t.Errorf("row of ada %+v", row)
+	}
+	// a deleted user keeps its row, its email free for another
+	if row := rows[bob.ID]; row.email.Valid || !row.deletedAt.Valid {
+		t.Errorf("row of the deleted bob %+v", row)
+	}
+
+	reopenSQL(t, conn, nil)
+	if got := GetUser(ada.ID); got == nil || got.Name != "Ada L" {
+		t.Errorf("reopened ada %+v", got)
+	}
+	if got := GetUser(bob.ID); got != nil {
+		t.Errorf("reopened the deleted bob %+v", got)
+	}
+	if stats := GetStats(); stats.CreatedTotal != 2 || stats.DeletedTotal != 1 {
+		t.Errorf("reopened counters %+v", stats)
+	}
+	if _, err := RestoreUser(bob.ID, "test"); err != nil {
+		t.Errorf("restoring bob after the restart: %v", err)
+	}
+	if row := sqlRows(t, conn)[bob.ID]; row.email.String != "bob@example.com" || row.deletedAt.Valid {
+		t.Errorf("row of the restored bob %+v", row)
+	}
+}
+
+func TestSQLEmailIndex(t *testing.T) {
+	conn := openSQLite(t, nil)
+	ada, bob := addTestUser(t, "ada"), addTestUser(t, "bob")
+
+	// the database rejects a second row with an email, whatever the store
+	_, err := conn.Exec(`INSERT INTO users (id, email, record) VALUES ('x', 'ada@example.com', '{}')`)
+	if err == nil {
+		t.Fatal("inserted a second row with the email of ada")
+	}
+
+	// a write of two rows, the source of the merge deleted
+	if _, err := MergeUsers(ada.ID, bob.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(ada.ID, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	eve, err := AddUser(models.User{Name: "eve", Email: "ADA@example.com"}, "test")
+	if err != nil {
+		t.Fatalf("adding an email freed by a delete: %v", err)
+	}
+
+	// a row the store does not know, say from another process, holding an
+	// email: the write it breaks fails and is undone
+	if _, err := conn.Exec(`INSERT INTO users (id, email, record) VALUES ('x', 'cy@example.com', '{}')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddUser(models.User{Name: "cy", Email: "cy@example.com"}, "test"); !errors.Is(err, ErrNotSaved) {
+		t.Fatalf("adding an email the database holds: error %v, want ErrNotSaved", err)
+	}
+	if n := CountUsers(false); n != 1 {
+		t.Errorf("%d users after the failed write, want eve alone", n)
+	}
+	if _, err := conn.Exec(`DELETE FROM users WHERE id = 'x'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Ping(); err == nil {
+		t.Error("ping after the failed write, want its error")
+	}
+
+	// without the email constraint, the column is left empty
+	if err := SetUniqueFields(nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetUniqueFields([]string{"email"}) })
+	reopenSQL(t, conn, nil)
+	if row := sqlRows(t, conn)[eve.ID]; row.email.Valid {
+		t.Errorf("row of eve %+v, want no email without the constraint", row)
+	}
+	if _, err := AddUser(models.User{Name: "eve", Email: "ada@example.com"}, "test"); err != nil {
+		t.Errorf("adding an email taken without the constraint: %v", err)
+	}
+}
+
+func TestSQLEncrypted(t *testing.T) {
+	keys, err := fieldcrypt.Parse("k1:" + strings.Repeat("A", 43) + "=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := openSQLite(t, keys)
+	ada := addTestUser(t, "ada")
+
+	row := sqlRows(t, conn)[ada.ID]
+	if !row.email.Valid || row.email.String != keys.Digest("ada@example.com") {
+		t.Errorf("email column %q, want the digest of the email", row.email.String)
+	}
+	if strings.Contains(strings.ToLower(row.record), "ada@example.com") {
+		t.Errorf("email in plaintext in the row: %s", row.record)
+	}
+	if _, err := AddUser(models.User{Name: "eve", Email: "ada@example.com"}, "test"); err == nil {
+		t.Error("added a second user with the email")
+	}
+
+	reopenSQL(t, conn, keys)
+	if got := GetUser(ada.ID); got == nil || got.Email != "ada@Example.com" {
+		t.Errorf("reopened ada %+v", got)
+	}
+}
+
+func TestSQLCompact(t *testing.T) {
+	c := useFakeClock(t, time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC))
+	conn := openSQLite(t, nil)
+	ada, bob := addTestUser(t, "ada"), addTestUser(t, "bob")
+	if err := DeleteUser(bob.ID, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	c.advance(time.Hour)
+	if n, err := Compact(time.Minute, "test"); err != nil || n != 1 {
+		t.Fatalf("compact: purged %d, %v", n, err)
+	}
+	rows := sqlRows(t, conn)
+	if _, ok := rows[bob.ID]; ok || len(rows) != 1 {
+		t.Errorf("rows after the compaction %v, want ada's alone", rows)
+	}
+	reopenSQL(t, conn, nil)
+	if GetUser(ada.ID) == nil {
+		t.Error("ada gone after the compaction")
+	}
+}
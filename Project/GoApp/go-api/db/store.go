@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// Store is what the handlers read and write users through, so wrappers such
+// as Instrumented see every call. ctx is the context of the request a call
+// is made for. A missing user is ErrNotFound, and a store that cannot be
+// reached fails calls with an error wrapping ErrUnavailable.
+type Store interface {
+	GetUsers(ctx context.Context, q UserQuery) ([]models.User, int, error)
+	GetUser(ctx context.Context, id models.ID) (*models.User, error)
+	SearchUsers(ctx context.Context, text string, q UserQuery) ([]models.User, int, error)
+	CountUsers(ctx context.Context, includeDeleted bool) (int, error)
+	GetStats(ctx context.Context) (Stats, error)
+	LastModified(ctx context.Context) (time.Time, error)
+	CheckUnique(ctx context.Context, user models.User) error
+	GetAvatar(ctx context.Context, id models.ID) (*AvatarImage, error)
+	History(ctx context.Context, id models.ID) ([]HistoryEntry, error)
+	Audit(ctx context.Context, id models.ID, page pagination.Page) ([]AuditEntry, int, error)
+	APIKeys(ctx context.Context, userID models.ID) ([]APIKey, error)
+	AuthenticateAPIKey(ctx context.Context, key string) (models.ID, bool, error)
+
+	// by names who makes the change, for the history and audit log
+	AddUser(ctx context.Context, user models.User, by string) (*models.User, error)
+	AddUsers(ctx context.Context, users []models.User, atomic bool, by string) ([]models.User, []error, error)
+	UpdateUser(ctx context.Context, id models.ID, user models.User, avatar *AvatarImage, emailTTL time.Duration, by string) (string, error)
+	PatchUser(ctx context.Context, id models.ID, patch func(user *models.User) error, emailTTL time.Duration, by string) (*models.User, string, error)
+	DeleteUser(ctx context.Context, id models.ID, version int64, by string) error
+	DeleteUsers(ctx context.Context, ids []models.ID, by string) ([]models.ID, error)
+	RestoreUser(ctx context.Context, id models.ID, by string) (*models.User, error)
+	MergeUsers(ctx context.Context, id, sourceID models.ID, by string) (*models.User, error)
+	SetActive(ctx context.Context, id models.ID, active bool, by string) (*models.User, error)
+	Reorder(ctx context.Context, ids []models.ID, by string) error
+	TouchUsers(ctx context.Context, ids []models.ID, by string) ([]models.ID, error)
+	MarkWelcomed(ctx context.Context, id models.ID, by string) (*models.User, error)
+	UnmarkWelcomed(ctx context.Context, id models.ID, by string) error
+	CancelEmailChange(ctx context.Context, id models.ID, by string) error
+	ConfirmEmail(ctx context.Context, id models.ID, token, by string) (*models.User, error)
+	CreateAPIKey(ctx context.Context, userID models.ID, name, by string) (*APIKey, string, error)
+	RevokeAPIKey(ctx context.Context, userID models.ID, keyID, by string) error
+	Compact(ctx context.Context, age time.Duration, by string) (int, error)
+}
+
+// Memory is the store of this package: users in memory, saved to a data
+// file by Open or to a database by OpenSQL. It answers right away and
+// ignores ctx; its reads only fail with ErrNotFound.
+type Memory struct{}
+
+func (Memory) GetUsers(_ context.Context, q UserQuery) ([]models.User, int, error) {
+	users, total := GetUsers(q)
+	return users, total, nil
+}
+
+func (Memory) GetUser(_ context.Context, id models.ID) (*models.User, error) {
+	if user := GetUser(id); user != nil {
+		return user, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (Memory) SearchUsers(_ context.Context, text string, q UserQuery) ([]models.User, int, error) {
+	users, total := SearchUsers(text, q)
+	return users, total, nil
+}
+
+func (Memory) CountUsers(_ context.Context, includeDeleted bool) (int, error) {
+	return CountUsers(includeDeleted), nil
+}
+
+func (Memory) GetStats(context.Context) (Stats, error)         { return GetStats(), nil }
+func (Memory) LastModified(context.Context) (time.Time, error) { return LastModified(), nil }
+
+func (Memory) CheckUnique(_ context.Context, user models.User) error { return CheckUnique(user) }
+
+func (Memory) GetAvatar(_ context.Context, id models.ID) (*AvatarImage, error) { return GetAvatar(id) }
+
+func (Memory) History(_ context.Context, id models.ID) ([]HistoryEntry, error) { return History(id) }
+
+func (Memory) Audit(_ context.Context, id models.ID, page pagination.Page) ([]AuditEntry, int, error) {
+	entries, total := Audit(id, page)
+	return entries, total, nil
+}
+
+func (Memory) APIKeys(_ context.Context, userID models.ID) ([]APIKey, error) { return APIKeys(userID) }
+
+func (Memory) AuthenticateAPIKey(_ context.Context, key string) (models.ID, bool, error) {
+	id, ok := AuthenticateAPIKey(key)
+	return id, ok, nil
+}
+
+func (Memory) AddUser(_ context.Context, user models.User, by string) (*models.User, error) {
+	return AddUser(user, by)
+}
+
+func (Memory) AddUsers(_ context.Context, users []models.User, atomic bool, by string) ([]models.User, []error, error) {
+	return AddUsers(users, atomic, by)
+}
+
+func (Memory) UpdateUser(_ context.Context, id models.ID, user models.User, avatar *AvatarImage, emailTTL time.Duration, by string) (string, error) {
+	return UpdateUser(id, user, avatar, emailTTL, by)
+}
+
+func (Memory) PatchUser(_ context.Context, id models.ID, patch func(user *models.User) error, emailTTL time.Duration, by string) (*models.User, string, error) {
+	return PatchUser(id, patch, emailTTL, by)
+}
+
+func (Memory) DeleteUser(_ context.Context, id models.ID, version int64, by string) error {
+	return DeleteUser(id, version, by)
+}
+
+func (Memory) DeleteUsers(_ context.Context, ids []models.ID, by string) ([]models.ID, error) {
+	return DeleteUsers(ids, by)
+}
+
+func (Memory) RestoreUser(_ context.Context, id models.ID, by string) (*models.User, error) {
+	return RestoreUser(id, by)
+}
+
+func (Memory) MergeUsers(_ context.Context, id, sourceID models.ID, by string) (*models.User, error) {
+	return MergeUsers(id, sourceID, by)
+}
+
+func (Memory) SetActive(_ context.Context, id models.ID, active bool, by string) (*models.User, error) {
+	return SetActive(id, active, by)
+}
+
+func (Memory) Reorder(_ context.Context, ids []models.ID, by string) error { return Reorder(ids, by) }
+
+func (Memory) TouchUsers(_ context.Context, ids []models.ID, by string) ([]models.ID, error) {
+	return TouchUsers(ids, by)
+}
+
+func (Memory) MarkWelcomed(_ context.Context, id models.ID, by string) (*models.User, error) {
+	return MarkWelcomed(id, by)
+}
+
+func (Memory) UnmarkWelcomed(_ context.Context, id models.ID, by string) error {
+	return UnmarkWelcomed(id, by)
+}
+
+func (Memory) CancelEmailChange(_ context.Context, id models.ID, by string) error {
+	return CancelEmailChange(id, by)
+}
+
+func (Memory) ConfirmEmail(_ context.Context, id models.ID, token, by string) (*models.User, error) {
+	return ConfirmEmail(id, token, by)
+}
+
+func (Memory) CreateAPIKey(_ context.Context, userID models.ID, name, by string) (*APIKey, string, error) {
+	return CreateAPIKey(userID, name, by)
+}
+
+func (Memory) RevokeAPIKey(_ context.Context, userID models.ID, keyID, by string) error {
+	return RevokeAPIKey(userID, keyID, by)
+}
+
+func (Memory) Compact(_ context.Context, age time.Duration, by string) (int, error) {
+	return Compact(age, by)
+}
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go-api/models"
+	"go-api/pagination"
+)
+
+// goroutines of the stress test, each making its own users through every
+// kind of change while reading everyone's
+const (
+	stressWorkers = 16
+	stressUsers   = 100
+)
+
+// what a worker of the stress test left in the store
+type stressResult struct {
+	// every user it created, and those it deleted
+	created, deleted []models.ID
+	// patches of the users it kept
+	patches map[models.ID]int64
+}
+
+// make and change the users of worker w, checking each answer, and read
+// the others' users; the users answered are scribbled over, as callers may,
+// so the race detector catches any the store still holds
+func stressWorker(t *testing.T, w int) stressResult {
+	res := stressResult{patches: map[models.ID]int64{}}
+	for i := range stressUsers {
+		name := fmt.Sprintf("w%d-%d", w, i)
+		user, err := AddUser(models.User{Name: name, Email: name + "@example.com"}, "stress")
+		if err != nil {
+			t.Errorf("create %s: %v", name, err)
+			return res
+		}
+		res.created = append(res.created, user.ID)
+		user.Name = "scribbled"
+
+		got := GetUser(user.ID)
+		if got == nil || got.Name != name {
+			t.Errorf("read of %s just created: %+v", user.ID, got)
+			return res
+		}
+		got.Name = "scribbled"
+
+		patched, _, err := PatchUser(user.ID, func(u *models.User) error { u.Priority = i; return nil }, 0, "stress")
+		if err != nil || patched.Version != 2 {
+			t.Errorf("patch of %s: %+v, %v", user.ID, patched, err)
+			return res
+		}
+		patched.Name = "scribbled"
+
+		users, total := GetUsers(UserQuery{Page: pagination.Page{Limit: 20, Offset: i}})
+		if len(users) > total {
+			t.Errorf("page of %d users of %d", len(users), total)
+		}
+		for j := range users {
+			if users[j].ID == "" {
+				t.Errorf("user with no id listed: %+v", users[j])
+			}
+			users[j].Name = "scribbled"
+		}
+		if found, _ := SearchUsers(name, UserQuery{}); len(found) == 0 {
+			t.Errorf("search for %s found nothing", name)
+		}
+
+		switch i % 4 {
+		case 0:
+			if err := DeleteUser(user.ID, 2, "stress"); err != nil {
+				t.Errorf("delete of %s: %v", user.ID, err)
+			}
+			res.deleted = append(res.deleted, user.ID)
+			if err := DeleteUser(user.ID, 0, "stress"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("second delete of %s: %v", user.ID, err)
+			}
+		case 1:
+			// a stale version fails whatever the others do
+			if err := DeleteUser(user.ID, 1, "stress"); !errors.Is(err, ErrStale) {
+				t.Errorf("delete of %s at a stale version: %v", user.ID, err)
+			}
+			res.patches[user.ID] = 1
+		case 2:
+			if _, err := SetActive(user.ID, false, "stress"); err != nil {
+				t.Errorf("deactivate %s: %v", user.ID, err)
+			}
+			res.patches[user.ID] = 2
+		default:
+			res.patches[user.ID] = 1
+		}
+	}
+	// a batch delete of a user already deleted deletes nothing
+	if len(res.deleted) > 1 {
+		if deleted, err := DeleteUsers(res.deleted[:1], "stress"); err != nil || len(deleted) != 0 {
+			t.Errorf("batch delete of a deleted user: deleted %v, %v", deleted, err)
+		}
+	}
+	return res
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	Reset()
+	t.Cleanup(Reset)
+
+	results := make([]stressResult, stressWorkers)
+	var wg sync.WaitGroup
+	for w := range stressWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[w] = stressWorker(t, w)
+		}()
+	}
+	// a reader of the whole store next to the writers
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 200 {
+			users, _ := GetUsers(UserQuery{ActiveOnly: true})
+			for i := range users {
+				users[i].Email = "scribbled"
+			}
+			CountUsers(true)
+			CheckIntegrity()
+		}
+	}()
+	wg.Wait()
+	<-done
+	if t.Failed() {
+		return
+	}
+
+	seen := map[models.ID]bool{}
+	kept := 0
+	for _, res := range results {
+		for _, id := range res.created {
+			if seen[id] {
+				t.Errorf("id %s given to two users", id)
+			}
+			seen[id] = true
+		}
+		for _, id := range res.deleted {
+			if GetUser(id) != nil {
+				t.Errorf("deleted user %s still read", id)
+			}
+		}
+		for id, patches := range res.patches {
+			user := GetUser(id)
+			if user == nil {
+				t.Errorf("user %s lost", id)
+				continue
+			}
+			if user.Version != 1+patches || user.Name == "scribbled" || user.Email == "scribbled" {
+				t.Errorf("user %s at version %d with name %q and email %q, want version %d as stored", id, user.Version, user.Name, user.Email, 1+patches)
+			}
+			kept++
+		}
+	}
+	if len(seen) != stressWorkers*stressUsers {
+		t.Errorf("%d users created, want %d", len(seen), stressWorkers*stressUsers)
+	}
+	if n := CountUsers(false); n != kept {
+		t.Errorf("%d users counted, want the %d kept", n, kept)
+	}
+	users, total := GetUsers(UserQuery{})
+	if total != kept {
+		t.Errorf("%d users listed, want the %d kept", total, kept)
+	}
+	for _, user := range users {
+		if user.ID == "" || !seen[user.ID] {
+			t.Errorf("listed user %+v was never created", user)
+		}
+	}
+	if report := CheckIntegrity(); !report.OK() {
+		t.Errorf("integrity problems: %v", report.Problems)
+	}
+}
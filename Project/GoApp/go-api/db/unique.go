@@ -0,0 +1,145 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go-api/models"
+)
+
+// ConflictError reports the unique constraint a write would violate
+type ConflictError struct {
+	Constraint string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("unique constraint %q violated", e.Constraint)
+}
+
+// unique constraints, each a set of json field names whose combined values
+// may appear only once in the store; guarded by the userStore lock
+var uniqueFields = [][]string{{"email"}}
+
+// for each constraint of uniqueFields, the id of the user holding each key,
+// soft-deleted users left out, so checks don't scan the store. Guarded by
+// the userStore lock; writes keep it in step with indexUser and
+// unindexUser, and bulk changes rebuild it with reindex.
+var uniqueIndex = []map[string]models.ID{{}}
+
+// index of every string field of models.User by its json name
+var stringFields = func() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(models.User{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Type.Kind() == reflect.String && name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	return fields
+}()
+
+// replace the unique constraints, each given as a field name or as a
+// composite of names joined by "+", e.g. "email", "username", "name+phone"
+func SetUniqueFields(constraints []string) error {
+	var parsed [][]string
+	for _, c := range constraints {
+		fields := strings.Split(c, "+")
+		for _, f := range fields {
+			if _, ok := stringFields[f]; !ok {
+				return fmt.Errorf("unique constraint %q: unknown field %q", c, f)
+			}
+		}
+		parsed = append(parsed, fields)
+	}
+	userStore.Lock()
+	defer userStore.Unlock()
+	uniqueFields = parsed
+	reindex()
+	return nil
+}
+
+// check user against the unique constraints without writing it
+func CheckUnique(user models.User) error {
+	user.Normalize()
+	userStore.RLock()
+	defer userStore.RUnlock()
+	return checkUnique(user)
+}
+
+// check user against every constraint, ignoring the stored record with the
+// same id and soft-deleted ones; callers hold the lock. Constraints with an
+// empty value are skipped.
+func checkUnique(user models.User) error {
+	for n, fields := range uniqueFields {
+		key, ok := uniqueKey(user, fields)
+		if !ok {
+			continue
+		}
+		if id, taken := uniqueIndex[n][key]; taken && id != user.ID {
+			return &ConflictError{Constraint: strings.Join(fields, "+")}
+		}
+	}
+	return nil
+}
+
+// add the keys of a stored user to the index, a no-op for soft-deleted
+// users; callers hold the lock
+func indexUser(user models.User) {
+	if user.DeletedAt != nil {
+		return
+	}
+	for n, fields := range uniqueFields {
+		if key, ok := uniqueKey(user, fields); ok {
+			uniqueIndex[n][key] = user.ID
+		}
+	}
+	indexSearch(user)
+}
+
+// remove the keys of user from the index, before it changes or goes away;
+// callers hold the lock. Keys another user holds are left alone, which only
+// happens in a store that already broke a constraint, see CheckIntegrity.
+func unindexUser(user models.User) {
+	for n, fields := range uniqueFields {
+		if key, ok := uniqueKey(user, fields); ok && uniqueIndex[n][key] == user.ID {
+			delete(uniqueIndex[n], key)
+		}
+	}
+	unindexSearch(user.ID)
+}
+
+// rebuild the index, the search index and the positions from the store;
+// callers hold the lock
+func reindex() {
+	reposition()
+	uniqueIndex = make([]map[string]models.ID, len(uniqueFields))
+	for n := range uniqueIndex {
+		uniqueIndex[n] = map[string]models.ID{}
+	}
+	searchIndex, searchWords = map[string]map[models.ID]struct{}{}, map[models.ID][]string{}
+	for _, u := range userStore.users {
+		indexUser(u)
+	}
+}
+
+// the values of fields joined, false when one is empty. Values are
+// normalized as models.User.Normalize stores them, and emails compare
+// case-insensitively, so "Jo@Example.com" and "jo@example.com" collide
+// whatever path the user came in by.
+func uniqueKey(user models.User, fields []string) (string, bool) {
+	v := reflect.ValueOf(user)
+	values := make([]string, len(fields))
+	for i, f := range fields {
+		values[i] = strings.TrimSpace(v.Field(stringFields[f]).String())
+		if f == "email" || f == "pending_email" {
+			values[i] = strings.ToLower(values[i])
+		}
+		if values[i] == "" {
+			return "", false
+		}
+	}
+	return strings.Join(values, "\x00"), true
+}
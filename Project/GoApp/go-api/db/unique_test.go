@@ -0,0 +1,180 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+
+	"go-api/models"
+)
+
+// the emails the random changes pick from: a few addresses, each spelled
+// in ways that must collide
+var fuzzEmails = []string{
+	"ada@example.com", "ADA@example.com", " Ada@Example.COM ",
+	"bob@example.com", "Bob@example.com\t",
+	"eve@example.com",
+	"",
+}
+
+// the unique index as a scan of the store finds it: the trimmed, lowercased
+// email of each user not deleted, and the keys more than one of them holds.
+// Callers hold the lock.
+func scanEmails() (map[string]models.ID, []string) {
+	holders := map[string]models.ID{}
+	var shared []string
+	for _, u := range userStore.users {
+		key := strings.ToLower(strings.TrimSpace(u.Email))
+		if u.DeletedAt != nil || key == "" {
+			continue
+		}
+		if _, ok := holders[key]; ok {
+			shared = append(shared, key)
+		}
+		holders[key] = u.ID
+	}
+	return holders, shared
+}
+
+// whether a scan finds the email held by a user not deleted other than id
+func emailTaken(email string, id models.ID) bool {
+	userStore.RLock()
+	defer userStore.RUnlock()
+	holders, _ := scanEmails()
+	holder, ok := holders[strings.ToLower(strings.TrimSpace(email))]
+	return ok && holder != id
+}
+
+// check the index against a scan of the store
+func checkIndex(t *testing.T, step string) {
+	t.Helper()
+	userStore.RLock()
+	defer userStore.RUnlock()
+	holders, shared := scanEmails()
+	if len(shared) > 0 {
+		t.Fatalf("%s: emails %q held by several users", step, shared)
+	}
+	if !maps.Equal(uniqueIndex[0], holders) {
+		t.Fatalf("%s: index %v, scan %v", step, uniqueIndex[0], holders)
+	}
+}
+
+// check err is a conflict exactly when the scan found the email taken
+func checkConflict(t *testing.T, step string, err error, taken bool) {
+	t.Helper()
+	var conflict *ConflictError
+	if errors.As(err, &conflict) != taken {
+		t.Fatalf("%s: error %v, taken %v", step, err, taken)
+	}
+	if err != nil && !taken {
+		t.Fatalf("%s: %v", step, err)
+	}
+}
+
+// each pair of bytes of ops is a change, the first picking what the change
+// is, the second the user and the email it changes
+func FuzzUniqueIndex(f *testing.F) {
+	// changes of the email in another case, and to one taken
+	f.Add([]byte{0, 0, 0, 3, 1, 1, 2, 1, 1, 3, 2, 0})
+	// an email taken while deleted, then restored and confirmed after
+	f.Add([]byte{0, 0, 0, 3, 1, 7, 3, 0, 0, 1, 1, 8, 4, 0, 2, 1})
+	// batches, merges and deactivations
+	f.Add([]byte{5, 3, 0, 5, 6, 7, 0, 6, 5, 0, 7, 0, 6, 14, 0, 2})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		Reset()
+		t.Cleanup(Reset)
+		var ids []models.ID
+		// the token of the email change staged for each user
+		tokens := map[models.ID]string{}
+		for n := 0; n+1 < len(ops); n += 2 {
+			arg := int(ops[n+1])
+			email := fuzzEmails[arg%len(fuzzEmails)]
+			var id models.ID
+			if len(ids) > 0 {
+				id = ids[arg%len(ids)]
+			}
+			op := ops[n] % 8
+			step := fmt.Sprintf("change %d (%d %q of %s)", n/2, op, email, id)
+			switch {
+			case op == 0 || id == "":
+				taken := emailTaken(email, "")
+				user, err := AddUser(models.User{Name: "user", Email: email}, "fuzz")
+				checkConflict(t, step, err, taken)
+				if err == nil {
+					ids = append(ids, user.ID)
+				}
+			case op == 1:
+				taken := emailTaken(email, id)
+				if user := GetUser(id); user != nil && user.PendingEmail == strings.TrimSpace(email) {
+					// the change stays pending as it was, checked when
+					// it is confirmed
+					taken = false
+				}
+				_, token, err := PatchUser(id, func(u *models.User) error { u.PendingEmail = email; return nil }, time.Hour, "fuzz")
+				if !errors.Is(err, ErrNotFound) {
+					checkConflict(t, step, err, taken)
+				}
+				if token != "" {
+					tokens[id] = token
+				}
+			case op == 2:
+				user := GetUser(id)
+				if user == nil || user.PendingEmail == "" {
+					break
+				}
+				taken := emailTaken(user.PendingEmail, id)
+				_, err := ConfirmEmail(id, tokens[id], "fuzz")
+				checkConflict(t, step, err, taken)
+			case op == 3:
+				if err := DeleteUser(id, 0, "fuzz"); err != nil && !errors.Is(err, ErrNotFound) {
+					t.Fatalf("%s: %v", step, err)
+				}
+			case op == 4:
+				var deleted *models.User
+				userStore.RLock()
+				for _, u := range userStore.users {
+					if u.ID == id && u.DeletedAt != nil {
+						deleted = &u
+					}
+				}
+				userStore.RUnlock()
+				if deleted == nil {
+					break
+				}
+				taken := emailTaken(deleted.Email, id)
+				_, err := RestoreUser(id, "fuzz")
+				checkConflict(t, step, err, taken)
+			case op == 5:
+				// a batch of two with the same email, the second taken by
+				// the first whatever the store holds
+				taken := emailTaken(email, "")
+				batch := []models.User{{Name: "user", Email: email}, {Name: "user", Email: email}}
+				added, errs, err := AddUsers(batch, false, "fuzz")
+				if err != nil {
+					t.Fatalf("%s: %v", step, err)
+				}
+				checkConflict(t, step, errs[0], taken)
+				checkConflict(t, step, errs[1], email != "")
+				for _, u := range added {
+					ids = append(ids, u.ID)
+				}
+			case op == 6:
+				// merges of a user into itself or a gone one fail, and
+				// must leave the index as it was
+				source := ids[(arg/len(fuzzEmails))%len(ids)]
+				MergeUsers(id, source, "fuzz")
+			default:
+				if _, err := SetActive(id, arg%2 == 0, "fuzz"); err != nil && !errors.Is(err, ErrNotFound) {
+					t.Fatalf("%s: %v", step, err)
+				}
+			}
+			checkIndex(t, step)
+		}
+		if report := CheckIntegrity(); !report.OK() {
+			t.Errorf("integrity problems: %v", report.Problems)
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"go-api/models"
+)
+
+// write-ahead log next to the data file, off until UseWAL: every mutation
+// appends the users it touched, synced to disk, and the whole data file is
+// only rewritten every walEvery records, which empties the log again.
+// Guarded by the userStore lock.
+var (
+	walFile    *os.File
+	walEvery   int
+	walRecords int
+)
+
+// one mutation: the full state of the users it touched, their avatars, API
+// keys and email changes, the counters, and the entries of the audit log
+// not saved yet, numbered so replaying a record twice does no harm
+type walRecord struct {
+	Users        []models.User                   `json:"users"`
+	Avatars      map[models.ID][]byte            `json:"avatars,omitempty"`
+	APIKeys      map[models.ID][]storedKey       `json:"api_keys,omitempty"`
+	EmailChanges map[models.ID]storedEmailChange `json:"email_changes,omitempty"`
+	CreatedTotal int64                           `json:"created_total"`
+	DeletedTotal int64                           `json:"deleted_total"`
+	PurgedID     int64                           `json:"purged_id,omitempty"`
+	Audit        []auditRecord                   `json:"audit,omitempty"`
+}
+
+func walPath() string {
+	return dataFile + ".wal"
+}
+
+// log mutations instead of saving the data file on each of them, rewriting
+// it after every records of them; call it after Open
+func UseWAL(every int) error {
+	userStore.Lock()
+	defer userStore.Unlock()
+	if dataFile == "" {
+		return errors.New("the write-ahead log needs a data file")
+	}
+	f, err := os.OpenFile(walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	walFile, walEvery, walRecords = f, max(every, 1), 0
+	return nil
+}
+
+// append the state of the users ids to the log, saving the data file once
+// the log is long enough; callers hold the lock
+func appendWAL(ids []models.ID) error {
+	rec, err := recordOf(ids)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := walFile.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := walFile.Sync(); err != nil {
+		return err
+	}
+	// the change is safe in the log from here, a failed save of the data
+	// file is only logged and tried again with the next record
+	if walRecords++; walRecords >= walEvery {
+		if err := save(); err != nil {
+			log.Printf("db: saving %s, the log is kept: %v", dataFile, err)
+		}
+	}
+	return nil
+}
+
+// the state of the users ids and the unsaved entries of the audit log as
+// stored, encrypted with the keyring if there is one; callers hold the lock
+func recordOf(ids []models.ID) (walRecord, error) {
+	entries, err := storedAudit(unsavedAudit)
+	if err != nil {
+		return walRecord{}, err
+	}
+	rec := walRecord{
+		Avatars:      map[models.ID][]byte{},
+		APIKeys:      map[models.ID][]storedKey{},
+		EmailChanges: map[models.ID]storedEmailChange{},
+		CreatedTotal: createdTotal.Load(),
+		DeletedTotal: deletedTotal.Load(),
+		PurgedID:     purgedID,
+		Audit:        entries,
+	}
+	for _, id := range ids {
+		// soft-deleted users are logged as well, indexOf skips them
+		for _, u := range userStore.users {
+			if u.ID != id {
+				continue
+			}
+			if keyring != nil {
+				var err error
+				if u, err = encryptUser(u); err != nil {
+					return rec, err
+				}
+			}
+			rec.Users = append(rec.Users, u)
+			if data, ok := avatars[id]; ok {
+				rec.Avatars[id] = data
+			}
+			if ch := storedEmailChangeOf(id); ch != nil {
+				rec.EmailChanges[id] = *ch
+			}
+		}
+		rec.APIKeys[id] = []storedKey{}
+	}
+	for _, k := range apiKeys {
+		if keys, ok := rec.APIKeys[k.UserID]; ok {
+			rec.APIKeys[k.UserID] = append(keys, k)
+		}
+	}
+	return rec, nil
+}
+
+// apply the records of the log at path to the store loaded from the data
+// file, returning how many there were and whether the log held anything. A
+// torn last line, from a crash in the middle of a write, ends the replay.
+// Callers hold the lock.
+func replayWAL(path string) (int, bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	n := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			log.Printf("db: %s: record %d is incomplete, ignoring the rest", path, n+1)
+			break
+		}
+		if err := applyWAL(rec); err != nil {
+			return n, true, fmt.Errorf("replay %s: record %d: %w", path, n+1, err)
+		}
+		n++
+	}
+	return n, len(data) > 0, scanner.Err()
+}
+
+func applyWAL(rec walRecord) error {
+	for _, u := range rec.Users {
+		if keyring != nil {
+			var err error
+			if u, _, err = decryptUser(u); err != nil {
+				return err
+			}
+		}
+		replaced := false
+		for i := range userStore.users {
+			if userStore.users[i].ID == u.ID {
+				userStore.users[i], replaced = u, true
+			}
+		}
+		if !replaced {
+			userStore.users = append(userStore.users, u)
+		}
+		if data, ok := rec.Avatars[u.ID]; ok {
+			avatars[u.ID] = data
+		} else {
+			delete(avatars, u.ID)
+		}
+		var change *storedEmailChange
+		if ch, ok := rec.EmailChanges[u.ID]; ok {
+			change = &ch
+		}
+		loadEmailChange(u, change)
+	}
+	for id, keys := range rec.APIKeys {
+		for keyID, k := range apiKeys {
+			if k.UserID == id {
+				delete(apiKeys, keyID)
+			}
+		}
+		for _, k := range keys {
+			apiKeys[k.ID] = k
+		}
+	}
+	for _, entry := range rec.Audit {
+		if keyring != nil {
+			var err error
+			if entry, _, err = decryptAudit(entry); err != nil {
+				return err
+			}
+		}
+		loadAudit(entry)
+	}
+	createdTotal.Store(rec.CreatedTotal)
+	deletedTotal.Store(rec.DeletedTotal)
+	purgedID = rec.PurgedID
+	seqKnown = false
+	return nil
+}
+
+// empty the log after the data file was saved; callers hold the lock
+func truncateWAL() error {
+	walRecords = 0
+	if walFile != nil {
+		return walFile.Truncate(0)
+	}
+	// a log left by an earlier run, already replayed
+	if err := os.Remove(walPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
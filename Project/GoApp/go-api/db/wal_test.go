@@ -0,0 +1,130 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-api/models"
+)
+
+// the lines of the write-ahead log of the data file at path, none if it is
+// gone
+func walLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path + ".wal")
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+// check the store holds ada renamed, bob deleted and cy
+func checkReplayed(t *testing.T, step string, ada, bob, cy models.ID) {
+	t.Helper()
+	if got := GetUser(ada); got == nil || got.Name != "Ada L" {
+		t.Errorf("%s: ada %+v, want her renamed", step, got)
+	}
+	if got := GetUser(bob); got != nil {
+		t.Errorf("%s: bob %+v, want him deleted", step, got)
+	}
+	if got := GetUser(cy); got == nil || got.Email != "cy@example.com" {
+		t.Errorf("%s: cy %+v, want him created", step, got)
+	}
+	if report := CheckIntegrity(); !report.OK() {
+		t.Errorf("%s: integrity problems: %v", step, report.Problems)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	tests := []struct {
+		name  string
+		every int
+		// a record cut short by the crash, after the others
+		torn string
+		// the records in the log at the crash
+		logged int
+	}{
+		{"stale data file", 100, "", 4},
+		{"torn last record", 100, `{"users":[{"id":"9","name":"Dan"`, 4},
+		{"data file saved", 2, "", 0},
+		{"data file saved, then a record", 3, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			Reset()
+			t.Cleanup(Reset)
+			if err := Open(path, nil); err != nil {
+				t.Fatal(err)
+			}
+			add := func(name string) models.ID {
+				t.Helper()
+				user, err := AddUser(models.User{Name: name, Email: name + "@example.com"}, "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+				return user.ID
+			}
+			// saved to the data file before the log is on
+			ada := add("ada")
+			if err := UseWAL(tt.every); err != nil {
+				t.Fatal(err)
+			}
+			bob := add("bob")
+			if _, _, err := PatchUser(ada, func(u *models.User) error { u.Name = "Ada L"; return nil }, 0, "test"); err != nil {
+				t.Fatal(err)
+			}
+			if err := DeleteUser(bob, 0, "test"); err != nil {
+				t.Fatal(err)
+			}
+			cy := add("cy")
+			if n := walLines(t, path); n != tt.logged {
+				t.Fatalf("%d records logged at the crash, want %d", n, tt.logged)
+			}
+			// the last change is only in the log, unless it was just saved
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved := bytes.Contains(data, []byte("cy@example.com")); saved != (tt.logged == 0) {
+				t.Fatalf("last change saved to the data file %v, with %d records logged", saved, tt.logged)
+			}
+			if tt.torn != "" {
+				f, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0o600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.WriteString(tt.torn); err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			}
+
+			// a crash: the store is dropped without saving
+			Reset()
+			if err := Open(path, nil); err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			checkReplayed(t, "replayed", ada, bob, cy)
+			if GetUser("9") != nil {
+				t.Error("the torn record was replayed")
+			}
+			if info, err := os.Stat(path + ".wal"); err == nil && info.Size() > 0 {
+				t.Errorf("log of %d bytes left after the replay was saved", info.Size())
+			}
+
+			// the replayed changes are in the data file now
+			Reset()
+			if err := Open(path, nil); err != nil {
+				t.Fatal(err)
+			}
+			checkReplayed(t, "reopened", ada, bob, cy)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package dedupe
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"go-api/models"
+)
+
+// Window remembers the users created from each request body for a while, so
+// an accidental resubmit of the same body gets the earlier user back instead
+// of a second one
+type Window struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	seen map[[sha256.Size]byte]entry
+}
+
+type entry struct {
+	id models.ID
+	at time.Time
+}
+
+func New(ttl time.Duration) *Window {
+	return &Window{ttl: ttl, seen: map[[sha256.Size]byte]entry{}}
+}
+
+// return the id created from body within the window, as long as alive still
+// reports it, or run create and remember the id it returns. Creates run one
+// at a time so concurrent duplicates are caught as well.
+func (w *Window) Do(body []byte, alive func(models.ID) bool, create func() (models.ID, error)) (models.ID, bool, error) {
+	key := sha256.Sum256(body)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range w.seen {
+		if now.Sub(e.at) > w.ttl {
+			delete(w.seen, k)
+		}
+	}
+	if e, ok := w.seen[key]; ok && alive(e.id) {
+		return e.id, true, nil
+	}
+
+	id, err := create()
+	if err != nil {
+		return "", false, err
+	}
+	w.seen[key] = entry{id: id, at: now}
+	return id, false, nil
+}
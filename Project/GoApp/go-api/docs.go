@@ -0,0 +1,22 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed docs.html
+var docsPage string
+
+var docsTemplate = template.Must(template.New("docs").Parse(docsPage))
+
+// Swagger UI for /openapi.json. Its scripts and styles are loaded from
+// DOCS_ASSETS_URL, they are not part of the binary.
+func docsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	docsTemplate.Execute(c.Writer, gin.H{"Assets": conf.DocsAssetsURL, "Spec": "/openapi.json"})
+}
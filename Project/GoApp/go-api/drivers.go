@@ -0,0 +1,8 @@
+package main
+
+// the database/sql drivers of DATABASE_DRIVER: "sqlite", pure Go so no cgo
+// is needed, and "pgx" for Postgres
+import (
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
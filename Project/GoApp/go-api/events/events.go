@@ -0,0 +1,106 @@
+package events
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go-api/models"
+)
+
+// event types published by the db package
+const (
+	Created  = "created"
+	Updated  = "updated"
+	Deleted  = "deleted"
+	Restored = "restored"
+)
+
+// Types are the event types there are
+var Types = []string{Created, Updated, Deleted, Restored}
+
+type Event struct {
+	// 1, 2, 3... in the order published, starting over with the process
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	User models.User `json:"user"`
+	Time time.Time   `json:"time"`
+	// fields changed by an update with their old and new values
+	Changes map[string]models.Change `json:"changes,omitempty"`
+}
+
+// buffered events per subscriber before new ones are dropped for it
+const bufferSize = 64
+
+// latest events kept for subscribers catching up, see SubscribeAfter
+const replaySize = 1024
+
+var bus = struct {
+	sync.Mutex
+	subscribers map[chan Event]struct{}
+	// id of the last event and the latest events, oldest first
+	lastID uint64
+	recent []Event
+}{subscribers: map[chan Event]struct{}{}}
+
+// receive every event published from now on, call cancel when done
+func Subscribe() (<-chan Event, func()) {
+	ch, _, _, cancel := SubscribeAfter(0)
+	return ch, cancel
+}
+
+// SubscribeAfter is Subscribe for a subscriber that has seen the events up
+// to id, 0 for none: it also returns the kept events published since, and
+// whether they are all of them. They are not when id is older than the
+// events kept, or newer than the last event, as after a restart.
+func SubscribeAfter(id uint64) (<-chan Event, []Event, bool, func()) {
+	ch := make(chan Event, bufferSize)
+	bus.Lock()
+	bus.subscribers[ch] = struct{}{}
+	var missed []Event
+	complete := id == 0 || id == bus.lastID
+	if id != 0 && id < bus.lastID {
+		n := sort.Search(len(bus.recent), func(i int) bool { return bus.recent[i].ID > id })
+		missed = slices.Clone(bus.recent[n:])
+		complete = n > 0 || bus.recent[0].ID == id+1
+	}
+	bus.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			bus.Lock()
+			delete(bus.subscribers, ch)
+			bus.Unlock()
+		})
+	}
+	return ch, missed, complete, cancel
+}
+
+// send the event to all subscribers without waiting on slow ones
+func Publish(eventType string, user models.User) {
+	send(Event{Type: eventType, User: user, Time: time.Now()})
+}
+
+// publish an update of old to user, listing the fields that changed
+func PublishUpdate(old, user models.User) {
+	send(Event{Type: Updated, User: user, Time: time.Now(), Changes: models.Diff(old, user)})
+}
+
+func send(ev Event) {
+	bus.Lock()
+	defer bus.Unlock()
+	bus.lastID++
+	ev.ID = bus.lastID
+	if len(bus.recent) == replaySize {
+		bus.recent = slices.Delete(bus.recent, 0, 1)
+	}
+	bus.recent = append(bus.recent, ev)
+	for ch := range bus.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
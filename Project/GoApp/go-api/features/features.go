@@ -0,0 +1,75 @@
+package features
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry is the central list of named endpoints and whether each of them is
+// enabled. Endpoints are enabled unless their name was disabled in config.
+type Registry struct {
+	mu        sync.RWMutex
+	disabled  map[string]bool
+	endpoints map[string]bool
+}
+
+func New(disabled []string) *Registry {
+	r := &Registry{disabled: map[string]bool{}, endpoints: map[string]bool{}}
+	for _, name := range disabled {
+		r.disabled[name] = true
+	}
+	return r
+}
+
+// add an endpoint to the registry and report whether it is enabled
+func (r *Registry) Register(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	enabled := !r.disabled[name]
+	r.endpoints[name] = enabled
+	return enabled
+}
+
+// replace the disabled names, switching registered endpoints on and off
+func (r *Registry) SetDisabled(disabled []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disabled = map[string]bool{}
+	for _, name := range disabled {
+		r.disabled[name] = true
+	}
+	for name := range r.endpoints {
+		r.endpoints[name] = !r.disabled[name]
+	}
+}
+
+func (r *Registry) Enabled(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.endpoints[name]
+}
+
+// all registered endpoints with their state
+func (r *Registry) Endpoints() map[string]bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make(map[string]bool, len(r.endpoints))
+	for name, enabled := range r.endpoints {
+		out[name] = enabled
+	}
+	return out
+}
+
+// names that were disabled but never registered, usually typos in config
+func (r *Registry) Unknown() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var names []string
+	for name := range r.disabled {
+		if _, ok := r.endpoints[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,125 @@
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encrypted values look like "enc:<key id>:<base64 nonce+ciphertext>"
+const prefix = "enc:"
+
+// Keyring encrypts values with AES-GCM under its active key and decrypts
+// values written under any of its keys, which makes key rotation a matter of
+// putting the new key first and keeping the old ones around
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+	// the bytes of the active key, for Digest
+	activeKey []byte
+}
+
+// parse "id:base64key,id:base64key", the first key is the active one. Keys
+// are 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+func Parse(spec string) (*Keyring, error) {
+	k := &Keyring{keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("encryption key %q: want id:base64key", entry)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("encryption key %s listed twice", id)
+		}
+		k.keys[id] = aead
+		if k.active == "" {
+			k.active, k.activeKey = id, raw
+		}
+	}
+	if k.active == "" {
+		return nil, errors.New("no encryption keys")
+	}
+	return k, nil
+}
+
+func (k *Keyring) Encrypt(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(k.active))
+	return prefix + k.active + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt a value written by Encrypt; values without the prefix are
+// returned unchanged so plaintext written before encryption was turned on
+// still reads
+func (k *Keyring) Decrypt(value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return value, nil
+	}
+	id, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", errors.New("malformed encrypted value")
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return "", fmt.Errorf("value encrypted with unknown key %s", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("decrypt with key %s: %w", id, err)
+	}
+	return string(plain), nil
+}
+
+// an HMAC-SHA256 of value under the active key, hex encoded: the same for
+// the same value, unlike Encrypt, so a database can index it without
+// holding the value. It changes with the active key.
+func (k *Keyring) Digest(value string) string {
+	mac := hmac.New(sha256.New, k.activeKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// report whether value needs re-encrypting under the active key
+func (k *Keyring) Stale(value string) bool {
+	rest, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return value != ""
+	}
+	id, _, _ := strings.Cut(rest, ":")
+	return id != k.active
+}
@@ -0,0 +1,148 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// a key of n bytes of b, as ENCRYPTION_KEYS lists it under id
+func key(id string, b byte, n int) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, n))
+}
+
+func keyring(t *testing.T, spec string) *Keyring {
+	t.Helper()
+	k, err := Parse(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, spec := range []string{key("k1", 1, 16), key("k1", 1, 24), key("k1", 1, 32)} {
+		k := keyring(t, spec)
+		for _, plain := range []string{"ada@example.com", "+15550100", "Zoë ☃", strings.Repeat("x", 1000)} {
+			sealed, err := k.Encrypt(plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(sealed, "enc:k1:") || strings.Contains(sealed, plain) {
+				t.Errorf("%q encrypted as %q", plain, sealed)
+			}
+			again, _ := k.Encrypt(plain)
+			if again == sealed {
+				t.Errorf("%q encrypted twice the same, want a new nonce each time", plain)
+			}
+			if got, err := k.Decrypt(sealed); err != nil || got != plain {
+				t.Errorf("decrypted %q, %v, want %q", got, err, plain)
+			}
+		}
+	}
+
+	k := keyring(t, key("k1", 1, 32))
+	if sealed, err := k.Encrypt(""); err != nil || sealed != "" {
+		t.Errorf("empty value encrypted as %q, %v", sealed, err)
+	}
+	if got, err := k.Decrypt("ada@example.com"); err != nil || got != "ada@example.com" {
+		t.Errorf("plaintext read as %q, %v", got, err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old := keyring(t, key("2024-06", 1, 32))
+	rotated := keyring(t, key("2025-01", 2, 32)+", "+key("2024-06", 1, 32))
+	sealed, err := old.Encrypt("ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rotated.Decrypt(sealed); err != nil || got != "ada@example.com" {
+		t.Errorf("old value decrypted as %q, %v", got, err)
+	}
+	resealed, err := rotated.Encrypt("ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value string
+		stale bool
+	}{
+		{sealed, true},
+		{resealed, false},
+		{"ada@example.com", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := rotated.Stale(tt.value); got != tt.stale {
+			t.Errorf("Stale(%q) = %v, want %v", tt.value, got, tt.stale)
+		}
+	}
+	if _, err := old.Decrypt(resealed); err == nil || err.Error() != "value encrypted with unknown key 2025-01" {
+		t.Errorf("new value with the old keys: error %v", err)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	k := keyring(t, key("k1", 1, 32))
+	other := keyring(t, key("k1", 2, 32))
+	sealed, _ := other.Encrypt("ada@example.com")
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"no key id", "enc:abc", "malformed encrypted value"},
+		{"not base64", "enc:k1:***", "malformed encrypted value"},
+		{"shorter than a nonce", "enc:k1:" + base64.StdEncoding.EncodeToString([]byte("short")), "malformed encrypted value"},
+		{"unknown key", "enc:k9:" + strings.TrimPrefix(sealed, "enc:k1:"), "value encrypted with unknown key k9"},
+		{"another key of the same id", sealed, "decrypt with key k1: cipher: message authentication failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := k.Decrypt(tt.value); err == nil || err.Error() != tt.want {
+				t.Errorf("error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"", "no encryption keys"},
+		{" , ", "no encryption keys"},
+		{"k1", `encryption key "k1": want id:base64key`},
+		{":" + key("", 1, 32)[1:], `encryption key ":` + key("", 1, 32)[1:] + `": want id:base64key`},
+		{"k1:***", "encryption key k1: illegal base64 data at input byte 0"},
+		{key("k1", 1, 10), "encryption key k1: crypto/aes: invalid key size 10"},
+		{key("k1", 1, 32) + "," + key("k1", 2, 32), "encryption key k1 listed twice"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.spec); err == nil || err.Error() != tt.want {
+			t.Errorf("Parse(%q): error %v, want %s", tt.spec, err, tt.want)
+		}
+	}
+}
+
+func TestDigest(t *testing.T) {
+	k1 := keyring(t, key("k1", 1, 32)+","+key("k0", 2, 32))
+	d := k1.Digest("ada@example.com")
+	if len(d) != 64 || strings.Contains(d, "ada") {
+		t.Errorf("digest %q, want 64 hex digits", d)
+	}
+	if again := k1.Digest("ada@example.com"); again != d {
+		t.Errorf("digests %q and %q of the same value", d, again)
+	}
+	if other := k1.Digest("bob@example.com"); other == d {
+		t.Errorf("same digest %q of two values", d)
+	}
+	// a new active key, a new digest
+	if rotated := keyring(t, key("k0", 2, 32)+","+key("k1", 1, 32)).Digest("ada@example.com"); rotated == d {
+		t.Errorf("same digest %q under another key", d)
+	}
+}
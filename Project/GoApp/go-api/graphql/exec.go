@@ -0,0 +1,344 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Resolver resolves a field of the Query or Mutation type from its
+// arguments. An object is answered as an Object, a list of them as a slice
+// of Objects, anything else as the JSON value of the field; nil is null.
+type Resolver func(ctx context.Context, args Args) (any, error)
+
+// Object is a resolved object by field name, with its "__typename"
+type Object map[string]any
+
+// Schema is the root fields the operations of each type may select
+type Schema struct {
+	Query    map[string]Resolver
+	Mutation map[string]Resolver
+}
+
+// Request is the body of a POST, or the query of a GET, of the endpoint
+type Request struct {
+	Query         string         `json:"query" form:"query"`
+	OperationName string         `json:"operationName" form:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// Response is the answer to a request: the data of the fields of the
+// operation, null for those that failed, and the errors
+type Response struct {
+	Data   any     `json:"data"`
+	Errors []Error `json:"errors,omitempty"`
+}
+
+// Error is a field that failed or a request that could not be run; Path
+// leads to the field, by names and list indexes
+type Error struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+// Execute runs op with the variables against the schema. Mutation fields
+// run one after the other, as the spec has it. An error of a resolver is
+// reported at its field, which is null; variables that do not fit the
+// operation fail it as a whole, with no data.
+func (s Schema) Execute(ctx context.Context, op *Operation, variables map[string]any) Response {
+	vars, err := coerceVariables(op, variables)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+	root, typename := s.Query, "Query"
+	if op.Type == "mutation" {
+		root, typename = s.Mutation, "Mutation"
+	}
+	for _, f := range op.selection {
+		if _, ok := root[f.name]; !ok && f.name != "__typename" {
+			return Response{Errors: []Error{{Message: fmt.Sprintf("cannot query field %q on type %s", f.name, typename)}}}
+		}
+	}
+	e := &execution{vars: vars}
+	data := orderedObject{}
+	for _, f := range op.selection {
+		path := []any{f.alias}
+		include, err := e.included(f)
+		if err != nil {
+			e.fail(err, path)
+			continue
+		}
+		if !include {
+			continue
+		}
+		if f.name == "__typename" {
+			data = append(data, member{f.alias, typename})
+			continue
+		}
+		var v any
+		args, err := e.args(f.args)
+		if err == nil {
+			v, err = root[f.name](ctx, args)
+		}
+		if err != nil {
+			e.fail(err, path)
+			v = nil
+		}
+		data = append(data, member{f.alias, e.complete(v, f, path)})
+	}
+	return Response{Data: data, Errors: e.errors}
+}
+
+type execution struct {
+	vars   map[string]any
+	errors []Error
+}
+
+func (e *execution) fail(err error, path []any) {
+	e.errors = append(e.errors, Error{Message: err.Error(), Path: path})
+}
+
+// the value of a field as answered: objects narrowed to the fields
+// selected, in the order of the selection
+func (e *execution) complete(v any, f field, path []any) any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case Object:
+		if f.selection == nil {
+			e.fail(fmt.Errorf("field %q of type %v must have a selection of subfields", f.name, v["__typename"]), path)
+			return nil
+		}
+		out := orderedObject{}
+		for _, sub := range f.selection {
+			include, err := e.included(sub)
+			if err != nil {
+				e.fail(err, at(path, sub.alias))
+				continue
+			}
+			if !include {
+				continue
+			}
+			value, ok := v[sub.name]
+			if !ok {
+				e.fail(fmt.Errorf("cannot query field %q on type %v", sub.name, v["__typename"]), at(path, sub.alias))
+			}
+			out = append(out, member{sub.alias, e.complete(value, sub, at(path, sub.alias))})
+		}
+		return out
+	case []Object:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = e.complete(item, f, at(path, i))
+		}
+		return list
+	default:
+		if f.selection != nil {
+			e.fail(fmt.Errorf("field %q is a scalar and takes no selection", f.name), path)
+			return nil
+		}
+		return v
+	}
+}
+
+// path with elem after it, in a slice of its own
+func at(path []any, elem any) []any {
+	return append(path[:len(path):len(path)], elem)
+}
+
+// whether @skip and @include let the field through
+func (e *execution) included(f field) (bool, error) {
+	for _, d := range f.directives {
+		args, err := e.args(d.args)
+		if err != nil {
+			return false, err
+		}
+		cond, ok := args["if"].(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a Boolean if", d.name)
+		}
+		switch d.name {
+		case "skip":
+			if cond {
+				return false, nil
+			}
+		case "include":
+			if !cond {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+	}
+	return true, nil
+}
+
+func (e *execution) args(values map[string]value) (Args, error) {
+	args := Args{}
+	for name, v := range values {
+		resolved, err := e.resolve(v)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = resolved
+	}
+	return args, nil
+}
+
+// a value of the document with its variables put in, as JSON would decode
+// it but for integers, which are int64
+func (e *execution) resolve(v value) (any, error) {
+	switch v := v.(type) {
+	case variableRef:
+		value, ok := e.vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", v)
+		}
+		return value, nil
+	case enumValue:
+		return string(v), nil
+	case []value:
+		list := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if list[i], err = e.resolve(item); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[string]value:
+		object := map[string]any{}
+		for name, item := range v {
+			var err error
+			if object[name], err = e.resolve(item); err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	}
+	return v, nil
+}
+
+// the values of the variables of op: those sent, else their defaults
+func coerceVariables(op *Operation, sent map[string]any) (map[string]any, error) {
+	vars := map[string]any{}
+	for _, def := range op.variables {
+		v, ok := sent[def.name]
+		if !ok && def.fallback != nil {
+			var err error
+			if v, err = (&execution{}).resolve(def.fallback); err != nil {
+				return nil, err
+			}
+		}
+		if v == nil && def.nonNull {
+			return nil, fmt.Errorf("variable $%s of a non-null type is missing", def.name)
+		}
+		// unsent ones are null, which arguments take as missing
+		vars[def.name] = jsonInts(v)
+	}
+	return vars, nil
+}
+
+// v decoded from JSON with its whole numbers as int64, as they are written
+// in a document
+func jsonInts(v any) any {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i := range v {
+			v[i] = jsonInts(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = jsonInts(v[k])
+		}
+	}
+	return v
+}
+
+// the members of an answered object, in the order they were selected
+type orderedObject []member
+
+type member struct {
+	name  string
+	value any
+}
+
+func (o orderedObject) MarshalJSON() ([]byte, error) {
+	b := []byte{'{'}
+	for i, m := range o {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendQuote(b, m.name)
+		b = append(b, ':')
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, value...)
+	}
+	return append(b, '}'), nil
+}
+
+// Args is the arguments of a field, integers as int64
+type Args map[string]any
+
+// the string argument name, "" when it is null or missing
+func (a Args) String(name string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %s must be a String", name)
+}
+
+// the Int argument name, fallback when it is null or missing
+func (a Args) Int(name string, fallback int) (int, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return fallback, nil
+	case int64:
+		if v >= math.MinInt32 && v <= math.MaxInt32 {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %s must be an Int", name)
+}
+
+// the ID argument name, which is written as a string or an integer
+func (a Args) ID(name string) (string, error) {
+	switch v := a[name].(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case nil:
+		return "", fmt.Errorf("argument %s is required", name)
+	}
+	return "", fmt.Errorf("argument %s must be an ID", name)
+}
+
+// the input object argument name, nil when it is null or missing
+func (a Args) Object(name string) (Args, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return nil, nil
+	case map[string]any:
+		return Args(v), nil
+	}
+	return nil, fmt.Errorf("argument %s must be an input object", name)
+}
@@ -0,0 +1,555 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// the part of the GraphQL language the endpoint takes, written out by hand
+// as there is no GraphQL library among the dependencies: operations with
+// variables, fields with aliases, arguments and @skip and @include, and
+// every kind of value. Fragments and subscriptions are refused.
+
+// Operation is the operation of a document a request runs
+type Operation struct {
+	// "query" or "mutation"
+	Type      string
+	Name      string
+	variables []variableDef
+	selection []field
+}
+
+type variableDef struct {
+	name     string
+	nonNull  bool
+	fallback value
+}
+
+type field struct {
+	alias, name string
+	args        map[string]value
+	directives  []directive
+	selection   []field
+}
+
+type directive struct {
+	name string
+	args map[string]value
+}
+
+// a value as written in the document, variables resolved when it is run
+type value interface{}
+
+// the variable of that name
+type variableRef string
+
+// an enum value, kept as its name
+type enumValue string
+
+type token struct {
+	kind string // "name", "int", "float", "string", "punct" or "eof"
+	text string
+	pos  int
+}
+
+type parser struct {
+	src string
+	pos int
+	tok token
+}
+
+// ParseError is a document that is not valid GraphQL, or that uses what
+// the endpoint does not take
+type ParseError struct {
+	Message string
+}
+
+func (e *ParseError) Error() string { return e.Message }
+
+func (p *parser) errorf(format string, args ...any) *ParseError {
+	line := 1 + strings.Count(p.src[:p.tok.pos], "\n")
+	column := p.tok.pos - strings.LastIndex(p.src[:p.tok.pos], "\n")
+	return &ParseError{fmt.Sprintf("syntax error at %d:%d: %s", line, column, fmt.Sprintf(format, args...))}
+}
+
+// Parse reads the document and picks the operation called name, which may
+// be empty when the document has only one
+func Parse(document, name string) (*Operation, error) {
+	p := &parser{src: document}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var ops []*Operation
+	for p.tok.kind != "eof" {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	switch {
+	case len(ops) == 0:
+		return nil, &ParseError{"the document has no operation"}
+	case name != "":
+		for _, op := range ops {
+			if op.Name == name {
+				return op, nil
+			}
+		}
+		return nil, &ParseError{fmt.Sprintf("no operation named %q", name)}
+	case len(ops) > 1:
+		return nil, &ParseError{"operationName is required with several operations"}
+	}
+	return ops[0], nil
+}
+
+func (p *parser) operation() (*Operation, error) {
+	op := &Operation{Type: "query"}
+	if p.peek("{") {
+		var err error
+		op.selection, err = p.selectionSet()
+		return op, err
+	}
+	if p.tok.kind != "name" {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	switch p.tok.text {
+	case "query", "mutation":
+		op.Type = p.tok.text
+	case "subscription":
+		return nil, p.errorf("subscriptions are not supported")
+	case "fragment":
+		return nil, p.errorf("fragments are not supported")
+	default:
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == "name" {
+		op.Name = p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.peek(")") {
+			def, err := p.variableDef()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, def)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek("@") {
+		return nil, p.errorf("directives of operations are not supported")
+	}
+	var err error
+	op.selection, err = p.selectionSet()
+	return op, err
+}
+
+func (p *parser) variableDef() (variableDef, error) {
+	var def variableDef
+	if err := p.expect("$"); err != nil {
+		return def, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return def, err
+	}
+	def.name = name
+	if err := p.expect(":"); err != nil {
+		return def, err
+	}
+	if def.nonNull, err = p.typeRef(); err != nil {
+		return def, err
+	}
+	if p.peek("=") {
+		if err := p.next(); err != nil {
+			return def, err
+		}
+		if def.fallback, err = p.value(true); err != nil {
+			return def, err
+		}
+	}
+	return def, nil
+}
+
+// skip a type, reporting whether it is non-null
+func (p *parser) typeRef() (bool, error) {
+	if p.peek("[") {
+		if err := p.next(); err != nil {
+			return false, err
+		}
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.peek("!") {
+		return true, p.next()
+	}
+	return false, nil
+}
+
+func (p *parser) selectionSet() ([]field, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []field
+	for !p.peek("}") {
+		if p.peek("...") {
+			return nil, p.errorf("fragments are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection")
+	}
+	return fields, p.next()
+}
+
+func (p *parser) field() (field, error) {
+	var f field
+	name, err := p.name()
+	if err != nil {
+		return f, err
+	}
+	f.alias, f.name = name, name
+	if p.peek(":") {
+		if err := p.next(); err != nil {
+			return f, err
+		}
+		if f.name, err = p.name(); err != nil {
+			return f, err
+		}
+	}
+	if f.args, err = p.arguments(); err != nil {
+		return f, err
+	}
+	for p.peek("@") {
+		if err := p.next(); err != nil {
+			return f, err
+		}
+		var d directive
+		if d.name, err = p.name(); err != nil {
+			return f, err
+		}
+		if d.args, err = p.arguments(); err != nil {
+			return f, err
+		}
+		f.directives = append(f.directives, d)
+	}
+	if p.peek("{") {
+		f.selection, err = p.selectionSet()
+	}
+	return f, err
+}
+
+func (p *parser) arguments() (map[string]value, error) {
+	args := map[string]value{}
+	if !p.peek("(") {
+		return args, nil
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for !p.peek(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.next()
+}
+
+// a value; constant ones, of variable defaults, may not name variables
+func (p *parser) value(constant bool) (value, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == "punct" && tok.text == "$":
+		if constant {
+			return nil, p.errorf("a default value cannot be a variable")
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return variableRef(name), err
+	case tok.kind == "punct" && tok.text == "[":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []value{}
+		for !p.peek("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case tok.kind == "punct" && tok.text == "{":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		object := map[string]value{}
+		for !p.peek("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return object, p.next()
+	case tok.kind == "int":
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("integer %s out of range", tok.text)
+		}
+		return n, p.next()
+	case tok.kind == "float":
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok.text)
+		}
+		return f, p.next()
+	case tok.kind == "string":
+		return tok.text, p.next()
+	case tok.kind == "name":
+		var v value
+		switch tok.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = enumValue(tok.text)
+		}
+		return v, p.next()
+	}
+	return nil, p.errorf("unexpected %q, want a value", tok.text)
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != "name" {
+		return "", p.errorf("unexpected %q, want a name", p.tok.text)
+	}
+	name := p.tok.text
+	return name, p.next()
+}
+
+func (p *parser) peek(punct string) bool {
+	return p.tok.kind == "punct" && p.tok.text == punct
+}
+
+func (p *parser) expect(punct string) error {
+	if !p.peek(punct) {
+		return p.errorf("unexpected %q, want %q", p.tok.text, punct)
+	}
+	return p.next()
+}
+
+// read the next token into p.tok
+func (p *parser) next() error {
+	// white space, commas, comments and a byte order mark are ignored
+skip:
+	for p.pos < len(p.src) {
+		switch rest := p.src[p.pos:]; {
+		case strings.HasPrefix(rest, "\ufeff"):
+			p.pos += len("\ufeff")
+		case rest[0] == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+		case strings.IndexByte(" \t\n\r,", rest[0]) >= 0:
+			p.pos++
+		default:
+			break skip
+		}
+	}
+	start := p.pos
+	p.tok = token{kind: "eof", pos: start}
+	if p.pos >= len(p.src) {
+		return nil
+	}
+	rest := p.src[p.pos:]
+	switch c := rest[0]; {
+	case strings.HasPrefix(rest, "..."):
+		p.pos += 3
+		p.tok = token{"punct", "...", start}
+	case strings.ContainsRune("!$()[]{}:=@|&", rune(c)):
+		p.pos++
+		p.tok = token{"punct", string(c), start}
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = token{"name", p.src[start:p.pos], start}
+	case c == '-' || isDigit(c):
+		return p.number()
+	case strings.HasPrefix(rest, `"""`):
+		end := strings.Index(rest[3:], `"""`)
+		if end < 0 {
+			return p.errorf("unterminated string")
+		}
+		p.pos += 3 + end + 3
+		p.tok = token{"string", blockString(rest[3 : 3+end]), start}
+	case c == '"':
+		return p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(rest)
+		p.tok.text = string(r)
+		return p.errorf("unexpected character %q", r)
+	}
+	return nil
+}
+
+func (p *parser) number() error {
+	start := p.pos
+	p.tok = token{"punct", "", start}
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	kind := "int"
+	if digits() == 0 {
+		return p.errorf("invalid number")
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		p.pos++
+		kind = "float"
+		if digits() == 0 {
+			return p.errorf("invalid number")
+		}
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		p.pos++
+		kind = "float"
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			return p.errorf("invalid number")
+		}
+	}
+	p.tok = token{kind, p.src[start:p.pos], start}
+	return nil
+}
+
+func (p *parser) string() error {
+	start := p.pos
+	p.tok = token{"punct", `"`, start}
+	var b strings.Builder
+	p.pos++
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+			return p.errorf("unterminated string")
+		}
+		c := p.src[p.pos]
+		if c == '"' {
+			p.pos++
+			p.tok = token{"string", b.String(), start}
+			return nil
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 >= len(p.src) {
+			return p.errorf("unterminated string")
+		}
+		escape := p.src[p.pos+1]
+		p.pos += 2
+		switch escape {
+		case '"', '\\', '/':
+			b.WriteByte(escape)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if p.pos+4 > len(p.src) {
+				return p.errorf("invalid escape")
+			}
+			r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+			if err != nil {
+				return p.errorf("invalid escape")
+			}
+			b.WriteRune(rune(r))
+			p.pos += 4
+		default:
+			return p.errorf("invalid escape \\%c", escape)
+		}
+	}
+}
+
+// the value of a block string: the common indentation of its lines and its
+// blank first and last lines removed
+func blockString(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(strings.ReplaceAll(raw, "\r\n", "\n"), `\"""`, `"""`), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && (indent < 0 || len(line)-len(trimmed) < indent) {
+			indent = len(line) - len(trimmed)
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		lines[i] = lines[i][min(indent, len(lines[i])):]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
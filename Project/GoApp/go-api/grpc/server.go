@@ -0,0 +1,169 @@
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"go-api/db"
+	"go-api/models"
+)
+
+// the gRPC protocol over HTTP/2 written out by hand, google.golang.org/grpc
+// only being a dependency of the tests, which call it with its client: unary
+// calls of length-prefixed protobuf messages, answered with grpc-status and
+// grpc-message trailers. Compressed messages are refused, clients only
+// compress when told to.
+
+// status codes of the calls, as numbered by gRPC
+type code int
+
+const (
+	codeOK                 code = 0
+	codeInvalidArgument    code = 3
+	codeNotFound           code = 5
+	codeAlreadyExists      code = 6
+	codeResourceExhausted  code = 8
+	codeFailedPrecondition code = 9
+	codeUnimplemented      code = 12
+	codeInternal           code = 13
+	codeUnavailable        code = 14
+	codeUnauthenticated    code = 16
+)
+
+// largest request message, the default of grpc-go
+const maxMessageSize = 4 << 20
+
+// the error a call ends with
+type status struct {
+	code    code
+	message string
+}
+
+func (s *status) Error() string { return fmt.Sprintf("code %d: %s", s.code, s.message) }
+
+func errorf(c code, format string, args ...any) *status {
+	return &status{c, fmt.Sprintf(format, args...)}
+}
+
+// Server serves the users.v1.UserService of proto/user.proto from store
+type Server struct {
+	store db.Store
+	// callers must send "authorization: Bearer <Token>" when set
+	Token string
+	// the checks of the REST api for created and updated users, none when nil
+	Check func(user models.User) error
+	// mails the token confirming the pending email of user, as the REST api
+	// does; email changes fail while it is nil
+	ConfirmEmail func(ctx context.Context, user models.User, token, by string) error
+	// how long a token confirming a new email is valid
+	EmailTTL time.Duration
+	// reject updates and deletes without a version, as REQUIRE_IF_MATCH does
+	RequireVersion bool
+}
+
+func NewServer(store db.Store) *Server {
+	return &Server{store: store}
+}
+
+// a unary method: the request message in, the response message out
+type method func(s *Server, ctx context.Context, request []byte) ([]byte, error)
+
+var methods = map[string]method{
+	"/users.v1.UserService/GetUser":    (*Server).getUser,
+	"/users.v1.UserService/ListUsers":  (*Server).listUsers,
+	"/users.v1.UserService/CreateUser": (*Server).createUser,
+	"/users.v1.UserService/UpdateUser": (*Server).updateUser,
+	"/users.v1.UserService/DeleteUser": (*Server).deleteUser,
+}
+
+// Handler serves the calls over HTTP/2 without TLS (h2c), as internal
+// clients dial it
+func (s *Server) Handler() http.Handler {
+	return h2c.NewHandler(s, &http2.Server{})
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 {
+		http.Error(w, "gRPC takes POST over HTTP/2", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") {
+		http.Error(w, "gRPC takes application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	response, err := s.call(r)
+	if err == nil {
+		frame := make([]byte, 5, 5+len(response))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(response)))
+		_, err = w.Write(append(frame, response...))
+	}
+	st, ok := err.(*status)
+	switch {
+	case err == nil:
+		st = &status{code: codeOK}
+	case !ok:
+		st = errorf(codeInternal, "%v", err)
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(st.code)))
+	if st.message != "" {
+		w.Header().Set("Grpc-Message", encodeMessage(st.message))
+	}
+}
+
+// read the request message of r and run its method
+func (s *Server) call(r *http.Request) ([]byte, error) {
+	m, ok := methods[r.URL.Path]
+	if !ok {
+		return nil, errorf(codeUnimplemented, "unknown method %s", r.URL.Path)
+	}
+	if s.Token != "" {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			return nil, errorf(codeUnauthenticated, "missing or invalid token")
+		}
+	}
+
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+		return nil, errorf(codeInvalidArgument, "no request message: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, errorf(codeUnimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, errorf(codeResourceExhausted, "request message of %d bytes is over %d", size, maxMessageSize)
+	}
+	request := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, request); err != nil {
+		return nil, errorf(codeInvalidArgument, "short request message: %v", err)
+	}
+	return m(s, r.Context(), request)
+}
+
+// percent-encode what grpc-message cannot carry as is
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
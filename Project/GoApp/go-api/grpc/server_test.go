@@ -0,0 +1,397 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bufbuild/protocompile"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"go-api/db"
+	"go-api/models"
+)
+
+// a listener of in-memory connections, dialed by its client
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "pipe"} }
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// a client of srv over an in-process HTTP/2 connection, as a gRPC client
+// without TLS dials it
+type testClient struct {
+	http  *http.Client
+	token string
+}
+
+func connect(t *testing.T, srv *Server) *testClient {
+	t.Helper()
+	l := newPipeListener()
+	hs := &http.Server{Handler: srv.Handler()}
+	go hs.Serve(l)
+	t.Cleanup(func() { hs.Close() })
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(context.Context, string, string, *tls.Config) (net.Conn, error) {
+			return l.dial()
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &testClient{http: &http.Client{Transport: transport}}
+}
+
+// the framed request message of a unary call
+func frame(message []byte, compressed bool) []byte {
+	b := make([]byte, 5, 5+len(message))
+	if compressed {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint32(b[1:], uint32(len(message)))
+	return append(b, message...)
+}
+
+// call the method with the request message, returning the response message
+// and the status the call ended with
+func (c *testClient) call(t *testing.T, method string, body []byte) ([]byte, code, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, "http://grpc/users.v1.UserService/"+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("%s: answered %s as %s", method, resp.Status, resp.Header.Get("Content-Type"))
+	}
+	st, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: grpc-status %q", method, resp.Trailer.Get("Grpc-Status"))
+	}
+	var message []byte
+	if len(data) > 0 {
+		if len(data) < 5 || data[0] != 0 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+			t.Fatalf("%s: malformed response frame %x", method, data)
+		}
+		message = data[5:]
+	}
+	return message, code(st), resp.Trailer.Get("Grpc-Message")
+}
+
+// a request message of the fields, strings or int64s by number
+func request(fields ...any) []byte {
+	var b []byte
+	for i := 0; i < len(fields); i += 2 {
+		num := protowire.Number(fields[i].(int))
+		switch v := fields[i+1].(type) {
+		case string:
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, v)
+		case int:
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(v))
+		}
+	}
+	return b
+}
+
+// the users of a ListUsersResponse
+func users(t *testing.T, b []byte) []models.User {
+	t.Helper()
+	var list []models.User
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 || num != 1 || typ != protowire.BytesType {
+			t.Fatalf("malformed ListUsersResponse %x", b)
+		}
+		b = b[n:]
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			t.Fatalf("malformed ListUsersResponse %x", b)
+		}
+		b = b[n:]
+		var u models.User
+		if err := u.UnmarshalProto(v); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, u)
+	}
+	return list
+}
+
+// a test server over the store of the db package, its email confirmation
+// tokens recorded in sent
+func testServer(t *testing.T, sent *[]string) *Server {
+	db.Reset()
+	t.Cleanup(db.Reset)
+	srv := NewServer(db.Memory{})
+	srv.Check = func(user models.User) error {
+		if user.Name == "" {
+			return errors.New("name is required")
+		}
+		return nil
+	}
+	srv.ConfirmEmail = func(_ context.Context, user models.User, token, _ string) error {
+		*sent = append(*sent, user.PendingEmail+" "+token)
+		return nil
+	}
+	return srv
+}
+
+func TestUserService(t *testing.T) {
+	var sent []string
+	client := connect(t, testServer(t, &sent))
+
+	steps := []struct {
+		name    string
+		method  string
+		request []byte
+		code    code
+		message string
+		// the user answered, the zero one for none
+		want models.User
+	}{
+		{"create", "CreateUser", request(1, "Ada", 2, "ada@example.com"), codeOK, "", models.User{ID: "1", Name: "Ada", Email: "ada@example.com", Version: 1}},
+		{"create of another user", "CreateUser", request(1, " Bob ", 2, "bob@example.com"), codeOK, "", models.User{ID: "2", Name: "Bob", Email: "bob@example.com", Version: 1}},
+		{"create with an email taken", "CreateUser", request(1, "Eve", 2, "ada@example.com"), codeAlreadyExists, `unique constraint "email" violated`, models.User{}},
+		{"create of an invalid user", "CreateUser", request(2, "eve@example.com"), codeInvalidArgument, "name is required", models.User{}},
+		{"get", "GetUser", request(1, 1), codeOK, "", models.User{ID: "1", Name: "Ada", Email: "ada@example.com", Version: 1}},
+		{"get by uid", "GetUser", request(2, "2"), codeOK, "", models.User{ID: "2", Name: "Bob", Email: "bob@example.com", Version: 1}},
+		{"get of a missing user", "GetUser", request(1, 999), codeNotFound, "user not found", models.User{}},
+		{"get of a malformed uid", "GetUser", request(2, "x"), codeInvalidArgument, `invalid id "x"`, models.User{}},
+		{"update", "UpdateUser", request(1, 1, 2, "Ada L", 5, 1), codeOK, "", models.User{ID: "1", Name: "Ada L", Email: "ada@example.com", Version: 2}},
+		{"update of a stale version", "UpdateUser", request(1, 1, 2, "Ada", 5, 1), codeFailedPrecondition, "user was changed since this version", models.User{}},
+		{"update of the email", "UpdateUser", request(1, 1, 3, "lovelace@example.com"), codeOK, "", models.User{ID: "1", Name: "Ada L", Email: "ada@example.com", PendingEmail: "lovelace@example.com", Version: 3}},
+		{"update of no field", "UpdateUser", request(4, "2", 2, ""), codeOK, "", models.User{ID: "2", Name: "Bob", Email: "bob@example.com", Version: 2}},
+		{"update of a missing user", "UpdateUser", request(1, 999, 2, "Eve"), codeNotFound, "user not found", models.User{}},
+		{"delete of a stale version", "DeleteUser", request(1, 2, 3, 1), codeFailedPrecondition, "user was changed since this version", models.User{}},
+		{"delete", "DeleteUser", request(1, 2, 3, 2), codeOK, "", models.User{}},
+		{"get of the deleted user", "GetUser", request(1, 2), codeNotFound, "user not found", models.User{}},
+		{"delete again", "DeleteUser", request(2, "2"), codeNotFound, "user not found", models.User{}},
+	}
+	for _, step := range steps {
+		response, code, message := client.call(t, step.method, frame(step.request, false))
+		if code != step.code || message != step.message {
+			t.Fatalf("%s: status %d %q, want %d %q", step.name, code, message, step.code, step.message)
+		}
+		var got models.User
+		if err := got.UnmarshalProto(response); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got != step.want {
+			t.Errorf("%s: answered %+v, want %+v", step.name, got, step.want)
+		}
+	}
+
+	response, code, _ := client.call(t, "ListUsers", frame(nil, false))
+	if code != codeOK {
+		t.Fatalf("list: status %d", code)
+	}
+	if list := users(t, response); len(list) != 1 || list[0].Name != "Ada L" {
+		t.Errorf("listed %+v, want the user not deleted", list)
+	}
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "lovelace@example.com ") {
+		t.Errorf("confirmations sent %q, want one to the new email", sent)
+	}
+}
+
+func TestUserServiceCalls(t *testing.T) {
+	var sent []string
+	srv := testServer(t, &sent)
+	srv.Token = "secret"
+	srv.RequireVersion = true
+	srv.ConfirmEmail = nil
+	if _, err := db.AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	client := connect(t, srv)
+
+	tests := []struct {
+		name    string
+		token   string
+		method  string
+		body    []byte
+		code    code
+		message string
+	}{
+		{"without a token", "", "GetUser", frame(request(1, 1), false), codeUnauthenticated, "missing or invalid token"},
+		{"with another token", "other", "GetUser", frame(request(1, 1), false), codeUnauthenticated, "missing or invalid token"},
+		{"with the token", "secret", "GetUser", frame(request(1, 1), false), codeOK, ""},
+		{"unknown method", "secret", "RenameUser", frame(nil, false), codeUnimplemented, "unknown method /users.v1.UserService/RenameUser"},
+		{"compressed message", "secret", "GetUser", frame(request(1, 1), true), codeUnimplemented, "compressed messages are not supported"},
+		{"no message", "secret", "GetUser", nil, codeInvalidArgument, "no request message: EOF"},
+		{"short message", "secret", "GetUser", frame(request(1, 1), false)[:6], codeInvalidArgument, "short request message: unexpected EOF"},
+		{"invalid protobuf", "secret", "GetUser", frame([]byte{0x0a, 0x05}, false), codeInvalidArgument, "invalid protobuf field 1: unexpected EOF"},
+		{"update without a version", "secret", "UpdateUser", frame(request(1, 1, 2, "Ada L"), false), codeFailedPrecondition, "version is required"},
+		{"delete without a version", "secret", "DeleteUser", frame(request(1, 1), false), codeFailedPrecondition, "version is required"},
+		{"email change not served", "secret", "UpdateUser", frame(request(1, 1, 3, "new@example.com", 5, 1), false), codeUnimplemented, "email changes are not served"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client.token = tt.token
+			_, code, message := client.call(t, tt.method, tt.body)
+			if code != tt.code || message != tt.message {
+				t.Errorf("status %d %q, want %d %q", code, message, tt.code, tt.message)
+			}
+		})
+	}
+}
+
+// the messages of proto/user.proto, compiled from the file so the service
+// is checked against it
+func userProto(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	compiler := protocompile.Compiler{Resolver: &protocompile.SourceResolver{ImportPaths: []string{"../proto"}}}
+	files, err := compiler.Compile(context.Background(), "user.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files[0]
+}
+
+// a message of the type name of file with the fields set, by field name
+func protoMessage(file protoreflect.FileDescriptor, name string, fields map[string]any) *dynamicpb.Message {
+	m := dynamicpb.NewMessage(file.Messages().ByName(protoreflect.Name(name)))
+	for field, v := range fields {
+		m.Set(m.Descriptor().Fields().ByName(protoreflect.Name(field)), protoreflect.ValueOf(v))
+	}
+	return m
+}
+
+// the service as grpc-go clients call it, over TCP
+func TestUserServiceGRPCClient(t *testing.T) {
+	var sent []string
+	srv := testServer(t, &sent)
+	srv.Token = "secret"
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &http.Server{Handler: srv.Handler()}
+	go hs.Serve(ln)
+	t.Cleanup(func() { hs.Close() })
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	file := userProto(t)
+	service := file.Services().ByName("UserService")
+	authorized := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer secret")
+	steps := []struct {
+		name    string
+		ctx     context.Context
+		method  string
+		request map[string]any
+		code    codes.Code
+		message string
+		// fields of the answered message
+		want map[string]any
+	}{
+		{"without a token", context.Background(), "GetUser", map[string]any{"id": int64(1)}, codes.Unauthenticated, "missing or invalid token", nil},
+		{"create", authorized, "CreateUser", map[string]any{"name": "Ada", "email": "ada@example.com"}, codes.OK, "", map[string]any{"id": int64(1), "name": "Ada", "email": "ada@example.com", "version": int64(1)}},
+		{"create with an email taken", authorized, "CreateUser", map[string]any{"name": "Eve", "email": "ada@example.com"}, codes.AlreadyExists, `unique constraint "email" violated`, nil},
+		{"create of an invalid user", authorized, "CreateUser", map[string]any{"email": "eve@example.com"}, codes.InvalidArgument, "name is required", nil},
+		{"get", authorized, "GetUser", map[string]any{"id": int64(1)}, codes.OK, "", map[string]any{"id": int64(1), "name": "Ada"}},
+		{"get by uid", authorized, "GetUser", map[string]any{"uid": "1"}, codes.OK, "", map[string]any{"id": int64(1), "email": "ada@example.com"}},
+		{"get of a missing user", authorized, "GetUser", map[string]any{"id": int64(999)}, codes.NotFound, "user not found", nil},
+		{"update", authorized, "UpdateUser", map[string]any{"id": int64(1), "name": "Ada L", "version": int64(1)}, codes.OK, "", map[string]any{"name": "Ada L", "version": int64(2)}},
+		{"update of a stale version", authorized, "UpdateUser", map[string]any{"id": int64(1), "name": "Ada", "version": int64(1)}, codes.FailedPrecondition, "user was changed since this version", nil},
+		{"update of the email", authorized, "UpdateUser", map[string]any{"id": int64(1), "email": "lovelace@example.com"}, codes.OK, "", map[string]any{"email": "ada@example.com", "pending_email": "lovelace@example.com"}},
+		{"delete", authorized, "DeleteUser", map[string]any{"id": int64(1), "version": int64(3)}, codes.OK, "", map[string]any{}},
+		{"get of the deleted user", authorized, "GetUser", map[string]any{"id": int64(1)}, codes.NotFound, "user not found", nil},
+	}
+	for _, step := range steps {
+		rpc := service.Methods().ByName(protoreflect.Name(step.method))
+		request := protoMessage(file, string(rpc.Input().Name()), step.request)
+		response := dynamicpb.NewMessage(rpc.Output())
+		err := conn.Invoke(step.ctx, "/users.v1.UserService/"+step.method, request, response)
+		if st := grpcstatus.Convert(err); st.Code() != step.code || st.Message() != step.message {
+			t.Fatalf("%s: status %s %q, want %s %q", step.name, st.Code(), st.Message(), step.code, step.message)
+		}
+		for field, want := range step.want {
+			if got := response.Get(rpc.Output().Fields().ByName(protoreflect.Name(field))).Interface(); got != want {
+				t.Errorf("%s: %s %v, want %v", step.name, field, got, want)
+			}
+		}
+	}
+
+	// a repeated field of messages
+	if _, err := db.AddUser(models.User{Name: "Bob", Email: "bob@example.com"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	list := dynamicpb.NewMessage(file.Messages().ByName("ListUsersResponse"))
+	if err := conn.Invoke(authorized, "/users.v1.UserService/ListUsers", protoMessage(file, "ListUsersRequest", nil), list); err != nil {
+		t.Fatal(err)
+	}
+	listed := list.Get(list.Descriptor().Fields().ByName("users")).List()
+	if listed.Len() != 1 || listed.Get(0).Message().Get(file.Messages().ByName("User").Fields().ByName("name")).String() != "Bob" {
+		t.Errorf("listed %v, want bob alone", list)
+	}
+
+	err = conn.Invoke(authorized, "/users.v1.UserService/RenameUser", protoMessage(file, "GetUserRequest", nil), list)
+	if grpcstatus.Code(err) != codes.Unimplemented {
+		t.Errorf("unknown method: %v, want Unimplemented", err)
+	}
+}
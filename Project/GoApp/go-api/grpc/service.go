@@ -0,0 +1,219 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"go-api/db"
+	"go-api/models"
+)
+
+// who the changes of the calls are attributed to in the history and audit log
+const actor = "grpc"
+
+// the scalar fields of a request message by number, the last value of a
+// field winning as in protobuf; fields of other types are skipped
+type message struct {
+	varints map[protowire.Number]uint64
+	strings map[protowire.Number]string
+}
+
+func parseMessage(b []byte) (message, error) {
+	m := message{varints: map[protowire.Number]uint64{}, strings: map[protowire.Number]string{}}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, errorf(codeInvalidArgument, "invalid protobuf: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.VarintType:
+			m.varints[num], n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			m.strings[num], n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return m, errorf(codeInvalidArgument, "invalid protobuf field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return m, nil
+}
+
+// the id of a request, in the numeric field id or the string field uid
+func (m message) id(id, uid protowire.Number) (models.ID, error) {
+	s := m.strings[uid]
+	if s == "" && m.varints[id] != 0 {
+		s = strconv.FormatInt(int64(m.varints[id]), 10)
+	}
+	parsed, err := db.ParseID(s)
+	if err != nil {
+		return "", errorf(codeInvalidArgument, "%v", err)
+	}
+	return parsed, nil
+}
+
+// the version of an update or delete, 0 for any
+func (s *Server) version(m message, field protowire.Number) (int64, error) {
+	version := int64(m.varints[field])
+	if version == 0 && s.RequireVersion {
+		return 0, errorf(codeFailedPrecondition, "version is required")
+	}
+	return version, nil
+}
+
+func (s *Server) getUser(ctx context.Context, request []byte) ([]byte, error) {
+	m, err := parseMessage(request)
+	if err != nil {
+		return nil, err
+	}
+	id, err := m.id(1, 2)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.store.GetUser(ctx, id)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return user.MarshalProto(), nil
+}
+
+// the active users by ascending id, as GET /users lists them
+func (s *Server) listUsers(ctx context.Context, request []byte) ([]byte, error) {
+	if _, err := parseMessage(request); err != nil {
+		return nil, err
+	}
+	users, _, err := s.store.GetUsers(ctx, db.UserQuery{ActiveOnly: true})
+	if err != nil {
+		return nil, storeError(err)
+	}
+	var b []byte
+	for _, user := range users {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, user.MarshalProto())
+	}
+	return b, nil
+}
+
+func (s *Server) createUser(ctx context.Context, request []byte) ([]byte, error) {
+	m, err := parseMessage(request)
+	if err != nil {
+		return nil, err
+	}
+	user := models.User{Name: m.strings[1], Email: m.strings[2]}
+	user.Normalize()
+	if err := s.check(user); err != nil {
+		return nil, err
+	}
+	added, err := s.store.AddUser(ctx, user, actor)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	return added.MarshalProto(), nil
+}
+
+// set the fields of the request that are not empty, as PATCH /users/:id
+func (s *Server) updateUser(ctx context.Context, request []byte) ([]byte, error) {
+	m, err := parseMessage(request)
+	if err != nil {
+		return nil, err
+	}
+	id, err := m.id(1, 4)
+	if err != nil {
+		return nil, err
+	}
+	version, err := s.version(m, 5)
+	if err != nil {
+		return nil, err
+	}
+	name, email := m.strings[2], m.strings[3]
+	if email != "" && s.ConfirmEmail == nil {
+		return nil, errorf(codeUnimplemented, "email changes are not served")
+	}
+
+	user, token, err := s.store.PatchUser(ctx, id, func(user *models.User) error {
+		if version != 0 && user.Version != version {
+			return db.ErrStale
+		}
+		if name != "" {
+			user.Name = name
+		}
+		if email != "" {
+			user.Email = email
+		}
+		user.Normalize()
+		if err := s.check(*user); err != nil {
+			return err
+		}
+		// the new email waits for confirmation, written with the rest
+		if email != "" {
+			user.PendingEmail = user.Email
+		}
+		return nil
+	}, s.EmailTTL, actor)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	if token != "" {
+		if err := s.ConfirmEmail(ctx, *user, token, actor); err != nil {
+			return nil, storeError(err)
+		}
+	}
+	return user.MarshalProto(), nil
+}
+
+func (s *Server) deleteUser(ctx context.Context, request []byte) ([]byte, error) {
+	m, err := parseMessage(request)
+	if err != nil {
+		return nil, err
+	}
+	id, err := m.id(1, 2)
+	if err != nil {
+		return nil, err
+	}
+	version, err := s.version(m, 3)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.DeleteUser(ctx, id, version, actor); err != nil {
+		return nil, storeError(err)
+	}
+	return nil, nil
+}
+
+// run the Check of the server, its failures are invalid arguments
+func (s *Server) check(user models.User) error {
+	if s.Check == nil {
+		return nil
+	}
+	if err := s.Check(user); err != nil {
+		return errorf(codeInvalidArgument, "%v", err)
+	}
+	return nil
+}
+
+// the status of an error of the store
+func storeError(err error) error {
+	var conflict *db.ConflictError
+	var st *status
+	switch {
+	case errors.As(err, &st):
+		return st
+	case errors.Is(err, db.ErrNotFound):
+		return errorf(codeNotFound, "user not found")
+	case errors.Is(err, db.ErrStale):
+		return errorf(codeFailedPrecondition, "%v", err)
+	case errors.As(err, &conflict):
+		return errorf(codeAlreadyExists, "%v", conflict)
+	case db.Unavailable(err):
+		return errorf(codeUnavailable, "%v", err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"go-api/api/v1"
+	"go-api/config"
+	"go-api/grpc"
+	"go-api/models"
+)
+
+// the server of the gRPC UserService on GRPC_ADDR, sharing the store, the
+// checks and the email confirmation of the REST api. HTTP/2 without TLS
+// hijacks its connections, so a shutdown does not wait for calls in flight.
+func newGRPCServer(cfg config.Config) *http.Server {
+	users := grpc.NewServer(store)
+	users.Token = cfg.GRPCToken
+	users.RequireVersion = cfg.RequireIfMatch
+	users.Check = func(user models.User) error {
+		if errs := v1.CheckUser(user); errs != nil {
+			return errs
+		}
+		return nil
+	}
+	users.ConfirmEmail = v1.SendEmailConfirmation
+	users.EmailTTL = cfg.EmailTokenTTL
+	return &http.Server{
+		Addr:              cfg.GRPCAddr,
+		Handler:           users.Handler(),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
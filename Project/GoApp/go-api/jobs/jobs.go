@@ -0,0 +1,116 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// states of a job
+const (
+	Running   = "running"
+	Completed = "completed"
+	Failed    = "failed"
+)
+
+// Job reports a piece of work running in the background
+type Job struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Status     string     `json:"status"`
+	Total      int        `json:"total"`
+	Processed  int        `json:"processed"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// what the work returned, once completed
+	Result any `json:"result,omitempty"`
+	// why the work failed
+	Error string `json:"error,omitempty"`
+}
+
+// Registry runs jobs and keeps them in memory until ttl after they finished,
+// so a job is lost with the process that ran it
+type Registry struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	jobs    map[string]*Job
+	running sync.WaitGroup
+}
+
+func New(ttl time.Duration) *Registry {
+	return &Registry{ttl: ttl, jobs: map[string]*Job{}}
+}
+
+// Start runs work in a goroutine as a job of total items and returns the job
+// as started. Work reports the items done so far through progress.
+func (r *Registry) Start(jobType string, total int, work func(progress func(processed int)) (any, error)) (Job, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Job{}, err
+	}
+	job := &Job{ID: hex.EncodeToString(b), Type: jobType, Status: Running, Total: total, CreatedAt: time.Now()}
+
+	r.mu.Lock()
+	r.sweep(job.CreatedAt)
+	r.jobs[job.ID] = job
+	started := *job
+	r.mu.Unlock()
+
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		result, err := work(func(processed int) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			job.Processed = processed
+		})
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		now := time.Now()
+		job.FinishedAt = &now
+		if err != nil {
+			job.Status, job.Error = Failed, err.Error()
+			return
+		}
+		job.Status, job.Result, job.Processed = Completed, result, job.Total
+	}()
+	return started, nil
+}
+
+// Wait returns once no job is running, or with the error of ctx when it is
+// done first
+func (r *Registry) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get returns a copy of the job, false when it is unknown or expired
+func (r *Registry) Get(id string) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// drop jobs finished more than ttl ago; callers hold the lock
+func (r *Registry) sweep(now time.Time) {
+	for id, job := range r.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > r.ttl {
+			delete(r.jobs, id)
+		}
+	}
+}
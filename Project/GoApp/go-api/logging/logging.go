@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+	"go-api/tracing"
+)
+
+// formats of New
+const (
+	JSON = "json"
+	Text = "text"
+)
+
+// New makes a logger writing to w one JSON object per line, or logfmt-like
+// key=value lines with format "text", of level and above: "debug", "info",
+// "warn" or "error".
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case JSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case Text:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+type loggerKey struct{}
+
+// NewContext returns ctx carrying l, for FromContext
+func NewContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext is the logger of the request ctx belongs to, with its
+// request_id, or slog.Default() outside of a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// From is FromContext for the request of c
+func From(c *gin.Context) *slog.Logger {
+	return FromContext(c.Request.Context())
+}
+
+// Context gives the request a logger with its request_id in the context of
+// c.Request, so the handlers and what they pass the context to log with it,
+// and the trace_id of its span when it is traced. Put it after
+// apierror.Handler, which assigns the id, and middleware.Trace.
+func Context() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		l := slog.Default().With("request_id", apierror.RequestID(c))
+		if sc := tracing.SpanContextFrom(c.Request.Context()); sc.Valid() {
+			l = l.With("trace_id", sc.TraceID.String())
+		}
+		c.Request = c.Request.WithContext(NewContext(c.Request.Context(), l))
+		c.Next()
+	}
+}
+
+// Requests logs one "request" entry per request once it is answered, with
+// its method, path, route, status, latency, client IP and request id, at
+// error level for a 5xx and info otherwise. caller names who made the
+// request, e.g. a user; headers are the request headers to log too, none
+// when it returns nil. Put it first, so it sees the final status.
+func Requests(caller func(c *gin.Context) string, headers func(c *gin.Context) http.Header) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.String("request_id", apierror.RequestID(c)),
+			slog.String("caller", caller(c)),
+		}
+		if h := headers(c); h != nil {
+			attrs = append(attrs, slog.Any("headers", h))
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", c.Errors.String()))
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Default().LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
@@ -0,0 +1,26 @@
+package mailer
+
+import (
+	"log"
+
+	"go-api/models"
+)
+
+// Sender delivers emails to users, swap it out to mock sending
+type Sender interface {
+	SendWelcome(user models.User) error
+	SendEmailConfirmation(user models.User, email, token string) error
+}
+
+// LogSender only logs the emails it is asked to send
+type LogSender struct{}
+
+func (LogSender) SendWelcome(user models.User) error {
+	log.Printf("mailer: welcome email to %s <%s>", user.Name, user.Email)
+	return nil
+}
+
+func (LogSender) SendEmailConfirmation(user models.User, email, token string) error {
+	log.Printf("mailer: email confirmation for user %s to <%s>, token %s", user.ID, email, token)
+	return nil
+}
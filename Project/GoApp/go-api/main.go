@@ -1,107 +1,785 @@
 package main
 
-import (	
-	"strconv"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	// zone names for ?tz= even where the system has no tz database
+	_ "time/tzdata"
+
 	"github.com/gin-gonic/gin"
+
+	v1 "go-api/api/v1"
+	"go-api/apierror"
+	"go-api/auth"
+	"go-api/circuit"
+	"go-api/config"
 	"go-api/db"
+	"go-api/dedupe"
+	"go-api/features"
+	"go-api/fieldcrypt"
+	"go-api/jobs"
+	"go-api/logging"
+	"go-api/metrics"
+	"go-api/middleware"
 	"go-api/models"
-)	
+	"go-api/objectstore"
+	"go-api/readiness"
+	"go-api/tracing"
+	"go-api/webhook"
+)
+
+// users read and written by the handlers, replaceable in tests; every
+// operation is timed for /metrics
+var store db.Store = instrumented(db.Memory{})
+
+// the store of cfg over base: reads retried READ_RETRIES times, and with
+// BREAKER_THRESHOLD set a circuit breaker around the calls, reported on
+// /metrics, /status and /readyz. The breaker sees a read once, retries
+// included. With CACHE_SIZE set, reads of a user the cache answers do not
+// reach any of it.
+func newStore(cfg config.Config, base db.Store) db.Store {
+	base = db.RetryReads(base, cfg.ReadRetries, cfg.ReadRetryBackoff, func(op db.Operation) {
+		storeReadRetries.Inc(op.Name)
+	})
+	breaker = nil
+	checks.Unregister("breaker")
+	if cfg.BreakerThreshold <= 0 {
+		return cached(cfg, traced(instrumented(base)))
+	}
+
+	b := circuit.New(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	breaker = b
+	registry.MustRegister(
+		metrics.NewGaugeFunc("breaker_state", "State of the circuit breaker around the store: 0 closed, 1 half open, 2 open.", func() float64 {
+			return breakerStates[b.State()]
+		}),
+		metrics.NewCounterFunc("breaker_trips_total", "Times the circuit breaker around the store opened.", func() float64 {
+			return float64(b.Trips())
+		}),
+	)
+	// it only holds back some calls, so it can only degrade readiness
+	checks.Register(readiness.Check{Name: "breaker", Run: func(context.Context) error {
+		if state := b.State(); state != circuit.Closed {
+			return fmt.Errorf("circuit breaker %s", state)
+		}
+		return nil
+	}})
+	return cached(cfg, traced(instrumented(guarded(base, b))))
+}
+
+// time every operation of s for /metrics
+func instrumented(s db.Store) db.Store {
+	return db.Instrumented(s, func(operation string, took time.Duration) {
+		storeDuration.Observe(took.Seconds(), operation)
+	})
+}
 
-func main(){
-	r := gin.Default()
+// s behind the user cache of CACHE_SIZE users, set as userCache, or s
+// alone when it is 0
+func cached(cfg config.Config, s db.Store) db.Store {
+	userCache = nil
+	if cfg.CacheSize <= 0 {
+		return s
+	}
+	userCache = db.Cached(s, cfg.CacheSize)
+	return userCache
+}
 
-	r.GET("/users", getUsersHandler)
-	r.GET("/users/:id", getUserHandler)
-	r.POST("/users", createUserHandler)
-	r.PUT("/users/:id", updateUserHandler)
-	r.DELETE("/users", deleteUserHandler)
+// fill the user cache as CACHE_WARMUP asks, before the server takes
+// requests
+func warmCache(cfg config.Config) error {
+	limit, err := warmupLimit(cfg.CacheWarmup)
+	if err != nil || limit < 0 {
+		return err
+	}
+	if userCache == nil {
+		return errors.New("CACHE_WARMUP needs a CACHE_SIZE")
+	}
+	start := time.Now()
+	n, err := userCache.Warm(context.Background(), limit)
+	if err != nil {
+		return fmt.Errorf("warming the user cache: %w", err)
+	}
+	log.Printf("warmed the user cache with %d users in %v", n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
 
-	r.Run(":8000")
+// the users CACHE_WARMUP loads, 0 for all of them and -1 for none
+func warmupLimit(warmup string) (int, error) {
+	switch warmup {
+	case "off":
+		return -1, nil
+	case "all":
+		return 0, nil
+	}
+	n, err := strconv.Atoi(warmup)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("CACHE_WARMUP %q: want off, all or a number of users", warmup)
+	}
+	return n, nil
 }
 
-func getUsersHandler(c *gin.Context) {
-	users := db.GetUsers()
-	c.JSON(http.StatusOK, users)
-}	
+// make every operation of s a span, a child of the request's, named after
+// the operation and with the user it is about; off unless tracer is set.
+// Only failures of the store fail the span, a missing user is an answer.
+func traced(s db.Store) db.Store {
+	if tracer == nil {
+		return s
+	}
+	t := tracer
+	return db.Intercept(s, func(ctx context.Context, op db.Operation, call func(ctx context.Context) error) error {
+		ctx, span := t.Start(ctx, "store "+op.Name, tracing.Internal)
+		span.SetAttribute("db.operation.name", op.Name)
+		if op.ID != "" {
+			span.SetAttribute("user.id", string(op.ID))
+		}
+		err := call(ctx)
+		if db.Unavailable(err) {
+			span.End(err)
+		} else {
+			span.End(nil)
+		}
+		return err
+	})
+}
+
+// refuse the calls to s while b is open, as the store being unavailable;
+// only calls failing the way a degraded store fails count against it
+func guarded(s db.Store, b *circuit.Breaker) db.Store {
+	return db.Intercept(s, func(ctx context.Context, _ db.Operation, call func(ctx context.Context) error) error {
+		err := b.Do(func() error { return call(ctx) }, db.Unavailable)
+		var open *circuit.OpenError
+		if errors.As(err, &open) {
+			return fmt.Errorf("%w: %w", db.ErrUnavailable, err)
+		}
+		return err
+	})
+}
+
+// metrics served on /metrics: requests are recorded by recordRequest, store
+// operations by the instrumented store and the rest is read at each scrape
+var (
+	httpRequests     = metrics.NewCounterVec("http_requests_total", "Requests answered, by method, route and status.", "method", "route", "status")
+	httpDuration     = metrics.NewHistogramVec("http_request_duration_seconds", "Time taken to answer requests, by method, route and status.", metrics.DefaultBuckets, "method", "route", "status")
+	storeDuration    = metrics.NewHistogramVec("store_operation_duration_seconds", "Time taken by store operations, by operation.", metrics.DefaultBuckets, "operation")
+	storeReadRetries = metrics.NewCounterVec("store_read_retries_total", "Store reads made again after the store was unavailable, by operation.", "operation")
+	registry         = newRegistry()
+)
+
+func newRegistry() *metrics.Registry {
+	r := metrics.NewRegistry()
+	r.MustRegister(
+		httpRequests,
+		httpDuration,
+		storeDuration,
+		storeReadRetries,
+		metrics.NewGaugeFunc("users", "Users in the store, soft-deleted ones excluded.", func() float64 {
+			return float64(db.CountUsers(false))
+		}),
+		metrics.NewCounterFunc("users_created_total", "Users created over the lifetime of the store.", func() float64 {
+			return float64(db.GetStats().CreatedTotal)
+		}),
+		metrics.NewCounterFunc("users_deleted_total", "Users deleted over the lifetime of the store.", func() float64 {
+			return float64(db.GetStats().DeletedTotal)
+		}),
+		metrics.NewCounterFunc("user_index_hits_total", "Lookups of a user by id found in the id index of the store.", func() float64 {
+			return float64(db.GetIndexStats().Hits)
+		}),
+		metrics.NewCounterFunc("user_index_misses_total", "Lookups of a user by id not in the index: unknown or soft-deleted ids.", func() float64 {
+			return float64(db.GetIndexStats().Misses)
+		}),
+		metrics.NewCounterFunc("user_cache_hits_total", "Reads of a user by id the user cache answered.", func() float64 {
+			hits, _ := cacheStats()
+			return float64(hits)
+		}),
+		metrics.NewCounterFunc("user_cache_misses_total", "Reads of a user by id the user cache passed on to the store.", func() float64 {
+			_, misses := cacheStats()
+			return float64(misses)
+		}),
+		metrics.NewGaugeFunc("go_goroutines", "Goroutines that currently exist.", func() float64 {
+			return float64(runtime.NumGoroutine())
+		}),
+		metrics.NewGaugeFunc("process_start_time_seconds", "Start time of the process since the Unix epoch, in seconds.", func() float64 {
+			return float64(startedAt.UnixNano()) / 1e9
+		}),
+	)
+	return r
+}
+
+// the hits and misses of the user cache, none without one
+func cacheStats() (hits, misses int64) {
+	if c := userCache; c != nil {
+		return c.Stats()
+	}
+	return 0, 0
+}
+
+// values of the breaker_state gauge
+var breakerStates = map[string]float64{circuit.Closed: 0, circuit.HalfOpen: 1, circuit.Open: 2}
+
+// process start, reported as uptime on /status
+var startedAt = time.Now()
+
+// target of user backups, nil when no bucket is configured; set by
+// newRouter
+var uploader objectstore.Uploader
+
+// settings the handlers run with, set by newRouter
+var conf config.Config
+
+// enabled state of every endpoint, set by newRouter
+var endpoints *features.Registry
+
+// checks of /readyz, registered by what they check as it is set up: the
+// store and object storage by newRouter, the breaker by newStore
+var checks = readiness.NewRegistry()
+
+// per client IP limits of the api routes, set by newRouter and changed by
+// a config reload
+var limiter *middleware.RateLimiter
+
+// add the request headers to access log lines, see LOG_HEADERS
+var logHeaders atomic.Bool
+
+// circuit breaker around the store calls, nil unless BREAKER_THRESHOLD is set
+var breaker *circuit.Breaker
+
+// result of the store integrity check at start, reported on /status
+var integrity db.IntegrityReport
+
+// issues and checks JWTs, nil unless JWT_SECRET is set
+var tokens *auth.Signer
+
+// checks inbound webhooks, nil unless WEBHOOK_SECRET is set
+var webhooks *webhook.Verifier
+
+// async imports and other background work, set by newRouter
+var background *jobs.Registry
+
+// recent creates by body, nil unless DEDUPE_WINDOW is set
+var creates *dedupe.Window
+
+// users read by id, in front of the store; nil unless CACHE_SIZE is set
+var userCache *db.Cache
+
+// records the spans of requests and store calls, nil unless
+// OTEL_EXPORTER_OTLP_ENDPOINT is set
+var tracer *tracing.Tracer
+
+func main() {
+	cfg, err := config.Load()
 
-func getUserHandler(c *gin.Context) {
-	idStr := c.Param("id")
-	
-	id, err:= strconv.Atoi(idStr)
-	
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-		return
-	}		
-	
-	user := db.GetUser(id)
-	
-	if user == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
-		return
-	}
-
-	c.JSON(http.StatusOK, user)
-}
-
-func createUserHandler(c *gin.Context) {
-	var user models.User
-	
-	if err := c.BindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-	
-	user.ID = len(db.GetUsers()) + 1
-	db.AddUser(user)
-
-	c.JSON(http.StatusCreated, user)
-}	
-
-func updateUserHandler(c *gin.Context) {
-	idStr := c.Param("id")
-	
-	id, err := strconv.Atoi(idStr)
-	
+		log.Fatal(err)
+	}
+
+	// the standard log goes through it too, as lines of level info
+	logger, err := logging.New(os.Stderr, cfg.LogFormat, cfg.LogLevel)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	slog.SetDefault(logger)
+
+	setGinMode(cfg.AppEnv)
+	models.IDAsString = cfg.IDAsString
+
+	if err := db.SetUniqueFields(cfg.UniqueFields); err != nil {
+		log.Fatal(err)
+	}
+
+	ids, err := db.NewIDGenerator(cfg.IDStrategy)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-		return
+		log.Fatal(err)
 	}
-	
-	var user models.User
-	
-	if err := c.BindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	db.SetIDGenerator(ids)
+
+	var keys *fieldcrypt.Keyring
+	if cfg.EncryptionKeys != "" {
+		if keys, err = fieldcrypt.Parse(cfg.EncryptionKeys); err != nil {
+			log.Fatal(err)
+		}
 	}
-	
-	updated := db.UpdateUser(id, user)
 
-	if !updated {
-		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
-		return
+	if cfg.DataFile != "" && cfg.DatabaseURL != "" {
+		log.Fatal("set DATA_FILE or DATABASE_URL, not both")
 	}
 
-	c.JSON(http.StatusOK, user)
+	db.SetAuditLimit(cfg.AuditMaxEntries)
+
+	if cfg.DatabaseURL != "" {
+		conn, err := sql.Open(cfg.DatabaseDriver, cfg.DatabaseURL)
+		if err != nil {
+			log.Fatalf("DATABASE_DRIVER %q: %v (want sqlite or pgx)", cfg.DatabaseDriver, err)
+		}
+		start := time.Now()
+		if err := db.OpenSQL(conn, keys); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded %d users from the %s database in %v", db.CountUsers(true), cfg.DatabaseDriver, time.Since(start).Round(time.Millisecond))
+	}
+
+	if cfg.DataFile != "" {
+		start := time.Now()
+		if err := db.Open(cfg.DataFile, keys); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded %d users from %s in %v", db.CountUsers(true), cfg.DataFile, time.Since(start).Round(time.Millisecond))
+		if cfg.DataWAL {
+			if err := db.UseWAL(cfg.SnapshotEvery); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if err := checkIntegrity(cfg.StrictIntegrity); err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := v1.UserOrder(cfg.DefaultSort); err != nil {
+		log.Fatal("DEFAULT_SORT: ", err)
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		tracer = tracing.New(tracing.NewOTLP(cfg.OTLPEndpoint, cfg.ServiceName))
+	}
+
+	store = newStore(cfg, db.Memory{})
+
+	if err := warmCache(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	handler, err := middleware.TrailingSlash(cfg.TrailingSlash, newRouter(cfg))
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler = middleware.Watchdog(cfg.RequestTimeout, cfg.RetryAfter, handler)
+
+	servers := []*http.Server{newServer(cfg, handler)}
+
+	if cfg.GRPCAddr != "" {
+		servers = append(servers, newGRPCServer(cfg))
+	}
+
+	reloadOnHangup(cfg)
+
+	serve(servers, cfg.ShutdownTimeout)
 }
 
-func deleteUserHandler(c *gin.Context) {
-	idStr := c.Param("id")
-	
-	id, err := strconv.Atoi(idStr)
-	
+// closed once the server starts shutting down, ending long-lived streams
+// that would otherwise hold the drain up until its timeout
+var shuttingDown = make(chan struct{})
+
+// serve until SIGINT or SIGTERM, then stop accepting connections and wait up
+// to timeout for the requests and background jobs in flight. A second
+// signal, or the timeout, closes whatever is left. The first server is the
+// HTTP one, others such as gRPC run next to it and stop with it.
+func serve(servers []*http.Server, timeout time.Duration) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	servers[0].RegisterOnShutdown(func() { close(shuttingDown) })
+
+	failed := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			failed <- srv.ListenAndServe()
+		}()
+		log.Printf("listening on %s", srv.Addr)
+	}
+
+	select {
+	case err := <-failed:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("%v: shutting down, waiting up to %v for requests in flight", sig, timeout)
+	}
+	// from here a second signal kills the process as usual
+	signal.Stop(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v, closing the remaining connections", err)
+			srv.Close()
+		}
+	}
+
+	if err := background.Wait(ctx); err != nil {
+		log.Printf("shutdown: %v, background jobs still running are lost", err)
+	}
+
+	if tracer != nil {
+		if err := tracer.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v, spans not exported are lost", err)
+		}
+	}
+	log.Print("shut down")
+}
+
+// re-read the config on every SIGHUP, cfg being the one the server started
+// with, and apply what can change while serving
+func reloadOnHangup(cfg config.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg = reloadConfig(cfg)
+		}
+	}()
+}
+
+// settings a reload applies to the running server, by Config field name;
+// everything else is used once at start and needs a restart
+var reloadable = map[string]bool{
+	"LogHeaders":        true,
+	"RateLimit":         true,
+	"RateBurst":         true,
+	"RateWarmup":        true,
+	"RateWarmupStart":   true,
+	"DisabledEndpoints": true,
+}
+
+// load the config again and apply its reloadable settings, warning about
+// the other ones that changed. It returns current with only the applied
+// settings updated, so a change still waiting for a restart is warned
+// about on every reload. A config that fails to load changes nothing.
+func reloadConfig(current config.Config) config.Config {
+	cfg, err := config.Load()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-		return
+		log.Printf("reload: %v, keeping the current config", err)
+		return current
+	}
+	for _, name := range config.Changed(current, cfg) {
+		if reloadable[name] {
+			log.Printf("reload: applied %s", name)
+		} else {
+			log.Printf("reload: %s changed but needs a restart, ignored", name)
+		}
+	}
+
+	logHeaders.Store(cfg.LogHeaders)
+	limiter.SetLimits(cfg.RateLimit, cfg.RateBurst, cfg.RateWarmup, cfg.RateWarmupStart)
+	endpoints.SetDisabled(cfg.DisabledEndpoints)
+	for _, name := range endpoints.Unknown() {
+		log.Printf("DISABLED_ENDPOINTS names unknown endpoint %q", name)
+	}
+
+	current.LogHeaders = cfg.LogHeaders
+	current.RateLimit, current.RateBurst = cfg.RateLimit, cfg.RateBurst
+	current.RateWarmup, current.RateWarmupStart = cfg.RateWarmup, cfg.RateWarmupStart
+	current.DisabledEndpoints = cfg.DisabledEndpoints
+	return current
+}
+
+// check the loaded store, keeping the report for /status and logging each
+// problem; strict, a problem is an error and the server does not start
+func checkIntegrity(strict bool) error {
+	integrity = db.CheckIntegrity()
+	for _, p := range integrity.Problems {
+		log.Printf("integrity: %s", p)
+	}
+	if !integrity.OK() && strict {
+		return fmt.Errorf("store failed its integrity check with %d problems", len(integrity.Problems))
+	}
+	return nil
+}
+
+// run gin in the mode of APP_ENV; what it still prints in debug mode goes
+// to the same log as ours
+func setGinMode(env string) {
+	gin.SetMode(ginMode(env))
+	gin.DebugPrintFunc = func(format string, values ...any) {
+		log.Printf("[GIN-debug] "+strings.TrimSuffix(format, "\n"), values...)
+	}
+}
+
+// gin mode of an APP_ENV
+func ginMode(env string) string {
+	switch env {
+	case "production":
+		return gin.ReleaseMode
+	case "test":
+		return gin.TestMode
+	default:
+		return gin.DebugMode
+	}
+}
+
+// wrap the router in a server with timeouts so slow clients cannot hold
+// connections open forever (slowloris)
+func newServer(cfg config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// set up the engine with all routes mounted under the configured base path
+func newRouter(cfg config.Config) *gin.Engine {
+	conf = cfg
+	logHeaders.Store(cfg.LogHeaders)
+	apierror.RetryAfter = cfg.RetryAfter
+
+	background = jobs.New(cfg.JobTTL)
+
+	creates = nil
+	if cfg.DedupeWindow > 0 {
+		creates = dedupe.New(cfg.DedupeWindow)
+	}
+
+	r := gin.New()
+	// trailing slashes are handled by middleware.TrailingSlash in front of gin
+	r.RedirectTrailingSlash = false
+	if len(cfg.TrustedProxies) > 0 {
+		if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+			log.Fatal(err)
+		}
+	}
+	r.Use(logging.Requests(v1.Actor, loggedHeaders), recordRequest)
+	if tracer != nil {
+		r.Use(middleware.Trace(tracer))
+	}
+	r.Use(apierror.Handler(), logging.Context())
+	r.NoRoute(routeNotFound)
+	// every request is logged, so its headers are redacted for all of them
+	r.Use(middleware.RedactHeaders())
+
+	// probes stay at the root whatever the base path
+	r.GET("/health", healthHandler)
+	r.GET("/healthz", healthHandler)
+	r.GET("/status", statusHandler)
+	r.GET("/readiness", readinessHandler)
+	r.GET("/readyz", readinessHandler)
+	r.GET("/metrics", gin.WrapH(registry))
+	r.GET("/version", versionHandler)
+
+	api := r.Group(cfg.BasePath)
+	// probes are not limited, they are registered outside the group; a rate
+	// of 0 lets everything through until a reload sets one
+	limiter = middleware.NewRateLimiter(cfg.RateLimit, cfg.RateBurst, cfg.RateWarmup, cfg.RateWarmupStart)
+	api.Use(limiter.Handler())
+	api.Use(middleware.BodyLimit(cfg.MaxBodyBytes, cfg.MaxUploadBytes))
+	api.Use(v1.DisplayZone, auth.APIKeys(db.APIKeyPrefix, store.AuthenticateAPIKey))
+	tokens = nil
+	if cfg.JWTSecret != "" {
+		tokens = auth.NewSigner([]byte(cfg.JWTSecret), cfg.JWTTTL)
+		api.Use(auth.JWT(tokens))
+	}
+
+	// disabled endpoints answer 404 as if they did not exist; they are still
+	// registered, so a config reload can switch them on and off
+	endpoints = features.New(cfg.DisabledEndpoints)
+
+	// the routes of a version are served under its prefix, and while
+	// LEGACY_ROUTES is on at the bare BASE_PATH as well, where responses
+	// carry a Sunset header and a Link to the versioned path. Both paths
+	// share the endpoint name, DISABLED_ENDPOINTS switches off the two.
+	versioned := api.Group(v1.Prefix, v1.ServedUnder(cfg.BasePath+v1.Prefix))
+	var legacy *gin.RouterGroup
+	if cfg.LegacyRoutes {
+		legacy = api.Group("", middleware.Deprecated(cfg.LegacySunset, cfg.BasePath, cfg.BasePath+v1.Prefix), v1.ServedUnder(cfg.BasePath))
 	}
-	
-	deleted := db.DeleteUser(id)
-	
-	if !deleted {
-		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
-		return
+	route := func(method, path, name string, handlers ...gin.HandlerFunc) {
+		if !endpoints.Register(name) {
+			log.Printf("endpoint %s (%s %s) is disabled", name, method, path)
+		}
+		chain := append([]gin.HandlerFunc{endpointEnabled(endpoints, name)}, access(method, path, name)...)
+		// the checks of the route, such as the admin token, run before the
+		// body is asked for, the handler itself after
+		last := len(handlers) - 1
+		chain = append(chain, handlers[:last]...)
+		chain = append(chain, middleware.ExpectContinue(), middleware.BufferBody(), handlers[last])
+		versioned.Handle(method, path, chain...)
+		if legacy != nil {
+			legacy.Handle(method, path, chain...)
+		}
+		v1.DocumentRoute(method, path, name, accessRole(method, path, name))
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "user deleted"})
-}	
\ No newline at end of file
+	if uploader == nil && cfg.S3Bucket != "" {
+		uploader = &objectstore.S3{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Name:      cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+		}
+	}
+	if cfg.WebhookSecret != "" {
+		webhooks = webhook.NewVerifier([]byte(cfg.WebhookSecret), cfg.WebhookTolerance)
+	}
+
+	// the store is critical; object storage only limits backups, so it can
+	// only degrade readiness
+	checks.Register(readiness.Check{Name: "db", Critical: true, Run: func(context.Context) error { return db.Ping() }})
+	if uploader != nil {
+		checks.Register(readiness.Check{Name: "object_store", Run: uploader.Ping})
+	} else {
+		checks.Unregister("object_store")
+	}
+
+	v1.Setup(v1.Deps{
+		Config:       cfg,
+		Store:        store,
+		Uploader:     uploader,
+		Tokens:       tokens,
+		Webhooks:     webhooks,
+		Jobs:         background,
+		Creates:      creates,
+		ShuttingDown: shuttingDown,
+	})
+	v1.Routes(cfg, route)
+
+	// the document of the routes above, and Swagger UI to browse it; at the
+	// root as the probes, and off with DISABLED_ENDPOINTS like the rest
+	endpoints.Register("openapi")
+	endpoints.Register("docs")
+	r.GET("/openapi.json", endpointEnabled(endpoints, "openapi"), v1.OpenAPIHandler)
+	r.GET("/docs", endpointEnabled(endpoints, "docs"), docsHandler)
+
+	for _, name := range endpoints.Unknown() {
+		log.Printf("DISABLED_ENDPOINTS names unknown endpoint %q", name)
+	}
+
+	return r
+}
+
+// what a route needs of its caller once JWT_SECRET is set: reads of users
+// and jobs any signed-in caller, other methods on /users the admin role.
+// Email confirmation links are opened from a mail client and carry their
+// own token, the other routes take other credentials or none.
+func access(method, path, name string) []gin.HandlerFunc {
+	switch accessRole(method, path, name) {
+	case auth.User:
+		return []gin.HandlerFunc{auth.Required()}
+	case auth.Admin:
+		return []gin.HandlerFunc{auth.RequireRole(auth.Admin)}
+	}
+	return nil
+}
+
+// the role access requires of the route: auth.User for any signed-in
+// caller, auth.Admin, or "" for none. The API keys of a user are left to
+// their handlers, which let the user in as well as an admin.
+func accessRole(method, path, name string) string {
+	switch {
+	case tokens == nil, name == "confirm_email":
+		return ""
+	case name == "create_api_key", name == "list_api_keys", name == "revoke_api_key":
+		return ""
+	}
+	users := strings.HasPrefix(path, "/users")
+	switch {
+	case (users || strings.HasPrefix(path, "/jobs")) && (method == http.MethodGet || method == http.MethodHead):
+		return auth.User
+	case users:
+		return auth.Admin
+	}
+	return ""
+}
+
+// answer what routes the router does not have answer while the endpoint is
+// disabled in registry
+func endpointEnabled(registry *features.Registry, name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !registry.Enabled(name) {
+			routeNotFound(c)
+		}
+	}
+}
+
+// the answer to a route the router does not have
+func routeNotFound(c *gin.Context) {
+	apierror.Respond(c, apierror.New(http.StatusNotFound, "route not found"))
+}
+
+// the request headers of the access log, redacted, while LOG_HEADERS is on
+func loggedHeaders(c *gin.Context) http.Header {
+	if !logHeaders.Load() {
+		return nil
+	}
+	return middleware.RedactedHeaders(c.Keys)
+}
+
+// count and time every request by method, route and status. The route is
+// the pattern it matched, e.g. /users/:id, and "unmatched" for requests that
+// matched none, so unknown paths do not each make a series.
+func recordRequest(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	httpRequests.Inc(c.Request.Method, route, status)
+	httpDuration.Observe(time.Since(start).Seconds(), c.Request.Method, route, status)
+}
+
+// liveness only, kept cheap for frequent probes
+func healthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// diagnostics for humans, see /health for probes
+func statusHandler(c *gin.Context) {
+	breakerState := "off"
+	if breaker != nil {
+		breakerState = breaker.State()
+	}
+
+	// null while the store is refusing calls
+	var users *int
+	if stats, err := store.GetStats(c.Request.Context()); err == nil {
+		users = &stats.Current
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":         "ok",
+		"uptime":         time.Since(startedAt).Round(time.Second).String(),
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+		"users":          users,
+		"version":        buildVersion(),
+		"go_version":     runtime.Version(),
+		"goroutines":     runtime.NumGoroutine(),
+		"breaker":        breakerState,
+		"integrity":      integrity,
+	})
+}
+
+// whether the dependencies are usable, 503 when a critical one is not
+func readinessHandler(c *gin.Context) {
+	report := checks.Run(c.Request.Context(), conf.ReadinessTimeout)
+
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+		apierror.SetRetryAfter(c.Writer.Header())
+	}
+
+	c.JSON(status, report)
+}
@@ -0,0 +1,1895 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/auth"
+	"go-api/client"
+	"go-api/config"
+	"go-api/db"
+	"go-api/jobs"
+	"go-api/middleware"
+	"go-api/models"
+	"go-api/pagination"
+	"go-api/readiness"
+	"go-api/tracing"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// the access log and gin's debug lines would drown the test output
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// the config of the defaults with env on top, as config.Load reads it
+func testConfig(t *testing.T, env map[string]string) config.Config {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	// most tests write without If-Match, the ones about it require it again
+	t.Setenv("REQUIRE_IF_MATCH", "false")
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// the router main serves for cfg over base, with fresh metrics
+func testRouter(t *testing.T, cfg config.Config, base db.Store) http.Handler {
+	t.Helper()
+	registry = newRegistry()
+	store = newStore(cfg, base)
+	t.Cleanup(func() {
+		store = instrumented(db.Memory{})
+		breaker = nil
+		userCache = nil
+	})
+	return newRouter(cfg)
+}
+
+// answer of h to a request, with a JSON body unless body is empty
+func do(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	var r *http.Request
+	if body == "" {
+		r = httptest.NewRequest(method, path, nil)
+	} else {
+		r = httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	return do(h, http.MethodGet, path, "")
+}
+
+// value of the series of /metrics, 0 when there is none
+func metric(h http.Handler, series string) float64 {
+	for _, line := range strings.Split(get(h, "/metrics").Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, _ := strconv.ParseFloat(value, 64)
+			return v
+		}
+	}
+	return 0
+}
+
+// a store whose reads for the user list, its date, the users, their stats
+// and API keys, and whose creates fail with the error set in it
+type failingStore struct {
+	db.Memory
+	mu    sync.Mutex
+	err   error
+	times int
+	calls int
+}
+
+// fail the next times calls with err, every call when times is negative
+func (s *failingStore) fail(err error, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err, s.times = err, times
+}
+
+// calls made so far
+func (s *failingStore) called() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// count a call and tell its error
+func (s *failingStore) call() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.err == nil || s.times == 0 {
+		return nil
+	}
+	s.times--
+	return s.err
+}
+
+func (s *failingStore) LastModified(ctx context.Context) (time.Time, error) {
+	if err := s.call(); err != nil {
+		return time.Time{}, err
+	}
+	return s.Memory.LastModified(ctx)
+}
+
+func (s *failingStore) GetUsers(ctx context.Context, q db.UserQuery) ([]models.User, int, error) {
+	if err := s.call(); err != nil {
+		return nil, 0, err
+	}
+	return s.Memory.GetUsers(ctx, q)
+}
+
+func (s *failingStore) AddUser(ctx context.Context, user models.User, by string) (*models.User, error) {
+	if err := s.call(); err != nil {
+		return nil, err
+	}
+	return s.Memory.AddUser(ctx, user, by)
+}
+
+func (s *failingStore) AddUsers(ctx context.Context, users []models.User, atomic bool, by string) ([]models.User, []error, error) {
+	if err := s.call(); err != nil {
+		if atomic {
+			err = &db.BatchError{Index: 0, Err: err}
+		}
+		return nil, nil, err
+	}
+	return s.Memory.AddUsers(ctx, users, atomic, by)
+}
+
+func (s *failingStore) GetStats(ctx context.Context) (db.Stats, error) {
+	if err := s.call(); err != nil {
+		return db.Stats{}, err
+	}
+	return s.Memory.GetStats(ctx)
+}
+
+func (s *failingStore) AuthenticateAPIKey(ctx context.Context, key string) (models.ID, bool, error) {
+	if err := s.call(); err != nil {
+		return "", false, err
+	}
+	return s.Memory.AuthenticateAPIKey(ctx, key)
+}
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		name string
+		// error of the store reads, nil for none
+		err error
+		// path requested, once for each of want
+		path      string
+		want      []int
+		wantCalls int
+		wantState string
+		wantTrips string
+	}{
+		{
+			name:      "opens after the threshold and stops calling the store",
+			err:       db.ErrUnavailable,
+			path:      "/api/v1/users",
+			want:      []int{503, 503, 503, 503},
+			wantCalls: 2,
+			wantState: "breaker_state 2",
+			wantTrips: "breaker_trips_total 1",
+		},
+		{
+			name:      "timeouts of the store count",
+			err:       context.DeadlineExceeded,
+			path:      "/api/v1/users",
+			want:      []int{503, 503, 503},
+			wantCalls: 2,
+			wantState: "breaker_state 2",
+			wantTrips: "breaker_trips_total 1",
+		},
+		{
+			name:      "errors of the caller do not count",
+			path:      "/api/v1/users/999",
+			want:      []int{404, 404, 404, 404},
+			wantState: "breaker_state 0",
+			wantTrips: "breaker_trips_total 0",
+		},
+		{
+			name:      "healthy reads keep it closed",
+			path:      "/api/v1/users",
+			want:      []int{200, 200, 200},
+			wantCalls: 6,
+			wantState: "breaker_state 0",
+			wantTrips: "breaker_trips_total 0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"BREAKER_THRESHOLD": "2", "BREAKER_COOLDOWN": "1m"})
+			base := &failingStore{}
+			base.fail(tt.err, -1)
+			h := testRouter(t, cfg, base)
+
+			for i, want := range tt.want {
+				w := get(h, tt.path)
+				if w.Code != want {
+					t.Fatalf("request %d: status %d, want %d: %s", i+1, w.Code, want, w.Body)
+				}
+			}
+			if got := base.called(); got != tt.wantCalls {
+				t.Errorf("store called %d times, want %d", got, tt.wantCalls)
+			}
+
+			body := get(h, "/metrics").Body.String()
+			for _, want := range []string{tt.wantState, tt.wantTrips} {
+				if !strings.Contains(body, want+"\n") {
+					t.Errorf("/metrics has no %q:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerRefusal(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"BREAKER_THRESHOLD": "1", "BREAKER_COOLDOWN": "50ms"})
+	base := &failingStore{}
+	base.fail(db.ErrUnavailable, -1)
+	h := testRouter(t, cfg, base)
+
+	get(h, "/api/v1/users")
+	w := get(h, "/api/v1/users")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("open breaker answered %d with Retry-After %q, want 503 with 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	var answer struct{ Error string }
+	json.Unmarshal(w.Body.Bytes(), &answer)
+	if answer.Error != "store unavailable, try again later" {
+		t.Errorf("open breaker answered %q", answer.Error)
+	}
+
+	// the probes are not the store's, but readiness reports the breaker
+	if w := get(h, "/health"); w.Code != http.StatusOK {
+		t.Errorf("/health answered %d while open", w.Code)
+	}
+	if w := get(h, "/readyz"); !strings.Contains(w.Body.String(), "circuit breaker open") {
+		t.Errorf("/readyz does not report the open breaker: %s", w.Body)
+	}
+	if w := get(h, "/status"); !strings.Contains(w.Body.String(), `"breaker":"open"`) {
+		t.Errorf("/status does not report the open breaker: %s", w.Body)
+	}
+
+	// a successful probe after the cooldown closes it again
+	base.fail(nil, 0)
+	time.Sleep(60 * time.Millisecond)
+	if w := get(h, "/api/v1/users"); w.Code != http.StatusOK {
+		t.Fatalf("probe answered %d, want 200", w.Code)
+	}
+	if state := breaker.State(); state != "closed" {
+		t.Errorf("breaker %s after a successful probe, want closed", state)
+	}
+}
+
+// every 503 tells the client when to try again, whatever answers it
+func TestRetryAfter(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"RETRY_AFTER": "3s"})
+	base := &failingStore{}
+	h := testRouter(t, cfg, base)
+	base.fail(db.ErrUnavailable, -1)
+	checks.Register(readiness.Check{Name: "queue", Critical: true, Run: func(context.Context) error { return errors.New("queue down") }})
+	t.Cleanup(func() { checks.Unregister("queue") })
+
+	tests := []struct {
+		name, method, path, body string
+		header                   map[string]string
+	}{
+		{"api key check", http.MethodGet, "/api/v1/users/1", "", map[string]string{"X-API-Key": "key"}},
+		{"atomic batch", http.MethodPost, "/api/v1/users/batch?atomic=true", `[{"name":"Ada","email":"ada@example.com"}]`, nil},
+		{"batch", http.MethodPost, "/api/v1/users/batch", `[{"name":"Ada","email":"ada@example.com"}]`, nil},
+		{"user list", http.MethodGet, "/api/v1/users", "", nil},
+		{"readiness", http.MethodGet, "/readyz", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "3" {
+				t.Errorf("answered %d with Retry-After %q, want 503 with 3: %s", w.Code, w.Header().Get("Retry-After"), w.Body)
+			}
+		})
+	}
+}
+
+func TestReadRetries(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		method string
+		body   string
+		err    error
+		// calls failing
+		failing     int
+		want        int
+		wantCalls   int
+		wantRetries float64
+	}{
+		{
+			name:        "read retried until it succeeds",
+			method:      http.MethodGet,
+			err:         db.ErrUnavailable,
+			failing:     2,
+			want:        http.StatusOK,
+			wantCalls:   4,
+			wantRetries: 2,
+		},
+		{
+			name:        "read out of retries",
+			method:      http.MethodGet,
+			err:         db.ErrUnavailable,
+			failing:     3,
+			want:        http.StatusServiceUnavailable,
+			wantCalls:   3,
+			wantRetries: 2,
+		},
+		{
+			name:      "missing data not retried",
+			method:    http.MethodGet,
+			err:       db.ErrNotFound,
+			failing:   1,
+			want:      http.StatusNotFound,
+			wantCalls: 1,
+		},
+		{
+			name:      "write not retried",
+			method:    http.MethodPost,
+			body:      `{"name":"Ada","email":"ada@example.com"}`,
+			err:       db.ErrNotSaved,
+			failing:   1,
+			want:      http.StatusServiceUnavailable,
+			wantCalls: 1,
+		},
+		{
+			name:        "breaker sees the read once",
+			env:         map[string]string{"BREAKER_THRESHOLD": "1"},
+			method:      http.MethodGet,
+			err:         db.ErrUnavailable,
+			failing:     2,
+			want:        http.StatusOK,
+			wantCalls:   4,
+			wantRetries: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"READ_RETRIES": "2", "READ_RETRY_BACKOFF": "1ms"}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			cfg := testConfig(t, env)
+			base := &failingStore{}
+			base.fail(tt.err, tt.failing)
+			h := testRouter(t, cfg, base)
+			// the counter lives as long as the process, as on /metrics
+			retries := metric(h, `store_read_retries_total{operation="last_modified"}`)
+
+			if w := do(h, tt.method, "/api/v1/users", tt.body); w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if got := base.called(); got != tt.wantCalls {
+				t.Errorf("store called %d times, want %d", got, tt.wantCalls)
+			}
+			if breaker != nil && breaker.State() != "closed" {
+				t.Errorf("breaker %s, want closed", breaker.State())
+			}
+
+			if got := metric(h, `store_read_retries_total{operation="last_modified"}`) - retries; got != tt.wantRetries {
+				t.Errorf("%v retries counted, want %v", got, tt.wantRetries)
+			}
+		})
+	}
+}
+
+// send the request head to srv with "Expect: 100-continue" and the body
+// only once the server asks for it, in one chunk when chunked is set,
+// returning the status of each answer in order: 100 then the final one, or
+// the final one alone
+func expectContinue(t *testing.T, srv *httptest.Server, path, contentType, body string, chunked bool, header map[string]string) []int {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	head := "POST " + path + " HTTP/1.1\r\nHost: test\r\nExpect: 100-continue\r\nContent-Type: " + contentType + "\r\n"
+	if chunked {
+		head += "Transfer-Encoding: chunked\r\n"
+		body = strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+	} else {
+		head += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n"
+	}
+	for k, v := range header {
+		head += k + ": " + v + "\r\n"
+	}
+	if _, err := io.WriteString(conn, head+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	var statuses []int
+	for {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("after %v: %v", statuses, err)
+		}
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+		if resp.StatusCode != http.StatusContinue {
+			return statuses
+		}
+		if _, err := io.WriteString(conn, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	const user = `{"name":"Ada","email":"ada@example.com"}`
+	jwt := map[string]string{"JWT_SECRET": "test-jwt-secret"}
+	tests := []struct {
+		name        string
+		env         map[string]string
+		path        string
+		contentType string
+		chunked     bool
+		header      map[string]string
+		want        []int
+	}{
+		{"body asked for", nil, "/api/v1/users", "application/json", false, nil, []int{100, 201}},
+		{"unsupported content type", nil, "/api/v1/users", "text/plain", false, nil, []int{417}},
+		{"unauthenticated", jwt, "/api/v1/users", "application/json", false, nil, []int{401}},
+		{"without the admin token", map[string]string{"ADMIN_TOKEN": "test-admin-token"}, "/api/v1/admin/compact", "text/plain", false, nil, []int{401}},
+		{"admin token, unsupported content type", map[string]string{"ADMIN_TOKEN": "test-admin-token"}, "/api/v1/admin/compact", "text/plain", false,
+			map[string]string{"Authorization": "Bearer test-admin-token"}, []int{417}},
+		{"unknown route", nil, "/api/v1/nothing", "application/json", false, nil, []int{404}},
+		{"chunked, body asked for", nil, "/api/v1/users", "application/json", true, nil, []int{100, 201}},
+		{"chunked, unsupported content type", nil, "/api/v1/users", "text/plain", true, nil, []int{417}},
+		{"chunked, unauthenticated", jwt, "/api/v1/users", "application/json", true, nil, []int{401}},
+		{"chunked, over the limit", map[string]string{"MAX_BODY_BYTES": "10"}, "/api/v1/users", "application/json", true, nil, []int{100, 413}},
+		{"over the limit", map[string]string{"MAX_BODY_BYTES": "10"}, "/api/v1/users", "application/json", false, nil, []int{413}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.Reset()
+			t.Cleanup(db.Reset)
+			srv := httptest.NewServer(testRouter(t, testConfig(t, tt.env), db.Memory{}))
+			defer srv.Close()
+
+			got := expectContinue(t, srv, tt.path, tt.contentType, user, tt.chunked, tt.header)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("answered %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTracing(t *testing.T) {
+	spans := &tracing.InMemory{}
+	tracer = tracing.New(spans)
+	t.Cleanup(func() {
+		tracer.Shutdown(context.Background())
+		tracer = nil
+	})
+	db.Reset()
+	t.Cleanup(db.Reset)
+	h := testRouter(t, testConfig(t, nil), db.Memory{})
+	user, err := db.AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const caller = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name        string
+		path        string
+		traceparent string
+		// the trace continued and the parent of the request span, none
+		// for a new trace
+		trace, parent string
+		status        int
+		// no span is exported
+		unsampled bool
+	}{
+		{name: "new trace", path: "/api/v1/users/" + string(user.ID), status: http.StatusOK},
+		{name: "trace of the caller", path: "/api/v1/users/" + string(user.ID), traceparent: caller, trace: "4bf92f3577b34da6a3ce929d0e0e4736", parent: "00f067aa0ba902b7", status: http.StatusOK},
+		{name: "missing user", path: "/api/v1/users/999", traceparent: caller, trace: "4bf92f3577b34da6a3ce929d0e0e4736", parent: "00f067aa0ba902b7", status: http.StatusNotFound},
+		{name: "malformed traceparent", path: "/api/v1/users/" + string(user.ID), traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", status: http.StatusOK},
+		{name: "trace not sampled", path: "/api/v1/users/" + string(user.ID), traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", status: http.StatusOK, unsampled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := len(spans.Spans())
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if err := tracer.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			got := spans.Spans()[seen:]
+			if tt.unsampled {
+				if len(got) != 0 {
+					t.Fatalf("%d spans of a trace not sampled exported", len(got))
+				}
+				return
+			}
+
+			// the store call ends first, then the request
+			if len(got) != 2 {
+				t.Fatalf("%d spans, want the request and its store call: %+v", len(got), got)
+			}
+			call, req := got[0], got[1]
+			if req.Name != "GET /api/v1/users/:id" || req.Kind != tracing.Server {
+				t.Errorf("request span %q of kind %d", req.Name, req.Kind)
+			}
+			if tt.trace != "" && (req.Context.TraceID.String() != tt.trace || req.Parent.String() != tt.parent) {
+				t.Errorf("request span of trace %s under %s, want %s under %s", req.Context.TraceID, req.Parent, tt.trace, tt.parent)
+			}
+			if tt.trace == "" && req.Parent != (tracing.SpanID{}) {
+				t.Errorf("request span under %s, want the root of a new trace", req.Parent)
+			}
+			if status := attribute(req, "http.response.status_code"); status != tt.status {
+				t.Errorf("request span of status %v, want %d", status, tt.status)
+			}
+
+			if call.Name != "store get_user" || call.Context.TraceID != req.Context.TraceID || call.Parent != req.Context.SpanID {
+				t.Errorf("store span %q of trace %s under %s, want a child of the request span %s", call.Name, call.Context.TraceID, call.Parent, req.Context.SpanID)
+			}
+			id := strings.TrimPrefix(tt.path, "/api/v1/users/")
+			if attribute(call, "db.operation.name") != "get_user" || attribute(call, "user.id") != id || call.Error != "" {
+				t.Errorf("store span attributes %v, error %q, want get_user of %s without an error", call.Attributes, call.Error, id)
+			}
+		})
+	}
+}
+
+// the value of the attribute key of span, nil when it has none
+func attribute(span tracing.SpanData, key string) any {
+	for _, a := range span.Attributes {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+// a store counting the reads of a user by id
+type countingStore struct {
+	db.Memory
+	reads atomic.Int64
+}
+
+func (s *countingStore) GetUser(ctx context.Context, id models.ID) (*models.User, error) {
+	s.reads.Add(1)
+	return s.Memory.GetUser(ctx, id)
+}
+
+// a clock a second further on at each reading, so users are created in a
+// known order
+type tickingClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(time.Second)
+	return c.now
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func TestCacheWarmup(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   string
+		warmup string
+		// users the warmup loads, oldest first, and read from the store
+		warmed []string
+		cold   []string
+	}{
+		{"all users", "10", "all", []string{"1", "2", "3"}, nil},
+		{"most recent users", "10", "2", []string{"2", "3"}, []string{"1"}},
+		{"all users past the size", "2", "all", []string{"2", "3"}, []string{"1"}},
+		{"warmup off", "10", "off", nil, []string{"1", "2", "3"}},
+		{"no cache", "0", "off", nil, []string{"1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.Reset()
+			t.Cleanup(db.Reset)
+			db.SetClock(&tickingClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)})
+			t.Cleanup(func() { db.SetClock(systemClock{}) })
+			for _, name := range []string{"Ada", "Bob", "Eve"} {
+				if _, err := db.AddUser(models.User{Name: name, Email: strings.ToLower(name) + "@example.com"}, "test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			base := &countingStore{}
+			h := testRouter(t, testConfig(t, map[string]string{"CACHE_SIZE": tt.size, "CACHE_WARMUP": tt.warmup}), base)
+			if err := warmCache(conf); err != nil {
+				t.Fatal(err)
+			}
+			if userCache == nil && tt.size != "0" {
+				t.Fatal("no user cache")
+			}
+			if userCache != nil && userCache.Len() != len(tt.warmed) {
+				t.Errorf("%d users cached, want %d", userCache.Len(), len(tt.warmed))
+			}
+
+			for _, id := range append(slices.Clone(tt.warmed), tt.cold...) {
+				before := base.reads.Load()
+				if w := get(h, "/api/v1/users/"+id); w.Code != http.StatusOK {
+					t.Fatalf("user %s: status %d", id, w.Code)
+				}
+				if read := base.reads.Load() > before; read != slices.Contains(tt.cold, id) {
+					t.Errorf("user %s read from the store %v, want %v", id, read, !read)
+				}
+			}
+			if hits := metric(h, "user_cache_hits_total"); hits != float64(len(tt.warmed)) {
+				t.Errorf("%v cache hits, want %d", hits, len(tt.warmed))
+			}
+		})
+	}
+}
+
+func TestCacheWarmupErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"without a cache", map[string]string{"CACHE_WARMUP": "all"}, "CACHE_WARMUP needs a CACHE_SIZE"},
+		{"not a number", map[string]string{"CACHE_SIZE": "10", "CACHE_WARMUP": "some"}, `CACHE_WARMUP "some": want off, all or a number of users`},
+		{"no users", map[string]string{"CACHE_SIZE": "10", "CACHE_WARMUP": "0"}, `CACHE_WARMUP "0": want off, all or a number of users`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testRouter(t, testConfig(t, tt.env), db.Memory{})
+			if err := warmCache(conf); err == nil || err.Error() != tt.want {
+				t.Errorf("error %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+// a clock standing at a set time
+type fixedClock struct{ now time.Time }
+
+func (c fixedClock) Now() time.Time { return c.now }
+
+func TestTimestamps(t *testing.T) {
+	created := time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC)
+	db.SetClock(fixedClock{created})
+	t.Cleanup(func() { db.SetClock(systemClock{}) })
+	h := testRouter(t, testConfig(t, map[string]string{"LEGACY_SUNSET": "2027-01-31"}), db.Memory{})
+	db.Reset()
+	t.Cleanup(db.Reset)
+
+	if w := do(h, http.MethodPost, "/api/v1/users", `{"name":"Ada","email":"ada@example.com"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	db.SetClock(fixedClock{created.Add(90 * time.Minute)})
+	if w := do(h, http.MethodPatch, "/api/v1/users/1", `{"name":"Ada L"}`); w.Code != http.StatusOK {
+		t.Fatalf("update: status %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		sunset  string
+		created string
+		updated string
+	}{
+		{"versioned path", "/api/v1/users/1", "", "2026-03-01T09:30:00Z", "2026-03-01T11:00:00Z"},
+		{"legacy path", "/users/1", "Sun, 31 Jan 2027 00:00:00 GMT", "2026-03-01T09:30:00Z", "2026-03-01T11:00:00Z"},
+		{"in a zone", "/api/v1/users/1?tz=America/New_York", "", "2026-03-01T04:30:00-05:00", "2026-03-01T06:00:00-05:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(h, tt.path)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Sunset"); got != tt.sunset {
+				t.Errorf("Sunset %q, want %q", got, tt.sunset)
+			}
+			var user struct {
+				CreatedAt string `json:"created_at"`
+				UpdatedAt string `json:"updated_at"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+				t.Fatal(err)
+			}
+			if user.CreatedAt != tt.created || user.UpdatedAt != tt.updated {
+				t.Errorf("created at %s, updated at %s, want %s and %s", user.CreatedAt, user.UpdatedAt, tt.created, tt.updated)
+			}
+		})
+	}
+}
+
+// serve h as main does for cfg on a loopback port, returning its address
+func listen(t testing.TB, cfg config.Config, h http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(cfg, h)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestSlowClients(t *testing.T) {
+	cfg := testConfig(t, map[string]string{
+		"READ_HEADER_TIMEOUT": "200ms",
+		"READ_TIMEOUT":        "400ms",
+		"IDLE_TIMEOUT":        "300ms",
+	})
+	addr := listen(t, cfg, testRouter(t, cfg, db.Memory{}))
+
+	tests := []struct {
+		name string
+		// what the client sends before it stalls
+		sent string
+		// the timeout the server hangs up after
+		timeout time.Duration
+	}{
+		{"unfinished headers", "GET /health HTTP/1.1\r\nHost: x\r\n", cfg.ReadHeaderTimeout},
+		{"unfinished body", "POST /api/v1/users HTTP/1.1\r\nHost: x\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"name\":", cfg.ReadTimeout},
+		{"idle after a request", "GET /health HTTP/1.1\r\nHost: x\r\n\r\n", cfg.IdleTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			if _, err := io.WriteString(conn, tt.sent); err != nil {
+				t.Fatal(err)
+			}
+			// held far longer than the timeout unless the server hangs up
+			conn.SetReadDeadline(start.Add(10 * tt.timeout))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Fatalf("connection held past %v: %v", 10*tt.timeout, err)
+			}
+			if elapsed := time.Since(start); elapsed < tt.timeout {
+				t.Errorf("dropped after %v, before the timeout of %v", elapsed, tt.timeout)
+			}
+		})
+	}
+}
+
+// requests to the server main runs, over one kept-alive connection
+func BenchmarkServer(b *testing.B) {
+	b.Setenv("CONFIG_FILE", "")
+	cfg, err := config.Load()
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := listen(b, cfg, newRouter(cfg))
+	client := &http.Client{}
+	b.Cleanup(client.CloseIdleConnections)
+	b.ResetTimer()
+	for range b.N {
+		resp, err := client.Get("http://" + addr + "/health")
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	h := testRouter(t, testConfig(t, map[string]string{"BASE_PATH": "/gateway/"}), db.Memory{})
+	db.Reset()
+	t.Cleanup(db.Reset)
+	if w := do(h, http.MethodPost, "/gateway/api/v1/users", `{"name":"Ada","email":"ada@example.com"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want int
+		// a link the answer carries, if any
+		link string
+	}{
+		{"list", "/gateway/api/v1/users", http.StatusOK, "</gateway/api/v1/users?page=1>; rel=\"first\""},
+		{"user", "/gateway/api/v1/users/1", http.StatusOK, ""},
+		{"legacy list", "/gateway/users", http.StatusOK, "</gateway/api/v1/users>; rel=\"successor-version\""},
+		{"legacy user", "/gateway/users/1?tz=UTC", http.StatusOK, "</gateway/api/v1/users/1?tz=UTC>; rel=\"successor-version\""},
+		{"bare list", "/users", http.StatusNotFound, ""},
+		{"bare versioned list", "/api/v1/users", http.StatusNotFound, ""},
+		{"bare user", "/users/1", http.StatusNotFound, ""},
+		{"probe at the root", "/health", http.StatusOK, ""},
+		{"probe under the base path", "/gateway/health", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(h, tt.path)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.link != "" && !strings.Contains(w.Header().Get("Link"), tt.link) {
+				t.Errorf("Link %q lacks %s", w.Header().Get("Link"), tt.link)
+			}
+		})
+	}
+
+	var doc struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(get(h, "/openapi.json").Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != "/gateway/api/v1" {
+		t.Errorf("servers %+v, want /gateway/api/v1", doc.Servers)
+	}
+	if _, ok := doc.Paths["/users/{id}"]; !ok {
+		t.Errorf("paths %v lack /users/{id} under the server", slices.Collect(maps.Keys(doc.Paths)))
+	}
+}
+
+// a store whose reads of users and creates block until released, whatever
+// their context
+type blockingStore struct {
+	db.Memory
+	release chan struct{}
+	calls   atomic.Int64
+}
+
+func (s *blockingStore) block() {
+	s.calls.Add(1)
+	<-s.release
+}
+
+func (s *blockingStore) GetUser(ctx context.Context, id models.ID) (*models.User, error) {
+	s.block()
+	return s.Memory.GetUser(ctx, id)
+}
+
+func (s *blockingStore) LastModified(ctx context.Context) (time.Time, error) {
+	s.block()
+	return s.Memory.LastModified(ctx)
+}
+
+func (s *blockingStore) AddUser(ctx context.Context, user models.User, by string) (*models.User, error) {
+	s.block()
+	return s.Memory.AddUser(ctx, user, by)
+}
+
+func (s *blockingStore) AddUsers(ctx context.Context, users []models.User, atomic bool, by string) ([]models.User, []error, error) {
+	s.block()
+	return s.Memory.AddUsers(ctx, users, atomic, by)
+}
+
+func TestStalledStore(t *testing.T) {
+	const limit = 100 * time.Millisecond
+	base := &blockingStore{release: make(chan struct{})}
+	cfg := testConfig(t, map[string]string{"REQUEST_TIMEOUT": limit.String(), "RETRY_AFTER": "3s"})
+	// as main serves it, counting the handlers still running so the test
+	// ends with them
+	var running sync.WaitGroup
+	router := testRouter(t, cfg, base)
+	h := middleware.Watchdog(cfg.RequestTimeout, cfg.RetryAfter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		running.Add(1)
+		defer running.Done()
+		router.ServeHTTP(w, r)
+	}))
+	// cleanups run last first: the handlers are let go and finish before
+	// the store is reset
+	db.Reset()
+	t.Cleanup(db.Reset)
+	t.Cleanup(func() {
+		close(base.release)
+		running.Wait()
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		want    int
+		message string
+	}{
+		{"read of a user", http.MethodGet, "/api/v1/users/1", "", http.StatusServiceUnavailable, "request timed out"},
+		{"list", http.MethodGet, "/api/v1/users", "", http.StatusServiceUnavailable, "request timed out"},
+		{"create", http.MethodPost, "/api/v1/users", `{"name":"Ada","email":"ada@example.com"}`, http.StatusServiceUnavailable, "request timed out"},
+		{"probe without the store", http.MethodGet, "/health", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			w := do(h, tt.method, tt.path, tt.body)
+			elapsed := time.Since(start)
+			var body struct {
+				Error string `json:"error"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if w.Code != tt.want || body.Error != tt.message {
+				t.Fatalf("status %d %q, want %d %q", w.Code, body.Error, tt.want, tt.message)
+			}
+			if w.Code != http.StatusServiceUnavailable {
+				return
+			}
+			if elapsed < limit || elapsed > limit+time.Second {
+				t.Errorf("answered after %v, want right after %v", elapsed, limit)
+			}
+			if got := w.Header().Get("Retry-After"); got != "3" {
+				t.Errorf("Retry-After %q, want 3", got)
+			}
+		})
+	}
+
+	// the stalled handlers pile up to a bound, past which requests are refused
+	// without calling the store
+	var wg sync.WaitGroup
+	for range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			do(h, http.MethodGet, "/api/v1/users/1", "")
+		}()
+	}
+	wg.Wait()
+	calls := base.calls.Load()
+	start := time.Now()
+	w := do(h, http.MethodGet, "/api/v1/users/1", "")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "too many stalled requests") || time.Since(start) >= limit {
+		t.Errorf("with the handlers stalled: status %d after %v: %s", w.Code, time.Since(start), w.Body)
+	}
+	if base.calls.Load() != calls {
+		t.Errorf("store called by a refused request")
+	}
+}
+
+func TestAsyncImport(t *testing.T) {
+	cfg := testConfig(t, nil)
+	file := "name,email\nAda,ada@example.com\nBob,not an email\nCy,cy@example.com\n"
+	// the job of an import answered 202, checking its Location
+	enqueue := func(t *testing.T, h http.Handler) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/users/import?async=true", strings.NewReader(file))
+		r.Header.Set("Content-Type", "text/csv")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var job jobs.Job
+		if err := json.Unmarshal(w.Body.Bytes(), &job); w.Code != http.StatusAccepted || err != nil {
+			t.Fatalf("import: status %d: %s", w.Code, w.Body)
+		}
+		if job.Status != jobs.Running || job.Type != "import_users" || job.Total != 3 {
+			t.Errorf("job enqueued %+v", job)
+		}
+		if loc := w.Header().Get("Location"); loc != "/api/v1/jobs/"+job.ID {
+			t.Errorf("Location %q, want the job", loc)
+		}
+		return w.Header().Get("Location")
+	}
+	// the job at path, as GET answers it
+	poll := func(t *testing.T, h http.Handler, path string) jobs.Job {
+		t.Helper()
+		w := get(h, path)
+		var job jobs.Job
+		if err := json.Unmarshal(w.Body.Bytes(), &job); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("job: status %d: %s", w.Code, w.Body)
+		}
+		return job
+	}
+	// the job at path once it is no longer running
+	finished := func(t *testing.T, h http.Handler, path string) jobs.Job {
+		t.Helper()
+		if err := background.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return poll(t, h, path)
+	}
+
+	t.Run("completed", func(t *testing.T) {
+		base := &blockingStore{release: make(chan struct{})}
+		h := testRouter(t, cfg, base)
+		db.Reset()
+		t.Cleanup(db.Reset)
+		path := enqueue(t, h)
+		if job := poll(t, h, path); job.Status != jobs.Running || job.Processed != 0 || job.FinishedAt != nil || job.Result != nil {
+			t.Errorf("job while the store is held %+v", job)
+		}
+		close(base.release)
+
+		job := finished(t, h, path)
+		if job.Status != jobs.Completed || job.Processed != 3 || job.FinishedAt == nil || job.Error != "" {
+			t.Fatalf("job %+v", job)
+		}
+		// the report a synchronous import answers
+		report, _ := json.Marshal(job.Result)
+		var result struct {
+			Imported int `json:"imported"`
+			Failed   int `json:"failed"`
+			Results  []struct {
+				Row    int    `json:"row"`
+				Status int    `json:"status"`
+				Error  string `json:"error"`
+			} `json:"results"`
+		}
+		json.Unmarshal(report, &result)
+		if result.Imported != 2 || result.Failed != 1 || len(result.Results) != 3 || result.Results[1].Status != http.StatusUnprocessableEntity || result.Results[2].Status != http.StatusCreated {
+			t.Errorf("result %s", report)
+		}
+		if n := db.CountUsers(false); n != 2 {
+			t.Errorf("%d users stored, want 2", n)
+		}
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		base := &failingStore{}
+		base.fail(errors.New("disk full"), -1)
+		h := testRouter(t, cfg, base)
+		db.Reset()
+		t.Cleanup(db.Reset)
+		path := enqueue(t, h)
+
+		job := finished(t, h, path)
+		if job.Status != jobs.Failed || !strings.Contains(job.Error, "disk full") || job.Result != nil || job.FinishedAt == nil {
+			t.Errorf("job %+v, want it failed with the store error", job)
+		}
+		if n := db.CountUsers(false); n != 0 {
+			t.Errorf("%d users stored by the failed import", n)
+		}
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		h := testRouter(t, cfg, db.Memory{})
+		if w := get(h, "/api/v1/jobs/nope"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "job not found") {
+			t.Errorf("status %d: %s", w.Code, w.Body)
+		}
+	})
+}
+
+func TestRedactedHeaders(t *testing.T) {
+	var logged strings.Builder
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logged, nil)))
+	t.Cleanup(func() { slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil))) })
+	h := testRouter(t, testConfig(t, map[string]string{"LOG_HEADERS": "true", "ADMIN_TOKEN": "admin-secret"}), db.Memory{})
+
+	w := do(h, http.MethodPost, "/api/v1/users", `{"name":"Ada","email":"redacted@example.com"}`)
+	var user models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	send := func(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		logged.Reset()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	// the request line of the log, and the secret must not be in it
+	check := func(name, secret string) {
+		t.Helper()
+		var entry struct {
+			Headers http.Header `json:"headers"`
+		}
+		if err := json.Unmarshal([]byte(logged.String()), &entry); err != nil {
+			t.Fatalf("log %q: %v", logged.String(), err)
+		}
+		if got := entry.Headers.Get(name); got != "[REDACTED]" {
+			t.Errorf("%s logged as %q, want [REDACTED]", name, got)
+		}
+		if strings.Contains(logged.String(), secret) {
+			t.Errorf("%s in the log: %s", secret, logged.String())
+		}
+	}
+
+	// the handlers still see the headers: the admin token mints a key, the
+	// key authenticates its user
+	w = send(http.MethodPost, "/api/v1/users/"+string(user.ID)+"/api-keys", `{"name":"ci"}`, map[string]string{"Authorization": "Bearer admin-secret"})
+	var key struct{ Key string }
+	json.Unmarshal(w.Body.Bytes(), &key)
+	if w.Code != http.StatusCreated || key.Key == "" {
+		t.Fatalf("create key: status %d: %s", w.Code, w.Body)
+	}
+	check("Authorization", "admin-secret")
+	for _, name := range []string{"X-API-Key", "Authorization"} {
+		value := key.Key
+		if name == "Authorization" {
+			value = "Bearer " + key.Key
+		}
+		w = send(http.MethodGet, "/api/v1/users/me", "", map[string]string{name: value, "Cookie": "session=cookie-secret"})
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "redacted@example.com") {
+			t.Errorf("me with the key in %s: status %d: %s", name, w.Code, w.Body)
+		}
+		check(name, key.Key)
+		check("Cookie", "cookie-secret")
+	}
+}
+
+func TestAccessRoles(t *testing.T) {
+	db.Reset()
+	t.Cleanup(db.Reset)
+	h := testRouter(t, testConfig(t, map[string]string{"JWT_SECRET": "test-jwt-secret", "ADMIN_TOKEN": "test-admin-token"}), db.Memory{})
+	var ids []models.ID
+	for _, name := range []string{"ada", "bob"} {
+		user, err := db.AddUser(models.User{Name: name, Email: name + "@example.com"}, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, user.ID)
+	}
+	ada, bob := string(ids[0]), string(ids[1])
+	issue := func(subject, role string) string {
+		t.Helper()
+		token, _, err := tokens.Issue(subject, role, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + token
+	}
+	asAda, asAdmin := issue(ada, auth.User), issue("", auth.Admin)
+	adminToken := "Bearer test-admin-token"
+	keyOf := func(id string) string {
+		t.Helper()
+		keys, err := db.APIKeys(models.ID(id))
+		if err != nil || len(keys) == 0 {
+			t.Fatalf("keys of %s: %v, %v", id, keys, err)
+		}
+		return keys[len(keys)-1].ID
+	}
+
+	send := func(method, path, authorization string) *httptest.ResponseRecorder {
+		body := ""
+		if method == http.MethodPost || method == http.MethodPatch {
+			body = `{"name":"ci"}`
+		}
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	tests := []struct {
+		name   string
+		method string
+		// "{ada}" and "{bob}" stand for their ids, "{key}" for the last
+		// key of the user of the path
+		path          string
+		authorization string
+		want          int
+	}{
+		{"anonymous create of a key", http.MethodPost, "/users/{ada}/api-keys", "", http.StatusUnauthorized},
+		{"own create of a key", http.MethodPost, "/users/{ada}/api-keys", asAda, http.StatusCreated},
+		{"create of a key of another", http.MethodPost, "/users/{bob}/api-keys", asAda, http.StatusForbidden},
+		{"admin create of a key", http.MethodPost, "/users/{bob}/api-keys", asAdmin, http.StatusCreated},
+		{"ADMIN_TOKEN create of a key", http.MethodPost, "/users/{bob}/api-keys", adminToken, http.StatusCreated},
+		{"own list of keys", http.MethodGet, "/users/{ada}/api-keys", asAda, http.StatusOK},
+		{"list of the keys of another", http.MethodGet, "/users/{bob}/api-keys", asAda, http.StatusForbidden},
+		{"ADMIN_TOKEN list of keys", http.MethodGet, "/users/{bob}/api-keys", adminToken, http.StatusOK},
+		{"revoke of a key of another", http.MethodDelete, "/users/{bob}/api-keys/{key}", asAda, http.StatusForbidden},
+		{"own revoke of a key", http.MethodDelete, "/users/{ada}/api-keys/{key}", asAda, http.StatusNoContent},
+		{"admin revoke of a key", http.MethodDelete, "/users/{bob}/api-keys/{key}", asAdmin, http.StatusNoContent},
+		{"anonymous list of users", http.MethodGet, "/users", "", http.StatusUnauthorized},
+		{"user list of users", http.MethodGet, "/users", asAda, http.StatusOK},
+		{"user update of itself", http.MethodPatch, "/users/{ada}", asAda, http.StatusForbidden},
+		{"user delete of another", http.MethodDelete, "/users/{bob}", asAda, http.StatusForbidden},
+		{"admin update", http.MethodPatch, "/users/{ada}", asAdmin, http.StatusOK},
+		{"tampered token", http.MethodGet, "/users", asAda + "x", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := strings.NewReplacer("{ada}", ada, "{bob}", bob).Replace(tt.path)
+			if strings.Contains(path, "{key}") {
+				owner := strings.Split(path, "/")[2]
+				path = strings.Replace(path, "{key}", keyOf(owner), 1)
+			}
+			if w := send(tt.method, "/api/v1"+path, tt.authorization); w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+// a store taking its time over the pages of a list after the first
+type slowPagesStore struct {
+	db.Memory
+	delay time.Duration
+	pages atomic.Int64
+}
+
+func (s *slowPagesStore) GetUsers(ctx context.Context, q db.UserQuery) ([]models.User, int, error) {
+	if q.After != "" {
+		s.pages.Add(1)
+		time.Sleep(s.delay)
+	}
+	return s.Memory.GetUsers(ctx, q)
+}
+
+// an export longer than the request and write timeouts gets through whole,
+// as it flushes page by page
+func TestExportStream(t *testing.T) {
+	const limit = 100 * time.Millisecond
+	cfg := testConfig(t, map[string]string{"REQUEST_TIMEOUT": limit.String(), "WRITE_TIMEOUT": "250ms"})
+	base := &slowPagesStore{delay: 150 * time.Millisecond}
+	h := middleware.Watchdog(cfg.RequestTimeout, cfg.RetryAfter, testRouter(t, cfg, base))
+	db.Reset()
+	t.Cleanup(db.Reset)
+	// three pages, the last of one user
+	const users = 1001
+	for n := range users {
+		if _, err := db.AddUser(models.User{Name: "user " + strconv.Itoa(n), Email: "user" + strconv.Itoa(n) + "@example.com"}, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := listen(t, cfg, h)
+
+	resp, err := http.Get("http://" + addr + "/api/v1/users/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	var last models.ID
+	lines := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var u models.User
+		if err := json.Unmarshal(scanner.Bytes(), &u); err != nil {
+			t.Fatalf("line %d: %v", lines, err)
+		}
+		if lines > 0 && !last.Less(u.ID) {
+			t.Fatalf("user %s after %s", u.ID, last)
+		}
+		last = u.ID
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("after %d users: %v", lines, err)
+	}
+	if lines != users {
+		t.Errorf("%d users exported, want %d", lines, users)
+	}
+	if n := base.pages.Load(); n != 2 {
+		t.Errorf("%d pages read after the first, want 2", n)
+	}
+}
+
+func TestDisabledEndpoints(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"DISABLED_ENDPOINTS": "create_user,delete_user,docs"})
+	h := testRouter(t, cfg, db.Memory{})
+	db.Reset()
+	t.Cleanup(db.Reset)
+	ada, err := db.AddUser(models.User{Name: "Ada", Email: "ada@example.com"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"disabled create", http.MethodPost, "/api/v1/users", `{"name":"Bob","email":"bob@example.com"}`, http.StatusNotFound},
+		{"disabled create at the legacy path", http.MethodPost, "/users", `{"name":"Bob","email":"bob@example.com"}`, http.StatusNotFound},
+		{"disabled delete", http.MethodDelete, "/api/v1/users/" + string(ada.ID), "", http.StatusNotFound},
+		{"disabled docs", http.MethodGet, "/docs", "", http.StatusNotFound},
+		{"list", http.MethodGet, "/api/v1/users", "", http.StatusOK},
+		{"read", http.MethodGet, "/api/v1/users/" + string(ada.ID), "", http.StatusOK},
+		{"update", http.MethodPatch, "/api/v1/users/" + string(ada.ID), `{"name":"Ada L"}`, http.StatusOK},
+		{"batch create, another endpoint", http.MethodPost, "/api/v1/users/batch", `[{"name":"Cy","email":"cy@example.com"}]`, http.StatusMultiStatus},
+		{"OpenAPI document", http.MethodGet, "/openapi.json", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(h, tt.method, tt.path, tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			// as a route the router does not have
+			if tt.want == http.StatusNotFound && !strings.Contains(w.Body.String(), `"route not found"`) {
+				t.Errorf("body %s", w.Body)
+			}
+		})
+	}
+	// the disabled handlers did not run
+	if n := db.CountUsers(true); n != 2 {
+		t.Errorf("%d users, want ada and cy", n)
+	}
+	if got := db.GetUser(ada.ID); got == nil {
+		t.Error("ada deleted through a disabled endpoint")
+	}
+
+	// a reload switches them on again
+	endpoints.SetDisabled(nil)
+	if w := do(h, http.MethodPost, "/api/v1/users", `{"name":"Bob","email":"bob@example.com"}`); w.Code != http.StatusCreated {
+		t.Errorf("create switched on: status %d, want 201", w.Code)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	base := &failingStore{}
+	h := testRouter(t, testConfig(t, nil), base)
+	db.Reset()
+	t.Cleanup(db.Reset)
+	started := startedAt
+	t.Cleanup(func() { startedAt = started })
+	// up for a while already
+	startedAt = time.Now().Add(-90 * time.Second)
+
+	var status struct {
+		Status        string `json:"status"`
+		Uptime        string `json:"uptime"`
+		UptimeSeconds int64  `json:"uptime_seconds"`
+		Users         *int   `json:"users"`
+	}
+	read := func(step string) {
+		t.Helper()
+		status.Users = nil
+		w := get(h, "/status")
+		if err := json.Unmarshal(w.Body.Bytes(), &status); w.Code != http.StatusOK || err != nil || status.Status != "ok" {
+			t.Fatalf("%s: status %d %s, %v", step, w.Code, w.Body, err)
+		}
+	}
+	users := func(step string, want int) {
+		t.Helper()
+		if status.Users == nil || *status.Users != want {
+			t.Errorf("%s: users %v, want %d", step, status.Users, want)
+		}
+	}
+
+	read("empty store")
+	users("empty store", 0)
+	if status.UptimeSeconds < 90 || status.UptimeSeconds > 100 || status.Uptime != "1m30s" && status.Uptime != "1m31s" {
+		t.Errorf("uptime %s, %d seconds, want 90", status.Uptime, status.UptimeSeconds)
+	}
+	before := status.UptimeSeconds
+
+	for _, name := range []string{"ada", "bob"} {
+		do(h, http.MethodPost, "/api/v1/users", `{"name":"`+name+`","email":"`+name+`@example.com"}`)
+	}
+	read("two users")
+	users("two users", 2)
+	do(h, http.MethodDelete, "/api/v1/users/1", "")
+	// a minute later
+	startedAt = startedAt.Add(-time.Minute)
+	read("a delete later")
+	users("a delete later", 1)
+	if status.UptimeSeconds < before+60 {
+		t.Errorf("uptime %d seconds a minute after %d", status.UptimeSeconds, before)
+	}
+
+	// the store refusing calls does not fail the status, it has no count
+	base.fail(db.ErrUnavailable, -1)
+	read("store unavailable")
+	if status.Users != nil {
+		t.Errorf("users %d while the store is unavailable, want null", *status.Users)
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	tests := []struct {
+		mode string
+		// the first answer to a path with a slash, and the last once
+		// redirects are followed
+		first, last int
+	}{
+		{middleware.SlashRedirect, http.StatusPermanentRedirect, 0},
+		{middleware.SlashIgnore, 0, 0},
+		{middleware.SlashStrict, http.StatusNotFound, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"TRAILING_SLASH": tt.mode})
+			h, err := middleware.TrailingSlash(cfg.TrailingSlash, testRouter(t, cfg, db.Memory{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Reset()
+			t.Cleanup(db.Reset)
+			srv := httptest.NewServer(h)
+			t.Cleanup(srv.Close)
+			noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+			// status and body of a request through client
+			send := func(client *http.Client, method, path, body string) (int, string) {
+				t.Helper()
+				req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body != "" {
+					req.Header.Set("Content-Type", "application/json")
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				data, _ := io.ReadAll(resp.Body)
+				return resp.StatusCode, string(data)
+			}
+
+			for n, req := range []struct {
+				name, method, path, body string
+				// the answer without the slash
+				want int
+			}{
+				{"create", http.MethodPost, "/api/v1/users/", `{"name":"Ada","email":"ada@example.com"}`, http.StatusCreated},
+				{"create through two slashes", http.MethodPost, "/api/v1/users//", `{"name":"Bob","email":"bob@example.com"}`, http.StatusCreated},
+				{"list", http.MethodGet, "/api/v1/users/", "", http.StatusOK},
+				{"user", http.MethodGet, "/api/v1/users/1/", "", http.StatusOK},
+				{"legacy user", http.MethodGet, "/users/1//", "", http.StatusOK},
+			} {
+				first, last := tt.first, tt.last
+				if first == 0 {
+					first = req.want
+				}
+				if last == 0 {
+					last = req.want
+				}
+				// a create is sent once, followed or not
+				if req.method == http.MethodGet {
+					if code, _ := send(noFollow, req.method, req.path, req.body); code != first {
+						t.Errorf("%s: first status %d, want %d", req.name, code, first)
+					}
+				}
+				code, body := send(http.DefaultClient, req.method, req.path, req.body)
+				if code != last {
+					t.Fatalf("%s: status %d, want %d: %s", req.name, code, last, body)
+				}
+				if code >= 300 {
+					continue
+				}
+				// the same answer as the path without the slash
+				if req.method == http.MethodGet {
+					if _, want := send(http.DefaultClient, req.method, strings.TrimRight(req.path, "/"), ""); body != want {
+						t.Errorf("%s: answered %s, without the slash %s", req.name, body, want)
+					}
+					continue
+				}
+				// the body made it through the redirect
+				var user models.User
+				json.Unmarshal([]byte(body), &user)
+				if want := []string{"Ada", "Bob"}[n]; user.Name != want {
+					t.Errorf("%s: created %+v, want %s", req.name, user, want)
+				}
+			}
+		})
+	}
+
+	if _, err := middleware.TrailingSlash("lenient", http.NotFoundHandler()); err == nil {
+		t.Error("accepted an unknown mode")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	h := testRouter(t, testConfig(t, map[string]string{"READINESS_TIMEOUT": "50ms"}), db.Memory{})
+	db.Reset()
+	t.Cleanup(db.Reset)
+	// a dependency answering with err, after delay unless the check times out
+	dependency := func(err error, delay time.Duration) func(context.Context) error {
+		return func(ctx context.Context) error {
+			select {
+			case <-time.After(delay):
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	// registered checks are the db's and these
+	tests := []struct {
+		name   string
+		checks []readiness.Check
+		want   int
+		// the status and error of each check
+		statuses, errors map[string]string
+	}{
+		{"all ok", []readiness.Check{
+			{Name: "queue", Critical: true, Run: dependency(nil, 0)},
+			{Name: "cache", Run: dependency(nil, 0)},
+		}, http.StatusOK, map[string]string{"db": "ok", "queue": "ok", "cache": "ok"}, nil},
+		{"a critical one failing", []readiness.Check{
+			{Name: "queue", Critical: true, Run: dependency(errors.New("queue down"), 0)},
+			{Name: "cache", Run: dependency(nil, 0)},
+		}, http.StatusServiceUnavailable, map[string]string{"db": "ok", "queue": "failed", "cache": "ok"}, map[string]string{"queue": "queue down"}},
+		{"another one failing", []readiness.Check{
+			{Name: "queue", Critical: true, Run: dependency(nil, 0)},
+			{Name: "cache", Run: dependency(errors.New("cache full"), 0)},
+		}, http.StatusOK, map[string]string{"db": "ok", "queue": "ok", "cache": "degraded"}, map[string]string{"cache": "cache full"}},
+		{"both failing", []readiness.Check{
+			{Name: "queue", Critical: true, Run: dependency(errors.New("queue down"), 0)},
+			{Name: "cache", Run: dependency(errors.New("cache full"), 0)},
+		}, http.StatusServiceUnavailable, map[string]string{"db": "ok", "queue": "failed", "cache": "degraded"}, map[string]string{"queue": "queue down", "cache": "cache full"}},
+		{"a critical one timing out", []readiness.Check{
+			{Name: "queue", Critical: true, Run: dependency(nil, time.Second)},
+			{Name: "cache", Run: dependency(nil, 0)},
+		}, http.StatusServiceUnavailable, map[string]string{"db": "ok", "queue": "failed", "cache": "ok"}, map[string]string{"queue": "context deadline exceeded"}},
+		{"one ignoring its timeout", []readiness.Check{
+			{Name: "queue", Critical: true, Run: func(context.Context) error { time.Sleep(time.Second); return nil }},
+		}, http.StatusServiceUnavailable, map[string]string{"db": "ok", "queue": "failed"}, map[string]string{"queue": "context deadline exceeded"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, check := range tt.checks {
+				checks.Register(check)
+				t.Cleanup(func() { checks.Unregister(check.Name) })
+			}
+			start := time.Now()
+			w := get(h, "/readiness")
+			if took := time.Since(start); took > 500*time.Millisecond {
+				t.Errorf("answered after %s, want each check cut off at 50ms", took)
+			}
+			var report readiness.Report
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.want || report.Ready != (tt.want == http.StatusOK) {
+				t.Errorf("status %d, ready %v, want %d", w.Code, report.Ready, tt.want)
+			}
+			if !maps.Equal(report.Checks, tt.statuses) || !maps.Equal(report.Errors, tt.errors) {
+				t.Errorf("checks %v with errors %v, want %v with %v", report.Checks, report.Errors, tt.statuses, tt.errors)
+			}
+			if retry := w.Header().Get("Retry-After"); (retry != "") != (tt.want == http.StatusServiceUnavailable) {
+				t.Errorf("Retry-After %q with status %d", retry, w.Code)
+			}
+		})
+	}
+}
+
+func TestGinMode(t *testing.T) {
+	var out strings.Builder
+	logged := log.Writer()
+	log.SetOutput(&out)
+	t.Cleanup(func() {
+		log.SetOutput(logged)
+		gin.SetMode(gin.TestMode)
+		gin.DebugPrintFunc = nil
+	})
+
+	tests := []struct {
+		env, mode string
+		// whether registering a route prints it
+		debug bool
+	}{
+		{"production", gin.ReleaseMode, false},
+		{"test", gin.TestMode, false},
+		{"development", gin.DebugMode, true},
+		{"staging", gin.DebugMode, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			cfg := testConfig(t, map[string]string{"APP_ENV": tt.env})
+			out.Reset()
+			setGinMode(cfg.AppEnv)
+			if gin.Mode() != tt.mode {
+				t.Errorf("mode %s, want %s", gin.Mode(), tt.mode)
+			}
+			gin.New().GET("/ping", func(*gin.Context) {})
+			printed := out.String()
+			if tt.debug != strings.Contains(printed, "[GIN-debug] GET    /ping") {
+				t.Errorf("logged %q, want the route listed %v", printed, tt.debug)
+			}
+			if tt.debug != strings.Contains(printed, "[WARNING]") {
+				t.Errorf("logged %q, want the debug warning %v", printed, tt.debug)
+			}
+		})
+	}
+}
+
+func TestStartupIntegrity(t *testing.T) {
+	var out strings.Builder
+	logged := log.Writer()
+	log.SetOutput(&out)
+	t.Cleanup(func() {
+		log.SetOutput(logged)
+		integrity = db.IntegrityReport{}
+	})
+	// a data file holding id 1 twice
+	path := filepath.Join(t.TempDir(), "users.json")
+	data := `{"users":[{"id":1,"name":"Ada","email":"ada@example.com"},{"id":1,"name":"Bob","email":"bob@example.com"}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		strict bool
+		// the data file to load, an empty store if none
+		file string
+		// whether the server refuses to start
+		fails bool
+	}{
+		{"sound, strict", true, "", false},
+		{"duplicate id", false, path, false},
+		{"duplicate id, strict", true, path, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db.Reset()
+			t.Cleanup(db.Reset)
+			if tt.file != "" {
+				if err := db.Open(tt.file, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out.Reset()
+			err := checkIntegrity(tt.strict)
+			if (err != nil) != tt.fails {
+				t.Fatalf("error %v, want one %v", err, tt.fails)
+			}
+			if problem := strings.Contains(out.String(), "integrity: duplicate id 1"); problem != (tt.file != "") {
+				t.Errorf("logged %q", out.String())
+			}
+
+			h := testRouter(t, testConfig(t, nil), db.Memory{})
+			var status struct {
+				Integrity db.IntegrityReport `json:"integrity"`
+			}
+			if err := json.Unmarshal(get(h, "/status").Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{}
+			if tt.file != "" {
+				want = []string{"duplicate id 1"}
+			}
+			if !slices.Equal(status.Integrity.Problems, want) || status.Integrity.CheckedAt.IsZero() {
+				t.Errorf("/status integrity %+v, want the problems %q", status.Integrity, want)
+			}
+		})
+	}
+}
+
+// a log output safe to read while a goroutine writes to it
+type lockedLog struct {
+	mu  sync.Mutex
+	out strings.Builder
+}
+
+func (l *lockedLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.Write(p)
+}
+
+func (l *lockedLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out.String()
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	out := &lockedLog{}
+	logged := log.Writer()
+	log.SetOutput(out)
+	t.Cleanup(func() { log.SetOutput(logged) })
+	path := filepath.Join(t.TempDir(), "go-api.env")
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("PORT=8000\n")
+	cfg := testConfig(t, map[string]string{"CONFIG_FILE": path})
+	h := testRouter(t, cfg, db.Memory{})
+	db.Reset()
+	t.Cleanup(db.Reset)
+	reloadOnHangup(cfg)
+	t.Cleanup(func() { signal.Reset(syscall.SIGHUP) })
+
+	// send SIGHUP and wait for the log to report the reload
+	hangup := func(done string) {
+		t.Helper()
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); !strings.Contains(out.String(), done); {
+			if time.Now().After(deadline) {
+				t.Fatalf("no %q logged after SIGHUP: %s", done, out.String())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	create := `{"name":"Ada","email":"ada@example.com"}`
+	if w := do(h, http.MethodPost, "/api/v1/users", create); w.Code != http.StatusCreated {
+		t.Fatalf("create before the reload: status %d", w.Code)
+	}
+
+	write("PORT=9000\nLOG_HEADERS=true\nRATE_LIMIT=0.01\nRATE_BURST=1\nDISABLED_ENDPOINTS=create_user\n")
+	hangup("reload: applied DisabledEndpoints")
+	for _, s := range []string{"reload: applied LogHeaders", "reload: applied RateLimit", "reload: applied RateBurst", "reload: Addr changed but needs a restart, ignored"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("no %q logged: %s", s, out.String())
+		}
+	}
+	if !logHeaders.Load() {
+		t.Error("LOG_HEADERS not applied")
+	}
+	if w := do(h, http.MethodPost, "/api/v1/users", create); w.Code != http.StatusNotFound {
+		t.Errorf("create after disabling it: status %d, want 404", w.Code)
+	}
+	if w := get(h, "/api/v1/users"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("a request past the burst of 1: status %d, want 429", w.Code)
+	}
+
+	// a file that cannot be read changes nothing
+	os.Remove(path)
+	hangup("keeping the current config")
+	if !logHeaders.Load() {
+		t.Error("LOG_HEADERS dropped by a failed reload")
+	}
+	if w := get(h, "/api/v1/users"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("a request after a failed reload: status %d, want the 429 of the burst", w.Code)
+	}
+}
+
+func TestClient(t *testing.T) {
+	cfg := testConfig(t, map[string]string{"REQUIRE_IF_MATCH": "true", "RESPONSE_ENVELOPE": "true", "BASE_PATH": "/gateway"})
+	srv := httptest.NewServer(testRouter(t, cfg, db.Memory{}))
+	t.Cleanup(srv.Close)
+	db.Reset()
+	t.Cleanup(db.Reset)
+	c := client.New(srv.URL + "/gateway/")
+	ctx := context.Background()
+
+	// an error of a call, checked against its sentinel and status
+	failed := func(name string, err, sentinel error, status int) *client.Error {
+		t.Helper()
+		var apiErr *client.Error
+		if !errors.As(err, &apiErr) || apiErr.Status != status || (sentinel != nil && !errors.Is(err, sentinel)) {
+			t.Fatalf("%s: error %v, want %d matching %v", name, err, status, sentinel)
+		}
+		if apiErr.Message == "" || apiErr.Code == "" || apiErr.RequestID == "" {
+			t.Errorf("%s: error %+v without the envelope", name, apiErr)
+		}
+		return apiErr
+	}
+
+	ada, err := c.CreateUser(ctx, models.User{Name: "Ada", Email: "ada@example.com"})
+	if err != nil || ada.ID == "" || ada.Name != "Ada" || ada.Version != 1 {
+		t.Fatalf("create: %+v, %v", ada, err)
+	}
+	_, err = c.CreateUser(ctx, models.User{Name: "Eve", Email: "ada@example.com"})
+	if e := failed("create with the email taken", err, client.ErrConflict, http.StatusConflict); e.Message != `unique constraint "email" violated` {
+		t.Errorf("conflict %q", e.Message)
+	}
+	_, err = c.CreateUser(ctx, models.User{Name: "Eve", Email: "not an email"})
+	if e := failed("create of an invalid user", err, client.ErrInvalid, http.StatusUnprocessableEntity); e.Details["fields"] == nil {
+		t.Errorf("invalid user without the fields in the details: %+v", e.Details)
+	}
+
+	got, err := c.GetUser(ctx, ada.ID)
+	if err != nil || got.ID != ada.ID || got.Email != "ada@example.com" {
+		t.Errorf("get: %+v, %v", got, err)
+	}
+	_, err = c.GetUser(ctx, "999")
+	failed("get of a missing user", err, client.ErrNotFound, http.StatusNotFound)
+	_, err = c.GetUser(ctx, "x/y")
+	failed("get of an id with a slash, escaped", err, client.ErrNotFound, http.StatusNotFound)
+	_, err = c.GetUser(ctx, "x")
+	failed("get of a malformed id", err, client.ErrBadRequest, http.StatusBadRequest)
+
+	updated, err := c.UpdateUser(ctx, ada.ID, models.User{Name: "Ada L", Email: "ada@example.com", Version: ada.Version})
+	if err != nil || updated.Name != "Ada L" || updated.Version != 2 {
+		t.Fatalf("update: %+v, %v", updated, err)
+	}
+	_, err = c.UpdateUser(ctx, ada.ID, models.User{Name: "Ada M", Email: "ada@example.com", Version: ada.Version})
+	failed("update of a stale version", err, client.ErrStale, http.StatusPreconditionFailed)
+	if updated, err = c.UpdateUser(ctx, ada.ID, models.User{Name: "Ada M", Email: "ada@example.com"}); err != nil || updated.Version != 3 {
+		t.Fatalf("update of any version: %+v, %v", updated, err)
+	}
+	patched, err := c.PatchUser(ctx, ada.ID, updated.Version, map[string]any{"priority": 3})
+	if err != nil || patched.Priority != 3 || patched.Name != "Ada M" || patched.Version != 4 {
+		t.Fatalf("patch: %+v, %v", patched, err)
+	}
+	_, err = c.PatchUser(ctx, ada.ID, 1, map[string]any{"priority": 4})
+	failed("patch of a stale version", err, client.ErrStale, http.StatusPreconditionFailed)
+
+	// more users than a page takes
+	batch := make([]models.User, pagination.MaxLimit+5)
+	for n := range batch {
+		batch[n] = models.User{Name: "User " + strconv.Itoa(n), Email: "user" + strconv.Itoa(n) + "@example.com"}
+	}
+	batch[3].Email = "ada@example.com"
+	results, err := c.CreateUsers(ctx, batch)
+	if err != nil || len(results) != len(batch) || results[0].Status != http.StatusCreated || results[0].User == nil || results[3].Status != http.StatusConflict || results[3].Error == "" {
+		t.Fatalf("bulk create: %d results, %v", len(results), err)
+	}
+	users, err := c.GetUsers(ctx)
+	if err != nil || len(users) != len(batch) || users[0].ID != ada.ID {
+		t.Fatalf("list: %d users, %v", len(users), err)
+	}
+
+	err = c.DeleteUser(ctx, ada.ID, 1)
+	failed("delete of a stale version", err, client.ErrStale, http.StatusPreconditionFailed)
+	if err := c.DeleteUser(ctx, ada.ID, patched.Version); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	_, err = c.GetUser(ctx, ada.ID)
+	failed("get of a deleted user", err, client.ErrNotFound, http.StatusNotFound)
+	err = c.DeleteUser(ctx, ada.ID, 0)
+	failed("delete again", err, client.ErrNotFound, http.StatusNotFound)
+
+	deleted, notFound, err := c.DeleteUsers(ctx, []models.ID{results[0].User.ID, ada.ID, "999"})
+	if err != nil || !slices.Equal(deleted, []models.ID{results[0].User.ID}) || !slices.Equal(notFound, []models.ID{ada.ID, "999"}) {
+		t.Errorf("bulk delete: deleted %v, not found %v, %v", deleted, notFound, err)
+	}
+
+	// an unknown key is refused whatever the call, matching no sentinel
+	c.APIKey = "nope"
+	_, err = c.GetUsers(ctx)
+	if e := failed("list with an unknown key", err, nil, http.StatusUnauthorized); errors.Is(err, client.ErrNotFound) || errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("401 %+v matches a sentinel", e)
+	}
+}
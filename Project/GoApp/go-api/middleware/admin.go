@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+)
+
+// AdminToken lets a request through only when it carries
+// "Authorization: Bearer <token>", answering 401 otherwise
+func AdminToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+			apierror.Respond(c, apierror.New(http.StatusUnauthorized, "admin token required"))
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+)
+
+// gin context key of the limit BufferBody reads a body of unknown length to
+const chunkedLimitKey = "middleware.chunked_limit"
+
+// BodyLimit answers 413 to POST, PUT, PATCH and DELETE requests with a body
+// over limit bytes, or over uploadLimit for multipart and CSV uploads; a
+// limit of 0 or less is none. A Content-Length over the limit is refused
+// before the body is read. A body of unknown length is left to BufferBody,
+// as reading it here would send the 100 Continue a client waits for before
+// the checks of the route ran.
+func BodyLimit(limit, uploadLimit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			c.Next()
+			return
+		}
+
+		max := limit
+		if ct := c.ContentType(); ct == gin.MIMEMultipartPOSTForm || ct == MIMECSV {
+			max = uploadLimit
+		}
+		if max <= 0 || c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > max {
+			tooLarge(c, max)
+			return
+		}
+		if c.Request.ContentLength < 0 {
+			c.Set(chunkedLimitKey, max)
+		} else {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max)
+		}
+		c.Next()
+	}
+}
+
+// BufferBody reads a body of unknown length up to the limit BodyLimit set
+// for it, answering 413 past it, so handlers never see a cut off one. Put it
+// right before the handler, after ExpectContinue.
+func BufferBody() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get(chunkedLimitKey)
+		max, ok := value.(int64)
+		if !ok {
+			c.Next()
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(c.Request.Body, max+1))
+		if err != nil {
+			apierror.Respond(c, apierror.New(http.StatusBadRequest, err.Error()))
+			return
+		}
+		if int64(len(data)) > max {
+			tooLarge(c, max)
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(data))
+		c.Request.ContentLength = int64(len(data))
+		c.Next()
+	}
+}
+
+func tooLarge(c *gin.Context, max int64) {
+	// the rest of the body is not worth reading to keep the connection
+	c.Header("Connection", "close")
+	apierror.Respond(c, apierror.New(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", max)).With("limit", max))
+}
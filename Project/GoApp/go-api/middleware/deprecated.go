@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deprecated marks the responses of routes still served at an old path: a
+// Sunset header (RFC 8594) with the date they go away, and a Link with
+// rel="successor-version" to the same request with the prefix of its path
+// replaced by successor. Handlers setting their own Link must add to it,
+// not set it.
+func Deprecated(sunset time.Time, prefix, successor string) gin.HandlerFunc {
+	date := sunset.UTC().Format(http.TimeFormat)
+	return func(c *gin.Context) {
+		c.Header("Sunset", date)
+		path := successor + strings.TrimPrefix(c.Request.URL.Path, prefix)
+		if c.Request.URL.RawQuery != "" {
+			path += "?" + c.Request.URL.RawQuery
+		}
+		c.Writer.Header().Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, path))
+		c.Next()
+	}
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+	"go-api/models"
+)
+
+// content type of CSV imports
+const MIMECSV = "text/csv"
+
+// ExpectContinue checks requests sent with "Expect: 100-continue" before
+// their body is transmitted. net/http only writes the interim 100 response
+// once a handler starts reading the body, so a request failing these checks
+// is answered with 417 and the client never uploads the payload. Register it
+// on each route after its auth middleware, right before BufferBody and the
+// handler, so unauthenticated clients are rejected early too and nothing
+// reads the body first.
+func ExpectContinue() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strings.EqualFold(c.GetHeader("Expect"), "100-continue") {
+			c.Next()
+			return
+		}
+
+		switch c.ContentType() {
+		case gin.MIMEJSON, models.MIMEProtobuf, MIMECSV, gin.MIMEMultipartPOSTForm:
+		default:
+			apierror.Respond(c, apierror.New(http.StatusExpectationFailed, "content type must be application/json, application/x-protobuf, text/csv or multipart/form-data"))
+			return
+		}
+
+		c.Next()
+	}
+}
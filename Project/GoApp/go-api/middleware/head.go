@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Head runs a GET handler for a HEAD request: the handler writes its
+// response as usual, and only the headers go out, with the Content-Length
+// the body would have had. Put it first on the HEAD route.
+func Head() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		w := &headWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		if c.Writer.Header().Get("Content-Length") == "" {
+			c.Header("Content-Length", strconv.Itoa(w.size))
+		}
+	}
+}
+
+// headWriter counts the body instead of sending it; the status and headers
+// are written by gin once the handlers are done
+type headWriter struct {
+	gin.ResponseWriter
+	size int
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	w.size += len(b)
+	return len(b), nil
+}
+
+func (w *headWriter) WriteString(s string) (int, error) {
+	w.size += len(s)
+	return len(s), nil
+}
+
+// the body is counted, the handler sees it as written
+func (w *headWriter) Written() bool {
+	return w.size > 0 || w.ResponseWriter.Written()
+}
+
+func (w *headWriter) Size() int {
+	return w.size
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/apierror"
+)
+
+// clients not seen for this long past their warmup are forgotten, and come
+// back as new clients
+const rateIdle = 10 * time.Minute
+
+// RateLimiter is a token bucket per client IP: rate requests a second with
+// bursts of up to burst. A client seen for the first time gets startFraction
+// of both, growing linearly to the full limits over warmup, so a burst of
+// fresh addresses cannot take the full rate straight away. A rate of 0 or
+// less lets everything through.
+type RateLimiter struct {
+	mu            sync.Mutex
+	rate          float64
+	burst         float64
+	warmup        time.Duration
+	startFraction float64
+	clients       map[string]*bucket
+	swept         time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	last      time.Time
+	firstSeen time.Time
+}
+
+// NewRateLimiter makes a limiter, startFraction is clamped to 0..1 and a
+// zero warmup gives every client the full limits at once
+func NewRateLimiter(rate float64, burst int, warmup time.Duration, startFraction float64) *RateLimiter {
+	l := &RateLimiter{clients: map[string]*bucket{}, swept: time.Now()}
+	l.SetLimits(rate, burst, warmup, startFraction)
+	return l
+}
+
+// SetLimits replaces the limits while the limiter is in use, as
+// NewRateLimiter takes them. Clients keep their tokens, capped to the new
+// burst on their next request.
+func (l *RateLimiter) SetLimits(rate float64, burst int, warmup time.Duration, startFraction float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = math.Max(float64(burst), 1)
+	l.warmup = warmup
+	l.startFraction = math.Min(math.Max(startFraction, 0), 1)
+}
+
+// Handler answers 429 with a Retry-After once the client IP is out of tokens
+func (l *RateLimiter) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if wait, ok := l.Allow(c.ClientIP(), time.Now()); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			apierror.Respond(c, apierror.New(http.StatusTooManyRequests, "rate limit exceeded"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// Allow takes a token of the client at now, or reports how long until it
+// has one
+func (l *RateLimiter) Allow(client string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0, true
+	}
+	l.sweep(now)
+	b := l.clients[client]
+	if b == nil {
+		b = &bucket{tokens: l.burst * l.fraction(0), last: now, firstSeen: now}
+		l.clients[client] = b
+	}
+	f := l.fraction(now.Sub(b.firstSeen))
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * l.rate * f
+		b.last = now
+	}
+	// at least one token fits, otherwise a low start would refuse everything
+	b.tokens = math.Min(b.tokens, math.Max(l.burst*f, 1))
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / (l.rate * f) * float64(time.Second)), false
+}
+
+// share of the full limits a client gets age after it was first seen
+func (l *RateLimiter) fraction(age time.Duration) float64 {
+	if l.warmup <= 0 || age >= l.warmup {
+		return 1
+	}
+	f := l.startFraction + (1-l.startFraction)*float64(age)/float64(l.warmup)
+	// a zero start would never refill
+	return math.Max(f, 1/l.burst)
+}
+
+// drop idle clients once a minute so the map does not grow with every
+// address ever seen; callers hold the lock
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for client, b := range l.clients {
+		if now.Sub(b.last) > rateIdle && now.Sub(b.firstSeen) > l.warmup {
+			delete(l.clients, client)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// a clock standing still until advanced
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// the requests of client l lets through at once at the clock's time, and
+// the wait it reports for the next one
+func burst(l *RateLimiter, client string, c *fakeClock) (int, time.Duration) {
+	for n := 0; ; n++ {
+		if wait, ok := l.Allow(client, c.now); !ok {
+			return n, wait
+		}
+	}
+}
+
+func TestRateLimitWarmup(t *testing.T) {
+	start := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name string
+		// clock change before the burst, the client burst and its result
+		by     time.Duration
+		client string
+		want   int
+		wait   time.Duration
+	}{
+		// a tenth of the burst of 10, refilling at a tenth of the rate of 10
+		{"new client", 0, "10.0.0.1", 1, time.Second},
+		// 1.15 tokens refilling at 1.15 a second, 0.15 left
+		{"a second on", time.Second, "10.0.0.1", 1, 739 * time.Millisecond},
+		// half way, 0.55 of the limits: 5.5 tokens, refilling at 5.5 a second
+		{"half way", 29 * time.Second, "10.0.0.1", 5, 91 * time.Millisecond},
+		{"another new client", 0, "10.0.0.2", 1, time.Second},
+		// the full limits, 10 tokens refilling at 10 a second
+		{"warmed up", 30 * time.Second, "10.0.0.1", 10, 100 * time.Millisecond},
+		{"warmed up, later", 5 * time.Minute, "10.0.0.1", 10, 100 * time.Millisecond},
+		{"the other warmed up", 0, "10.0.0.2", 10, 100 * time.Millisecond},
+		// idle past rateIdle and the warmup: swept, and new again
+		{"new after a long idle", time.Hour, "10.0.0.1", 1, time.Second},
+	}
+	c := &fakeClock{now: start}
+	l := NewRateLimiter(10, 10, time.Minute, 0.1)
+	l.swept = start
+	for _, s := range steps {
+		c.advance(s.by)
+		n, wait := burst(l, s.client, c)
+		if n != s.want || wait.Round(time.Millisecond) != s.wait {
+			t.Errorf("%s: %d let through, then a wait of %s, want %d and %s", s.name, n, wait, s.want, s.wait)
+		}
+	}
+	if _, ok := l.clients["10.0.0.2"]; ok {
+		t.Error("an idle client was kept past the sweep")
+	}
+}
+
+func TestRateLimitLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		rate          float64
+		burst         int
+		warmup        time.Duration
+		startFraction float64
+		// the first burst of a new client
+		want int
+	}{
+		{"no warmup", 10, 10, 0, 0.1, 10},
+		{"a start of 0, still a token", 10, 10, time.Minute, 0, 1},
+		{"a start above 1, clamped", 10, 10, time.Minute, 2, 10},
+		{"a full start", 10, 4, time.Minute, 1, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeClock{now: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)}
+			l := NewRateLimiter(tt.rate, tt.burst, tt.warmup, tt.startFraction)
+			if n, _ := burst(l, "10.0.0.1", c); n != tt.want {
+				t.Errorf("%d let through, want %d", n, tt.want)
+			}
+		})
+	}
+
+	// a rate of 0 lets everything through
+	l := NewRateLimiter(0, 1, time.Minute, 0.1)
+	for range 100 {
+		if _, ok := l.Allow("10.0.0.1", time.Now()); !ok {
+			t.Fatal("refused with no rate")
+		}
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// half of the burst of 2 for a new client, refilling at half a second
+	r.Use(NewRateLimiter(1, 2, time.Hour, 0.5).Handler())
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	for n, want := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != want {
+			t.Fatalf("request %d: status %d, want %d", n, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "2" {
+			t.Errorf("Retry-After %q, want the 2 seconds of a token at half the rate", w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headers masked by RedactHeaders
+var SensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "X-API-Key", "Cookie", "Set-Cookie"}
+
+const redactedHeadersKey = "redacted_headers"
+
+// RedactHeaders stores a copy of the request headers with the sensitive ones
+// replaced by [REDACTED] for the logger to print. The request keeps its
+// original headers so auth still sees them.
+func RedactHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		headers := c.Request.Header.Clone()
+		for _, name := range SensitiveHeaders {
+			if _, ok := headers[http.CanonicalHeaderKey(name)]; ok {
+				headers.Set(name, "[REDACTED]")
+			}
+		}
+		c.Set(redactedHeadersKey, headers)
+		c.Next()
+	}
+}
+
+// request headers safe to log, taken from the context keys a log formatter
+// receives; nil when RedactHeaders did not run
+func RedactedHeaders(keys map[string]any) http.Header {
+	headers, _ := keys[redactedHeadersKey].(http.Header)
+	return headers
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// trailing slash modes, see TrailingSlash
+const (
+	SlashRedirect = "redirect"
+	SlashStrict   = "strict"
+	SlashIgnore   = "ignore"
+)
+
+// TrailingSlash decides what happens to a path ending in "/" before gin
+// routes it, in place of gin's own redirects (301 for GET but 307 elsewhere,
+// which some clients follow without the body):
+//
+//   - redirect: 308 to the path without the slash, method and body are kept
+//   - strict: no special treatment, "/users/" is a 404
+//   - ignore: served as if the slash was not there
+func TrailingSlash(mode string, next http.Handler) (http.Handler, error) {
+	switch mode {
+	case SlashStrict:
+		return next, nil
+	case SlashRedirect, SlashIgnore:
+	default:
+		return nil, fmt.Errorf("unknown trailing slash mode %q", mode)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if len(path) <= 1 || !strings.HasSuffix(path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path = strings.TrimRight(path, "/")
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		u.RawPath = ""
+
+		if mode == SlashRedirect {
+			http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	}), nil
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"go-api/tracing"
+)
+
+// Trace records a server span of each request with tracer, continuing the
+// trace of the caller when the request has a valid traceparent header, and
+// puts it in the context of c.Request so what the handlers do with that
+// context, such as store calls, makes child spans of it. Put it before
+// apierror.Handler, so it sees the final status.
+func Trace(tracer *tracing.Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if sc, ok := tracing.Parse(c.GetHeader(tracing.Header)); ok {
+			ctx = tracing.ContextWithRemote(ctx, sc)
+		}
+		route := c.FullPath()
+		name := c.Request.Method + " " + route
+		if route == "" {
+			name = c.Request.Method
+		}
+		ctx, span := tracer.Start(ctx, name, tracing.Server)
+		span.SetAttribute("http.request.method", c.Request.Method)
+		span.SetAttribute("url.path", c.Request.URL.Path)
+		if route != "" {
+			span.SetAttribute("http.route", route)
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttribute("http.response.status_code", status)
+		var err error
+		if status >= http.StatusInternalServerError {
+			err = errors.New(http.StatusText(status))
+		}
+		span.End(err)
+	}
+}
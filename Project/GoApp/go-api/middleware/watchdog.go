@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-api/apierror"
+)
+
+// handlers still running past the watchdog limit before new requests are
+// refused outright instead of adding to them
+const maxStuck = 64
+
+// Watchdog answers 503 with a Retry-After when a request has not completed
+// within limit, such as a store call blocked on a lock, and cancels the
+// request context. Go cannot stop the stuck handler; its late response is
+// dropped, and while maxStuck of them are still running every new request is
+// answered 503 right away rather than piling up more goroutines. Responses
+// that flush early (streams) are exempt once they have flushed.
+func Watchdog(limit, retryAfter time.Duration, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	var stuck atomic.Int64
+	retry := strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	unavailable := func(w http.ResponseWriter, r *http.Request, msg string) {
+		w.Header().Set("Retry-After", retry)
+		apierror.Write(w, r, apierror.New(http.StatusServiceUnavailable, msg))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stuck.Load() >= maxStuck {
+			unavailable(w, r, "too many stalled requests")
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		ww := &watchdogWriter{w: w, header: http.Header{}}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+		}()
+
+		timer := time.NewTimer(limit)
+		defer timer.Stop()
+		select {
+		case <-done:
+			ww.commit()
+		case <-timer.C:
+			if !ww.expire() {
+				// streaming already, the handler owns the response
+				<-done
+				return
+			}
+			log.Printf("watchdog: %s %s still running after %v", r.Method, r.URL.Path, limit)
+			cancel()
+			unavailable(w, r, "request timed out")
+			stuck.Add(1)
+			go func() {
+				<-done
+				stuck.Add(-1)
+			}()
+		}
+	})
+}
+
+// watchdogWriter buffers a response so it can be dropped when the watchdog
+// answers instead. Once the handler flushes it writes straight through.
+type watchdogWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	header  http.Header
+	status  int
+	body    bytes.Buffer
+	flushed bool
+	expired bool
+}
+
+func (ww *watchdogWriter) Header() http.Header {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.flushed {
+		return ww.w.Header()
+	}
+	return ww.header
+}
+
+func (ww *watchdogWriter) WriteHeader(status int) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	switch {
+	case ww.expired:
+	case ww.flushed:
+		ww.w.WriteHeader(status)
+	case ww.status == 0:
+		ww.status = status
+	}
+}
+
+func (ww *watchdogWriter) Write(b []byte) (int, error) {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	switch {
+	case ww.expired:
+		return 0, http.ErrHandlerTimeout
+	case ww.flushed:
+		return ww.w.Write(b)
+	}
+	if ww.status == 0 {
+		ww.status = http.StatusOK
+	}
+	return ww.body.Write(b)
+}
+
+func (ww *watchdogWriter) Flush() {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.expired {
+		return
+	}
+	if !ww.flushed {
+		ww.writeBuffered()
+		ww.flushed = true
+	}
+	if f, ok := ww.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// gin's c.Stream watches the client through it
+func (ww *watchdogWriter) CloseNotify() <-chan bool {
+	if cn, ok := ww.w.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// let http.ResponseController reach the connection, e.g. for write deadlines
+func (ww *watchdogWriter) Unwrap() http.ResponseWriter {
+	return ww.w
+}
+
+// drop whatever the handler writes from now on, false when it is streaming
+func (ww *watchdogWriter) expire() bool {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if ww.flushed {
+		return false
+	}
+	ww.expired = true
+	return true
+}
+
+// write the buffered response of a handler that finished in time
+func (ww *watchdogWriter) commit() {
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if !ww.flushed {
+		ww.writeBuffered()
+	}
+}
+
+func (ww *watchdogWriter) writeBuffered() {
+	for k, v := range ww.header {
+		ww.w.Header()[k] = v
+	}
+	if ww.status == 0 {
+		ww.status = http.StatusOK
+	}
+	ww.w.WriteHeader(ww.status)
+	ww.w.Write(ww.body.Bytes())
+}
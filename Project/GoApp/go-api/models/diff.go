@@ -0,0 +1,36 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Change is the old and new value of one field of an updated user
+type Change struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// fields Diff leaves out: updated_at and version move on every write, so
+// they say nothing about what changed
+var diffIgnored = map[string]bool{"updated_at": true, "version": true}
+
+// Diff lists the fields that differ between two versions of a user, keyed by
+// their json names. Fields hidden from JSON (json:"-"), such as secrets, are
+// never reported.
+func Diff(old, new User) map[string]Change {
+	changes := map[string]Change{}
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" || diffIgnored[name] {
+			continue
+		}
+		a, b := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if !reflect.DeepEqual(a, b) {
+			changes[name] = Change{Old: a, New: b}
+		}
+	}
+	return changes
+}
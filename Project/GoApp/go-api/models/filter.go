@@ -0,0 +1,27 @@
+package models
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FilterFields reads the value of every field of User tagged
+// filterable:"true", by its json name, for listings narrowed to the users
+// with a given value. Only string fields can be filterable.
+var FilterFields = func() map[string]func(u User) string {
+	fields := map[string]func(u User) string{}
+	t := reflect.TypeOf(User{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("filterable") != "true" {
+			continue
+		}
+		if f.Type.Kind() != reflect.String {
+			panic(fmt.Sprintf("models: field %s of type %s cannot be filterable", f.Name, f.Type))
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		fields[name] = func(u User) string { return reflect.ValueOf(u).Field(i).String() }
+	}
+	return fields
+}()
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// ID identifies a user. Depending on the id strategy it holds a sequential
+// number, a UUID or a ULID.
+//
+// Numeric ids are written as JSON numbers unless IDAsString is set, other ids
+// always as strings; both forms are read whatever the setting.
+type ID string
+
+func (id ID) MarshalJSON() ([]byte, error) {
+	if n, ok := id.Int(); ok && !IDAsString {
+		return strconv.AppendInt(nil, n, 10), nil
+	}
+	return json.Marshal(string(id))
+}
+
+func (id *ID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = ID(s)
+		return nil
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid id %s", data)
+	}
+	*id = ID(strconv.FormatInt(n, 10))
+	return nil
+}
+
+// Int reports the id as a number when it is a sequential one
+func (id ID) Int() (int64, bool) {
+	n, err := strconv.ParseInt(string(id), 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != string(id) {
+		return 0, false
+	}
+	return n, true
+}
+
+// Less orders ids: numeric ones by value and before the others, which sort
+// as strings, so ULIDs come in creation order
+func (id ID) Less(other ID) bool {
+	a, aok := id.Int()
+	b, bok := other.Int()
+	switch {
+	case aok && bok:
+		return a < b
+	case aok != bok:
+		return aok
+	}
+	return id < other
+}
@@ -1,8 +1,121 @@
 package models
 
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
 
+// when set, numeric ids are written as JSON strings instead of numbers
+var IDAsString bool
+
+// fields tagged sortable:"true" can be given to ?sort=, see SortFields
 type User struct {
-	ID 	int  `json:"id"`
-	Name string `json:"name"`
-	Email string `json:"email"`
-} 
\ No newline at end of file
+	ID       ID     `json:"id" sortable:"true"`
+	Name     string `json:"name" sortable:"true" filterable:"true" validate:"required"`
+	Email    string `json:"email" sortable:"true" filterable:"true" validate:"required,email"`
+	Username string `json:"username,omitempty" sortable:"true" filterable:"true"`
+	Phone    string `json:"phone,omitempty" validate:"phone"`
+	// display order, lower comes first; 0 means unranked
+	Priority int `json:"priority" sortable:"true"`
+	// new email waiting for confirmation, Email stays in use until then
+	PendingEmail string `json:"pending_email,omitempty"`
+	// set once the welcome email has been sent
+	WelcomedAt *time.Time `json:"welcomed_at,omitempty"`
+	// the avatar image itself is served by GET /users/:id/avatar
+	Avatar *Avatar `json:"avatar,omitempty"`
+	// deactivated users are kept but left out of default listings
+	Active bool `json:"active"`
+	// set by the db package from its clock
+	CreatedAt time.Time `json:"created_at" sortable:"true"`
+	UpdatedAt time.Time `json:"updated_at" sortable:"true"`
+	// 1 on create and one more on every change, the ETag of the user
+	Version int64 `json:"version"`
+	// set when the user is soft-deleted, such users are hidden by the api
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// who deleted the user, as the api authenticated them
+	DeletedBy string `json:"deleted_by,omitempty"`
+}
+
+// Avatar describes the avatar image of a user
+type Avatar struct {
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// userJSON has the fields of User without its json methods
+type userJSON User
+
+// completeness is computed on the way out and ignored on the way in
+func (u User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		userJSON
+		Completeness int `json:"completeness"`
+	}{userJSON(u), u.Completeness()})
+}
+
+// Completeness is the percentage of the profile fields that are filled in,
+// rounded down, for front-ends nudging users to complete their profile
+func (u User) Completeness() int {
+	fields := []string{u.Name, u.Email, u.Username, u.Phone}
+	filled := 0
+	for _, f := range fields {
+		if strings.TrimSpace(f) != "" {
+			filled++
+		}
+	}
+	return filled * 100 / len(fields)
+}
+
+// a missing "active" reads as true, users saved before the field existed
+// were all active, and a missing "version" as 1
+func (u *User) UnmarshalJSON(data []byte) error {
+	u.Active = true
+	u.Version = 1
+	return json.Unmarshal(data, (*userJSON)(u))
+}
+
+// Clone returns a copy of the user that shares no memory with it: a plain
+// copy shares what the pointer fields point to
+func (u User) Clone() User {
+	if u.WelcomedAt != nil {
+		t := *u.WelcomedAt
+		u.WelcomedAt = &t
+	}
+	if u.DeletedAt != nil {
+		t := *u.DeletedAt
+		u.DeletedAt = &t
+	}
+	if u.Avatar != nil {
+		a := *u.Avatar
+		u.Avatar = &a
+	}
+	return u
+}
+
+// In returns a copy of the user with its timestamps in loc, for display
+func (u User) In(loc *time.Location) User {
+	u = u.Clone()
+	u.CreatedAt = u.CreatedAt.In(loc)
+	u.UpdatedAt = u.UpdatedAt.In(loc)
+	if u.WelcomedAt != nil {
+		*u.WelcomedAt = u.WelcomedAt.In(loc)
+	}
+	if u.DeletedAt != nil {
+		*u.DeletedAt = u.DeletedAt.In(loc)
+	}
+	if u.Avatar != nil {
+		u.Avatar.UpdatedAt = u.Avatar.UpdatedAt.In(loc)
+	}
+	return u
+}
+
+// trim the string fields and collapse runs of whitespace inside the name, so
+// " John  Doe " and "John Doe" are the same user
+func (u *User) Normalize() {
+	u.Name = strings.Join(strings.Fields(u.Name), " ")
+	u.Email = strings.TrimSpace(u.Email)
+	u.Username = strings.TrimSpace(u.Username)
+	u.Phone = strings.TrimSpace(u.Phone)
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/ugorji/go/codec"
+)
+
+// content type of MessagePack response bodies
+const MIMEMsgpack = "application/msgpack"
+
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{WriteExt: true}
+	// sorted map keys, so the same user always encodes to the same bytes and
+	// the same strong ETag
+	h.Canonical = true
+	return h
+}()
+
+// JSONToMsgpack re-encodes a JSON document as MessagePack, so a MessagePack
+// response has exactly the fields and values of the JSON one: ids as the
+// JSON has them, times as RFC 3339 strings and completeness included.
+func JSONToMsgpack(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var out []byte
+	err := codec.NewEncoderBytes(&out, msgpackHandle).Encode(numbers(v))
+	return out, err
+}
+
+// replace the json.Numbers of a decoded document with integers, or floats
+// when they have a fraction
+func numbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = numbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = numbers(e)
+		}
+	}
+	return v
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// content type of protobuf request and response bodies
+const MIMEProtobuf = "application/x-protobuf"
+
+// field numbers of the User message in proto/user.proto
+const (
+	protoID           protowire.Number = 1
+	protoName         protowire.Number = 2
+	protoEmail        protowire.Number = 3
+	protoPendingEmail protowire.Number = 4
+	protoUsername     protowire.Number = 5
+	protoPhone        protowire.Number = 6
+	protoPriority     protowire.Number = 7
+	protoUID          protowire.Number = 8
+	protoVersion      protowire.Number = 9
+)
+
+// encode the user as a users.v1.User protobuf message
+func (u User) MarshalProto() []byte {
+	var b []byte
+	// sequential ids keep the numeric field, UUIDs and ULIDs go in uid
+	if id, ok := u.ID.Int(); ok && id != 0 {
+		b = protowire.AppendTag(b, protoID, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(id))
+	} else if !ok && u.ID != "" {
+		b = protowire.AppendTag(b, protoUID, protowire.BytesType)
+		b = protowire.AppendString(b, string(u.ID))
+	}
+	if u.Priority != 0 {
+		b = protowire.AppendTag(b, protoPriority, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(u.Priority))
+	}
+	if u.Version != 0 {
+		b = protowire.AppendTag(b, protoVersion, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(u.Version))
+	}
+	for _, f := range []struct {
+		num   protowire.Number
+		value string
+	}{
+		{protoName, u.Name},
+		{protoEmail, u.Email},
+		{protoPendingEmail, u.PendingEmail},
+		{protoUsername, u.Username},
+		{protoPhone, u.Phone},
+	} {
+		if f.value != "" {
+			b = protowire.AppendTag(b, f.num, protowire.BytesType)
+			b = protowire.AppendString(b, f.value)
+		}
+	}
+	return b
+}
+
+// decode a users.v1.User protobuf message, unknown fields are skipped
+func (u *User) UnmarshalProto(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+
+		var field *string
+		switch num {
+		case protoName:
+			field = &u.Name
+		case protoEmail:
+			field = &u.Email
+		case protoPendingEmail:
+			field = &u.PendingEmail
+		case protoUsername:
+			field = &u.Username
+		case protoPhone:
+			field = &u.Phone
+		}
+
+		switch {
+		case num == protoID && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			u.ID = ID(strconv.FormatInt(int64(v), 10))
+		case num == protoUID && typ == protowire.BytesType:
+			var v string
+			v, n = protowire.ConsumeString(b)
+			u.ID = ID(v)
+		case num == protoPriority && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			u.Priority = int(int64(v))
+		case num == protoVersion && typ == protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(b)
+			u.Version = int64(v)
+		case field != nil && typ == protowire.BytesType:
+			*field, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("invalid protobuf field %d: %w", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SortFields holds a comparison of users for every field of User tagged
+// sortable:"true", by its json name. Strings compare case-insensitively; a
+// new field is only sortable once it is tagged.
+var SortFields = func() map[string]func(a, b User) int {
+	fields := map[string]func(a, b User) int{}
+	t := reflect.TypeOf(User{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("sortable") != "true" {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		fields[name] = fieldCompare(f, i)
+	}
+	return fields
+}()
+
+func fieldCompare(f reflect.StructField, i int) func(a, b User) int {
+	get := func(u User) reflect.Value { return reflect.ValueOf(u).Field(i) }
+	switch {
+	case f.Type == reflect.TypeOf(ID("")):
+		return func(a, b User) int {
+			x, y := get(a).Interface().(ID), get(b).Interface().(ID)
+			switch {
+			case x.Less(y):
+				return -1
+			case y.Less(x):
+				return 1
+			}
+			return 0
+		}
+	case f.Type == reflect.TypeOf(time.Time{}):
+		return func(a, b User) int {
+			return get(a).Interface().(time.Time).Compare(get(b).Interface().(time.Time))
+		}
+	case f.Type.Kind() == reflect.String:
+		return func(a, b User) int {
+			return strings.Compare(strings.ToLower(get(a).String()), strings.ToLower(get(b).String()))
+		}
+	case f.Type.Kind() == reflect.Int:
+		return func(a, b User) int { return cmp.Compare(get(a).Int(), get(b).Int()) }
+	}
+	panic(fmt.Sprintf("models: field %s of type %s cannot be sortable", f.Name, f.Type))
+}
@@ -0,0 +1,73 @@
+package pagination
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// limits of a page when the request does not ask otherwise
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+)
+
+// Page is a limit/offset window over a list
+type Page struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// read ?limit= and ?offset= values, empty ones fall back to the defaults
+func Parse(limit, offset string) (Page, error) {
+	p := Page{Limit: DefaultLimit}
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxLimit {
+			return p, fmt.Errorf("limit must be between 1 and %d", MaxLimit)
+		}
+		p.Limit = n
+	}
+	if offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return p, fmt.Errorf("offset must be 0 or more")
+		}
+		p.Offset = n
+	}
+	return p, nil
+}
+
+// the items of the page
+func Apply[T any](items []T, p Page) []T {
+	if p.Offset >= len(items) {
+		return []T{}
+	}
+	return items[p.Offset:min(p.Offset+p.Limit, len(items))]
+}
+
+// read ?page= and ?per_page= values, pages counting from 1, into the window
+// they cover; empty ones fall back to the first page of DefaultLimit
+func ParsePage(page, perPage string) (Page, error) {
+	p, err := Parse(perPage, "")
+	if err != nil {
+		return p, fmt.Errorf("per_page must be between 1 and %d", MaxLimit)
+	}
+	if page != "" {
+		n, err := strconv.Atoi(page)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("page must be 1 or more")
+		}
+		p.Offset = (n - 1) * p.Limit
+	}
+	return p, nil
+}
+
+// Number is the page p is, counting from 1
+func (p Page) Number() int {
+	return p.Offset/p.Limit + 1
+}
+
+// Pages is how many pages of p.Limit total items take, at least 1
+func (p Page) Pages(total int) int {
+	return max(1, (total+p.Limit-1)/p.Limit)
+}
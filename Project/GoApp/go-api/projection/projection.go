@@ -0,0 +1,153 @@
+package projection
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Fields is a parsed ?fields= selection: json paths, nested ones dotted as
+// in "address.city"
+type Fields [][]string
+
+// parse a comma separated list of paths, checking each against the json
+// shape of model. Struct fields are walked by their json names and maps
+// accept any key; computed names the model writes without a struct field
+// (such as models.User's completeness) are allowed at the top level.
+func Parse(list string, model reflect.Type, computed ...string) (Fields, error) {
+	var fields Fields
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		path := strings.Split(f, ".")
+		if !valid(model, path) && !(len(path) == 1 && contains(computed, f)) {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		fields = append(fields, path)
+	}
+	return fields, nil
+}
+
+func valid(t reflect.Type, path []string) bool {
+	for len(path) > 0 {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+		}
+		switch {
+		case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String:
+			t = t.Elem()
+		case t.Kind() == reflect.Struct && t != reflect.TypeOf(time.Time{}):
+			f, ok := field(t, path[0])
+			if !ok {
+				return false
+			}
+			t = f.Type
+		default:
+			// strings, numbers, times... have no fields below them
+			return false
+		}
+		path = path[1:]
+	}
+	return true
+}
+
+// struct field by json name, looking into embedded structs
+func field(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			if inner, ok := field(f.Type, name); ok {
+				return inner, true
+			}
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		if tag == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply keeps only the selected paths of v, or of every element when v is a
+// list, as it is written to JSON. An empty selection keeps everything.
+func (fields Fields) Apply(v any) (any, error) {
+	if len(fields) == 0 {
+		return v, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if list, ok := doc.([]any); ok {
+		for i := range list {
+			list[i] = fields.pick(list[i])
+		}
+		return list, nil
+	}
+	return fields.pick(doc), nil
+}
+
+func (fields Fields) pick(doc any) any {
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return doc
+	}
+	out := map[string]any{}
+	for _, path := range fields {
+		copyPath(out, obj, path)
+	}
+	return out
+}
+
+// copy the value at path from src into dst, creating the objects on the way;
+// missing values are left out
+func copyPath(dst, src map[string]any, path []string) {
+	v, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+	inner, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	next, ok := dst[path[0]].(map[string]any)
+	if !ok {
+		if _, taken := dst[path[0]]; taken {
+			// the whole parent was selected already
+			return
+		}
+		next = map[string]any{}
+		dst[path[0]] = next
+	}
+	copyPath(next, inner, path[1:])
+}
@@ -0,0 +1,121 @@
+package readiness
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statuses of a check
+const (
+	OK = "ok"
+	// a failed check that is not critical, the api still serves
+	Degraded = "degraded"
+	Failed   = "failed"
+)
+
+// Check probes one dependency, returning nil when it is usable. A failing
+// critical check makes the api not ready.
+type Check struct {
+	Name     string
+	Critical bool
+	Run      func(ctx context.Context) error
+}
+
+// Report is the outcome of all checks by name, with the errors of the ones
+// that did not pass
+type Report struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// Registry holds the checks of a readiness probe by name. Each part of the
+// api registers its own as it is set up, a store backend its ping, and
+// registering a name again replaces its check.
+type Registry struct {
+	mu     sync.Mutex
+	checks map[string]Check
+}
+
+func NewRegistry() *Registry {
+	return &Registry{checks: map[string]Check{}}
+}
+
+func (r *Registry) Register(check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[check.Name] = check
+}
+
+// drop the check of name, e.g. of a dependency no longer configured
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.checks, name)
+}
+
+// the registered checks by name
+func (r *Registry) Checks() []Check {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	checks := make([]Check, 0, len(r.checks))
+	for _, check := range r.checks {
+		checks = append(checks, check)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks
+}
+
+// Run runs the registered checks, see Run
+func (r *Registry) Run(ctx context.Context, timeout time.Duration) Report {
+	return Run(ctx, timeout, r.Checks())
+}
+
+// Run runs the checks side by side, each limited to timeout. A check still
+// running at its timeout fails with context.DeadlineExceeded; checks that
+// cannot watch ctx are not waited for.
+func Run(ctx context.Context, timeout time.Duration, checks []Check) Report {
+	report := Report{Ready: true, Checks: map[string]string{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := run(ctx, timeout, check)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				report.Checks[check.Name] = OK
+				return
+			case check.Critical:
+				report.Checks[check.Name] = Failed
+				report.Ready = false
+			default:
+				report.Checks[check.Name] = Degraded
+			}
+			if report.Errors == nil {
+				report.Errors = map[string]string{}
+			}
+			report.Errors[check.Name] = err.Error()
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+func run(ctx context.Context, timeout time.Duration, check Check) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- check.Run(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,59 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// Header is the W3C Trace Context header a caller's span comes in
+const Header = "traceparent"
+
+// Parse reads the span of a traceparent header, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01". ok is false for
+// a header that is malformed or names no span, which starts a new trace.
+// Versions after 00 are read as 00, as the spec asks, their extra fields
+// ignored.
+func Parse(traceparent string) (sc SpanContext, ok bool) {
+	h := traceparent
+	if len(h) < 55 || h[2] != '-' || h[35] != '-' || h[52] != '-' {
+		return SpanContext{}, false
+	}
+	version := lowerHex(h[:2])
+	switch {
+	case version == nil || version[0] == 0xff:
+		return SpanContext{}, false
+	case version[0] == 0 && len(h) != 55:
+		return SpanContext{}, false
+	case len(h) > 55 && h[55] != '-':
+		return SpanContext{}, false
+	}
+	trace, span, flags := lowerHex(h[3:35]), lowerHex(h[36:52]), lowerHex(h[53:55])
+	if trace == nil || span == nil || flags == nil {
+		return SpanContext{}, false
+	}
+	copy(sc.TraceID[:], trace)
+	copy(sc.SpanID[:], span)
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.Valid()
+}
+
+// lowerHex decodes s, nil unless it is all lowercase hex digits
+func lowerHex(s string) []byte {
+	if strings.ToLower(s) != s {
+		return nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// Traceparent is the traceparent header passing sc on to another service
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
@@ -0,0 +1,293 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// TraceID is the id of a trace, shared by all its spans
+type TraceID [16]byte
+
+// SpanID is the id of a span within its trace
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext is what identifies a span to its children, local ones or
+// those of another service it is sent to in a traceparent header
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// the trace is recorded; spans of a trace that is not are still made,
+	// to pass it on, but not exported
+	Sampled bool
+}
+
+// Valid tells whether sc identifies a span, none of its ids being zero
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// kinds of spans, with their OTLP values
+const (
+	Internal Kind = 1
+	Server   Kind = 2
+)
+
+// Kind tells a span serving a request from one inside the service
+type Kind int
+
+// Attribute is a key of a span and its value: a string, an int, an int64
+// or a bool
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// SpanData is an ended span, as exporters are handed it
+type SpanData struct {
+	Name    string
+	Kind    Kind
+	Context SpanContext
+	// zero for the root span of a trace
+	Parent     SpanID
+	Start, End time.Time
+	Attributes []Attribute
+	// the error the span ended with, "" for none
+	Error string
+}
+
+// Exporter sends ended spans somewhere, in batches
+type Exporter interface {
+	Export(ctx context.Context, spans []SpanData) error
+}
+
+// settings of the batching of a Tracer
+const (
+	batchSize     = 512
+	maxQueue      = 2048
+	flushInterval = 5 * time.Second
+)
+
+// Tracer makes spans and hands them to its exporter once they end, in
+// batches sent every flushInterval or once batchSize spans are waiting.
+// Spans ended while maxQueue are waiting are dropped.
+type Tracer struct {
+	exporter Exporter
+
+	mu      sync.Mutex
+	queue   []SpanData
+	dropped int64
+
+	full     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// New starts a tracer exporting to exporter until Shutdown
+func New(exporter Exporter) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		full:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	tick := time.NewTicker(flushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-tick.C:
+		case <-t.full:
+		}
+		if err := t.Flush(context.Background()); err != nil {
+			log.Printf("tracing: %v", err)
+		}
+	}
+}
+
+// Flush exports the spans ended so far
+func (t *Tracer) Flush(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		n := min(len(t.queue), batchSize)
+		batch := t.queue[:n:n]
+		t.queue = t.queue[n:]
+		t.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			return err
+		}
+	}
+}
+
+// Shutdown stops the tracer and exports the spans still waiting, within
+// ctx; spans ended after it are dropped
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	<-t.done
+	return t.Flush(ctx)
+}
+
+// Dropped reports how many spans were dropped because the queue was full
+func (t *Tracer) Dropped() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dropped
+}
+
+func (t *Tracer) export(span SpanData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.stop:
+		t.dropped++
+		return
+	default:
+	}
+	if len(t.queue) >= maxQueue {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, span)
+	if len(t.queue) >= batchSize {
+		select {
+		case t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Span is a span being recorded, ended by End
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// Start starts a span named name, a child of the span of ctx if it has one,
+// else the root of a new trace, and returns it with ctx carrying it
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	parent := SpanContextFrom(ctx)
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+	if !parent.Valid() {
+		sc = SpanContext{TraceID: newTraceID(), Sampled: true}
+	}
+	sc.SpanID = newSpanID()
+	span := &Span{tracer: t, data: SpanData{Name: name, Kind: kind, Context: sc, Parent: parent.SpanID, Start: time.Now()}}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Context is the SpanContext of the span
+func (s *Span) Context() SpanContext { return s.data.Context }
+
+// SetAttribute sets the attribute key of the span to value, a string, an
+// int, an int64 or a bool; once the span ended it does nothing
+func (s *Span) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	for i, a := range s.data.Attributes {
+		if a.Key == key {
+			s.data.Attributes[i].Value = value
+			return
+		}
+	}
+	s.data.Attributes = append(s.data.Attributes, Attribute{key, value})
+}
+
+// End ends the span, failed with err unless it is nil, and exports it if
+// its trace is sampled. Later calls do nothing.
+func (s *Span) End(err error) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+	data := s.data
+	s.mu.Unlock()
+	if data.Context.Sampled {
+		s.tracer.export(data)
+	}
+}
+
+type spanKey struct{}
+
+// remote is the span of another service a request continues, see
+// ContextWithRemote
+type remote struct{ sc SpanContext }
+
+// SpanContextFrom is the SpanContext of the span ctx carries, of this
+// service or the caller's, the zero one when it has none
+func SpanContextFrom(ctx context.Context) SpanContext {
+	switch v := ctx.Value(spanKey{}).(type) {
+	case *Span:
+		return v.Context()
+	case remote:
+		return v.sc
+	}
+	return SpanContext{}
+}
+
+// ContextWithRemote returns ctx carrying sc, the span of a caller, so the
+// spans started from it are its children
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, remote{sc})
+}
+
+func newTraceID() (id TraceID) {
+	for id == (TraceID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	for id == (SpanID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// InMemory is an Exporter keeping the spans it is handed, for tests
+type InMemory struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (m *InMemory) Export(_ context.Context, spans []SpanData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+// Spans reports the spans exported so far, in the order they ended
+func (m *InMemory) Spans() []SpanData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]SpanData(nil), m.spans...)
+}
@@ -0,0 +1,112 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	const (
+		trace = "4bf92f3577b34da6a3ce929d0e0e4736"
+		span  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name        string
+		traceparent string
+		ok, sampled bool
+	}{
+		{"sampled", "00-" + trace + "-" + span + "-01", true, true},
+		{"not sampled", "00-" + trace + "-" + span + "-00", true, false},
+		{"later version", "01-" + trace + "-" + span + "-01-more", true, true},
+		{"later version without its fields", "01-" + trace + "-" + span + "-01", true, true},
+		{"version 00 with more fields", "00-" + trace + "-" + span + "-01-more", false, false},
+		{"version ff", "ff-" + trace + "-" + span + "-01", false, false},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + span + "-01", false, false},
+		{"zero trace", "00-00000000000000000000000000000000-" + span + "-01", false, false},
+		{"zero span", "00-" + trace + "-0000000000000000-01", false, false},
+		{"short", "00-" + trace + "-" + span, false, false},
+		{"not hex", "00-" + trace + "-" + span + "-0g", false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := Parse(tt.traceparent)
+			if ok != tt.ok {
+				t.Fatalf("ok %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if sc.TraceID.String() != trace || sc.SpanID.String() != span || sc.Sampled != tt.sampled {
+				t.Errorf("parsed %s %s sampled %v", sc.TraceID, sc.SpanID, sc.Sampled)
+			}
+			want := "00-" + trace + "-" + span + "-00"
+			if tt.sampled {
+				want = "00-" + trace + "-" + span + "-01"
+			}
+			if got := sc.Traceparent(); got != want {
+				t.Errorf("passed on as %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	var got otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("posted to %s as %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer collector.Close()
+
+	tracer := New(NewOTLP(collector.URL+"/", "users"))
+	ctx, parent := tracer.Start(context.Background(), "GET /users", Server)
+	_, child := tracer.Start(ctx, "store get_users", Internal)
+	child.SetAttribute("user.id", "7")
+	child.SetAttribute("rows", 3)
+	child.End(errors.New("store unavailable"))
+	parent.End(nil)
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("request %+v, want the spans of one resource", got)
+	}
+	resource := got.ResourceSpans[0]
+	if a := resource.Resource.Attributes; len(a) != 1 || a[0].Key != "service.name" || a[0].Value["stringValue"] != "users" {
+		t.Errorf("resource attributes %+v, want the service name", a)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" || len(c.TraceID) != 32 || len(c.SpanID) != 16 {
+		t.Errorf("spans %+v and %+v, want a root and its child", p, c)
+	}
+	if c.Kind != Internal || p.Kind != Server {
+		t.Errorf("kinds %d and %d", c.Kind, p.Kind)
+	}
+	if c.Status == nil || c.Status.Code != statusError || c.Status.Message != "store unavailable" || p.Status != nil {
+		t.Errorf("statuses %+v and %+v, want the child failed", c.Status, p.Status)
+	}
+	if len(c.Attributes) != 2 || c.Attributes[0].Value["stringValue"] != "7" || c.Attributes[1].Value["intValue"] != "3" {
+		t.Errorf("attributes %+v", c.Attributes)
+	}
+	start, err1 := strconv.ParseInt(c.StartTimeUnixNano, 10, 64)
+	end, err2 := strconv.ParseInt(c.EndTimeUnixNano, 10, 64)
+	if err1 != nil || err2 != nil || time.Unix(0, start).Year() < 2020 || end < start {
+		t.Errorf("times %s to %s, want unix nanoseconds", c.StartTimeUnixNano, c.EndTimeUnixNano)
+	}
+}
@@ -0,0 +1,156 @@
+package usercsv
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go-api/models"
+)
+
+// Columns are the CSV columns of a user, in the order assumed for files
+// without a header row
+var Columns = []string{"name", "email", "username", "phone", "priority"}
+
+// ExportColumns are the columns Write writes: the id, which Read skips as
+// the store hands out ids, then Columns
+var ExportColumns = append([]string{"id"}, Columns...)
+
+// Row is one record of an imported file, Err set when it could not be read
+// as a user
+type Row struct {
+	Row  int
+	User models.User
+	Err  error
+}
+
+// read users from CSV. A first record made only of column names is taken as
+// the header and may list them in any order or leave some out, and may have
+// an id column, which is skipped; otherwise the records follow Columns.
+// Malformed records are reported in their Row and reading goes on; the error
+// is for input that cannot be read at all.
+func Read(r io.Reader) ([]Row, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	columns := Columns
+	var rows []Row
+	for n := 1; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, Row{Row: n, Err: parseErr.Err})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 {
+			if header, ok := parseHeader(record); ok {
+				columns = header
+				continue
+			}
+		}
+		row := Row{Row: n}
+		row.User, row.Err = parseUser(columns, record)
+		rows = append(rows, row)
+	}
+}
+
+func parseHeader(record []string) ([]string, bool) {
+	header := make([]string, len(record))
+	seen := map[string]bool{}
+	for i, f := range record {
+		name := strings.ToLower(strings.TrimSpace(f))
+		if (!known(name) && name != "id") || seen[name] {
+			return nil, false
+		}
+		seen[name] = true
+		header[i] = name
+	}
+	return header, true
+}
+
+func known(name string) bool {
+	for _, c := range Columns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseUser(columns, record []string) (models.User, error) {
+	var u models.User
+	if len(record) != len(columns) {
+		return u, fmt.Errorf("expected %d fields, got %d", len(columns), len(record))
+	}
+	u.Active = true
+	for i, v := range record {
+		switch columns[i] {
+		case "name":
+			u.Name = v
+		case "email":
+			u.Email = v
+		case "username":
+			u.Username = v
+		case "phone":
+			u.Phone = v
+		case "priority":
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				return u, fmt.Errorf("priority %q is not a number", v)
+			}
+			u.Priority = p
+		}
+	}
+	return u, nil
+}
+
+// write users as CSV with a header row of ExportColumns, so Read takes the
+// file back
+func Write(w io.Writer, users []models.User) error {
+	uw := NewWriter(w)
+	if err := uw.Write(users); err != nil {
+		return err
+	}
+	return uw.Close()
+}
+
+// Writer writes a file as Write does, a batch of users at a time
+type Writer struct {
+	cw     *csv.Writer
+	header bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{cw: csv.NewWriter(w)}
+}
+
+// write users after those already written, the header row before the first
+func (w *Writer) Write(users []models.User) error {
+	if !w.header {
+		w.cw.Write(ExportColumns)
+		w.header = true
+	}
+	for _, u := range users {
+		w.cw.Write([]string{string(u.ID), u.Name, u.Email, u.Username, u.Phone, strconv.Itoa(u.Priority)})
+	}
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+// end the file, which is the header row alone when no user was written
+func (w *Writer) Close() error {
+	return w.Write(nil)
+}
@@ -0,0 +1,109 @@
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strings"
+)
+
+// FieldError is one invalid field of a request body, by its json name, and
+// why it is invalid
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// Errors lists every invalid field of a body, nil when it has none
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + " " + fe.Reason
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Add appends a reason field is invalid
+func (e Errors) Add(field, reason string) Errors {
+	return append(e, FieldError{Field: field, Reason: reason})
+}
+
+// Has reports whether field is invalid already
+func (e Errors) Has(field string) bool {
+	for _, fe := range e {
+		if fe.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// checks a validate tag can name; each answers why a non-empty value is
+// invalid, "" when it is valid
+var rules = map[string]func(value string) string{
+	"email": func(value string) string {
+		addr, err := mail.ParseAddress(value)
+		if err != nil || addr.Address != value {
+			return "is not a valid email address"
+		}
+		return ""
+	},
+	"phone": func(value string) string {
+		digits := 0
+		for i, r := range value {
+			switch {
+			case r >= '0' && r <= '9':
+				digits++
+			case r == '+' && i == 0, r == ' ', r == '-', r == '(', r == ')', r == '.':
+			default:
+				return "may only have digits, spaces, dashes, dots, parentheses and a leading +"
+			}
+		}
+		if digits < 7 || digits > 15 {
+			return "must have between 7 and 15 digits"
+		}
+		return ""
+	},
+}
+
+// Struct checks the string fields of the struct v against their
+// validate:"..." tags, a comma-separated list of "required" and the rules
+// above. Empty values only fail "required", the other rules are for the
+// values that are set.
+func Struct(v any) Errors {
+	val := reflect.Indirect(reflect.ValueOf(v))
+	t := val.Type()
+	var errs Errors
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		if f.Type.Kind() != reflect.String {
+			panic(fmt.Sprintf("validation: field %s of type %s cannot be validated", f.Name, f.Type))
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		value := val.Field(i).String()
+		for _, rule := range strings.Split(tag, ",") {
+			reason := ""
+			switch {
+			case rule == "required":
+				if strings.TrimSpace(value) == "" {
+					reason = "is required"
+				}
+			case rules[rule] == nil:
+				panic(fmt.Sprintf("validation: unknown rule %q on field %s", rule, f.Name))
+			case value != "":
+				reason = rules[rule](value)
+			}
+			if reason != "" {
+				errs = errs.Add(name, reason)
+				break
+			}
+		}
+	}
+	return errs
+}
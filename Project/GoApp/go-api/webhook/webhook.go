@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headers of a signed webhook request
+const (
+	HeaderID        = "X-Webhook-Id"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+var (
+	ErrSignature = errors.New("invalid webhook signature")
+	ErrStale     = errors.New("webhook timestamp outside the allowed window")
+	ErrReplay    = errors.New("webhook already received")
+)
+
+// Sign returns the signature header of a delivery: "v1=" and the hex
+// HMAC-SHA256 of "id.timestamp.body", timestamp in unix seconds. Senders and
+// receivers both use it, so the id and time cannot be swapped without
+// breaking the signature.
+func Sign(secret []byte, id string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id + "." + strconv.FormatInt(timestamp.Unix(), 10) + "."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verifier checks inbound deliveries: signed with the secret, sent within
+// tolerance of now either way, and with an id it has not accepted before.
+// Ids are remembered for as long as their timestamp could still pass.
+type Verifier struct {
+	mu        sync.Mutex
+	secret    []byte
+	tolerance time.Duration
+	seen      map[string]time.Time
+}
+
+func NewVerifier(secret []byte, tolerance time.Duration) *Verifier {
+	return &Verifier{secret: secret, tolerance: tolerance, seen: map[string]time.Time{}}
+}
+
+// Verify checks a delivery by its header values, recording its id when it
+// passes
+func (v *Verifier) Verify(id, timestamp, signature string, body []byte, now time.Time) error {
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || id == "" {
+		return ErrSignature
+	}
+	sent := time.Unix(secs, 0)
+	// a sender may list several signatures while rotating secrets
+	valid := false
+	want := Sign(v.secret, id, sent, body)
+	for _, sig := range strings.Split(signature, ",") {
+		if hmac.Equal([]byte(strings.TrimSpace(sig)), []byte(want)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrSignature
+	}
+	if now.Sub(sent) > v.tolerance || sent.Sub(now) > v.tolerance {
+		return ErrStale
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// an id is dropped once its timestamp is stale, a replay fails on that
+	for seenID, at := range v.seen {
+		if now.Sub(at) > v.tolerance {
+			delete(v.seen, seenID)
+		}
+	}
+	if _, ok := v.seen[id]; ok {
+		return ErrReplay
+	}
+	v.seen[id] = sent
+	return nil
+}